@@ -0,0 +1,83 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/atomist/k8svent/vent"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage k8svent configuration",
+	Long:  "Commands for working with k8svent configuration files.",
+}
+
+// configValidateCmd represents the config validate command
+var configValidateCmd = &cobra.Command{
+	Use:   "validate [CONFIG]",
+	Short: "Validate a configuration file",
+	Long: `Validate the configuration file CONFIG, or the file provided by
+--config if CONFIG is not provided, and report every error found with
+the path of the field in error.  Exits with a non-zero status if the
+configuration is invalid.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		configFile := cfgFile
+		if len(args) > 0 {
+			configFile = args[0]
+		}
+		if configFile == "" {
+			fmt.Fprintln(os.Stderr, "k8svent: no configuration file provided")
+			os.Exit(1)
+		}
+		if !validateConfig(configFile, os.Stdout) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd)
+	RootCmd.AddCommand(configCmd)
+}
+
+// validateConfig loads and validates the configuration file, writing
+// the errors found to out.  It returns true if the configuration is
+// valid.
+func validateConfig(configFile string, out io.Writer) bool {
+	config, loadErr := vent.LoadConfig(configFile)
+	if loadErr == nil {
+		loadErr = config.Validate()
+	}
+	if loadErr == nil {
+		fmt.Fprintf(out, "%s: valid\n", configFile)
+		return true
+	}
+	if errs, ok := loadErr.(vent.ConfigErrors); ok {
+		for _, err := range errs {
+			fmt.Fprintf(out, "%s: %s\n", configFile, err.Error())
+		}
+	} else {
+		fmt.Fprintf(out, "%s: %v\n", configFile, loadErr)
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "k8svent-config")
+	if dirErr != nil {
+		t.Fatalf("failed to create temporary directory: %v", dirErr)
+	}
+	defer os.RemoveAll(dir)
+
+	valid := filepath.Join(dir, "valid.yaml")
+	if err := ioutil.WriteFile(valid, []byte("webhooks:\n  - url: https://one.com/webhook\n"), 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	if out := (&bytes.Buffer{}); !validateConfig(valid, out) {
+		t.Errorf("valid configuration reported as invalid: %s", out.String())
+	}
+
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := ioutil.WriteFile(invalid, []byte("logLevel: loud\nwebhooks:\n  - url: one.com\n"), 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	out := &bytes.Buffer{}
+	if validateConfig(invalid, out) {
+		t.Error("invalid configuration reported as valid")
+	}
+	for _, field := range []string{"logLevel: ", "webhooks[0].url: "} {
+		if !strings.Contains(out.String(), field) {
+			t.Errorf("report does not contain error for %s: %s", field, out.String())
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/atomist/k8svent/vent"
+)
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose problems with the k8svent setup",
+	Long: `Check the k8svent configuration and the cluster it runs in and
+print a pass/fail report.
+
+  $ kubectl exec -n k8svent deploy/k8svent -- k8svent doctor
+
+The doctor checks that
+
+  - the configuration is valid,
+  - the in-cluster Kubernetes config loads and the API can be reached,
+  - k8svent may list and watch pods in all namespaces and in each
+    namespace passing the filters, or in the namespace it is
+    restricted to, using SelfSubjectAccessReviews,
+  - every configured webhook accepts a signed test payload, and how
+    the correlation_id in its response is parsed, and
+  - the image checked for new releases can be read from its registry.
+
+The test payload is a pod named k8svent-doctor with the
+k8svent.atomist.com/doctor annotation, so receivers can discard it.
+Exits with a non-zero status if any check failed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, configErr := loadConfig()
+		if configErr != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: invalid configuration: %v\n", configErr)
+			os.Exit(1)
+		}
+		if !vent.Doctor(config, os.Stdout) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+}
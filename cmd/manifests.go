@@ -0,0 +1,67 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/atomist/k8svent/vent"
+)
+
+var manifestOptions vent.ManifestOptions
+
+// manifestsCmd represents the manifests command
+var manifestsCmd = &cobra.Command{
+	Use:   "manifests",
+	Short: "Print the Kubernetes resources deploying k8svent",
+	Long: `Print the Namespace, ServiceAccount, RBAC, Secret, and Deployment
+resources that deploy k8svent with the configuration provided by the
+configuration file, command-line options, and environment variables.
+
+  $ k8svent manifests --config=config.yaml --workspace-id=T29E48P34 | kubectl apply -f -
+
+The configuration, and any encryption and verification key files it
+refers to, are rendered into the Secret, which the Deployment mounts as
+its configuration file.  The RBAC grants exactly the resources and
+verbs the configuration needs: cluster-wide if pods in all namespaces
+are watched, otherwise only in the namespace provided by --namespace.
+Namespace annotations and VentSinks are only available when watching
+all namespaces.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, configErr := loadConfig()
+		if configErr != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: invalid configuration: %v\n", configErr)
+			os.Exit(1)
+		}
+		if err := vent.Manifests(config, manifestOptions, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: failed to render manifests: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	manifestsCmd.Flags().StringVar(&manifestOptions.CPU, "cpu", vent.DefaultManifestCPU, "Request and limit CPU for the k8svent container")
+	manifestsCmd.Flags().StringVar(&manifestOptions.Image, "image", "", "Run the k8svent container IMAGE, default the update image")
+	manifestsCmd.Flags().StringVar(&manifestOptions.Memory, "memory", vent.DefaultManifestMemory, "Request and limit MEMORY for the k8svent container")
+	manifestsCmd.Flags().StringVar(&manifestOptions.Namespace, "deploy-namespace", vent.DefaultManifestNamespace, "Deploy k8svent in DEPLOY_NAMESPACE")
+	manifestsCmd.Flags().BoolVar(&manifestOptions.VentSinks, "ventsinks", true, "Grant access to VentSinks when watching all namespaces")
+	manifestsCmd.Flags().StringVar(&manifestOptions.WorkspaceID, "workspace-id", "", "Label resources with the Atomist WORKSPACE_ID")
+	RootCmd.AddCommand(manifestsCmd)
+}
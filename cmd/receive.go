@@ -0,0 +1,250 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/atomist/k8svent/receiver"
+	"github.com/atomist/k8svent/vent"
+)
+
+var (
+	receiveDecryptionKey string
+	receiveDir           string
+	receiveFailRate      float64
+	receiveFailStatus    int
+	receiveLatency       time.Duration
+	receivePort          int
+	receiveThrottleRate  float64
+)
+
+// receiveCmd represents the receive command
+var receiveCmd = &cobra.Command{
+	Use:   "receive",
+	Short: "Run a mock webhook receiver",
+	Long: `Run an HTTP server that receives k8svent webhook requests on any
+path, verifies their signatures, and prints the payloads.
+
+  $ k8svent receive --port=8888 --secret=MyS3c43t
+  $ k8svent --url=http://localhost:8888/k8svent --secret=MyS3c43t
+
+Like the Atomist webhook endpoint, successful requests get a 200
+response with a JSON body containing a correlation_id.  Requests whose
+signature is invalid get a 401 response.  If --dir is provided, each
+payload is written to a file in DIR rather than printed.  Encrypted
+payloads are decrypted using the private key provided by
+--decryption-key.
+
+To test retries, failures can be injected: --latency delays every
+response, --fail-rate responds to that fraction of requests with
+--fail-status, and --throttle-rate responds to that fraction of
+requests with 429 Too Many Requests.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		mock, mockErr := newMockReceiver(os.Stdout)
+		if mockErr != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: %v\n", mockErr)
+			os.Exit(1)
+		}
+		addr := fmt.Sprintf(":%d", receivePort)
+		fmt.Printf("Receiving webhook requests on %s\n", addr)
+		if err := http.ListenAndServe(addr, mock); err != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: receiver failed: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	receiveCmd.Flags().StringVar(&receiveDecryptionKey, "decryption-key", "", "Decrypt payloads using the PEM-encoded RSA private key in FILE")
+	receiveCmd.Flags().StringVar(&receiveDir, "dir", "", "Write each payload to a file in DIR rather than printing it")
+	receiveCmd.Flags().Float64Var(&receiveFailRate, "fail-rate", 0, "Respond to FAIL_RATE fraction of requests with FAIL_STATUS")
+	receiveCmd.Flags().IntVar(&receiveFailStatus, "fail-status", http.StatusInternalServerError, "HTTP status of injected failures")
+	receiveCmd.Flags().DurationVar(&receiveLatency, "latency", 0, "Wait LATENCY before responding to each request")
+	receiveCmd.Flags().IntVar(&receivePort, "port", 8888, "Listen on PORT")
+	receiveCmd.Flags().Float64Var(&receiveThrottleRate, "throttle-rate", 0, "Respond to THROTTLE_RATE fraction of requests with 429")
+	RootCmd.AddCommand(receiveCmd)
+}
+
+// mockReceiver is a webhook receiver for testing k8svent.  It is safe
+// for concurrent use.
+type mockReceiver struct {
+	// opts verify requests.
+	opts receiver.Options
+	// out is where requests are reported.
+	out io.Writer
+	// dir, if not empty, is where payloads are written.
+	dir string
+	// latency is how long to wait before responding.
+	latency time.Duration
+	// failRate is the fraction of requests responded to with
+	// failStatus.
+	failRate   float64
+	failStatus int
+	// throttleRate is the fraction of requests responded to with 429.
+	throttleRate float64
+	// random returns a random number in [0, 1).
+	random func() float64
+
+	// mu guards attempts and writing to out.
+	mu sync.Mutex
+	// attempts are the number of requests received by delivery ID.
+	attempts map[string]int
+}
+
+// newMockReceiver creates a mock receiver from the command-line
+// options, reporting requests to out.
+func newMockReceiver(out io.Writer) (*mockReceiver, error) {
+	for _, rate := range []float64{receiveFailRate, receiveThrottleRate} {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid rate %g, must be between 0 and 1", rate)
+		}
+	}
+	if receiveFailStatus < 100 || receiveFailStatus > 599 {
+		return nil, fmt.Errorf("invalid HTTP status %d", receiveFailStatus)
+	}
+	m := &mockReceiver{
+		opts:         receiver.Options{Secret: webhookSecret},
+		out:          out,
+		dir:          receiveDir,
+		latency:      receiveLatency,
+		failRate:     receiveFailRate,
+		failStatus:   receiveFailStatus,
+		throttleRate: receiveThrottleRate,
+		random:       mathrand.Float64,
+		attempts:     map[string]int{},
+	}
+	if receiveDecryptionKey != "" {
+		keyBytes, readErr := ioutil.ReadFile(receiveDecryptionKey)
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read decryption key: %v", readErr)
+		}
+		key, keyErr := vent.ParsePrivateKey(keyBytes)
+		if keyErr != nil {
+			return nil, fmt.Errorf("invalid decryption key: %v", keyErr)
+		}
+		m.opts.Decrypt = func(b []byte) ([]byte, error) { return vent.DecryptPayload(b, key) }
+	}
+	if m.dir != "" {
+		if err := os.MkdirAll(m.dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create payload directory: %v", err)
+		}
+	}
+	return m, nil
+}
+
+// ServeHTTP verifies, reports, and responds to a webhook request,
+// injecting the configured latency and failures.
+func (m *mockReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.latency > 0 {
+		time.Sleep(m.latency)
+	}
+	correlationID := newCorrelationID()
+	delivery := r.Header.Get(receiver.DeliveryHeader)
+	m.mu.Lock()
+	m.attempts[delivery]++
+	attempt := m.attempts[delivery]
+	m.mu.Unlock()
+	line := fmt.Sprintf("%s %s %s delivery=%s attempt=%d", time.Now().UTC().Format(time.RFC3339), r.Method, r.URL.Path, delivery, attempt)
+
+	respond := func(status int, message string, payload []byte) {
+		m.mu.Lock()
+		fmt.Fprintf(m.out, "%s status=%d correlation_id=%s %s\n", line, status, correlationID, message)
+		if len(payload) > 0 {
+			fmt.Fprintf(m.out, "%s\n", payload)
+		}
+		m.mu.Unlock()
+		body := map[string]string{"correlation_id": correlationID}
+		if status < 200 || status > 299 {
+			body["message"] = message
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	}
+
+	if m.throttleRate > 0 && m.random() < m.throttleRate {
+		w.Header().Set("Retry-After", "1")
+		respond(http.StatusTooManyRequests, "injected throttling", nil)
+		return
+	}
+	if m.failRate > 0 && m.random() < m.failRate {
+		respond(m.failStatus, "injected failure", nil)
+		return
+	}
+	if r.Method != http.MethodPost {
+		respond(http.StatusMethodNotAllowed, "method not allowed", nil)
+		return
+	}
+	body, readErr := ioutil.ReadAll(r.Body)
+	if readErr != nil {
+		respond(http.StatusBadRequest, "failed to read request body", nil)
+		return
+	}
+	result, verifyErr := receiver.Verify(r.Header, body, m.opts)
+	if verifyErr != nil {
+		status := http.StatusBadRequest
+		switch verifyErr {
+		case receiver.ErrMissingSignature, receiver.ErrInvalidSignature, receiver.ErrMissingTimestamp,
+			receiver.ErrInvalidTimestamp, receiver.ErrExpiredTimestamp:
+			status = http.StatusUnauthorized
+		}
+		respond(status, verifyErr.Error(), nil)
+		return
+	}
+
+	pod := result.Payload.Pod
+	signature := "unchecked"
+	if result.Signed {
+		signature = "valid"
+	}
+	message := fmt.Sprintf("pod=%s/%s phase=%s signature=%s", pod.Namespace, pod.Name, pod.Status.Phase, signature)
+	pretty, prettyErr := json.MarshalIndent(result.Payload, "", "  ")
+	if prettyErr != nil {
+		respond(http.StatusBadRequest, fmt.Sprintf("failed to format payload: %v", prettyErr), nil)
+		return
+	}
+	if m.dir != "" {
+		file := filepath.Join(m.dir, fmt.Sprintf("%s-%s-%s-%s.json", time.Now().UTC().Format("20060102T150405.000"), pod.Namespace, pod.Name, correlationID))
+		if err := ioutil.WriteFile(file, append(pretty, '\n'), 0644); err != nil {
+			respond(http.StatusInternalServerError, fmt.Sprintf("failed to write payload: %v", err), nil)
+			return
+		}
+		respond(http.StatusOK, message+" file="+file, nil)
+		return
+	}
+	respond(http.StatusOK, message, pretty)
+}
+
+// newCorrelationID returns a random identifier for a response.
+func newCorrelationID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,109 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMockReceiver(t *testing.T) {
+	webhookSecret = "The400Unit"
+	defer func() { webhookSecret = "" }()
+	out := &bytes.Buffer{}
+	mock, mockErr := newMockReceiver(out)
+	if mockErr != nil {
+		t.Fatalf("failed to create mock receiver: %v", mockErr)
+	}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	post := func(signature string) (int, map[string]string) {
+		req, _ := http.NewRequest("POST", server.URL+"/k8svent", strings.NewReader(`{"pod":{"metadata":{"namespace":"drive-by","name":"truckers"}}}`))
+		req.Header.Set("x-atomist-signature", signature)
+		req.Header.Set("x-k8svent-delivery", "d1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to post: %v", err)
+		}
+		defer resp.Body.Close()
+		body := map[string]string{}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	signature := "sha1=ff5ad2f4bb07c9e0b5e0c3b31d1d42b41e1d3b87"
+	status, body := post(signature)
+	if status != http.StatusUnauthorized || body["correlation_id"] == "" {
+		t.Errorf("request with invalid signature got %d %v", status, body)
+	}
+	signature = "sha1=" + hmacSHA1(`{"pod":{"metadata":{"namespace":"drive-by","name":"truckers"}}}`, "The400Unit")
+	status, body = post(signature)
+	if status != http.StatusOK || body["correlation_id"] == "" {
+		t.Errorf("valid request got %d %v", status, body)
+	}
+	report := out.String()
+	if !strings.Contains(report, "attempt=2 status=200") || !strings.Contains(report, "pod=drive-by/truckers") ||
+		!strings.Contains(report, "signature=valid") || !strings.Contains(report, `"name": "truckers"`) {
+		t.Errorf("report not as expected:\n%s", report)
+	}
+
+	mock.throttleRate = 1
+	if status, _ := post(signature); status != http.StatusTooManyRequests {
+		t.Errorf("throttled request got %d", status)
+	}
+	mock.throttleRate = 0
+	mock.failRate, mock.failStatus = 1, http.StatusBadGateway
+	if status, _ := post(signature); status != http.StatusBadGateway {
+		t.Errorf("failed request got %d", status)
+	}
+	mock.failRate = 0
+
+	dir, dirErr := ioutil.TempDir("", "k8svent-receive")
+	if dirErr != nil {
+		t.Fatalf("failed to create temporary directory: %v", dirErr)
+	}
+	defer os.RemoveAll(dir)
+	mock.dir = dir
+	if status, _ := post(signature); status != http.StatusOK {
+		t.Errorf("stored request got %d", status)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || !strings.Contains(files[0].Name(), "drive-by-truckers") {
+		t.Errorf("stored payloads not as expected: %v", files)
+	}
+
+	receiveFailRate = 2
+	defer func() { receiveFailRate = 0 }()
+	if _, err := newMockReceiver(out); err == nil {
+		t.Error("invalid failure rate was accepted")
+	}
+}
+
+// hmacSHA1 returns the hex-encoded HMAC/SHA-1 of body using secret.
+func hmacSHA1(body string, secret string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	_, _ = mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,75 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/atomist/k8svent/vent"
+)
+
+var replaySpeed float64
+
+// replayCmd represents the replay command
+var replayCmd = &cobra.Command{
+	Use:   "replay RECORDING",
+	Short: "Send the payloads of a recording again",
+	Long: `Send the payloads in RECORDING, made using --record or a JSON
+array of webhook payloads, in order to the webhooks provided by --url or, if none are, the configured
+webhooks.
+
+  $ k8svent replay --url=http://localhost:8080/k8svent --secret=MyS3c43t k8svent.jsonl
+
+Payloads are signed and encrypted as they are by k8svent.  They are
+sent at the recorded pace divided by --speed, so --speed=10 replays a
+recording ten times faster.  With --speed=0, payloads are sent as fast
+as the webhooks accept them.  Exits with a non-zero status if any
+delivery failed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		config, configErr := loadConfig()
+		if configErr != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: invalid configuration: %v\n", configErr)
+			os.Exit(1)
+		}
+		recording, openErr := os.Open(args[0])
+		if openErr != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: %v\n", openErr)
+			os.Exit(1)
+		}
+		defer recording.Close()
+
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		summary, err := vent.Replay(ctx, config, recording, replaySpeed)
+		fmt.Printf("Replayed %d payloads: %d deliveries sent, %d failed\n", summary.Payloads, summary.Sent, summary.Failed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: replay failed: %v\n", err)
+			os.Exit(1)
+		}
+		if summary.Failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", 1, "Send payloads SPEED times faster than recorded, without delay if 0")
+	RootCmd.AddCommand(replayCmd)
+}
@@ -15,12 +15,16 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 
 	"github.com/atomist/k8svent/vent"
 )
@@ -28,14 +32,35 @@ import (
 var cfgFile string
 
 var (
-	logLevel      string
-	namespace     string
-	webhookSecret string
-	webhookURLs   = []string{}
+	dryRun         bool
+	dryRunProvided bool
+	encryptionKeys = []string{}
+	listen         string
+	logFormat      string
+	logLevel       string
+	namespace      string
+	recordFile     string
+	shutdownGrace  string
+	spoolFile      string
+	updatePolicy   string
+	webhookSecret  string
+	webhookURLs    = []string{}
 )
 
+const adminTokenEnv = "K8SVENT_ADMIN_TOKEN"
+const configEnv = "K8SVENT_CONFIG"
+const dryRunEnv = "K8SVENT_DRY_RUN"
+const encryptionKeysEnv = "K8SVENT_ENCRYPTION_KEYS"
+const listenEnv = "K8SVENT_LISTEN"
+const logFormatEnv = "K8SVENT_LOG_FORMAT"
 const logLevelEnv = "K8SVENT_LOG_LEVEL"
 const namespaceEnv = "K8SVENT_NAMESPACE"
+const otlpEndpointEnv = "OTEL_EXPORTER_OTLP_ENDPOINT"
+const otelServiceNameEnv = "OTEL_SERVICE_NAME"
+const recordEnv = "K8SVENT_RECORD"
+const shutdownGracePeriodEnv = "K8SVENT_SHUTDOWN_GRACE_PERIOD"
+const spoolFileEnv = "K8SVENT_SPOOL_FILE"
+const updatePolicyEnv = "K8SVENT_UPDATE_POLICY"
 const webhookEnv = "K8SVENT_WEBHOOKS"
 const webhookSecretEnv = "K8SVENT_WEBHOOK_SECRET"
 
@@ -52,8 +77,12 @@ webhooks.
   $ k8svent --url=http://one.com/webhook --url=http://two.com/webhook
 
 Alternatively, you can supply a comma-delimited list of webhook URLs
-in the K8SVENT_WEBHOOKS environment variable or provide them in the pod
-annotations.
+in the K8SVENT_WEBHOOKS environment variable.
+
+Pods and namespaces can add webhooks, or replace the webhooks above,
+for their pods using the k8svent.atomist.com/webhooks,
+k8svent.atomist.com/webhook-policy, and
+k8svent.atomist.com/webhook-secret annotations.
 
 By default k8svent watches pods in all namespaces.  If the --namespace
 or K8SVENT_NAMESPACE environment variable is provided, only pods in
@@ -61,9 +90,59 @@ that namespace are reported on.
 
 By default k8svent does not sign the webhook payloads.  If the
 --secret or K8SVENT_WEBHOOK_SECRET environment variable is provided,
-webhook payloads are signed using HMAC/SHA-1.`,
+webhook payloads are signed using HMAC/SHA-1.
+
+Payloads sent to a webhook can be encrypted to the receiver's RSA
+public key by providing --encryption-key=URL=KEY_FILE, where KEY_FILE
+is a PEM-encoded public key.  The option can be provided multiple
+times or as a comma-delimited list in the K8SVENT_ENCRYPTION_KEYS
+environment variable.  Encrypted payloads are sent as JWE compact
+serialization and are signed after they are encrypted.
+
+All settings, including filters and per-webhook secrets, can be
+provided in a YAML or JSON configuration file using --config or the
+K8SVENT_CONFIG environment variable.  Command-line options take
+precedence over environment variables, which take precedence over the
+configuration file.
+
+If a configuration file is provided, it is watched and changes are
+applied without restarting.  Sending k8svent SIGHUP also reloads the
+configuration.  If the new configuration is invalid, the current
+configuration is kept.
+
+Prometheus metrics are served at /metrics and liveness and readiness
+checks at /healthz and /readyz on the address provided by --listen or
+K8SVENT_LISTEN, ":8080" by default.  If K8SVENT_ADMIN_TOKEN is set,
+the admin API is served at /admin/ using it as the bearer token.
+
+Sending k8svent SIGUSR1 makes logging more verbose, up to the trace
+level, and sending it SIGUSR2 restores the configured log levels.
+
+If OTEL_EXPORTER_OTLP_ENDPOINT is set, traces of pod processing and
+webhook delivery are exported to that OpenTelemetry collector.
+
+On SIGTERM or SIGINT, k8svent stops listing pods and waits up to
+--shutdown-grace-period for pending deliveries to complete.  If
+--spool-file or K8SVENT_SPOOL_FILE is provided, deliveries still
+pending are written to it and sent when k8svent starts again.  The
+spool file must be on a volume that outlives the pod, e.g., a
+PersistentVolumeClaim, for deliveries to survive the pod being
+replaced; the provided manifests use an emptyDir, which does not.
+
+If --record or K8SVENT_RECORD is provided, every payload sent is
+appended to that file as a JSON line, which the replay command can
+send again.
+
+If --dry-run is provided or K8SVENT_DRY_RUN is true, pods are
+processed as usual but, rather than being sent, each payload is
+printed with the webhook it would be sent to, why it would be sent,
+and how the pod differs from the state last sent.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := vent.Vent(webhookURLs, namespace, webhookSecret, logLevel); err != nil {
+		if _, err := loadConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: invalid configuration: %v\n", err)
+			os.Exit(1)
+		}
+		if err := vent.Vent(loadConfig, cfgFile); err != nil {
 			fmt.Fprintf(os.Stderr, "k8svent: venting failed: %v\n", err)
 			os.Exit(1)
 		}
@@ -82,36 +161,145 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 
-	// Here you will define your flags and configuration settings.
-	// Cobra supports Persistent Flags, which, if defined here,
-	// will be global for your application.
-
-	//RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.k8svent.yaml)")
-	// Cobra also supports local flags, which will only run
-	// when this action is called directly.
-	//RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	RootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", os.Getenv(configEnv), "Read configuration from CONFIG file")
+	dryRunDefault, _ := strconv.ParseBool(os.Getenv(dryRunEnv))
+	RootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRunDefault, "Print payloads rather than sending them")
+	RootCmd.PersistentFlags().StringSliceVarP(&encryptionKeys, "encryption-key", "e", []string{}, "Encrypt payloads sent to URL using the public key in KEY_FILE, provided as URL=KEY_FILE")
+	RootCmd.PersistentFlags().StringVar(&listen, "listen", os.Getenv(listenEnv), "Serve metrics and health checks on LISTEN address, default "+vent.DefaultListen)
+	RootCmd.PersistentFlags().StringVar(&logFormat, "log-format", os.Getenv(logFormatEnv), "Output log messages in LOG_FORMAT: json, text, or logfmt")
 	RootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "l", os.Getenv(logLevelEnv), "Set log level to LOG_LEVEL")
 	RootCmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", os.Getenv(namespaceEnv), "Only watch pods in NAMESPACE")
+	RootCmd.PersistentFlags().StringVar(&recordFile, "record", os.Getenv(recordEnv), "Append every payload sent to RECORD as a JSON line")
+	RootCmd.PersistentFlags().StringVar(&shutdownGrace, "shutdown-grace-period", os.Getenv(shutdownGracePeriodEnv), "Wait up to SHUTDOWN_GRACE_PERIOD for pending deliveries when shutting down, default "+vent.DefaultShutdownGracePeriod.String())
+	RootCmd.PersistentFlags().StringVar(&spoolFile, "spool-file", os.Getenv(spoolFileEnv), "Persist deliveries pending at shutdown to SPOOL_FILE and send them on start, use a persistent volume to survive pod replacement")
+	RootCmd.PersistentFlags().StringVar(&updatePolicy, "update-policy", os.Getenv(updatePolicyEnv), "Act on new releases according to UPDATE_POLICY: restart, notify, or off")
 	RootCmd.PersistentFlags().StringVarP(&webhookSecret, "secret", "s", os.Getenv(webhookSecretEnv), "Sign webhook payloads using SECRET")
 	RootCmd.PersistentFlags().StringSliceVarP(&webhookURLs, "url", "u", []string{}, "Send event to URL")
 }
 
-// initConfig reads in config file and ENV variables if set.
+// initConfig reads in ENV variables for options that cannot be
+// defaulted from the environment.  Options provided on the command
+// line take precedence.
 func initConfig() {
-	if os.Getenv(webhookEnv) != "" {
+	if os.Getenv(webhookEnv) != "" && !RootCmd.PersistentFlags().Changed("url") {
 		webhookURLs = strings.Split(os.Getenv(webhookEnv), ",")
 	}
-
-	if cfgFile != "" { // enable ability to specify config file via flag
-		viper.SetConfigFile(cfgFile)
+	if os.Getenv(encryptionKeysEnv) != "" && !RootCmd.PersistentFlags().Changed("encryption-key") {
+		encryptionKeys = strings.Split(os.Getenv(encryptionKeysEnv), ",")
 	}
+	// dry run is off by default, so it only overrides the
+	// configuration file if provided
+	dryRunProvided = RootCmd.PersistentFlags().Changed("dry-run") || os.Getenv(dryRunEnv) != ""
+}
 
-	viper.SetConfigName(".k8svent") // name of config file (without extension)
-	viper.AddConfigPath("$HOME")    // adding home directory as first search path
-	viper.AutomaticEnv()            // read in environment variables that match
+// loadConfig reads the configuration file, if one was provided, and
+// overrides its values with those provided on the command line or in
+// the environment.
+func loadConfig() (c vent.Config, e error) {
+	config := vent.Config{}
+	if cfgFile != "" {
+		fileConfig, loadErr := vent.LoadConfig(cfgFile)
+		if loadErr != nil {
+			return c, loadErr
+		}
+		config = fileConfig
+	}
+	if dryRunProvided {
+		config.DryRun = dryRun
+	}
+	if listen != "" {
+		config.Listen = listen
+	}
+	if logFormat != "" {
+		config.LogFormat = logFormat
+	}
+	if logLevel != "" {
+		config.LogLevel = logLevel
+	}
+	if namespace != "" {
+		config.Namespace = namespace
+	}
+	if recordFile != "" {
+		config.Record = recordFile
+	}
+	if shutdownGrace != "" {
+		config.ShutdownGracePeriod = shutdownGrace
+	}
+	if spoolFile != "" {
+		config.SpoolFile = spoolFile
+	}
+	if updatePolicy != "" {
+		config.Update.Policy = updatePolicy
+	}
+	if webhookSecret != "" {
+		config.Secret = webhookSecret
+	}
+	if token := os.Getenv(adminTokenEnv); token != "" {
+		config.AdminToken = token
+	}
+	if endpoint := os.Getenv(otlpEndpointEnv); endpoint != "" {
+		config.Tracing.Endpoint = endpoint
+	}
+	if serviceName := os.Getenv(otelServiceNameEnv); serviceName != "" {
+		config.Tracing.ServiceName = serviceName
+	}
+	if err := applyWebhooks(&config); err != nil {
+		return c, err
+	}
+	return config, nil
+}
 
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+// applyWebhooks replaces the configured webhooks with the webhook URLs
+// provided on the command line or in the environment, if any, and
+// adds the encryption keys to the matching webhooks.  It returns an
+// error if an encryption key is malformed or provided for a URL that
+// is not a webhook.
+func applyWebhooks(config *vent.Config) error {
+	keys := map[string]string{}
+	for _, encryptionKey := range encryptionKeys {
+		sep := strings.LastIndex(encryptionKey, "=")
+		if sep < 1 || sep == len(encryptionKey)-1 {
+			return fmt.Errorf("encryption key '%s' is not of the form URL=KEY_FILE", encryptionKey)
+		}
+		keys[encryptionKey[:sep]] = encryptionKey[sep+1:]
+	}
+	if len(webhookURLs) > 0 {
+		hooks := make([]vent.Webhook, 0, len(webhookURLs))
+		for _, url := range webhookURLs {
+			hooks = append(hooks, vent.Webhook{URL: url})
+		}
+		config.Webhooks = hooks
+	}
+	for i, hook := range config.Webhooks {
+		if key, ok := keys[hook.URL]; ok {
+			config.Webhooks[i].EncryptionKey = key
+			delete(keys, hook.URL)
+		}
 	}
+	if len(keys) > 0 {
+		unknown := make([]string, 0, len(keys))
+		for url := range keys {
+			unknown = append(unknown, url)
+		}
+		sort.Strings(unknown)
+		return fmt.Errorf("encryption key provided for unknown webhooks: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// interruptContext returns a context that is canceled when the command
+// receives SIGTERM or SIGINT, or when cancel is called.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(interrupt)
+	}()
+	return ctx, cancel
 }
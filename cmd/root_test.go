@@ -15,10 +15,14 @@
 package cmd
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+
+	"github.com/atomist/k8svent/vent"
 )
 
 func TestEnv(t *testing.T) {
@@ -44,3 +48,93 @@ func TestEnv(t *testing.T) {
 		}
 	}
 }
+
+func TestApplyWebhooks(t *testing.T) {
+	webhookURLs = []string{"http://one", "https://two?x=y"}
+	encryptionKeys = []string{"https://two?x=y=/keys/two.pem"}
+	config := vent.Config{Webhooks: []vent.Webhook{{URL: "http://zero", Secret: "s"}}}
+	if err := applyWebhooks(&config); err != nil {
+		t.Fatalf("failed to apply webhooks: %v", err)
+	}
+	expected := []vent.Webhook{{URL: "http://one"}, {URL: "https://two?x=y", EncryptionKey: "/keys/two.pem"}}
+	if d := cmp.Diff(config.Webhooks, expected); d != "" {
+		t.Errorf("webhooks not as expected: %s", d)
+	}
+
+	webhookURLs = []string{}
+	encryptionKeys = []string{"http://zero=/keys/zero.pem"}
+	config = vent.Config{Webhooks: []vent.Webhook{{URL: "http://zero", Secret: "s"}}}
+	if err := applyWebhooks(&config); err != nil {
+		t.Fatalf("failed to apply webhooks: %v", err)
+	}
+	expected = []vent.Webhook{{URL: "http://zero", Secret: "s", EncryptionKey: "/keys/zero.pem"}}
+	if d := cmp.Diff(config.Webhooks, expected); d != "" {
+		t.Errorf("configured webhooks not as expected: %s", d)
+	}
+
+	webhookURLs = []string{"http://one"}
+	for _, bad := range []string{"http://three=/keys/three.pem", "http://one", "http://one="} {
+		encryptionKeys = []string{bad}
+		if err := applyWebhooks(&vent.Config{}); err == nil {
+			t.Errorf("invalid encryption key '%s' did not result in error", bad)
+		}
+	}
+	encryptionKeys = []string{}
+	webhookURLs = []string{}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "k8svent-config")
+	if dirErr != nil {
+		t.Fatalf("failed to create temporary directory: %v", dirErr)
+	}
+	defer os.RemoveAll(dir)
+	cfgFile = filepath.Join(dir, "k8svent.yaml")
+	defer func() { cfgFile = "" }()
+	configYAML := []byte(`dryRun: true
+logLevel: warn
+namespace: file
+secret: file-secret
+webhooks:
+  - url: https://file.com/webhook
+`)
+	if err := ioutil.WriteFile(cfgFile, configYAML, 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if !config.DryRun || config.LogLevel != "warn" || config.Namespace != "file" || config.Secret != "file-secret" || len(config.Webhooks) != 1 {
+		t.Errorf("configuration file not loaded: %+v", config)
+	}
+
+	if err := RootCmd.PersistentFlags().Set("dry-run", "false"); err != nil {
+		t.Fatalf("failed to set dry-run option: %v", err)
+	}
+	initConfig()
+	defer func() {
+		RootCmd.PersistentFlags().Lookup("dry-run").Changed = false
+		dryRunProvided = false
+	}()
+
+	logLevel = "debug"
+	namespace = "flag"
+	webhookURLs = []string{"http://flag.com/webhook"}
+	defer func() {
+		logLevel = ""
+		namespace = ""
+		webhookURLs = []string{}
+	}()
+	config, err = loadConfig()
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if config.DryRun || config.LogLevel != "debug" || config.Namespace != "flag" || config.Secret != "file-secret" {
+		t.Errorf("options did not override configuration file: %+v", config)
+	}
+	if len(config.Webhooks) != 1 || config.Webhooks[0].URL != "http://flag.com/webhook" {
+		t.Errorf("webhook option did not override configuration file: %+v", config.Webhooks)
+	}
+}
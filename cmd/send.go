@@ -0,0 +1,71 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/atomist/k8svent/vent"
+)
+
+var sendDeleted bool
+
+// sendCmd represents the send command
+var sendCmd = &cobra.Command{
+	Use:   "send NAMESPACE/POD",
+	Short: "Send a single pod to its webhooks",
+	Long: `Get the pod and send it as changed to its webhooks, signed and
+retried as usual, and print a summary of the deliveries.
+
+  $ kubectl exec -n k8svent deploy/k8svent -- k8svent send default/web-5d8f7c9b4-x2x7q
+
+Use it to re-trigger the webhooks for one pod, e.g., after fixing a
+problem on the receiver.  The filters are not applied.  With
+--deleted, the pod is sent as deleted with the phase "Deleted", like
+pods that no longer exist; if the pod does not exist, only its
+namespace and name are sent.  Exits with a non-zero status if any
+delivery failed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		config, configErr := loadConfig()
+		if configErr != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: invalid configuration: %v\n", configErr)
+			os.Exit(1)
+		}
+		ctx, cancel := interruptContext()
+		defer cancel()
+		summary, err := vent.Send(ctx, config, args[0], sendDeleted)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: send failed: %v\n", err)
+			os.Exit(1)
+		}
+		if config.DryRun {
+			fmt.Println("Dry run, nothing sent")
+			return
+		}
+		printDeliverySummary(os.Stdout, summary)
+		if summary.Failed() {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	sendCmd.Flags().BoolVar(&sendDeleted, "deleted", false, "Send the pod as deleted")
+	RootCmd.AddCommand(sendCmd)
+}
@@ -0,0 +1,102 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/atomist/k8svent/vent"
+)
+
+var snapshotStdout bool
+
+// snapshotCmd represents the snapshot command
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Send the current state of every pod once",
+	Long: `List the pods once, apply the configured filters, send every pod as
+new to its webhooks, wait for the deliveries to complete, and print a
+summary of what succeeded and failed.
+
+  $ k8svent snapshot --config=/etc/k8svent/config.yaml
+
+Use it to push the current state of every pod to a receiver, e.g.,
+after its database was wiped.  If --stdout is provided, the pods are
+written to standard output as JSON lines in the webhook payload format
+rather than sent.  Interrupting the snapshot abandons the pending
+deliveries.  Exits with a non-zero status if any delivery failed or
+was abandoned.
+
+Like k8svent itself, the snapshot uses the service account of the pod
+it runs in, so run it in the k8svent pod.
+
+  $ kubectl exec -n k8svent deploy/k8svent -- k8svent snapshot`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, configErr := loadConfig()
+		if configErr != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: invalid configuration: %v\n", configErr)
+			os.Exit(1)
+		}
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		var out io.Writer
+		report := io.Writer(os.Stdout)
+		if snapshotStdout {
+			out = os.Stdout
+			report = os.Stderr
+		}
+		summary, err := vent.Snapshot(ctx, config, out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: snapshot failed: %v\n", err)
+			os.Exit(1)
+		}
+		if snapshotStdout {
+			fmt.Fprintf(report, "Wrote %d pods\n", summary.Pods)
+		} else if config.DryRun {
+			fmt.Fprintf(report, "Dry run of %d pods, nothing sent\n", summary.Pods)
+		} else {
+			printDeliverySummary(report, summary)
+		}
+		if summary.Failed() {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	snapshotCmd.Flags().BoolVar(&snapshotStdout, "stdout", false, "Write pods to standard output as JSON lines rather than sending them")
+	RootCmd.AddCommand(snapshotCmd)
+}
+
+// printDeliverySummary writes the outcome of sending pods to out.
+func printDeliverySummary(out io.Writer, summary vent.DeliverySummary) {
+	fmt.Fprintf(out, "Sent %d pods to %d webhooks\n", summary.Pods, len(summary.Endpoints))
+	for _, e := range summary.Endpoints {
+		fmt.Fprintf(out, "  %s: %d sent, %d failed", e.URL, e.Sent, e.Failed)
+		if e.Abandoned > 0 {
+			fmt.Fprintf(out, ", %d abandoned", e.Abandoned)
+		}
+		fmt.Fprintln(out)
+		if e.LastError != "" {
+			fmt.Fprintf(out, "    last error: %s\n", e.LastError)
+		}
+	}
+}
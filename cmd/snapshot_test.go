@@ -0,0 +1,42 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/atomist/k8svent/vent"
+)
+
+func TestPrintDeliverySummary(t *testing.T) {
+	summary := vent.DeliverySummary{
+		Pods: 3,
+		Endpoints: []vent.EndpointSummary{
+			{URL: "https://one.com/webhook", Sent: 3},
+			{URL: "https://two.com/webhook", Sent: 1, Failed: 1, Abandoned: 1, LastError: "non-200 response"},
+		},
+	}
+	out := &bytes.Buffer{}
+	printDeliverySummary(out, summary)
+	expected := `Sent 3 pods to 2 webhooks
+  https://one.com/webhook: 3 sent, 0 failed
+  https://two.com/webhook: 1 sent, 1 failed, 1 abandoned
+    last error: non-200 response
+`
+	if out.String() != expected {
+		t.Errorf("summary not as expected:\n%s", out.String())
+	}
+}
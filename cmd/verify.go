@@ -0,0 +1,123 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/atomist/k8svent/receiver"
+	"github.com/atomist/k8svent/vent"
+)
+
+var (
+	verifyDecryptionKey    string
+	verifyMaxAge           time.Duration
+	verifyRequireTimestamp bool
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify a captured webhook request",
+	Long: `Read a raw HTTP webhook request sent by k8svent from standard input,
+verify its signatures, and print a report.
+
+  $ k8svent verify --secret=MyS3c43t < request.txt
+
+The request must be in HTTP/1.1 wire format, i.e., the request line,
+headers, a blank line, and the body.  Since captured requests are
+usually old, the delivery timestamp age is only checked if --max-age
+is provided.  If the payload is encrypted, provide the receiver's
+private key using --decryption-key.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := verifyRequest(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "k8svent: verification failed: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	verifyCmd.Flags().StringVar(&verifyDecryptionKey, "decryption-key", "", "Decrypt payload using the PEM-encoded RSA private key in FILE")
+	verifyCmd.Flags().DurationVar(&verifyMaxAge, "max-age", 0, "Reject requests whose delivery timestamp is older than MAX_AGE")
+	verifyCmd.Flags().BoolVar(&verifyRequireTimestamp, "require-timestamp", false, "Reject requests without a signed delivery timestamp")
+	RootCmd.AddCommand(verifyCmd)
+}
+
+// verifyRequest reads an HTTP request from in, verifies it, and
+// writes a report to out.
+func verifyRequest(in io.Reader, out io.Writer) error {
+	req, reqErr := http.ReadRequest(bufio.NewReader(in))
+	if reqErr != nil {
+		return fmt.Errorf("failed to parse HTTP request: %v", reqErr)
+	}
+	body, bodyErr := ioutil.ReadAll(req.Body)
+	if bodyErr != nil {
+		return fmt.Errorf("failed to read request body: %v", bodyErr)
+	}
+
+	opts := receiver.Options{
+		Secret:           webhookSecret,
+		Tolerance:        -1,
+		RequireTimestamp: verifyRequireTimestamp,
+	}
+	if verifyMaxAge > 0 {
+		opts.Tolerance = verifyMaxAge
+	}
+	if verifyDecryptionKey != "" {
+		keyBytes, readErr := ioutil.ReadFile(verifyDecryptionKey)
+		if readErr != nil {
+			return fmt.Errorf("failed to read decryption key: %v", readErr)
+		}
+		key, keyErr := vent.ParsePrivateKey(keyBytes)
+		if keyErr != nil {
+			return fmt.Errorf("invalid decryption key: %v", keyErr)
+		}
+		opts.Decrypt = func(b []byte) ([]byte, error) { return vent.DecryptPayload(b, key) }
+	}
+
+	fmt.Fprintf(out, "Request:   %s %s\n", req.Method, req.URL)
+	fmt.Fprintf(out, "Body:      %d bytes (%s)\n", len(body), req.Header.Get("content-type"))
+	result, verifyErr := receiver.Verify(req.Header, body, opts)
+	if verifyErr != nil {
+		return verifyErr
+	}
+	if result.Signed {
+		fmt.Fprintln(out, "Signature: valid")
+	} else {
+		fmt.Fprintln(out, "Signature: not checked, no secret provided")
+	}
+	if result.Delivery != "" {
+		fmt.Fprintf(out, "Delivery:  %s\n", result.Delivery)
+	}
+	if !result.Timestamp.IsZero() {
+		age := time.Since(result.Timestamp).Round(time.Second)
+		fmt.Fprintf(out, "Timestamp: %s (%s ago)\n", result.Timestamp.UTC().Format(time.RFC3339), age)
+	} else {
+		fmt.Fprintln(out, "Timestamp: none")
+	}
+	pod := result.Payload.Pod
+	fmt.Fprintf(out, "Pod:       %s/%s (%s)\n", pod.Namespace, pod.Name, pod.Status.Phase)
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestVerifyRequest(t *testing.T) {
+	request := "POST /k8svent HTTP/1.1\r\n" +
+		"Host: webhook.example.com\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-Length: 18\r\n" +
+		"X-Atomist-Signature: sha1=634212a9128672522f8d9ac32657d996d80ef7be\r\n" +
+		"\r\n" +
+		`{"jason":"isbell"}`
+
+	webhookSecret = "The400Unit"
+	defer func() { webhookSecret = "" }()
+	out := &bytes.Buffer{}
+	if err := verifyRequest(strings.NewReader(request), out); err != nil {
+		t.Fatalf("failed to verify request: %v", err)
+	}
+	if !strings.Contains(out.String(), "Signature: valid") {
+		t.Errorf("report does not contain valid signature: %s", out.String())
+	}
+
+	webhookSecret = "Southeastern"
+	if err := verifyRequest(strings.NewReader(request), &bytes.Buffer{}); err == nil {
+		t.Error("verified request signed with a different secret")
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package receiver verifies and decodes the webhook requests sent by
+// k8svent.  It is intended for use by webhook receivers written in
+// Go.
+package receiver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Headers set by k8svent on webhook requests.
+const (
+	// SignatureHeader contains the HMAC/SHA-1 signature of the body.
+	SignatureHeader = "x-atomist-signature"
+	// DeliveryHeader contains the unique ID of the delivery, which is
+	// the same for every attempt to deliver a payload.
+	DeliveryHeader = "x-k8svent-delivery"
+	// TimestampHeader contains the time of the delivery attempt in
+	// seconds since the Unix epoch.
+	TimestampHeader = "x-k8svent-timestamp"
+	// DeliverySignatureHeader contains the HMAC/SHA-256 signature of
+	// the delivery ID, timestamp, and body.
+	DeliverySignatureHeader = "x-k8svent-signature"
+)
+
+// DefaultTolerance is the default maximum age of a request.
+const DefaultTolerance = 5 * time.Minute
+
+// maxBodyBytes is the largest request body the middleware reads.
+const maxBodyBytes = 10 << 20
+
+// Verification errors.
+var (
+	ErrMissingSignature = errors.New("request is not signed")
+	ErrInvalidSignature = errors.New("request signature is invalid")
+	ErrMissingTimestamp = errors.New("request has no delivery timestamp")
+	ErrInvalidTimestamp = errors.New("request delivery timestamp is invalid")
+	ErrExpiredTimestamp = errors.New("request delivery timestamp is outside tolerance")
+	ErrReplayed         = errors.New("request delivery has already been received")
+)
+
+// Payload is the body of a k8svent webhook request.
+type Payload struct {
+	Pod v1.Pod `json:"pod"`
+}
+
+// ReplayCache records delivery IDs that have been received.
+type ReplayCache interface {
+	// Reserve records the delivery ID until expiry and returns true
+	// if it is not already recorded or its record has expired.
+	// Otherwise it returns false.  Checking and recording must be
+	// atomic, so concurrent deliveries with the same ID do not both
+	// reserve it.
+	Reserve(delivery string, expiry time.Time) bool
+	// Release removes the record of the delivery ID, so it can be
+	// reserved again.
+	Release(delivery string)
+}
+
+// Options configure request verification.
+type Options struct {
+	// Secret is the secret k8svent signs payloads with.  If it is
+	// empty, signatures are not verified.
+	Secret string
+	// Tolerance is the maximum difference between the delivery
+	// timestamp and now.  If it is zero, DefaultTolerance is used.
+	// If it is negative, the timestamp age is not checked.
+	Tolerance time.Duration
+	// RequireTimestamp rejects requests without delivery timestamp
+	// headers, i.e., requests from versions of k8svent that only
+	// sign the body.
+	RequireTimestamp bool
+	// ReplayCache detects replayed deliveries.  If it is nil,
+	// replays are not detected.
+	ReplayCache ReplayCache
+	// Decrypt, if not nil, is called with the verified body before
+	// it is decoded, e.g., to decrypt payloads encrypted to the
+	// receiver's public key.
+	Decrypt func([]byte) ([]byte, error)
+	// Now returns the current time.  If it is nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Result describes a verified request.
+type Result struct {
+	// Signed is true if the request body signature was verified.
+	Signed bool
+	// Delivery is the delivery ID, if any.
+	Delivery string
+	// Timestamp is the delivery timestamp, if any.
+	Timestamp time.Time
+	// Payload is the decoded body.
+	Payload *Payload
+}
+
+// Verify checks the signatures and delivery timestamp of a request
+// with the provided headers and body and decodes the body.  Replays
+// are not checked, see Options.ReplayCache.
+func Verify(header http.Header, body []byte, opts Options) (r *Result, e error) {
+	result := &Result{Delivery: header.Get(DeliveryHeader)}
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+
+	timestampHeader := header.Get(TimestampHeader)
+	if timestampHeader != "" {
+		seconds, parseErr := strconv.ParseInt(timestampHeader, 10, 64)
+		if parseErr != nil {
+			return r, ErrInvalidTimestamp
+		}
+		result.Timestamp = time.Unix(seconds, 0)
+		tolerance := opts.Tolerance
+		if tolerance == 0 {
+			tolerance = DefaultTolerance
+		}
+		if tolerance > 0 {
+			age := now().Sub(result.Timestamp)
+			if age > tolerance || age < -tolerance {
+				return r, ErrExpiredTimestamp
+			}
+		}
+	} else if opts.RequireTimestamp {
+		return r, ErrMissingTimestamp
+	}
+
+	if opts.Secret != "" {
+		if err := verifySignature(header.Get(SignatureHeader), body, opts.Secret); err != nil {
+			return r, err
+		}
+		if timestampHeader != "" || opts.RequireTimestamp {
+			if result.Delivery == "" {
+				return r, ErrMissingSignature
+			}
+			message := append([]byte(result.Delivery+"."+timestampHeader+"."), body...)
+			if err := verifyHMAC(header.Get(DeliverySignatureHeader), "sha256=", sha256.New, message, opts.Secret); err != nil {
+				return r, err
+			}
+		}
+		result.Signed = true
+	}
+
+	if opts.Decrypt != nil {
+		decrypted, decryptErr := opts.Decrypt(body)
+		if decryptErr != nil {
+			return r, fmt.Errorf("failed to decrypt payload: %v", decryptErr)
+		}
+		body = decrypted
+	}
+	var payload Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return r, fmt.Errorf("failed to decode payload: %v", err)
+	}
+	result.Payload = &payload
+	return result, nil
+}
+
+// verifySignature checks the HMAC/SHA-1 signature of body.
+func verifySignature(signature string, body []byte, secret string) error {
+	return verifyHMAC(signature, "sha1=", sha1.New, body, secret)
+}
+
+// verifyHMAC checks that signature is prefix followed by the
+// hex-encoded HMAC of message using secret.
+func verifyHMAC(signature string, prefix string, h func() hash.Hash, message []byte, secret string) error {
+	if signature == "" {
+		return ErrMissingSignature
+	}
+	if !strings.HasPrefix(signature, prefix) {
+		return ErrInvalidSignature
+	}
+	sum, decodeErr := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+	if decodeErr != nil {
+		return ErrInvalidSignature
+	}
+	mac := hmac.New(h, []byte(secret))
+	if _, err := mac.Write(message); err != nil {
+		return fmt.Errorf("failed to write message to HMAC: %v", err)
+	}
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// PayloadFromContext returns the payload stored in the request
+// context by Middleware.
+func PayloadFromContext(ctx context.Context) (*Payload, bool) {
+	payload, ok := ctx.Value(contextKey{}).(*Payload)
+	return payload, ok
+}
+
+// Middleware returns a handler that verifies k8svent webhook requests
+// before passing them to next.  Requests that fail verification get
+// a 401 response and requests whose payload cannot be decoded get a
+// 400 response.  Deliveries that have already been received get a
+// 200 response without calling next so k8svent does not retry them.
+// The decoded payload is available to next via PayloadFromContext.
+// Deliveries are reserved before next is called and released if next
+// does not respond with a 2xx status, so deliveries next fails to
+// handle are retried.  Deliveries received again while next is still
+// handling them get a 409 response, so k8svent retries them in case
+// handling fails.
+func Middleware(opts Options, next http.Handler) http.Handler {
+	var mu sync.Mutex
+	handling := map[string]bool{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		body, readErr := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+		if readErr != nil {
+			writeResponse(w, http.StatusBadRequest, "failed to read request body")
+			return
+		}
+		result, verifyErr := Verify(r.Header, body, opts)
+		if verifyErr != nil {
+			status := http.StatusBadRequest
+			if isVerificationError(verifyErr) {
+				status = http.StatusUnauthorized
+			}
+			writeResponse(w, status, verifyErr.Error())
+			return
+		}
+		ctx := context.WithValue(r.Context(), contextKey{}, result.Payload)
+		if opts.ReplayCache == nil || result.Delivery == "" {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		tolerance := DefaultTolerance
+		if opts.Tolerance > 0 {
+			tolerance = opts.Tolerance
+		}
+		mu.Lock()
+		if !opts.ReplayCache.Reserve(result.Delivery, time.Now().Add(2*tolerance)) {
+			inProgress := handling[result.Delivery]
+			mu.Unlock()
+			if inProgress {
+				writeResponse(w, http.StatusConflict, "delivery is being handled")
+				return
+			}
+			writeResponse(w, http.StatusOK, ErrReplayed.Error())
+			return
+		}
+		handling[result.Delivery] = true
+		mu.Unlock()
+		sw := &statusWriter{ResponseWriter: w}
+		handled := false
+		defer func() {
+			mu.Lock()
+			defer mu.Unlock()
+			delete(handling, result.Delivery)
+			if !handled || (sw.status != 0 && (sw.status < 200 || sw.status > 299)) {
+				opts.ReplayCache.Release(result.Delivery)
+			}
+		}()
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		handled = true
+	})
+}
+
+// statusWriter records the status of the response it writes.  A zero
+// status means the handler wrote nothing, which net/http sends as 200.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status and writes it.
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records an implicit 200 status and writes b.
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// isVerificationError returns true if err is a signature or
+// timestamp verification failure.
+func isVerificationError(err error) bool {
+	switch err {
+	case ErrMissingSignature, ErrInvalidSignature, ErrMissingTimestamp, ErrInvalidTimestamp, ErrExpiredTimestamp:
+		return true
+	}
+	return false
+}
+
+// writeResponse writes a JSON response with the provided message.
+func writeResponse(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// MemoryReplayCache is an in-memory ReplayCache.  It is safe for
+// concurrent use.
+type MemoryReplayCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+// NewMemoryReplayCache creates an empty in-memory replay cache.
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{entries: map[string]time.Time{}}
+}
+
+// Seen returns true if the delivery ID is recorded and has not
+// expired.  Expired entries are removed on each call.
+func (c *MemoryReplayCache) Seen(delivery string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for id, e := range c.entries {
+		if now.After(e) {
+			delete(c.entries, id)
+		}
+	}
+	_, ok := c.entries[delivery]
+	return ok
+}
+
+// Add records the delivery ID until expiry.
+func (c *MemoryReplayCache) Add(delivery string, expiry time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[delivery] = expiry
+}
+
+// Reserve implements ReplayCache.
+func (c *MemoryReplayCache) Reserve(delivery string, expiry time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[delivery]; ok && !time.Now().After(e) {
+		return false
+	}
+	c.entries[delivery] = expiry
+	return true
+}
+
+// Release implements ReplayCache.
+func (c *MemoryReplayCache) Release(delivery string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, delivery)
+}
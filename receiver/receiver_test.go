@@ -0,0 +1,278 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testSecret = "Decoration Day"
+
+var testBody = []byte(`{"pod":{"metadata":{"name":"sink-hole","namespace":"drive-by-truckers"},"status":{"phase":"Running"}}}`)
+
+// signedHeader returns the headers k8svent would send for body.
+func signedHeader(body []byte, delivery string, timestamp time.Time, secret string) http.Header {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	sha1Mac := hmac.New(sha1.New, []byte(secret))
+	sha1Mac.Write(body)
+	sha256Mac := hmac.New(sha256.New, []byte(secret))
+	sha256Mac.Write([]byte(delivery + "." + ts + "."))
+	sha256Mac.Write(body)
+	h := http.Header{}
+	h.Set(SignatureHeader, "sha1="+hex.EncodeToString(sha1Mac.Sum(nil)))
+	h.Set(DeliveryHeader, delivery)
+	h.Set(TimestampHeader, ts)
+	h.Set(DeliverySignatureHeader, "sha256="+hex.EncodeToString(sha256Mac.Sum(nil)))
+	return h
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	opts := Options{Secret: testSecret}
+
+	result, err := Verify(signedHeader(testBody, "d1", now, testSecret), testBody, opts)
+	if err != nil {
+		t.Fatalf("failed to verify valid request: %v", err)
+	}
+	if !result.Signed {
+		t.Error("valid request not reported as signed")
+	}
+	if result.Delivery != "d1" {
+		t.Errorf("unexpected delivery ID: %s", result.Delivery)
+	}
+	if result.Payload.Pod.Name != "sink-hole" || result.Payload.Pod.Namespace != "drive-by-truckers" {
+		t.Errorf("payload not decoded: %+v", result.Payload.Pod.ObjectMeta)
+	}
+
+	if _, err := Verify(signedHeader(testBody, "d1", now, "wrong"), testBody, opts); err != ErrInvalidSignature {
+		t.Errorf("expected invalid signature error: %v", err)
+	}
+
+	tampered := signedHeader(testBody, "d1", now, testSecret)
+	tampered.Set(DeliveryHeader, "d2")
+	if _, err := Verify(tampered, testBody, opts); err != ErrInvalidSignature {
+		t.Errorf("expected invalid signature error for altered delivery: %v", err)
+	}
+
+	old := now.Add(-10 * time.Minute)
+	if _, err := Verify(signedHeader(testBody, "d1", old, testSecret), testBody, opts); err != ErrExpiredTimestamp {
+		t.Errorf("expected expired timestamp error: %v", err)
+	}
+	if _, err := Verify(signedHeader(testBody, "d1", old, testSecret), testBody, Options{Secret: testSecret, Tolerance: -1}); err != nil {
+		t.Errorf("timestamp checked when tolerance is negative: %v", err)
+	}
+
+	legacy := http.Header{}
+	legacy.Set(SignatureHeader, signedHeader(testBody, "d1", now, testSecret).Get(SignatureHeader))
+	if _, err := Verify(legacy, testBody, opts); err != nil {
+		t.Errorf("failed to verify legacy request: %v", err)
+	}
+	if _, err := Verify(legacy, testBody, Options{Secret: testSecret, RequireTimestamp: true}); err != ErrMissingTimestamp {
+		t.Errorf("expected missing timestamp error: %v", err)
+	}
+
+	if _, err := Verify(http.Header{}, testBody, opts); err != ErrMissingSignature {
+		t.Errorf("expected missing signature error: %v", err)
+	}
+	unsigned, unsignedErr := Verify(http.Header{}, testBody, Options{})
+	if unsignedErr != nil {
+		t.Errorf("failed to decode unsigned request without secret: %v", unsignedErr)
+	} else if unsigned.Signed {
+		t.Error("unsigned request reported as signed")
+	}
+
+	decrypted := false
+	decrypt := func(b []byte) ([]byte, error) {
+		decrypted = true
+		return bytes.TrimPrefix(b, []byte("sealed:")), nil
+	}
+	sealed := append([]byte("sealed:"), testBody...)
+	if _, err := Verify(signedHeader(sealed, "d3", now, testSecret), sealed, Options{Secret: testSecret, Decrypt: decrypt}); err != nil {
+		t.Errorf("failed to verify encrypted request: %v", err)
+	}
+	if !decrypted {
+		t.Error("decrypt function not called")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		payload, ok := PayloadFromContext(r.Context())
+		if !ok {
+			t.Error("payload not found in request context")
+		} else if payload.Pod.Name != "sink-hole" {
+			t.Errorf("unexpected pod in payload: %s", payload.Pod.Name)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	handler := Middleware(Options{Secret: testSecret, ReplayCache: NewMemoryReplayCache()}, next)
+
+	send := func(header http.Header, body []byte) int {
+		req := httptest.NewRequest(http.MethodPost, "/k8svent", bytes.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	header := signedHeader(testBody, "d1", time.Now(), testSecret)
+	if code := send(header, testBody); code != http.StatusAccepted {
+		t.Errorf("valid request got response code %d", code)
+	}
+	if code := send(header, testBody); code != http.StatusOK {
+		t.Errorf("replayed request got response code %d", code)
+	}
+	if calls != 1 {
+		t.Errorf("expected handler to be called once, called %d times", calls)
+	}
+	if code := send(signedHeader(testBody, "d4", time.Now(), testSecret), testBody); code != http.StatusAccepted {
+		t.Errorf("implicit 200 response got response code %d", code)
+	}
+	if code := send(signedHeader(testBody, "d2", time.Now(), "wrong"), testBody); code != http.StatusUnauthorized {
+		t.Errorf("invalid signature got response code %d", code)
+	}
+	badBody := []byte("Southern Rock Opera")
+	if code := send(signedHeader(badBody, "d3", time.Now(), testSecret), badBody); code != http.StatusBadRequest {
+		t.Errorf("invalid payload got response code %d", code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/k8svent", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET request got response code %d", rec.Code)
+	}
+}
+
+func TestMiddlewareRetry(t *testing.T) {
+	fail := true
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if fail {
+			fail = false
+			http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"message":"ok"}`))
+	})
+	handler := Middleware(Options{Secret: testSecret, ReplayCache: NewMemoryReplayCache()}, next)
+	header := signedHeader(testBody, "retried", time.Now(), testSecret)
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/k8svent", bytes.NewReader(testBody))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+	}
+	if codes[0] != http.StatusServiceUnavailable || codes[1] != http.StatusOK || codes[2] != http.StatusOK {
+		t.Errorf("unexpected response codes %v", codes)
+	}
+	if calls != 2 {
+		t.Errorf("expected the failed delivery to be retried once by the handler, called %d times", calls)
+	}
+}
+
+func TestMemoryReplayCache(t *testing.T) {
+	c := NewMemoryReplayCache()
+	if c.Seen("a") {
+		t.Error("new delivery reported as seen")
+	}
+	c.Add("a", time.Now().Add(time.Minute))
+	if !c.Seen("a") {
+		t.Error("recorded delivery not reported as seen")
+	}
+	c.Add("b", time.Now().Add(-time.Minute))
+	if c.Seen("b") {
+		t.Error("expired delivery reported as seen")
+	}
+}
+
+func TestMemoryReplayCacheReserve(t *testing.T) {
+	c := NewMemoryReplayCache()
+	if !c.Reserve("a", time.Now().Add(time.Minute)) {
+		t.Error("failed to reserve new delivery")
+	}
+	if c.Reserve("a", time.Now().Add(time.Minute)) {
+		t.Error("reserved delivery reserved again")
+	}
+	c.Release("a")
+	if !c.Reserve("a", time.Now().Add(time.Minute)) {
+		t.Error("failed to reserve released delivery")
+	}
+	c.Add("b", time.Now().Add(-time.Minute))
+	if !c.Reserve("b", time.Now().Add(time.Minute)) {
+		t.Error("failed to reserve expired delivery")
+	}
+}
+
+func TestMiddlewareConcurrent(t *testing.T) {
+	entered := make(chan struct{})
+	finish := make(chan int)
+	var calls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(entered)
+		}
+		w.WriteHeader(<-finish)
+	})
+	handler := Middleware(Options{Secret: testSecret, ReplayCache: NewMemoryReplayCache()}, next)
+	header := signedHeader(testBody, "concurrent", time.Now(), testSecret)
+	send := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/k8svent", bytes.NewReader(testBody))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	first := make(chan int)
+	go func() { first <- send() }()
+	<-entered
+	if code := send(); code != http.StatusConflict {
+		t.Errorf("delivery received while being handled got response code %d", code)
+	}
+	finish <- http.StatusInternalServerError
+	if code := <-first; code != http.StatusInternalServerError {
+		t.Errorf("failed delivery got response code %d", code)
+	}
+
+	go func() { finish <- http.StatusOK }()
+	if code := send(); code != http.StatusOK {
+		t.Errorf("retried delivery got response code %d", code)
+	}
+	if code, n := send(), atomic.LoadInt32(&calls); code != http.StatusOK || n != 2 {
+		t.Errorf("replayed delivery got response code %d after %d calls", code, n)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// adminPrefix is the path prefix of the admin API.
+const adminPrefix = "/admin/"
+
+// adminPod summarizes a tracked pod.
+type adminPod struct {
+	Pod      string      `json:"pod"`
+	Phase    v1.PodPhase `json:"phase"`
+	Healthy  bool        `json:"healthy"`
+	Event    PodEvent    `json:"event"`
+	Sent     time.Time   `json:"sent"`
+	Webhooks []string    `json:"webhooks"`
+}
+
+// adminEndpoint is the state of a webhook endpoint.
+type adminEndpoint struct {
+	URL           string     `json:"url"`
+	Paused        bool       `json:"paused"`
+	CircuitOpen   bool       `json:"circuitOpen"`
+	Pending       int        `json:"pending"`
+	Sent          uint64     `json:"sent"`
+	Failed        uint64     `json:"failed"`
+	Retries       uint64     `json:"retries"`
+	LastSuccess   *time.Time `json:"lastSuccess,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+	Deliveries    []delivery `json:"deliveries"`
+	Failures      []delivery `json:"failures"`
+}
+
+// adminLogLevel is the request and response of the log level
+// endpoint.
+type adminLogLevel struct {
+	Level string `json:"level"`
+}
+
+// adminHandler serves the admin API.  Every request must provide the
+// configured admin token as a bearer token.  If no admin token is
+// configured, the admin API is disabled.
+func (v *Venter) adminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := v.currentConfig().AdminToken
+		if token == "" {
+			v.writeAdminError(w, http.StatusNotFound, "admin API is disabled")
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="k8svent"`)
+			v.writeAdminError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix), "/")
+		parts := strings.Split(path, "/")
+		switch {
+		case path == "pods" && r.Method == http.MethodGet:
+			v.adminListPods(w)
+		case len(parts) == 3 && parts[0] == "pods" && r.Method == http.MethodGet:
+			v.adminGetPod(w, parts[1]+"/"+parts[2])
+		case len(parts) == 4 && parts[0] == "pods" && parts[3] == "resend" && r.Method == http.MethodPost:
+			v.adminResendPod(w, parts[1]+"/"+parts[2])
+		case path == "endpoints" && r.Method == http.MethodGet:
+			v.writeAdminJSON(w, http.StatusOK, adminEndpoints(v.endpoints.statuses()))
+		case (path == "endpoints/pause" || path == "endpoints/resume") && r.Method == http.MethodPost:
+			v.adminPauseEndpoint(w, r.URL.Query().Get("url"), path == "endpoints/pause")
+		case path == "resync" && r.Method == http.MethodPost:
+			if !v.requestResync() {
+				v.writeAdminError(w, http.StatusServiceUnavailable, "resync is not available")
+				return
+			}
+			v.moduleLogger(LogModuleServer).Info("Resync requested using admin API")
+			v.writeAdminJSON(w, http.StatusAccepted, map[string]string{"status": "resyncing"})
+		case path == "loglevel":
+			v.adminLogLevel(w, r)
+		default:
+			v.writeAdminError(w, http.StatusNotFound, fmt.Sprintf("no such admin endpoint: %s %s", r.Method, r.URL.Path))
+		}
+	})
+}
+
+// adminListPods responds with a summary of every tracked pod and the
+// webhooks it is currently routed to.
+func (v *Venter) adminListPods(w http.ResponseWriter) {
+	tracked := v.trackedPods()
+	slugs := make([]string, 0, len(tracked))
+	for slug := range tracked {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+	pods := make([]adminPod, 0, len(slugs))
+	for _, slug := range slugs {
+		t := tracked[slug]
+		hooks := v.podWebhooks(t.Pod)
+		urls := make([]string, 0, len(hooks))
+		for _, hook := range hooks {
+			if hook.wants(t.Event) {
+				urls = append(urls, redactURL(hook.url))
+			}
+		}
+		pods = append(pods, adminPod{
+			Pod:      slug,
+			Phase:    t.Pod.Status.Phase,
+			Healthy:  v.health.Healthy(t.Pod),
+			Event:    t.Event,
+			Sent:     t.Sent,
+			Webhooks: urls,
+		})
+	}
+	v.writeAdminJSON(w, http.StatusOK, pods)
+}
+
+// adminGetPod responds with the last state of the pod sent.
+func (v *Venter) adminGetPod(w http.ResponseWriter, slug string) {
+	t, ok := v.trackedPods()[slug]
+	if !ok {
+		v.writeAdminError(w, http.StatusNotFound, fmt.Sprintf("pod %s is not tracked", slug))
+		return
+	}
+	v.writeAdminJSON(w, http.StatusOK, t)
+}
+
+// adminResendPod sends the last state of the pod to its webhooks
+// again.
+func (v *Venter) adminResendPod(w http.ResponseWriter, slug string) {
+	t, ok := v.trackedPods()[slug]
+	if !ok {
+		v.writeAdminError(w, http.StatusNotFound, fmt.Sprintf("pod %s is not tracked", slug))
+		return
+	}
+	v.moduleLogger(LogModuleServer).WithField("pod", slug).Info("Resending pod using admin API")
+	ctx := withTracer(context.Background(), v.tracer)
+	if err := v.processPod(ctx, t.Pod, t.Event); err != nil {
+		v.writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	v.writeAdminJSON(w, http.StatusAccepted, map[string]string{"status": "resending", "pod": slug})
+}
+
+// adminPauseEndpoint pauses or resumes the endpoints whose URL or
+// redacted URL is target.
+func (v *Venter) adminPauseEndpoint(w http.ResponseWriter, target string, pause bool) {
+	if target == "" {
+		v.writeAdminError(w, http.StatusBadRequest, "url query parameter is required")
+		return
+	}
+	var matched []string
+	for u := range v.endpoints.statuses() {
+		if u != target && redactURL(u) != target {
+			continue
+		}
+		state := v.endpoints.get(u)
+		if pause {
+			state.pause()
+		} else {
+			state.resume()
+		}
+		matched = append(matched, u)
+	}
+	if len(matched) == 0 {
+		v.writeAdminError(w, http.StatusNotFound, fmt.Sprintf("no endpoint matches '%s'", target))
+		return
+	}
+	action := "Resumed"
+	if pause {
+		action = "Paused"
+	}
+	statuses := map[string]endpointStatus{}
+	for _, u := range matched {
+		v.moduleLogger(LogModuleServer).Infof("%s deliveries to '%s' using admin API", action, redactURL(u))
+		statuses[u] = v.endpoints.get(u).status()
+	}
+	v.writeAdminJSON(w, http.StatusOK, adminEndpoints(statuses))
+}
+
+// adminLogLevel reports the current log level on GET, overrides the
+// level of all modules on PUT, and restores the configured levels on
+// DELETE.  If the log levels are controlled by the logger provided in
+// Options, they cannot be changed.
+func (v *Venter) adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	if v.levels == nil {
+		v.writeAdminError(w, http.StatusConflict, "log levels are controlled by the logger of the program running k8svent")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var request adminLogLevel
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			v.writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+			return
+		}
+		level, levelErr := parseLogLevel(request.Level)
+		if levelErr != nil || request.Level == "" {
+			v.writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid log level '%s'", request.Level))
+			return
+		}
+		v.levels.overrideLevel(level)
+		v.moduleLogger(LogModuleServer).Infof("Changed log level to %s using admin API", level)
+	case http.MethodDelete:
+		v.levels.reset()
+		v.moduleLogger(LogModuleServer).Info("Restored configured log levels using admin API")
+	default:
+		v.writeAdminError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		return
+	}
+	v.writeAdminJSON(w, http.StatusOK, adminLogLevel{Level: v.levels.current().String()})
+}
+
+// adminEndpoints converts the endpoint statuses, sorted by redacted
+// URL.  URLs are redacted since they may contain credentials.
+func adminEndpoints(statuses map[string]endpointStatus) []adminEndpoint {
+	endpoints := make([]adminEndpoint, 0, len(statuses))
+	for u, s := range statuses {
+		e := adminEndpoint{
+			URL:         redactURL(u),
+			Paused:      s.paused,
+			CircuitOpen: s.circuitOpen,
+			Pending:     s.pending,
+			Sent:        s.sent,
+			Failed:      s.failed,
+			Retries:     s.retries,
+			LastError:   s.lastError,
+			Deliveries:  s.deliveries,
+			Failures:    s.failures,
+		}
+		if !s.lastSuccess.IsZero() {
+			e.LastSuccess = &s.lastSuccess
+		}
+		if !s.lastErrorTime.IsZero() {
+			e.LastErrorTime = &s.lastErrorTime
+		}
+		if e.Deliveries == nil {
+			e.Deliveries = []delivery{}
+		}
+		if e.Failures == nil {
+			e.Failures = []delivery{}
+		}
+		endpoints = append(endpoints, e)
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].URL < endpoints[j].URL })
+	return endpoints
+}
+
+// writeAdminJSON writes value as the JSON response body.
+func (v *Venter) writeAdminJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		v.moduleLogger(LogModuleServer).Warnf("Failed to write admin response: %v", err)
+	}
+}
+
+// writeAdminError writes a JSON error response.
+func (v *Venter) writeAdminError(w http.ResponseWriter, code int, message string) {
+	v.writeAdminJSON(w, code, map[string]string{"error": message})
+}
@@ -0,0 +1,273 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAdminAPI(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "admin")
+	defer resetLogLevel()
+
+	received := make(chan string, 10)
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		received <- podSlug(payload.Pod)
+	}))
+	defer webhookServer.Close()
+	hookURL := webhookServer.URL + "/webhook"
+
+	v := newVenter()
+	if err := v.setConfig(Config{AdminToken: "t0k3n", Webhooks: []Webhook{{URL: hookURL}}}); err != nil {
+		t.Fatalf("failed to set configuration: %v", err)
+	}
+	server := httptest.NewServer(v.Handler())
+	defer server.Close()
+
+	request := func(method string, path string, token string, body string) (int, string) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if reqErr != nil {
+			t.Fatalf("failed to create request: %v", reqErr)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, respErr := http.DefaultClient.Do(req)
+		if respErr != nil {
+			t.Fatalf("request failed: %v", respErr)
+		}
+		defer resp.Body.Close()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(respBody)
+	}
+	waitFor := func(pod string) {
+		select {
+		case slug := <-received:
+			if slug != pod {
+				t.Errorf("webhook received %s rather than %s", slug, pod)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("webhook did not receive %s", pod)
+		}
+	}
+
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "rock", Name: "vedder"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+	if err := v.processPod(context.Background(), pod, PodNew); err != nil {
+		t.Fatalf("failed to process pod: %v", err)
+	}
+	waitFor("rock/vedder")
+
+	if code, _ := request("GET", "/admin/pods", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("request without token was not rejected: %d", code)
+	}
+	if code, _ := request("GET", "/admin/pods", "wrong", ""); code != http.StatusUnauthorized {
+		t.Errorf("request with wrong token was not rejected: %d", code)
+	}
+
+	code, body := request("GET", "/admin/pods", "t0k3n", "")
+	var pods []adminPod
+	if err := json.Unmarshal([]byte(body), &pods); err != nil || code != http.StatusOK {
+		t.Fatalf("failed to list pods: %d %v: %s", code, err, body)
+	}
+	if len(pods) != 1 || pods[0].Pod != "rock/vedder" || pods[0].Event != PodNew || pods[0].Phase != v1.PodRunning ||
+		len(pods[0].Webhooks) != 1 || pods[0].Webhooks[0] != hookURL {
+		t.Errorf("pods not as expected: %+v", pods)
+	}
+	if code, body := request("GET", "/admin/pods/rock/vedder", "t0k3n", ""); code != http.StatusOK || !strings.Contains(body, `"name":"vedder"`) {
+		t.Errorf("failed to get pod: %d: %s", code, body)
+	}
+	if code, _ := request("GET", "/admin/pods/rock/cornell", "t0k3n", ""); code != http.StatusNotFound {
+		t.Errorf("untracked pod was found: %d", code)
+	}
+	if code, body := request("POST", "/admin/pods/rock/vedder/resend", "t0k3n", ""); code != http.StatusAccepted {
+		t.Errorf("failed to resend pod: %d: %s", code, body)
+	}
+	waitFor("rock/vedder")
+
+	if code, body := request("POST", "/admin/endpoints/pause?url="+hookURL, "t0k3n", ""); code != http.StatusOK || !strings.Contains(body, `"paused":true`) {
+		t.Errorf("failed to pause endpoint: %d: %s", code, body)
+	}
+	if code, _ := request("POST", "/admin/endpoints/pause?url=https://nowhere.com/", "t0k3n", ""); code != http.StatusNotFound {
+		t.Errorf("pausing unknown endpoint did not fail: %d", code)
+	}
+	if err := v.processPod(context.Background(), pod, PodChanged); err != nil {
+		t.Fatalf("failed to process pod: %v", err)
+	}
+	select {
+	case <-received:
+		t.Error("paused endpoint received pod")
+	case <-time.After(100 * time.Millisecond):
+	}
+	code, body = request("GET", "/admin/endpoints", "t0k3n", "")
+	var endpoints []adminEndpoint
+	if err := json.Unmarshal([]byte(body), &endpoints); err != nil || code != http.StatusOK {
+		t.Fatalf("failed to list endpoints: %d %v: %s", code, err, body)
+	}
+	if len(endpoints) != 1 || !endpoints[0].Paused || endpoints[0].Sent != 2 || endpoints[0].Pending != 1 ||
+		len(endpoints[0].Deliveries) != 1 || endpoints[0].Deliveries[0].Event != PodChanged {
+		t.Errorf("endpoints not as expected: %+v", endpoints)
+	}
+	if code, body := request("POST", "/admin/endpoints/resume?url="+hookURL, "t0k3n", ""); code != http.StatusOK || !strings.Contains(body, `"paused":false`) {
+		t.Errorf("failed to resume endpoint: %d: %s", code, body)
+	}
+	waitFor("rock/vedder")
+
+	if code, _ := request("POST", "/admin/resync", "t0k3n", ""); code != http.StatusAccepted {
+		t.Errorf("failed to request resync: %d", code)
+	}
+	select {
+	case <-v.resync:
+	default:
+		t.Error("resync was not requested")
+	}
+
+	if code, body := request("PUT", "/admin/loglevel", "t0k3n", `{"level":"trace"}`); code != http.StatusOK || !strings.Contains(body, `"trace"`) {
+		t.Errorf("failed to change log level: %d: %s", code, body)
+	}
+	if code, _ := request("PUT", "/admin/loglevel", "t0k3n", `{"level":"loud"}`); code != http.StatusBadRequest {
+		t.Errorf("invalid log level was not rejected: %d", code)
+	}
+	if code, body := request("DELETE", "/admin/loglevel", "t0k3n", ""); code != http.StatusOK || !strings.Contains(body, `"info"`) {
+		t.Errorf("failed to restore log level: %d: %s", code, body)
+	}
+
+	if code, _ := request("GET", "/admin/nothing", "t0k3n", ""); code != http.StatusNotFound {
+		t.Errorf("unknown admin endpoint did not return 404: %d", code)
+	}
+	if err := v.setConfig(Config{}); err != nil {
+		t.Fatalf("failed to set configuration: %v", err)
+	}
+	if code, _ := request("GET", "/admin/pods", "t0k3n", ""); code != http.StatusNotFound {
+		t.Errorf("admin API without token was not disabled: %d", code)
+	}
+}
+
+func TestAdminAPIConcurrentWithRun(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "admin")
+
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer webhookServer.Close()
+
+	var objects []runtime.Object
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("pod-%d", i)
+		objects = append(objects,
+			&v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "pearl",
+					Name:      name,
+					Annotations: map[string]string{
+						WebhooksAnnotation:      webhookServer.URL + "/" + name,
+						WebhookSecretAnnotation: name,
+					},
+				},
+				Status: v1.PodStatus{Phase: v1.PodRunning},
+			},
+			&v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "pearl", Name: name},
+				Data:       map[string][]byte{defaultSecretKey: []byte("s3cr3t-" + name)},
+			},
+		)
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+	// slow secret reads so concurrent requests miss the secret cache
+	// together
+	clientset.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(time.Millisecond)
+		return false, nil, nil
+	})
+	v, venterErr := NewVenter(clientset, Options{
+		Config: Config{AdminToken: "t0k3n"},
+		// healthy pods are only sent once, so the admin requests
+		// are the first to read the secrets in most cycles
+		HealthPolicy: HealthPolicyFunc(func(pod v1.Pod) bool { return true }),
+		Interval:     time.Millisecond,
+		Logger:       logger,
+	})
+	if venterErr != nil {
+		t.Fatalf("failed to create venter: %v", venterErr)
+	}
+	server := httptest.NewServer(v.Handler())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- v.Run(ctx) }()
+
+	request := func(method string, path string) int {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer t0k3n")
+		resp, respErr := http.DefaultClient.Do(req)
+		if respErr != nil {
+			t.Errorf("request failed: %v", respErr)
+			return 0
+		}
+		defer resp.Body.Close()
+		_, _ = ioutil.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			deadline := time.Now().Add(300 * time.Millisecond)
+			for time.Now().Before(deadline) {
+				request("GET", "/admin/pods")
+				request("POST", fmt.Sprintf("/admin/pods/pearl/pod-%d/resend", c))
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after its context was done")
+	}
+	if code := request("GET", "/admin/pods/pearl/pod-0"); code != http.StatusOK {
+		t.Errorf("pod not tracked after concurrent requests: %d", code)
+	}
+	if code := request("PUT", "/admin/loglevel"); code != http.StatusConflict {
+		t.Errorf("log level of the provided logger changed using admin API: %d", code)
+	}
+}
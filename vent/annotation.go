@@ -0,0 +1,360 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotations on pods and namespaces that route pods to additional
+// webhooks.
+const (
+	// AnnotationPrefix is the prefix of all k8svent annotations.
+	AnnotationPrefix = "k8svent.atomist.com/"
+	// WebhooksAnnotation is a comma-delimited list of webhook URLs.
+	WebhooksAnnotation = AnnotationPrefix + "webhooks"
+	// WebhookPolicyAnnotation determines whether the annotation
+	// webhooks are added to, "append", or replace, "replace", the
+	// webhooks the pod would otherwise be sent to.  The default is
+	// "append".
+	WebhookPolicyAnnotation = AnnotationPrefix + "webhook-policy"
+	// WebhookSecretAnnotation references the Kubernetes secret, in
+	// the same namespace, holding the secret used to sign payloads
+	// sent to the annotation webhooks.  Its value is NAME or
+	// NAME/KEY, where NAME must be WebhookSecretName.  If KEY is not
+	// provided, "secret" is used.
+	WebhookSecretAnnotation = AnnotationPrefix + "webhook-secret"
+)
+
+// WebhookSecretName is the only Kubernetes secret webhook annotations
+// may reference, so k8svent is only granted access to it rather than
+// to every secret in the namespace.
+const WebhookSecretName = "k8svent-webhook"
+
+// Values of the WebhookPolicyAnnotation.
+const (
+	appendPolicy  = "append"
+	replacePolicy = "replace"
+)
+
+// defaultSecretKey is the key in the referenced Kubernetes secret
+// used if the WebhookSecretAnnotation does not provide one.
+const defaultSecretKey = "secret"
+
+// secretRef refers to a key in a Kubernetes secret.
+type secretRef struct {
+	namespace string
+	name      string
+	key       string
+}
+
+// annotationWebhooks are the webhooks parsed from the annotations of
+// a pod or namespace.
+type annotationWebhooks struct {
+	urls    []string
+	replace bool
+	secret  *secretRef
+}
+
+// parseWebhookAnnotations parses the k8svent webhook annotations.
+// Secret references are resolved in namespace.  It returns nil if
+// there are no k8svent webhook annotations.
+func parseWebhookAnnotations(annotations map[string]string, namespace string) (*annotationWebhooks, error) {
+	value, ok := annotations[WebhooksAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	a := &annotationWebhooks{}
+	for _, u := range strings.Split(value, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if msg := validateRemoteWebhookURL(u); msg != "" {
+			return nil, fmt.Errorf("invalid %s annotation: %s", WebhooksAnnotation, msg)
+		}
+		a.urls = append(a.urls, u)
+	}
+	switch policy := annotations[WebhookPolicyAnnotation]; policy {
+	case "", appendPolicy:
+	case replacePolicy:
+		a.replace = true
+	default:
+		return nil, fmt.Errorf("invalid %s annotation '%s', must be '%s' or '%s'", WebhookPolicyAnnotation,
+			policy, appendPolicy, replacePolicy)
+	}
+	if ref, ok := annotations[WebhookSecretAnnotation]; ok {
+		parts := strings.Split(ref, "/")
+		if len(parts) > 2 || parts[0] == "" || (len(parts) == 2 && parts[1] == "") {
+			return nil, fmt.Errorf("invalid %s annotation '%s', must be NAME or NAME/KEY", WebhookSecretAnnotation, ref)
+		}
+		if parts[0] != WebhookSecretName {
+			return nil, fmt.Errorf("invalid %s annotation '%s', only the %s secret may be referenced", WebhookSecretAnnotation,
+				ref, WebhookSecretName)
+		}
+		a.secret = &secretRef{namespace: namespace, name: parts[0], key: defaultSecretKey}
+		if len(parts) == 2 {
+			a.secret.key = parts[1]
+		}
+	}
+	return a, nil
+}
+
+// webhookRouter determines which webhooks each pod is sent to using
+// the configured webhooks, the annotations on the pod and its
+// namespace, and the VentSinks.  A new router should be created for
+// every cycle so namespaces, sinks, and secrets are current.
+type webhookRouter struct {
+	clientset kubernetes.Interface
+	// annotations is true if webhook annotations are used.
+	annotations bool
+	// secretNamespaces are the namespaces in which webhook
+	// annotations may reference a secret.
+	secretNamespaces map[string]bool
+	// allowReplace is true if webhook annotations may replace the
+	// webhooks a pod is sent to.
+	allowReplace bool
+	// namespaces are the metadata of each namespace, nil if
+	// namespaces are not available.
+	namespaces map[string]metav1.ObjectMeta
+	// sinks are the VentSinks.
+	sinks []*ventSink
+	// secretsMu guards secrets, which admin API requests read
+	// concurrently with the cycle.
+	secretsMu sync.Mutex
+	// secrets caches the secrets read during this cycle.
+	secrets map[secretRef]string
+	// log logs routing decisions, the global logger if nil.
+	log *logrus.Entry
+}
+
+// newWebhookRouter creates a router using the annotation settings of
+// config, reading the metadata of the watched namespace or, if
+// k8svent is not restricted to one, all namespaces.  If the
+// namespaces cannot be read, namespace annotations are ignored and
+// sinks with namespace selectors do not match any pods.  Routing
+// decisions are logged using log, the global logger if nil.
+func newWebhookRouter(clientset kubernetes.Interface, config Config, sinks []*ventSink, log *logrus.Entry) *webhookRouter {
+	r := &webhookRouter{
+		clientset:        clientset,
+		annotations:      !config.IgnoreAnnotations,
+		secretNamespaces: map[string]bool{},
+		allowReplace:     config.AllowWebhookReplace,
+		sinks:            sinks,
+		secrets:          map[secretRef]string{},
+		log:              log,
+	}
+	for _, ns := range config.WebhookSecretNamespaces {
+		r.secretNamespaces[ns] = true
+	}
+	if !r.annotations && len(sinks) == 0 {
+		return r
+	}
+	namespaces, nsErr := listNamespaces(clientset, config.Namespace)
+	if nsErr != nil {
+		entryLogger(r.log, LogModuleRouting).Debugf("Unable to read namespaces, ignoring namespace annotations and selectors: %v", nsErr)
+		return r
+	}
+	r.namespaces = namespaces
+	return r
+}
+
+// listNamespaces returns a map from namespace name to its metadata.
+func listNamespaces(clientset kubernetes.Interface, namespace string) (map[string]metav1.ObjectMeta, error) {
+	namespaces := map[string]metav1.ObjectMeta{}
+	if namespace != "" {
+		ns, getErr := clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+		if getErr != nil {
+			return nil, getErr
+		}
+		namespaces[ns.ObjectMeta.Name] = ns.ObjectMeta
+		return namespaces, nil
+	}
+	options := metav1.ListOptions{}
+	for ok := true; ok; ok = (options.Continue != "") {
+		nsList, listErr := clientset.CoreV1().Namespaces().List(options)
+		if listErr != nil {
+			return nil, listErr
+		}
+		for _, ns := range nsList.Items {
+			namespaces[ns.ObjectMeta.Name] = ns.ObjectMeta
+		}
+		options.Continue = nsList.Continue
+	}
+	return namespaces, nil
+}
+
+// route returns the webhooks pod should be sent to.  Namespace
+// annotations are applied to the configured webhooks, then the pod
+// annotations are applied to the result, and finally the webhooks of
+// matching sinks are added.  Annotations that are invalid or whose
+// secret cannot be read are logged and ignored.
+func (r *webhookRouter) route(pod v1.Pod, hooks []webhook) []webhook {
+	if r == nil {
+		return hooks
+	}
+	if r.annotations {
+		hooks = r.routeAnnotations(pod, hooks)
+	}
+	for _, sink := range r.sinks {
+		if hook, ok := r.sinkWebhook(sink, pod); ok {
+			hooks = appendWebhooks(hooks, []webhook{hook})
+		}
+	}
+	return hooks
+}
+
+// routeAnnotations applies the namespace and pod webhook annotations.
+func (r *webhookRouter) routeAnnotations(pod v1.Pod, hooks []webhook) []webhook {
+	ns := pod.ObjectMeta.Namespace
+	log := entryLogger(r.log, LogModuleRouting).WithField("pod", podSlug(pod))
+	sources := []struct {
+		kind        string
+		annotations map[string]string
+	}{
+		{"namespace", r.namespaces[ns].Annotations},
+		{"pod", pod.ObjectMeta.Annotations},
+	}
+	for _, source := range sources {
+		a, parseErr := parseWebhookAnnotations(source.annotations, ns)
+		if parseErr != nil {
+			log.Warnf("Ignoring %s webhook annotations: %v", source.kind, parseErr)
+			continue
+		}
+		if a == nil {
+			continue
+		}
+		secret := ""
+		if a.secret != nil {
+			if !r.secretNamespaces[ns] {
+				log.Warnf("Ignoring %s webhook annotations: namespace %s is not allowed to reference webhook secrets", source.kind, ns)
+				continue
+			}
+			var secretErr error
+			secret, secretErr = r.readSecret(*a.secret)
+			if secretErr != nil {
+				log.Warnf("Ignoring %s webhook annotations: %v", source.kind, secretErr)
+				continue
+			}
+		}
+		annotated := make([]webhook, len(a.urls))
+		for i, u := range a.urls {
+			annotated[i] = webhook{url: u, secret: secret}
+		}
+		replace := a.replace
+		if replace && !r.allowReplace {
+			log.Warnf("Adding %s webhook annotations rather than replacing webhooks, which is not allowed", source.kind)
+			replace = false
+		}
+		if replace {
+			hooks = annotated
+		} else {
+			hooks = appendWebhooks(hooks, annotated)
+		}
+	}
+	return hooks
+}
+
+// sinkWebhook returns the webhook of sink, with its secret, and true
+// if pod should be sent to the sink.
+func (r *webhookRouter) sinkWebhook(sink *ventSink, pod v1.Pod) (webhook, bool) {
+	ns, nsKnown := r.namespaces[pod.ObjectMeta.Namespace]
+	if !sink.matches(pod, ns.Labels, nsKnown) {
+		return webhook{}, false
+	}
+	hook := sink.hook
+	if sink.secret != nil {
+		secret, secretErr := r.readSecret(*sink.secret)
+		if secretErr != nil {
+			entryLogger(r.log, LogModuleRouting).WithField("pod", podSlug(pod)).Warnf("Not sending to VentSink %s: %v", sink.name, secretErr)
+			return webhook{}, false
+		}
+		hook.secret = secret
+	}
+	return hook, true
+}
+
+// webhookURLs returns the URLs of the webhooks the router may send
+// pods to in addition to the configured webhooks: the webhooks
+// annotated on pods and their namespaces and the VentSink webhooks.
+// Secrets are not read and invalid annotations are ignored.
+func (r *webhookRouter) webhookURLs(pods []v1.Pod) []string {
+	if r == nil {
+		return nil
+	}
+	var urls []string
+	for _, sink := range r.sinks {
+		urls = append(urls, sink.hook.url)
+	}
+	if !r.annotations {
+		return urls
+	}
+	for _, ns := range r.namespaces {
+		if a, err := parseWebhookAnnotations(ns.Annotations, ns.Name); err == nil && a != nil {
+			urls = append(urls, a.urls...)
+		}
+	}
+	for _, pod := range pods {
+		if a, err := parseWebhookAnnotations(pod.ObjectMeta.Annotations, pod.ObjectMeta.Namespace); err == nil && a != nil {
+			urls = append(urls, a.urls...)
+		}
+	}
+	return urls
+}
+
+// appendWebhooks returns a new slice with the webhooks in extra whose
+// URLs are not already in hooks appended to hooks.
+func appendWebhooks(hooks []webhook, extra []webhook) []webhook {
+	combined := make([]webhook, len(hooks), len(hooks)+len(extra))
+	copy(combined, hooks)
+	urls := map[string]bool{}
+	for _, hook := range hooks {
+		urls[hook.url] = true
+	}
+	for _, hook := range extra {
+		if urls[hook.url] {
+			continue
+		}
+		urls[hook.url] = true
+		combined = append(combined, hook)
+	}
+	return combined
+}
+
+// readSecret returns the value of the referenced secret key.
+func (r *webhookRouter) readSecret(ref secretRef) (string, error) {
+	r.secretsMu.Lock()
+	defer r.secretsMu.Unlock()
+	if value, ok := r.secrets[ref]; ok {
+		return value, nil
+	}
+	secret, getErr := r.clientset.CoreV1().Secrets(ref.namespace).Get(ref.name, metav1.GetOptions{})
+	if getErr != nil {
+		return "", fmt.Errorf("failed to read secret %s/%s: %v", ref.namespace, ref.name, getErr)
+	}
+	data, ok := secret.Data[ref.key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key '%s'", ref.namespace, ref.name, ref.key)
+	}
+	r.secrets[ref] = string(data)
+	return string(data), nil
+}
@@ -0,0 +1,211 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseWebhookAnnotations(t *testing.T) {
+	if a, err := parseWebhookAnnotations(map[string]string{"other": "x"}, "default"); a != nil || err != nil {
+		t.Errorf("expected nil for no annotations: %v %v", a, err)
+	}
+
+	a, err := parseWebhookAnnotations(map[string]string{
+		WebhooksAnnotation:      "https://one.com/webhook, https://two.com/webhook",
+		WebhookPolicyAnnotation: "replace",
+		WebhookSecretAnnotation: WebhookSecretName + "/token",
+	}, "lot")
+	if err != nil {
+		t.Fatalf("failed to parse valid annotations: %v", err)
+	}
+	if d := cmp.Diff(a.urls, []string{"https://one.com/webhook", "https://two.com/webhook"}); d != "" {
+		t.Errorf("URLs not as expected: %s", d)
+	}
+	if !a.replace {
+		t.Error("replace policy not parsed")
+	}
+	if a.secret == nil || *a.secret != (secretRef{namespace: "lot", name: WebhookSecretName, key: "token"}) {
+		t.Errorf("secret reference not as expected: %v", a.secret)
+	}
+
+	a, err = parseWebhookAnnotations(map[string]string{
+		WebhooksAnnotation:      "https://one.com/webhook",
+		WebhookSecretAnnotation: WebhookSecretName,
+	}, "lot")
+	if err != nil {
+		t.Fatalf("failed to parse valid annotations: %v", err)
+	}
+	if a.replace || a.secret.key != defaultSecretKey {
+		t.Errorf("defaults not applied: %v %v", a.replace, a.secret)
+	}
+
+	invalid := []map[string]string{
+		{WebhooksAnnotation: "ftp://one.com/webhook"},
+		{WebhooksAnnotation: "https://one.com/webhook", WebhookPolicyAnnotation: "prepend"},
+		{WebhooksAnnotation: "https://one.com/webhook", WebhookSecretAnnotation: "a/b/c"},
+		{WebhooksAnnotation: "https://one.com/webhook", WebhookSecretAnnotation: WebhookSecretName + "/"},
+		{WebhooksAnnotation: "https://one.com/webhook", WebhookSecretAnnotation: "database-credentials"},
+	}
+	for _, annotations := range invalid {
+		if _, err := parseWebhookAnnotations(annotations, "lot"); err == nil {
+			t.Errorf("invalid annotations did not return error: %v", annotations)
+		}
+	}
+}
+
+func TestWebhookRouterRoute(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "annotation")
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name: "brighton",
+			Annotations: map[string]string{
+				WebhooksAnnotation:      "https://brighton.com/webhook",
+				WebhookSecretAnnotation: WebhookSecretName,
+			},
+		}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "hove"}},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "brighton", Name: WebhookSecretName},
+			Data:       map[string][]byte{"secret": []byte("Sanctuary"), "pod": []byte("Heartbreaker")},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "hove", Name: WebhookSecretName},
+			Data:       map[string][]byte{"secret": []byte("Albion")},
+		},
+	)
+	global := []webhook{{url: "https://global.com/webhook", secret: "Global"}}
+	config := Config{WebhookSecretNamespaces: []string{"brighton", "default"}, AllowWebhookReplace: true}
+	router := newWebhookRouter(clientset, config, nil, nil)
+
+	pod := func(ns string, annotations map[string]string) v1.Pod {
+		return v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "rock", Annotations: annotations}}
+	}
+	tests := []struct {
+		name     string
+		pod      v1.Pod
+		expected []webhook
+	}{
+		{
+			name:     "no annotations",
+			pod:      pod("default", nil),
+			expected: global,
+		},
+		{
+			name: "namespace annotations",
+			pod:  pod("brighton", nil),
+			expected: []webhook{
+				{url: "https://global.com/webhook", secret: "Global"},
+				{url: "https://brighton.com/webhook", secret: "Sanctuary"},
+			},
+		},
+		{
+			name: "pod replaces namespace",
+			pod: pod("brighton", map[string]string{
+				WebhooksAnnotation:      "https://pod.com/webhook",
+				WebhookPolicyAnnotation: "replace",
+				WebhookSecretAnnotation: WebhookSecretName + "/pod",
+			}),
+			expected: []webhook{{url: "https://pod.com/webhook", secret: "Heartbreaker"}},
+		},
+		{
+			name: "secret in namespace not allowed",
+			pod: pod("hove", map[string]string{
+				WebhooksAnnotation:      "https://pod.com/webhook",
+				WebhookPolicyAnnotation: "replace",
+				WebhookSecretAnnotation: WebhookSecretName,
+			}),
+			expected: global,
+		},
+		{
+			name: "unsigned pod webhook",
+			pod: pod("default", map[string]string{
+				WebhooksAnnotation: "https://pod.com/webhook,https://global.com/webhook",
+			}),
+			expected: []webhook{
+				{url: "https://global.com/webhook", secret: "Global"},
+				{url: "https://pod.com/webhook"},
+			},
+		},
+		{
+			name: "missing secret",
+			pod: pod("default", map[string]string{
+				WebhooksAnnotation:      "https://pod.com/webhook",
+				WebhookPolicyAnnotation: "replace",
+				WebhookSecretAnnotation: WebhookSecretName,
+			}),
+			expected: global,
+		},
+		{
+			name: "invalid annotation",
+			pod: pod("brighton", map[string]string{
+				WebhooksAnnotation: "nope",
+			}),
+			expected: []webhook{
+				{url: "https://global.com/webhook", secret: "Global"},
+				{url: "https://brighton.com/webhook", secret: "Sanctuary"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hooks := router.route(tt.pod, global)
+			if d := cmp.Diff(webhookStrings(hooks), webhookStrings(tt.expected)); d != "" {
+				t.Errorf("webhooks not as expected: %s", d)
+			}
+		})
+	}
+	if len(global) != 1 {
+		t.Errorf("global webhooks were modified: %v", global)
+	}
+
+	config.AllowWebhookReplace = false
+	router = newWebhookRouter(clientset, config, nil, nil)
+	hooks := router.route(pod("brighton", map[string]string{
+		WebhooksAnnotation:      "https://pod.com/webhook",
+		WebhookPolicyAnnotation: "replace",
+	}), global)
+	expected := []webhook{
+		{url: "https://global.com/webhook", secret: "Global"},
+		{url: "https://brighton.com/webhook", secret: "Sanctuary"},
+		{url: "https://pod.com/webhook"},
+	}
+	if d := cmp.Diff(webhookStrings(hooks), webhookStrings(expected)); d != "" {
+		t.Errorf("webhooks replaced without being allowed: %s", d)
+	}
+
+	var nilRouter *webhookRouter
+	if hooks := nilRouter.route(pod("brighton", nil), global); len(hooks) != 1 {
+		t.Errorf("nil router should not add webhooks: %v", hooks)
+	}
+}
+
+// webhookStrings returns the URL and secret of each webhook.
+func webhookStrings(hooks []webhook) []string {
+	s := make([]string, len(hooks))
+	for i, hook := range hooks {
+		s[i] = hook.url + " " + hook.secret
+	}
+	return s
+}
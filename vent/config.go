@@ -0,0 +1,541 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the complete k8svent configuration.  It can be read from
+// a YAML or JSON file using LoadConfig.
+type Config struct {
+	// LogLevel is the minimum level of log messages to output.
+	LogLevel string `json:"logLevel,omitempty"`
+	// LogLevels are the minimum levels of log messages of specific
+	// modules, overriding LogLevel.  See LogModules.
+	LogLevels map[string]string `json:"logLevels,omitempty"`
+	// LogFormat is the format of log messages, LogFormatJSON if
+	// empty.  See LogFormats.
+	LogFormat string `json:"logFormat,omitempty"`
+	// Namespace, if not empty, restricts k8svent to listing pods in
+	// that namespace.  Otherwise pods in all namespaces are listed.
+	Namespace string `json:"namespace,omitempty"`
+	// Secret, if not empty, is used to sign webhook payloads.
+	Secret string `json:"secret,omitempty"`
+	// Webhooks are the endpoints pods are sent to.
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+	// Filters restrict which pods are sent.
+	Filters Filters `json:"filters,omitempty"`
+	// Sources are the kinds of resources k8svent watches.  If empty,
+	// only pods are watched.
+	Sources []string `json:"sources,omitempty"`
+	// Listen is the address the HTTP server providing metrics and
+	// health checks listens on, DefaultListen if empty.
+	Listen string `json:"listen,omitempty"`
+	// IgnoreAnnotations, if true, disables adding webhooks using pod
+	// and namespace annotations.
+	IgnoreAnnotations bool `json:"ignoreAnnotations,omitempty"`
+	// WebhookSecretNamespaces are the namespaces whose
+	// WebhookSecretName secret webhook annotations may use to sign
+	// payloads.  Annotations elsewhere cannot reference secrets.
+	WebhookSecretNamespaces []string `json:"webhookSecretNamespaces,omitempty"`
+	// AllowWebhookReplace, if true, lets the webhook policy
+	// annotation replace the webhooks a pod is sent to.  Otherwise
+	// annotation webhooks are only added.
+	AllowWebhookReplace bool `json:"allowWebhookReplace,omitempty"`
+	// AdminToken, if not empty, enables the admin API, which
+	// requires it as a bearer token.
+	AdminToken string `json:"adminToken,omitempty"`
+	// Tracing configures exporting OpenTelemetry traces.
+	Tracing Tracing `json:"tracing,omitempty"`
+	// ShutdownGracePeriod is how long k8svent waits for pending
+	// deliveries to complete when it shuts down, e.g., "20s".  The
+	// default is DefaultShutdownGracePeriod.
+	ShutdownGracePeriod string `json:"shutdownGracePeriod,omitempty"`
+	// SpoolFile, if not empty, is the file deliveries still pending
+	// after the shutdown grace period are written to.  They are sent
+	// when k8svent starts again, provided the file is on a volume
+	// that outlives the pod.
+	SpoolFile string `json:"spoolFile,omitempty"`
+	// Record, if not empty, is the file every payload sent is
+	// appended to as a JSON line, for replaying later.
+	Record string `json:"record,omitempty"`
+	// DryRun, if true, prints the payloads that would be sent, the
+	// endpoints they would be sent to, why, and how each pod changed
+	// rather than sending them.
+	DryRun bool `json:"dryRun,omitempty"`
+	// Update configures checking for new k8svent releases.
+	Update Update `json:"update,omitempty"`
+}
+
+// Update configures where k8svent looks for new releases of itself.
+type Update struct {
+	// Image is the image reference checked for new releases,
+	// DefaultImage if empty.  It may be in any OCI distribution
+	// registry, e.g., ghcr.io/atomist/k8svent.  If it has a tag, that
+	// tag is checked rather than the tag matching the k8svent
+	// version.
+	Image string `json:"image,omitempty"`
+	// PullSecret, if not empty, is the imagePullSecret, NAME or
+	// NAMESPACE/NAME, providing credentials for the registry.  If
+	// it has no namespace, the namespace of the k8svent pod is used.
+	PullSecret string `json:"pullSecret,omitempty"`
+	// Insecure, if true, uses HTTP rather than HTTPS to talk to the
+	// registry.
+	Insecure bool `json:"insecure,omitempty"`
+	// Policy is what to do when a new release is detected,
+	// UpdatePolicyRestart if empty.  See UpdatePolicies.
+	Policy string `json:"policy,omitempty"`
+	// Constraint, if not empty, restricts restarting to new versions
+	// satisfying it: "patch", "minor", "major", or a semantic version
+	// range like ">=0.18.0 <1.0.0".
+	Constraint string `json:"constraint,omitempty"`
+	// Window, if its start is not empty, restricts restarting to
+	// the maintenance window.
+	Window MaintenanceWindow `json:"window,omitempty"`
+	// PublicKey, if not empty, is the path to a PEM-encoded public
+	// key, e.g., cosign.pub.  New images are only installed if they
+	// have a cosign signature made with its private key.
+	PublicKey string `json:"publicKey,omitempty"`
+}
+
+// MaintenanceWindow is a recurring period of time during which k8svent
+// may restart to update itself.
+type MaintenanceWindow struct {
+	// Days are the days the window starts on, e.g., "sat", every day
+	// if empty.
+	Days []string `json:"days,omitempty"`
+	// Start is the time of day the window opens, HH:MM.
+	Start string `json:"start,omitempty"`
+	// End is the time of day the window closes, HH:MM.  If it is not
+	// after Start, the window closes the next day.
+	End string `json:"end,omitempty"`
+	// TimeZone is the IANA time zone of Start and End, UTC if empty.
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// Tracing configures exporting traces of pod processing and webhook
+// delivery to an OpenTelemetry collector.
+type Tracing struct {
+	// Endpoint is the base URL of an OTLP/HTTP collector, e.g.,
+	// http://otel-collector:4318.  If it is empty, tracing is
+	// disabled.
+	Endpoint string `json:"endpoint,omitempty"`
+	// ServiceName is the service.name resource attribute of the
+	// exported spans, "k8svent" if empty.
+	ServiceName string `json:"serviceName,omitempty"`
+	// Headers are sent with every export request, e.g., to
+	// authenticate with the collector.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Webhook is the configuration of a single webhook endpoint.
+type Webhook struct {
+	// URL is the webhook endpoint.
+	URL string `json:"url"`
+	// Secret, if not empty, is used to sign payloads sent to this
+	// webhook instead of the global secret.
+	Secret string `json:"secret,omitempty"`
+	// EncryptionKey is the path to a PEM-encoded RSA public key of
+	// the receiver.  If it is not empty, payloads sent to this
+	// webhook are encrypted to the key before they are signed.
+	EncryptionKey string `json:"encryptionKey,omitempty"`
+}
+
+// Filters restrict which pods are sent to the webhooks.
+type Filters struct {
+	// Namespaces, if not empty, are the only namespaces whose pods
+	// are sent.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// ExcludeNamespaces are namespaces whose pods are not sent.
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+	// LabelSelector, if not empty, is a Kubernetes label selector
+	// pods must match to be sent.
+	LabelSelector string `json:"labelSelector,omitempty"`
+}
+
+// PodSource is the source for pods, the only source currently
+// supported.
+const PodSource = "pods"
+
+// FieldError is an error in the value of a configuration field.
+type FieldError struct {
+	// Field is the path of the field, e.g., "webhooks[0].url".
+	Field string
+	// Message describes the error.
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ConfigErrors are all the errors found in a configuration.
+type ConfigErrors []FieldError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldErr := range e {
+		messages[i] = fieldErr.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// LoadConfig reads the YAML or JSON configuration file, returning the
+// configuration or an error.  Fields that are unknown or of the wrong
+// type are reported as ConfigErrors.  The returned configuration is
+// not validated, see Config.Validate.
+func LoadConfig(configFile string) (c Config, e error) {
+	configBytes, readErr := ioutil.ReadFile(configFile)
+	if readErr != nil {
+		return c, fmt.Errorf("failed to read configuration file %s: %v", configFile, readErr)
+	}
+	return ParseConfig(configBytes)
+}
+
+// ParseConfig parses YAML or JSON configuration data.  Fields that
+// are unknown or of the wrong type are reported as ConfigErrors.
+func ParseConfig(data []byte) (c Config, e error) {
+	configJSON, yamlErr := yaml.YAMLToJSON(data)
+	if yamlErr != nil {
+		return c, fmt.Errorf("failed to parse configuration: %v", yamlErr)
+	}
+	var raw interface{}
+	if err := json.Unmarshal(configJSON, &raw); err != nil {
+		return c, fmt.Errorf("failed to parse configuration: %v", err)
+	}
+	if raw == nil {
+		return c, nil
+	}
+	if errs := checkSchema("", raw, reflect.TypeOf(c)); len(errs) > 0 {
+		return c, errs
+	}
+	if err := json.Unmarshal(configJSON, &c); err != nil {
+		return c, fmt.Errorf("failed to decode configuration: %v", err)
+	}
+	return c, nil
+}
+
+// checkSchema compares the generic JSON value to the Go type it will
+// be decoded into, returning an error for every unknown field and
+// every value of the wrong type.
+func checkSchema(path string, value interface{}, t reflect.Type) ConfigErrors {
+	field := path
+	if field == "" {
+		field = "."
+	}
+	if value == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			return ConfigErrors{{field, fmt.Sprintf("must be a string, not %s", jsonType(value))}}
+		}
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return ConfigErrors{{field, fmt.Sprintf("must be a list, not %s", jsonType(value))}}
+		}
+		var errs ConfigErrors
+		for i, item := range items {
+			errs = append(errs, checkSchema(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+		return errs
+	case reflect.Map:
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			return ConfigErrors{{field, fmt.Sprintf("must be a map, not %s", jsonType(value))}}
+		}
+		var errs ConfigErrors
+		for _, key := range sortedKeys(entries) {
+			errs = append(errs, checkSchema(joinPath(path, key), entries[key], t.Elem())...)
+		}
+		return errs
+	case reflect.Struct:
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			return ConfigErrors{{field, fmt.Sprintf("must be an object, not %s", jsonType(value))}}
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			fields[name] = t.Field(i).Type
+		}
+		var errs ConfigErrors
+		for _, key := range sortedKeys(entries) {
+			fieldType, known := fields[key]
+			if !known {
+				errs = append(errs, FieldError{joinPath(path, key), "unknown field"})
+				continue
+			}
+			errs = append(errs, checkSchema(joinPath(path, key), entries[key], fieldType)...)
+		}
+		return errs
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return ConfigErrors{{field, fmt.Sprintf("must be a boolean, not %s", jsonType(value))}}
+		}
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		if _, ok := value.(float64); !ok {
+			return ConfigErrors{{field, fmt.Sprintf("must be a number, not %s", jsonType(value))}}
+		}
+	}
+	return nil
+}
+
+// joinPath appends key to the field path.
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedStringKeys returns the keys of m in order.
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonType returns the JSON type name of a generic JSON value.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// Validate checks the values in the configuration, returning
+// ConfigErrors describing every problem found or nil if the
+// configuration is valid.
+func (c Config) Validate() error {
+	var errs ConfigErrors
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, FieldError{"logLevel", err.Error()})
+	}
+	modules := map[string]bool{}
+	for _, module := range LogModules {
+		modules[module] = true
+	}
+	for _, module := range sortedStringKeys(c.LogLevels) {
+		field := "logLevels." + module
+		if !modules[module] {
+			errs = append(errs, FieldError{field, fmt.Sprintf("unknown module '%s', must be one of %s", module, strings.Join(LogModules, ", "))})
+		} else if _, err := parseLogLevel(c.LogLevels[module]); err != nil {
+			errs = append(errs, FieldError{field, err.Error()})
+		}
+	}
+	if _, err := newLogFormatter(c.LogFormat); err != nil {
+		errs = append(errs, FieldError{"logFormat", err.Error()})
+	}
+	urls := map[string]bool{}
+	for i, hook := range c.Webhooks {
+		field := fmt.Sprintf("webhooks[%d]", i)
+		if msg := validateWebhookURL(hook.URL); msg != "" {
+			errs = append(errs, FieldError{field + ".url", msg})
+		} else if urls[hook.URL] {
+			errs = append(errs, FieldError{field + ".url", fmt.Sprintf("duplicate webhook URL '%s'", hook.URL)})
+		}
+		urls[hook.URL] = true
+		if hook.EncryptionKey != "" {
+			if _, err := loadPublicKey(hook.EncryptionKey); err != nil {
+				errs = append(errs, FieldError{field + ".encryptionKey", err.Error()})
+			}
+		}
+	}
+	errs = append(errs, c.Filters.validate("filters", c.Namespace)...)
+	for i, ns := range c.WebhookSecretNamespaces {
+		field := fmt.Sprintf("webhookSecretNamespaces[%d]", i)
+		if ns == "" {
+			errs = append(errs, FieldError{field, "namespace must not be empty"})
+		} else if c.Namespace != "" && ns != c.Namespace {
+			errs = append(errs, FieldError{field, fmt.Sprintf("namespace '%s' is not the watched namespace '%s'", ns, c.Namespace)})
+		}
+	}
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			errs = append(errs, FieldError{"listen", fmt.Sprintf("invalid address '%s': %v", c.Listen, err)})
+		}
+	}
+	if c.Tracing.Endpoint != "" {
+		if msg := validateHTTPURL(c.Tracing.Endpoint); msg != "" {
+			errs = append(errs, FieldError{"tracing.endpoint", msg})
+		}
+	}
+	if c.ShutdownGracePeriod != "" {
+		if d, err := time.ParseDuration(c.ShutdownGracePeriod); err != nil || d < 0 {
+			errs = append(errs, FieldError{"shutdownGracePeriod", fmt.Sprintf("invalid duration '%s'", c.ShutdownGracePeriod)})
+		}
+	}
+	if c.Update.Image != "" {
+		if _, err := parseImageReference(c.Update.Image); err != nil {
+			errs = append(errs, FieldError{"update.image", err.Error()})
+		}
+	}
+	if c.Update.PullSecret != "" {
+		if _, _, err := parsePullSecretRef(c.Update.PullSecret, ""); err != nil {
+			errs = append(errs, FieldError{"update.pullSecret", err.Error()})
+		}
+	}
+	switch c.Update.Policy {
+	case "", UpdatePolicyRestart, UpdatePolicyNotify, UpdatePolicyOff:
+	default:
+		errs = append(errs, FieldError{"update.policy", fmt.Sprintf("unknown policy '%s', must be one of %s", c.Update.Policy, strings.Join(UpdatePolicies, ", "))})
+	}
+	if c.Update.Constraint != "" {
+		if _, err := versionConstraint(c.Update.Constraint, semver.Version{}); err != nil {
+			errs = append(errs, FieldError{"update.constraint", err.Error()})
+		}
+	}
+	errs = append(errs, c.Update.Window.validate("update.window")...)
+	if c.Update.PublicKey != "" {
+		if _, err := loadVerificationKey(c.Update.PublicKey); err != nil {
+			errs = append(errs, FieldError{"update.publicKey", err.Error()})
+		}
+	}
+	for i, source := range c.Sources {
+		if source != PodSource {
+			errs = append(errs, FieldError{fmt.Sprintf("sources[%d]", i), fmt.Sprintf("unsupported source '%s', must be '%s'", source, PodSource)})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateWebhookURL returns a message describing what is wrong with
+// the webhook URL or an empty string if it is valid.  The URL scheme
+// must be registered, see RegisterSinkScheme.  File URLs must have a
+// path, others a host.
+func validateWebhookURL(webhookURL string) string {
+	if webhookURL == "" {
+		return "webhook URL is required"
+	}
+	u, parseErr := url.Parse(webhookURL)
+	if parseErr != nil {
+		return fmt.Sprintf("invalid URL: %v", parseErr)
+	}
+	schemesMu.Lock()
+	scheme, ok := schemes[u.Scheme]
+	schemesMu.Unlock()
+	if !ok {
+		return fmt.Sprintf("URL scheme must be one of %s, not '%s'", strings.Join(sinkSchemes(), ", "), u.Scheme)
+	}
+	if scheme.path {
+		if u.Host != "" || u.Path == "" || u.Path == "/" {
+			return fmt.Sprintf("%s URL must have an absolute path and no host", u.Scheme)
+		}
+		return ""
+	}
+	if u.Host == "" {
+		return "URL has no host"
+	}
+	return ""
+}
+
+// validateRemoteWebhookURL is validateWebhookURL for webhooks added by
+// annotations and VentSinks, which must not write to the file system
+// of k8svent.
+func validateRemoteWebhookURL(webhookURL string) string {
+	if msg := validateWebhookURL(webhookURL); msg != "" {
+		return msg
+	}
+	if u, _ := url.Parse(webhookURL); u.Scheme == "file" {
+		return "file URLs are only allowed in the k8svent configuration"
+	}
+	return ""
+}
+
+// validateHTTPURL returns a message describing what is wrong with the
+// HTTP URL or an empty string if it is valid.
+func validateHTTPURL(httpURL string) string {
+	u, parseErr := url.Parse(httpURL)
+	if parseErr != nil {
+		return fmt.Sprintf("invalid URL: %v", parseErr)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Sprintf("URL scheme must be http or https, not '%s'", u.Scheme)
+	}
+	if u.Host == "" {
+		return "URL has no host"
+	}
+	return ""
+}
+
+// validate checks the filters, whose field path is path.
+func (f Filters) validate(path string, namespace string) ConfigErrors {
+	var errs ConfigErrors
+	included := map[string]bool{}
+	for i, ns := range f.Namespaces {
+		if ns == "" {
+			errs = append(errs, FieldError{fmt.Sprintf("%s.namespaces[%d]", path, i), "namespace must not be empty"})
+		}
+		included[ns] = true
+	}
+	if namespace != "" && len(f.Namespaces) > 0 && !included[namespace] {
+		errs = append(errs, FieldError{path + ".namespaces", fmt.Sprintf("does not include watched namespace '%s'", namespace)})
+	}
+	for i, ns := range f.ExcludeNamespaces {
+		field := fmt.Sprintf("%s.excludeNamespaces[%d]", path, i)
+		if ns == "" {
+			errs = append(errs, FieldError{field, "namespace must not be empty"})
+		} else if included[ns] {
+			errs = append(errs, FieldError{field, fmt.Sprintf("namespace '%s' is both included and excluded", ns)})
+		}
+	}
+	if f.LabelSelector != "" {
+		if _, err := labels.Parse(f.LabelSelector); err != nil {
+			errs = append(errs, FieldError{path + ".labelSelector", fmt.Sprintf("invalid label selector: %v", err)})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,168 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseConfig(t *testing.T) {
+	configYAML := []byte(`logLevel: debug
+namespace: drive-by-truckers
+secret: Decoration Day
+webhooks:
+  - url: https://webhook.atomist.com/atomist/kube/teams/T29E48P34
+  - url: https://second.com/webhook
+    secret: Southern Rock Opera
+filters:
+  namespaces:
+    - drive-by-truckers
+  excludeNamespaces:
+    - kube-system
+  labelSelector: app=sleep
+sources:
+  - pods
+`)
+	config, err := ParseConfig(configYAML)
+	if err != nil {
+		t.Fatalf("failed to parse valid configuration: %v", err)
+	}
+	expected := Config{
+		LogLevel:  "debug",
+		Namespace: "drive-by-truckers",
+		Secret:    "Decoration Day",
+		Webhooks: []Webhook{
+			{URL: "https://webhook.atomist.com/atomist/kube/teams/T29E48P34"},
+			{URL: "https://second.com/webhook", Secret: "Southern Rock Opera"},
+		},
+		Filters: Filters{
+			Namespaces:        []string{"drive-by-truckers"},
+			ExcludeNamespaces: []string{"kube-system"},
+			LabelSelector:     "app=sleep",
+		},
+		Sources: []string{"pods"},
+	}
+	if d := cmp.Diff(config, expected); d != "" {
+		t.Errorf("parsed configuration not as expected: %s", d)
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf("valid configuration failed validation: %v", err)
+	}
+
+	if _, err := ParseConfig([]byte(`{"webhooks":[{"url":"http://a.com"}]}`)); err != nil {
+		t.Errorf("failed to parse JSON configuration: %v", err)
+	}
+	if c, err := ParseConfig([]byte("")); err != nil || len(c.Webhooks) != 0 {
+		t.Errorf("failed to parse empty configuration: %v", err)
+	}
+
+	badYAML := []byte(`logLevel: [debug]
+webhook:
+  - url: https://webhook.atomist.com
+webhooks:
+  - url: https://webhook.atomist.com
+    secrets: nope
+filters:
+  namespaces: default
+`)
+	_, badErr := ParseConfig(badYAML)
+	errs, ok := badErr.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected ConfigErrors but got: %v", badErr)
+	}
+	expectedFields := []string{"filters.namespaces", "logLevel", "webhook", "webhooks[0].secrets"}
+	fields := make([]string, len(errs))
+	for i, e := range errs {
+		fields[i] = e.Field
+	}
+	if d := cmp.Diff(fields, expectedFields); d != "" {
+		t.Errorf("error fields not as expected: %s", d)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := Config{
+		LogLevel:  "loud",
+		LogLevels: map[string]string{"delivery": "debug", "pods": "quiet", "kafka": "info"},
+		LogFormat: "xml",
+		Namespace: "default",
+		Webhooks: []Webhook{
+			{URL: "https://one.com/webhook"},
+			{URL: "ftp://two.com/webhook"},
+			{URL: "https://one.com/webhook"},
+			{},
+			{URL: "https://three.com/webhook", EncryptionKey: "/no/such/key.pem"},
+		},
+		Filters: Filters{
+			Namespaces:        []string{"kube-system"},
+			ExcludeNamespaces: []string{"kube-system"},
+			LabelSelector:     "app in (",
+		},
+		WebhookSecretNamespaces: []string{"default", "", "kube-system"},
+		Sources:                 []string{"pods", "deployments"},
+		Listen:                  "8080",
+		ShutdownGracePeriod:     "soon",
+		Update: Update{
+			Image:      "atomist/k8svent@sha256:abc",
+			PullSecret: "a/b/c",
+			Policy:     "sometimes",
+			Constraint: "whenever",
+			Window:     MaintenanceWindow{Start: "02:00"},
+			PublicKey:  "/no/such/cosign.pub",
+		},
+	}
+	err := config.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected ConfigErrors but got: %v", err)
+	}
+	expectedFields := []string{
+		"logLevel",
+		"logLevels.kafka",
+		"logLevels.pods",
+		"logFormat",
+		"webhooks[1].url",
+		"webhooks[2].url",
+		"webhooks[3].url",
+		"webhooks[4].encryptionKey",
+		"filters.namespaces",
+		"filters.excludeNamespaces[0]",
+		"filters.labelSelector",
+		"webhookSecretNamespaces[1]",
+		"webhookSecretNamespaces[2]",
+		"listen",
+		"shutdownGracePeriod",
+		"update.image",
+		"update.pullSecret",
+		"update.policy",
+		"update.constraint",
+		"update.window.end",
+		"update.publicKey",
+		"sources[1]",
+	}
+	fields := make([]string, len(errs))
+	for i, e := range errs {
+		fields[i] = e.Field
+	}
+	if d := cmp.Diff(fields, expectedFields); d != "" {
+		t.Errorf("error fields not as expected: %s", d)
+	}
+
+	if err := (Config{}).Validate(); err != nil {
+		t.Errorf("empty configuration failed validation: %v", err)
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Results of doctor checks.
+const (
+	checkPass = "PASS"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+	checkSkip = "SKIP"
+)
+
+// doctorTimeout is how long the doctor waits for each webhook to
+// respond to the test payload.
+const doctorTimeout = 10 * time.Second
+
+// DoctorAnnotation is set on the pod sent to webhooks by the doctor so
+// receivers can recognize and discard it.
+const DoctorAnnotation = "k8svent.atomist.com/doctor"
+
+// doctorCheck is the result of a single diagnostic check.
+type doctorCheck struct {
+	status string
+	name   string
+	detail string
+}
+
+// doctor runs diagnostic checks of a k8svent configuration and the
+// cluster it runs in.
+type doctor struct {
+	config Config
+	// clientset talks to the Kubernetes API, nil if it could not be
+	// created.
+	clientset kubernetes.Interface
+	// client posts the test payload to the webhooks.
+	client *http.Client
+	checks []doctorCheck
+}
+
+// Doctor checks that the Kubernetes API client can be created, that
+// k8svent may get and list pods, that every configured webhook
+// accepts a signed test payload and responds with a correlation ID,
+// and that the update image can be found in its registry.  It writes
+// a pass/fail report to out and returns true if no check failed.
+func Doctor(config Config, out io.Writer) bool {
+	if err := setupLogger(config); err != nil {
+		fmt.Fprintf(out, "[%s] Configuration: invalid logging configuration: %v\n", checkFail, err)
+		return false
+	}
+	d := &doctor{config: config, client: &http.Client{Timeout: doctorTimeout}}
+	clientset, _, clientErr := inClusterClients()
+	if clientErr != nil {
+		d.add(checkFail, "Kubernetes config", "%v", clientErr)
+	} else {
+		d.clientset = clientset
+	}
+	d.run()
+	return d.report(out)
+}
+
+// run runs all the checks.
+func (d *doctor) run() {
+	d.checkConfig()
+	d.checkKubernetes()
+	d.checkAccess()
+	d.checkWebhooks()
+	d.checkRegistry()
+}
+
+// add records the result of a check.
+func (d *doctor) add(status string, name string, format string, args ...interface{}) {
+	d.checks = append(d.checks, doctorCheck{status: status, name: name, detail: fmt.Sprintf(format, args...)})
+}
+
+// report writes the results of the checks to out and returns true if
+// none failed.
+func (d *doctor) report(out io.Writer) bool {
+	counts := map[string]int{}
+	for _, c := range d.checks {
+		counts[c.status]++
+		fmt.Fprintf(out, "[%s] %s: %s\n", c.status, c.name, c.detail)
+	}
+	fmt.Fprintf(out, "%d passed, %d warnings, %d failed, %d skipped\n", counts[checkPass], counts[checkWarn], counts[checkFail], counts[checkSkip])
+	return counts[checkFail] == 0
+}
+
+// checkConfig validates the configuration.
+func (d *doctor) checkConfig() {
+	if err := d.config.Validate(); err != nil {
+		d.add(checkFail, "Configuration", "%v", err)
+		return
+	}
+	d.add(checkPass, "Configuration", "%d webhooks configured", len(d.config.Webhooks))
+}
+
+// checkKubernetes checks that the Kubernetes API can be reached.
+func (d *doctor) checkKubernetes() {
+	if d.clientset == nil {
+		return
+	}
+	version, versionErr := d.clientset.Discovery().ServerVersion()
+	if versionErr != nil {
+		d.add(checkFail, "Kubernetes config", "failed to reach the Kubernetes API: %v", versionErr)
+		d.clientset = nil
+		return
+	}
+	d.add(checkPass, "Kubernetes config", "connected to Kubernetes %s", version.GitVersion)
+}
+
+// checkAccess checks that k8svent may get and list pods in the
+// namespace it is restricted to or, if it is not, in all namespaces
+// and in each namespace.
+func (d *doctor) checkAccess() {
+	if d.clientset == nil {
+		d.add(checkSkip, "RBAC", "no Kubernetes client")
+		return
+	}
+	namespaces := []string{d.config.Namespace}
+	if d.config.Namespace == "" {
+		if nsMeta, err := listNamespaces(d.clientset, ""); err != nil {
+			d.add(checkWarn, "RBAC", "unable to list namespaces, namespace annotations will be ignored: %v", err)
+		} else {
+			filter := newPodFilter(d.config.Filters)
+			for ns := range nsMeta {
+				if filter.matches(v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: ns}}) {
+					namespaces = append(namespaces, ns)
+				}
+			}
+			sort.Strings(namespaces[1:])
+		}
+	}
+	verbs := sourceRules[PodSource][0].Verbs
+	for _, ns := range namespaces {
+		name := "RBAC all namespaces"
+		if ns != "" {
+			name = "RBAC namespace " + ns
+		}
+		var denied []string
+		var reviewErr error
+		for _, verb := range verbs {
+			allowed, reason, err := d.accessAllowed(ns, verb, "pods")
+			if err != nil {
+				reviewErr = fmt.Errorf("failed to review access to %s pods: %v", verb, err)
+				break
+			}
+			if !allowed {
+				denied = append(denied, fmt.Sprintf("%s pods denied%s", verb, reason))
+			}
+		}
+		if reviewErr != nil {
+			d.add(checkFail, name, "%v", reviewErr)
+		} else if len(denied) > 0 {
+			d.add(checkFail, name, "%s", strings.Join(denied, ", "))
+		} else {
+			d.add(checkPass, name, "%s pods allowed", strings.Join(verbs, " and "))
+		}
+	}
+}
+
+// accessAllowed asks the Kubernetes API whether k8svent may perform
+// verb on resource in namespace using a SelfSubjectAccessReview.
+func (d *doctor) accessAllowed(namespace string, verb string, resource string) (bool, string, error) {
+	review, err := d.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Resource:  resource,
+			},
+		},
+	})
+	if err != nil {
+		return false, "", err
+	}
+	reason := ""
+	if review.Status.Reason != "" {
+		reason = ": " + review.Status.Reason
+	}
+	return review.Status.Allowed, reason, nil
+}
+
+// checkWebhooks posts a signed test payload once to every configured
+// webhook and checks the correlation ID in the response is parsed.
+func (d *doctor) checkWebhooks() {
+	hooks, hooksErr := newWebhooks(d.config.Webhooks, d.config.Secret)
+	if hooksErr != nil {
+		d.add(checkFail, "Webhooks", "%v", hooksErr)
+		return
+	}
+	if len(hooks) == 0 {
+		d.add(checkWarn, "Webhooks", "no webhooks configured, only annotations and VentSinks add webhooks")
+		return
+	}
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   selfNamespace(),
+			Name:        "k8svent-doctor",
+			Annotations: map[string]string{DoctorAnnotation: "true"},
+		},
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = "default"
+	}
+	for _, hook := range hooks {
+		d.checkWebhook(hook, &webhookPayload{Pod: pod, event: PodNew})
+	}
+}
+
+// checkWebhook posts the payload to the webhook and reports the
+// response and how its correlation ID is parsed.  Webhooks that are
+// not HTTP endpoints are sent the payload using their sink.
+func (d *doctor) checkWebhook(hook webhook, payload *webhookPayload) {
+	name := "Webhook " + redactURL(hook.url)
+	payloadJSON, jsonErr := formatPayload(payload, hook.format)
+	if jsonErr != nil {
+		d.add(checkFail, name, "failed to marshal test payload: %v", jsonErr)
+		return
+	}
+	msg, msgErr := webhookMessage(podSlug(payload.Pod), hook, payloadJSON)
+	if msgErr != nil {
+		d.add(checkFail, name, "%v", msgErr)
+		return
+	}
+	msg, signErr := signMessage(msg, hook.secret)
+	if signErr != nil {
+		d.add(checkFail, name, "%v", signErr)
+		return
+	}
+	signed := "unsigned"
+	if hook.secret != "" {
+		signed = "signed"
+	}
+	if u, _ := url.Parse(hook.url); u == nil || (u.Scheme != "http" && u.Scheme != "https") {
+		d.checkSink(name, hook, msg, signed)
+		return
+	}
+	req, reqErr := newHTTPRequest(context.Background(), hook.url, msg)
+	if reqErr != nil {
+		d.add(checkFail, name, "%v", reqErr)
+		return
+	}
+	start := time.Now()
+	resp, postErr := d.client.Do(req)
+	if postErr != nil {
+		d.add(checkFail, name, "unreachable: %v", postErr)
+		return
+	}
+	defer resp.Body.Close()
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		d.add(checkFail, name, "%s test payload got %s in %s", signed, resp.Status, elapsed)
+	} else {
+		d.add(checkPass, name, "%s test payload got %s in %s", signed, resp.Status, elapsed)
+	}
+	corrID, corrErr := extractPropertyString(resp, "correlation_id")
+	if corrErr != nil {
+		d.add(checkWarn, name+" response", "correlation ID not parsed: %v", corrErr)
+	} else {
+		d.add(checkPass, name+" response", "correlation_id: %s", corrID)
+	}
+}
+
+// checkSink sends the signed test message to the webhook using its
+// sink.
+func (d *doctor) checkSink(name string, hook webhook, msg Message, signed string) {
+	sink, release, openErr := hook.sinks.acquire(hook.url)
+	if openErr != nil {
+		d.add(checkFail, name, "%v", openErr)
+		return
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := sink.Send(ctx, msg); err != nil {
+		d.add(checkFail, name, "%s test payload not sent: %v", signed, err)
+		return
+	}
+	d.add(checkPass, name, "%s test payload sent in %s", signed, time.Since(start).Round(time.Millisecond))
+}
+
+// checkRegistry checks that the digest of the image checked for new
+// releases can be read from its registry.
+func (d *doctor) checkRegistry() {
+	update := d.config.Update
+	if update.Policy == UpdatePolicyOff {
+		d.add(checkSkip, "Registry", "update policy is off")
+		return
+	}
+	c := newReleaseChecker(newVentMetrics(), nil, d.clientset, nil)
+	image, imageErr := newReleaseImage(d.clientset, update, c.defaultTag)
+	if imageErr != nil {
+		d.add(checkFail, "Registry", "%v", imageErr)
+		return
+	}
+	name := fmt.Sprintf("Registry %s/%s:%s", image.ref.registry, image.ref.repository, image.tag)
+	digest, digestErr := image.digest()
+	if digestErr != nil {
+		d.add(checkFail, name, "%v", digestErr)
+		return
+	}
+	d.add(checkPass, name, "digest %s", digest)
+}
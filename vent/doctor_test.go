@@ -0,0 +1,130 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDoctor(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "doctor")
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		signature, _ := generateSignature(body, "Wilco")
+		var payload webhookPayload
+		_ = json.Unmarshal(body, &payload)
+		switch {
+		case r.Header.Get("x-atomist-signature") != signature:
+			w.WriteHeader(http.StatusUnauthorized)
+		case payload.Pod.Annotations[DoctorAnnotation] != "true":
+			w.WriteHeader(http.StatusBadRequest)
+		case r.URL.Path == "/plain":
+			fmt.Fprint(w, "OK")
+		default:
+			fmt.Fprint(w, `{"correlation_id":"yankee-hotel"}`)
+		}
+	}))
+	defer hook.Close()
+	registry := &releaseRegistry{digests: map[string]string{"latest": "sha256:0171"}}
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "jeff"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tweedy"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}},
+	)
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		if attrs.Namespace == "tweedy" && attrs.Verb == "list" {
+			review.Status.Reason = "no RBAC policy matched"
+		} else {
+			review.Status.Allowed = true
+		}
+		return true, review, nil
+	})
+
+	d := &doctor{
+		config: Config{
+			Secret: "Wilco",
+			Webhooks: []Webhook{
+				{URL: hook.URL + "/json"},
+				{URL: hook.URL + "/plain"},
+				{URL: hook.URL + "/wrong-secret", Secret: "Uncle Tupelo"},
+			},
+			Filters: Filters{ExcludeNamespaces: []string{"kube-system"}},
+			Update:  Update{Image: strings.TrimPrefix(registryServer.URL, "http://") + "/atomist/k8svent:latest", Insecure: true},
+		},
+		clientset: clientset,
+		client:    http.DefaultClient,
+	}
+	d.run()
+	out := &bytes.Buffer{}
+	if d.report(out) {
+		t.Error("doctor passed with failed checks")
+	}
+	expected := []string{
+		"[PASS] Configuration: 3 webhooks configured",
+		"[PASS] Kubernetes config: connected to Kubernetes",
+		"[PASS] RBAC all namespaces: get and list pods allowed",
+		"[PASS] RBAC namespace jeff: get and list pods allowed",
+		"[FAIL] RBAC namespace tweedy: list pods denied: no RBAC policy matched",
+		"[PASS] Webhook " + hook.URL + "/json: signed test payload got 200 OK",
+		"[PASS] Webhook " + hook.URL + "/json response: correlation_id: yankee-hotel",
+		"[PASS] Webhook " + hook.URL + "/plain: signed test payload got 200 OK",
+		"[WARN] Webhook " + hook.URL + "/plain response: correlation ID not parsed: failed to parse 'OK' as JSON",
+		"[FAIL] Webhook " + hook.URL + "/wrong-secret: signed test payload got 401 Unauthorized",
+		"[WARN] Webhook " + hook.URL + "/wrong-secret response: correlation ID not parsed",
+		"[PASS] Registry " + strings.TrimPrefix(registryServer.URL, "http://") + "/atomist/k8svent:latest: digest sha256:0171",
+		"8 passed, 2 warnings, 2 failed, 0 skipped",
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("report has %d lines rather than %d:\n%s", len(lines), len(expected), out.String())
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, expected[i]) {
+			t.Errorf("report line %d is '%s' rather than '%s...'", i, line, expected[i])
+		}
+	}
+
+	d = &doctor{config: Config{Update: Update{Policy: UpdatePolicyOff}}}
+	d.run()
+	out.Reset()
+	if !d.report(out) {
+		t.Errorf("doctor without Kubernetes client or webhooks failed:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "[SKIP] RBAC") || !strings.Contains(out.String(), "[SKIP] Registry") {
+		t.Errorf("checks were not skipped:\n%s", out.String())
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+)
+
+// eventReasons explain why a pod is sent for each event.
+var eventReasons = map[PodEvent]string{
+	PodNew:       "pod not seen before",
+	PodChanged:   "pod state changed since it was last sent",
+	PodUnhealthy: "pod state unchanged but pod is not healthy",
+	PodDeleted:   "pod no longer exists",
+}
+
+// dryRun prints the deliveries k8svent would make rather than making
+// them.  It is safe for concurrent use.
+type dryRun struct {
+	// mu guards writing to out.
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// newDryRun creates a dry run printing to out.
+func newDryRun(out io.Writer) *dryRun {
+	return &dryRun{out: out}
+}
+
+// print writes, for each of hooks that wants the payload event, the
+// endpoint and the payload that would be posted to it, why, and the
+// difference between the pod and last, the state of the pod last sent,
+// if any.
+func (d *dryRun) print(ctx context.Context, hooks []webhook, payload *webhookPayload, last *v1.Pod) {
+	slug := podSlug(payload.Pod)
+	diff := "  no previous state\n"
+	if last != nil {
+		if lines := cmp.Diff(*last, payload.Pod); lines != "" {
+			diff = indent(lines)
+		} else {
+			diff = "  no changes\n"
+		}
+	}
+
+	var b strings.Builder
+	for _, hook := range hooks {
+		if !hook.wants(payload.event) {
+			continue
+		}
+		var body string
+		if payloadJSON, jsonErr := formatPayload(payload, hook.format); jsonErr != nil {
+			body = fmt.Sprintf("  failed to marshal payload: %v\n", jsonErr)
+		} else {
+			var pretty bytes.Buffer
+			if err := json.Indent(&pretty, payloadJSON, "  ", "  "); err != nil {
+				pretty.Write(payloadJSON)
+			}
+			body = "  " + pretty.String() + "\n"
+		}
+		var notes []string
+		if hook.format != "" && hook.format != FormatJSON {
+			notes = append(notes, hook.format)
+		}
+		if hook.key != nil {
+			notes = append(notes, "encrypted")
+		}
+		if hook.secret != "" {
+			notes = append(notes, "signed")
+		}
+		note := ""
+		if len(notes) > 0 {
+			note = " (" + strings.Join(notes, ", ") + ")"
+		}
+		fmt.Fprintf(&b, "=== %s %s %s to %s%s\n", time.Now().UTC().Format(time.RFC3339), payload.event, slug, redactURL(hook.url), note)
+		fmt.Fprintf(&b, "Reason: %s\n", eventReasons[payload.event])
+		fmt.Fprintf(&b, "Diff (-last +current):\n%s", diff)
+		fmt.Fprintf(&b, "Payload:\n%s", body)
+	}
+	if b.Len() == 0 {
+		contextLogger(ctx, LogModuleDelivery).WithField("pod", slug).Debugf("No webhooks want %s event", payload.event)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := io.WriteString(d.out, b.String()); err != nil {
+		contextLogger(ctx, LogModuleDelivery).Errorf("Failed to print dry run: %v", err)
+	}
+}
+
+// indent indents each line of s by two spaces.
+func indent(s string) string {
+	lines := strings.SplitAfter(s, "\n")
+	var b strings.Builder
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		b.WriteString("  " + line)
+	}
+	if !strings.HasSuffix(s, "\n") {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
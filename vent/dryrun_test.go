@@ -0,0 +1,114 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDryRun(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "dryrun")
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	v := newVenter()
+	if err := v.setConfig(Config{
+		Secret:   "Bob Mould",
+		Webhooks: []Webhook{{URL: server.URL + "/husker"}},
+		DryRun:   true,
+	}); err != nil {
+		t.Fatalf("failed to set configuration: %v", err)
+	}
+	var out bytes.Buffer
+	v.dryRun = newDryRun(&out)
+
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "minneapolis", Name: "husker-du"},
+		Status:     v1.PodStatus{Phase: v1.PodPending},
+	}
+	lastPods := processPods(context.Background(), &processPodsArgs{
+		pods:      []v1.Pod{pod},
+		lastPods:  map[string]v1.Pod{},
+		processor: v.processPod,
+	})
+	output := out.String()
+	for _, expected := range []string{
+		" new minneapolis/husker-du to " + server.URL + "/husker (signed)\n",
+		"Reason: pod not seen before\n",
+		"Diff (-last +current):\n  no previous state\n",
+		`"name": "husker-du"`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("dry run of new pod does not contain '%s':\n%s", expected, output)
+		}
+	}
+
+	out.Reset()
+	pod.Status.Phase = v1.PodRunning
+	lastPods = processPods(context.Background(), &processPodsArgs{
+		pods:      []v1.Pod{pod},
+		lastPods:  lastPods,
+		processor: v.processPod,
+	})
+	output = out.String()
+	for _, expected := range []string{
+		" changed minneapolis/husker-du to ",
+		"Reason: pod state changed since it was last sent\n",
+		`-`, `"Pending"`, `+`, `"Running"`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("dry run of changed pod does not contain '%s':\n%s", expected, output)
+		}
+	}
+
+	out.Reset()
+	processPods(context.Background(), &processPodsArgs{
+		pods:      []v1.Pod{},
+		lastPods:  lastPods,
+		processor: v.processPod,
+	})
+	output = out.String()
+	for _, expected := range []string{
+		" deleted minneapolis/husker-du to ",
+		"Reason: pod no longer exists\n",
+		`"Running"`, `"Deleted"`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("dry run of deleted pod does not contain '%s':\n%s", expected, output)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("dry run sent %d requests", n)
+	}
+	if len(v.trackedPods()) != 0 {
+		t.Errorf("deleted pod is still tracked: %v", v.trackedPods())
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+// jweContentType is the content type of encrypted webhook payloads.
+const jweContentType = "application/jose"
+
+// jweHeader is the protected header of the JWE compact serialization
+// used to encrypt webhook payloads.
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Cty string `json:"cty,omitempty"`
+}
+
+const (
+	jweAlg = "RSA-OAEP-256"
+	jweEnc = "A256GCM"
+)
+
+var jweEncoding = base64.RawURLEncoding
+
+// encryptPayload encrypts payload to the provided public key and
+// returns it as a JWE (RFC 7516) in compact serialization.  The
+// content encryption key is wrapped using RSA-OAEP-256 and the
+// payload is encrypted using AES-256-GCM.
+func encryptPayload(payload []byte, key *rsa.PublicKey) (j []byte, e error) {
+	headerJSON, headerErr := json.Marshal(jweHeader{Alg: jweAlg, Enc: jweEnc, Cty: "application/json"})
+	if headerErr != nil {
+		return j, fmt.Errorf("failed to marshal JWE header: %v", headerErr)
+	}
+	header := jweEncoding.EncodeToString(headerJSON)
+
+	cek := make([]byte, 32)
+	if _, err := rand.Read(cek); err != nil {
+		return j, fmt.Errorf("failed to generate content encryption key: %v", err)
+	}
+	encryptedKey, wrapErr := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, cek, nil)
+	if wrapErr != nil {
+		return j, fmt.Errorf("failed to encrypt content encryption key: %v", wrapErr)
+	}
+
+	gcm, gcmErr := newGCM(cek)
+	if gcmErr != nil {
+		return j, gcmErr
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return j, fmt.Errorf("failed to generate initialization vector: %v", err)
+	}
+	sealed := gcm.Seal(nil, iv, payload, []byte(header))
+	tagStart := len(sealed) - gcm.Overhead()
+
+	parts := [][]byte{
+		[]byte(header),
+		[]byte(jweEncoding.EncodeToString(encryptedKey)),
+		[]byte(jweEncoding.EncodeToString(iv)),
+		[]byte(jweEncoding.EncodeToString(sealed[:tagStart])),
+		[]byte(jweEncoding.EncodeToString(sealed[tagStart:])),
+	}
+	return bytes.Join(parts, []byte(".")), nil
+}
+
+// DecryptPayload decrypts a webhook payload encrypted by k8svent
+// using the receiver's private key.  The payload must be a JWE in
+// compact serialization using RSA-OAEP-256 key encryption and
+// AES-256-GCM content encryption.
+func DecryptPayload(jwe []byte, key *rsa.PrivateKey) (p []byte, e error) {
+	parts := bytes.Split(bytes.TrimSpace(jwe), []byte("."))
+	if len(parts) != 5 {
+		return p, fmt.Errorf("JWE compact serialization must have 5 parts, found %d", len(parts))
+	}
+	decoded := make([][]byte, len(parts))
+	for i, part := range parts {
+		d, decodeErr := jweEncoding.DecodeString(string(part))
+		if decodeErr != nil {
+			return p, fmt.Errorf("failed to decode JWE part %d: %v", i, decodeErr)
+		}
+		decoded[i] = d
+	}
+
+	var header jweHeader
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		return p, fmt.Errorf("failed to parse JWE header: %v", err)
+	}
+	if header.Alg != jweAlg || header.Enc != jweEnc {
+		return p, fmt.Errorf("unsupported JWE algorithm alg=%s,enc=%s", header.Alg, header.Enc)
+	}
+
+	cek, unwrapErr := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, decoded[1], nil)
+	if unwrapErr != nil {
+		return p, fmt.Errorf("failed to decrypt content encryption key: %v", unwrapErr)
+	}
+	gcm, gcmErr := newGCM(cek)
+	if gcmErr != nil {
+		return p, gcmErr
+	}
+	if len(decoded[2]) != gcm.NonceSize() {
+		return p, fmt.Errorf("JWE initialization vector has invalid length %d", len(decoded[2]))
+	}
+	sealed := append(decoded[3], decoded[4]...)
+	payload, openErr := gcm.Open(nil, decoded[2], sealed, parts[0])
+	if openErr != nil {
+		return p, fmt.Errorf("failed to decrypt payload: %v", openErr)
+	}
+	return payload, nil
+}
+
+// newGCM returns an AES-GCM AEAD using the provided key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, blockErr := aes.NewCipher(key)
+	if blockErr != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %v", blockErr)
+	}
+	gcm, gcmErr := cipher.NewGCM(block)
+	if gcmErr != nil {
+		return nil, fmt.Errorf("failed to create GCM cipher: %v", gcmErr)
+	}
+	return gcm, nil
+}
+
+// ParsePrivateKey parses a PEM-encoded RSA private key in either
+// PKCS #1 or PKCS #8 form.
+func ParsePrivateKey(pemBytes []byte) (k *rsa.PrivateKey, e error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return k, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, parseErr := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if parseErr != nil {
+		return k, fmt.Errorf("failed to parse private key: %v", parseErr)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return k, fmt.Errorf("private key is not an RSA key: %T", parsed)
+	}
+	return key, nil
+}
+
+// parsePublicKey parses a PEM-encoded RSA public key in either PKIX
+// or PKCS #1 form.
+func parsePublicKey(pemBytes []byte) (k *rsa.PublicKey, e error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return k, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, parseErr := x509.ParsePKIXPublicKey(block.Bytes)
+	if parseErr != nil {
+		return k, fmt.Errorf("failed to parse public key: %v", parseErr)
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return k, fmt.Errorf("public key is not an RSA key: %T", parsed)
+	}
+	return key, nil
+}
+
+// loadPublicKey reads and parses the PEM-encoded RSA public key in
+// the provided file.
+func loadPublicKey(keyFile string) (k *rsa.PublicKey, e error) {
+	keyBytes, readErr := ioutil.ReadFile(keyFile)
+	if readErr != nil {
+		return k, fmt.Errorf("failed to read public key file %s: %v", keyFile, readErr)
+	}
+	key, keyErr := parsePublicKey(keyBytes)
+	if keyErr != nil {
+		return k, fmt.Errorf("invalid public key file %s: %v", keyFile, keyErr)
+	}
+	return key, nil
+}
@@ -0,0 +1,193 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/atomist/k8svent/receiver"
+)
+
+func TestEncryptPayload(t *testing.T) {
+	key, keyErr := rsa.GenerateKey(rand.Reader, 2048)
+	if keyErr != nil {
+		t.Fatalf("failed to generate key: %v", keyErr)
+	}
+	payload := []byte(`{"pod":{"metadata":{"name":"zoe","namespace":"jason-isbell"}}}`)
+
+	jwe, encryptErr := encryptPayload(payload, &key.PublicKey)
+	if encryptErr != nil {
+		t.Fatalf("failed to encrypt payload: %v", encryptErr)
+	}
+	if bytes.Contains(jwe, []byte("jason-isbell")) {
+		t.Error("encrypted payload contains plain text")
+	}
+	if n := bytes.Count(jwe, []byte(".")); n != 4 {
+		t.Errorf("expected JWE compact serialization to have 4 separators, found %d", n)
+	}
+
+	decrypted, decryptErr := DecryptPayload(jwe, key)
+	if decryptErr != nil {
+		t.Fatalf("failed to decrypt payload: %v", decryptErr)
+	}
+	if string(decrypted) != string(payload) {
+		t.Errorf("decrypted payload does not match: %s", string(decrypted))
+	}
+
+	otherKey, otherErr := rsa.GenerateKey(rand.Reader, 2048)
+	if otherErr != nil {
+		t.Fatalf("failed to generate key: %v", otherErr)
+	}
+	if _, err := DecryptPayload(jwe, otherKey); err == nil {
+		t.Error("decrypted payload with wrong key")
+	}
+
+	tampered := append([]byte{}, jwe...)
+	last := bytes.LastIndex(tampered, []byte("."))
+	if tampered[last+1] == 'A' {
+		tampered[last+1] = 'B'
+	} else {
+		tampered[last+1] = 'A'
+	}
+	if _, err := DecryptPayload(tampered, key); err == nil {
+		t.Error("decrypted tampered payload")
+	}
+
+	if _, err := DecryptPayload([]byte("not.a.jwe"), key); err == nil {
+		t.Error("decrypted malformed payload")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	key, keyErr := rsa.GenerateKey(rand.Reader, 2048)
+	if keyErr != nil {
+		t.Fatalf("failed to generate key: %v", keyErr)
+	}
+
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if _, err := ParsePrivateKey(pkcs1); err != nil {
+		t.Errorf("failed to parse PKCS #1 private key: %v", err)
+	}
+	pkcs8Bytes, pkcs8Err := x509.MarshalPKCS8PrivateKey(key)
+	if pkcs8Err != nil {
+		t.Fatalf("failed to marshal private key: %v", pkcs8Err)
+	}
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Bytes})
+	if _, err := ParsePrivateKey(pkcs8); err != nil {
+		t.Errorf("failed to parse PKCS #8 private key: %v", err)
+	}
+	if _, err := ParsePrivateKey([]byte("Southeastern")); err == nil {
+		t.Error("parsed invalid private key")
+	}
+
+	pkixBytes, pkixErr := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if pkixErr != nil {
+		t.Fatalf("failed to marshal public key: %v", pkixErr)
+	}
+	pkix := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkixBytes})
+	if _, err := parsePublicKey(pkix); err != nil {
+		t.Errorf("failed to parse PKIX public key: %v", err)
+	}
+	pkcs1Pub := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	if _, err := parsePublicKey(pkcs1Pub); err != nil {
+		t.Errorf("failed to parse PKCS #1 public key: %v", err)
+	}
+}
+
+func TestPostToWebhookEncrypted(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "encrypt")
+
+	key, keyErr := rsa.GenerateKey(rand.Reader, 2048)
+	if keyErr != nil {
+		t.Fatalf("failed to generate key: %v", keyErr)
+	}
+	dir, dirErr := ioutil.TempDir("", "k8svent-encrypt")
+	if dirErr != nil {
+		t.Fatalf("failed to create temporary directory: %v", dirErr)
+	}
+	defer os.RemoveAll(dir)
+	pubBytes, pubErr := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if pubErr != nil {
+		t.Fatalf("failed to marshal public key: %v", pubErr)
+	}
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0600); err != nil {
+		t.Fatalf("failed to write public key: %v", err)
+	}
+
+	payload := []byte(`{"pod":{"metadata":{"name":"alabama-pines","namespace":"the-400-unit"}}}`)
+	secret := "DriveByTruckers"
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, bodyErr := ioutil.ReadAll(r.Body)
+		if bodyErr != nil {
+			t.Errorf("failed to read request body: %v", bodyErr)
+		}
+		if ct := r.Header.Get("content-type"); ct != jweContentType {
+			t.Errorf("request content-type header is not '%s': '%s'", jweContentType, ct)
+		}
+		eSignature, signErr := generateSignature(body, secret)
+		if signErr != nil {
+			t.Errorf("failed to generate signature: %v", signErr)
+		}
+		if signature := r.Header.Get("x-atomist-signature"); signature != eSignature {
+			t.Errorf("signature of encrypted body '%s' does not match '%s'", signature, eSignature)
+		}
+		decrypted, decryptErr := DecryptPayload(body, key)
+		if decryptErr != nil {
+			t.Errorf("failed to decrypt request body: %v", decryptErr)
+		}
+		received = decrypted
+		decrypt := func(b []byte) ([]byte, error) { return DecryptPayload(b, key) }
+		opts := receiver.Options{Secret: secret, RequireTimestamp: true, Decrypt: decrypt}
+		if _, err := receiver.Verify(r.Header, body, opts); err != nil {
+			t.Errorf("receiver failed to verify request: %v", err)
+		}
+		w.Header().Set("content-type", "application/json")
+		if _, err := w.Write([]byte(`{"correlation_id":"8a0b5d3e"}`)); err != nil {
+			t.Errorf("failed to write server response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	hooks, hooksErr := newWebhooks([]Webhook{{URL: server.URL, EncryptionKey: keyFile}}, secret)
+	if hooksErr != nil {
+		t.Fatalf("failed to create webhooks: %v", hooksErr)
+	}
+	if err := postToWebhook(context.Background(), "the-400-unit/alabama-pines", hooks[0], payload); err != nil {
+		t.Errorf("failed to post encrypted payload: %v", err)
+	}
+	if string(received) != string(payload) {
+		t.Errorf("received payload does not match sent payload: %s", string(received))
+	}
+
+	if _, err := newWebhooks([]Webhook{{URL: server.URL, EncryptionKey: filepath.Join(dir, "missing.pem")}}, ""); err == nil {
+		t.Error("created webhook with missing encryption key")
+	}
+}
@@ -0,0 +1,459 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxFailedDeliveries is the number of failed deliveries remembered
+// for each endpoint.
+const maxFailedDeliveries = 20
+
+// Circuit breaker settings.  Every delivery includes retries, so
+// these count deliveries that failed after all retries.
+const (
+	// failingThreshold is the number of deliveries in a row that
+	// must fail before the endpoint is reported as failing.
+	failingThreshold = 3
+	// circuitThreshold is the number of deliveries in a row that
+	// must fail before deliveries to the endpoint are held.
+	circuitThreshold = 5
+	// circuitCooldown is how long deliveries are held once the
+	// circuit opens before they are attempted again.
+	circuitCooldown = 5 * time.Minute
+)
+
+// delivery is a single payload sent, or being sent, to an endpoint.
+type delivery struct {
+	// Pod is the slug of the pod sent.
+	Pod string `json:"pod"`
+	// Event is why the pod was sent.
+	Event PodEvent `json:"event"`
+	// Started is when the delivery started.
+	Started time.Time `json:"started"`
+	// Finished is when the delivery completed, zero if it is
+	// pending.
+	Finished time.Time `json:"finished,omitempty"`
+	// Error is why the delivery failed.
+	Error string `json:"error,omitempty"`
+	// payload is the payload being delivered, so it can be spooled
+	// if k8svent shuts down before the delivery completes.
+	payload *webhookPayload
+}
+
+// endpointState tracks the deliveries to a single webhook endpoint.
+// It is safe for concurrent use.
+type endpointState struct {
+	mu            sync.Mutex
+	pending       int
+	sent          uint64
+	failed        uint64
+	retries       uint64
+	latency       histogram
+	lastSuccess   time.Time
+	lastError     string
+	lastErrorTime time.Time
+	// deliveries are the pending deliveries.
+	deliveries map[*delivery]bool
+	// abandoned are the deliveries abandoned at shutdown.
+	abandoned []*delivery
+	// failures are the most recent failed deliveries, oldest first.
+	failures []delivery
+	// url is the endpoint URL.
+	url string
+	// events records Kubernetes Events about the endpoint.
+	events *eventRecorder
+	// log logs changes of the circuit, the global logger if nil.
+	log *logrus.Entry
+	// consecutiveFailures is the number of deliveries in a row that
+	// failed.
+	consecutiveFailures int
+	// paused is true if deliveries were paused using pause.
+	paused bool
+	// circuitOpen is true if deliveries failed circuitThreshold
+	// times in a row and none has succeeded since.
+	circuitOpen bool
+	// cooling is true while deliveries are held after the circuit
+	// opened.
+	cooling bool
+	// resumed, if not nil, is closed when held deliveries are
+	// released.
+	resumed chan struct{}
+}
+
+// endpointStatus is a snapshot of an endpointState.
+type endpointStatus struct {
+	// pending is the number of deliveries not yet completed,
+	// including those being retried.
+	pending int
+	// sent is the number of payloads delivered.
+	sent uint64
+	// failed is the number of payloads that could not be delivered.
+	failed uint64
+	// retries is the number of retried delivery attempts.
+	retries uint64
+	// latency is the histogram of delivery durations in seconds.
+	latency histogram
+	// lastSuccess is when the last delivery succeeded.
+	lastSuccess time.Time
+	// lastError is the error of the last failed delivery.
+	lastError string
+	// lastErrorTime is when the last delivery failed.
+	lastErrorTime time.Time
+	// deliveries are the pending deliveries, oldest first.
+	deliveries []delivery
+	// failures are the most recent failed deliveries, oldest first.
+	failures []delivery
+	// paused is true if deliveries to the endpoint are paused.
+	paused bool
+	// circuitOpen is true if deliveries to the endpoint keep failing.
+	circuitOpen bool
+}
+
+// start records the start of a delivery of the pod for event,
+// returning the delivery to pass to finish.
+func (s *endpointState) start(pod string, event PodEvent) *delivery {
+	d := &delivery{Pod: pod, Event: event, Started: time.Now()}
+	if s == nil {
+		return d
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending++
+	if s.deliveries == nil {
+		s.deliveries = map[*delivery]bool{}
+	}
+	s.deliveries[d] = true
+	return d
+}
+
+// retry records that a delivery attempt is being retried.
+func (s *endpointState) retry() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries++
+}
+
+// finish records the result of the delivery, which took duration.
+func (s *endpointState) finish(d *delivery, err error, duration time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+	delete(s.deliveries, d)
+	s.latency.observe(duration.Seconds())
+	if err != nil {
+		s.failed++
+		s.lastError = err.Error()
+		s.lastErrorTime = time.Now()
+		failure := *d
+		failure.Finished = s.lastErrorTime
+		failure.Error = s.lastError
+		s.failures = append(s.failures, failure)
+		if len(s.failures) > maxFailedDeliveries {
+			s.failures = s.failures[len(s.failures)-maxFailedDeliveries:]
+		}
+		s.consecutiveFailures++
+		if s.consecutiveFailures == failingThreshold {
+			s.events.webhookFailing(s.url, s.consecutiveFailures, s.lastError)
+		}
+		if s.consecutiveFailures >= circuitThreshold && !s.cooling {
+			if !s.circuitOpen {
+				entryLogger(s.log, LogModuleDelivery).Warnf("Holding deliveries to '%s' for %s after %d failures in a row",
+					redactURL(s.url), circuitCooldown, s.consecutiveFailures)
+				s.events.circuitOpened(s.url, s.consecutiveFailures, circuitCooldown)
+			}
+			s.circuitOpen = true
+			s.cooling = true
+			s.hold()
+			time.AfterFunc(circuitCooldown, s.cooled)
+		}
+	} else {
+		s.sent++
+		s.lastSuccess = time.Now()
+		s.consecutiveFailures = 0
+		if s.circuitOpen {
+			entryLogger(s.log, LogModuleDelivery).Infof("Delivery to '%s' succeeded, closing circuit", redactURL(s.url))
+			s.events.circuitClosed(s.url)
+			s.circuitOpen = false
+		}
+	}
+}
+
+// status returns a snapshot of the endpoint state.
+func (s *endpointState) status() endpointStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latency := s.latency
+	latency.counts = append([]uint64(nil), s.latency.counts...)
+	deliveries := make([]delivery, 0, len(s.deliveries))
+	for d := range s.deliveries {
+		deliveries = append(deliveries, *d)
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].Started.Before(deliveries[j].Started) })
+	return endpointStatus{
+		pending:       s.pending,
+		sent:          s.sent,
+		failed:        s.failed,
+		retries:       s.retries,
+		latency:       latency,
+		lastSuccess:   s.lastSuccess,
+		lastError:     s.lastError,
+		lastErrorTime: s.lastErrorTime,
+		deliveries:    deliveries,
+		failures:      append([]delivery(nil), s.failures...),
+		paused:        s.paused,
+		circuitOpen:   s.circuitOpen,
+	}
+}
+
+// pause holds new deliveries and retries to the endpoint until resume
+// is called.
+func (s *endpointState) pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = true
+	s.hold()
+}
+
+// resume releases the deliveries held by pause, unless they are held
+// because the circuit is open.
+func (s *endpointState) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = false
+	s.release()
+}
+
+// cooled releases the deliveries held when the circuit opened so they
+// are attempted again.  If the next delivery fails, the circuit holds
+// deliveries again.
+func (s *endpointState) cooled() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cooling = false
+	s.release()
+}
+
+// hold makes wait block.  s.mu must be held.
+func (s *endpointState) hold() {
+	if s.resumed == nil {
+		s.resumed = make(chan struct{})
+	}
+}
+
+// release unblocks wait if deliveries are neither paused nor cooling.
+// s.mu must be held.
+func (s *endpointState) release() {
+	if s.resumed != nil && !s.paused && !s.cooling {
+		close(s.resumed)
+		s.resumed = nil
+	}
+}
+
+// abandon records that the delivery was abandoned without completing
+// because k8svent is shutting down.  It is neither a success nor a
+// failure.
+func (s *endpointState) abandon(d *delivery) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+	delete(s.deliveries, d)
+	s.abandoned = append(s.abandoned, d)
+}
+
+// wait blocks while deliveries to the endpoint are held.  It returns
+// an error if ctx is done first.
+func (s *endpointState) wait(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	resumed := s.resumed
+	s.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// endpointRegistry holds the state of every webhook endpoint by URL.
+// It is safe for concurrent use.
+type endpointRegistry struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointState
+	events    *eventRecorder
+	// log is the logger of new endpoints.  Set it before the
+	// registry is used.
+	log *logrus.Entry
+}
+
+// newEndpointRegistry creates an empty endpoint registry.
+func newEndpointRegistry() *endpointRegistry {
+	return &endpointRegistry{endpoints: map[string]*endpointState{}}
+}
+
+// get returns the state of the endpoint, creating it if needed.
+func (r *endpointRegistry) get(url string) *endpointState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.endpoints[url]
+	if !ok {
+		s = &endpointState{url: url, events: r.events, log: r.log}
+		r.endpoints[url] = s
+	}
+	return s
+}
+
+// evict forgets the endpoints whose URL keep returns false for and
+// that have no pending deliveries, so the endpoints of webhooks that
+// are no longer used are not reported forever.
+func (r *endpointRegistry) evict(keep func(url string) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for u, s := range r.endpoints {
+		if keep(u) {
+			continue
+		}
+		s.mu.Lock()
+		idle := s.pending == 0 && len(s.abandoned) == 0
+		s.mu.Unlock()
+		if idle {
+			delete(r.endpoints, u)
+		}
+	}
+}
+
+// setEvents makes every endpoint record Kubernetes Events using
+// events.
+func (r *endpointRegistry) setEvents(events *eventRecorder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = events
+	for _, s := range r.endpoints {
+		s.mu.Lock()
+		s.events = events
+		s.mu.Unlock()
+	}
+}
+
+// statuses returns a snapshot of the state of every endpoint by URL.
+func (r *endpointRegistry) statuses() map[string]endpointStatus {
+	statuses := map[string]endpointStatus{}
+	if r == nil {
+		return statuses
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for u, s := range r.endpoints {
+		statuses[u] = s.status()
+	}
+	return statuses
+}
+
+// attach returns a copy of hooks with the state of each endpoint set.
+// If r is nil, hooks is returned.
+func (r *endpointRegistry) attach(hooks []webhook) []webhook {
+	if r == nil {
+		return hooks
+	}
+	attached := make([]webhook, len(hooks))
+	for i, hook := range hooks {
+		hook.state = r.get(hook.url)
+		attached[i] = hook
+	}
+	return attached
+}
+
+// unfinished returns the payloads of the deliveries to every endpoint
+// that were abandoned or are still pending, oldest first.
+func (r *endpointRegistry) unfinished() []spooledDelivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deliveries []*delivery
+	urls := map[*delivery]string{}
+	add := func(u string, d *delivery) {
+		if d.payload != nil {
+			deliveries = append(deliveries, d)
+			urls[d] = u
+		}
+	}
+	for u, s := range r.endpoints {
+		s.mu.Lock()
+		for d := range s.deliveries {
+			add(u, d)
+		}
+		for _, d := range s.abandoned {
+			add(u, d)
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].Started.Before(deliveries[j].Started) })
+	spooled := make([]spooledDelivery, len(deliveries))
+	for i, d := range deliveries {
+		spooled[i] = spooledDelivery{URL: urls[d], Event: d.Event, Pod: d.payload.Pod}
+	}
+	return spooled
+}
+
+// drain waits until no deliveries to any endpoint are pending,
+// returning true, or ctx is done, returning false.
+func (r *endpointRegistry) drain(ctx context.Context) bool {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		if r.pendingCount() == 0 {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// pendingCount returns the number of pending deliveries to every
+// endpoint.
+func (r *endpointRegistry) pendingCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pending := 0
+	for _, s := range r.endpoints {
+		s.mu.Lock()
+		pending += s.pending
+		s.mu.Unlock()
+	}
+	return pending
+}
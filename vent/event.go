@@ -0,0 +1,214 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Environment variables identifying the k8svent pod.  If they are not
+// set, the pod name is the host name and the namespace is read from
+// the service account.
+const (
+	podNameEnv      = "K8SVENT_POD_NAME"
+	podNamespaceEnv = "K8SVENT_POD_NAMESPACE"
+)
+
+// serviceAccountNamespaceFile contains the namespace of the pod.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Reasons of the Kubernetes Events k8svent records.
+const (
+	// EventWebhookFailing is recorded when deliveries to a webhook
+	// have failed failingThreshold times in a row.
+	EventWebhookFailing = "WebhookFailing"
+	// EventCircuitOpened is recorded when deliveries to a webhook
+	// are held after failing circuitThreshold times in a row.
+	EventCircuitOpened = "CircuitOpened"
+	// EventCircuitClosed is recorded when a delivery to a webhook
+	// whose circuit was open succeeds.
+	EventCircuitClosed = "CircuitClosed"
+	// EventSelfUpdate is recorded when k8svent restarts to update
+	// itself.
+	EventSelfUpdate = "SelfUpdate"
+	// EventUpdateAvailable is recorded when a new k8svent release is
+	// detected but not installed because of the update policy.
+	EventUpdateAvailable = "UpdateAvailable"
+	// EventUpdateUnverified is recorded when a new k8svent image is
+	// not installed because its signature could not be verified.
+	EventUpdateUnverified = "UpdateUnverified"
+	// EventForbidden is recorded when RBAC denies k8svent access to a
+	// resource.
+	EventForbidden = "Forbidden"
+)
+
+// eventFlushDelay is how long to wait for events to be written before
+// k8svent exits.
+const eventFlushDelay = 2 * time.Second
+
+// eventRecorder records Kubernetes Events on the k8svent pod.  All
+// methods can be called on a nil eventRecorder, which records
+// nothing.
+type eventRecorder struct {
+	recorder    record.EventRecorder
+	broadcaster record.EventBroadcaster
+	ref         *v1.ObjectReference
+}
+
+// newEventRecorder creates an event recorder writing events about the
+// k8svent pod using clientset.  It returns nil if the k8svent pod
+// cannot be identified.
+func newEventRecorder(clientset kubernetes.Interface) *eventRecorder {
+	ref := selfReference(clientset)
+	if ref == nil {
+		return nil
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events(ref.Namespace)})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: Pkg})
+	return &eventRecorder{recorder: recorder, broadcaster: broadcaster, ref: ref}
+}
+
+// selfReference returns a reference to the k8svent pod, nil if its
+// name or namespace is unknown.
+func selfReference(clientset kubernetes.Interface) *v1.ObjectReference {
+	name := selfName()
+	namespace := selfNamespace()
+	if name == "" || namespace == "" {
+		return nil
+	}
+	ref := &v1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: namespace, Name: name}
+	if pod, err := clientset.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{}); err == nil {
+		ref.UID = pod.UID
+		ref.ResourceVersion = pod.ResourceVersion
+	} else {
+		moduleLogger(LogModuleServer).Debugf("Failed to get k8svent pod %s/%s: %v", namespace, name, err)
+	}
+	return ref
+}
+
+// selfName returns the name of the k8svent pod, an empty string if it
+// is unknown.
+func selfName() string {
+	if name := os.Getenv(podNameEnv); name != "" {
+		return name
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+// selfNamespace returns the namespace of the k8svent pod, an empty
+// string if it is unknown.
+func selfNamespace() string {
+	if namespace := os.Getenv(podNamespaceEnv); namespace != "" {
+		return namespace
+	}
+	if ns, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil {
+		return strings.TrimSpace(string(ns))
+	}
+	return ""
+}
+
+// webhookFailing records that deliveries to the webhook keep failing.
+func (e *eventRecorder) webhookFailing(url string, failures int, err string) {
+	if e == nil {
+		return
+	}
+	e.recorder.Eventf(e.ref, v1.EventTypeWarning, EventWebhookFailing,
+		"%d deliveries in a row to %s failed: %s", failures, redactURL(url), err)
+}
+
+// circuitOpened records that deliveries to the webhook are held.
+func (e *eventRecorder) circuitOpened(url string, failures int, cooldown time.Duration) {
+	if e == nil {
+		return
+	}
+	e.recorder.Eventf(e.ref, v1.EventTypeWarning, EventCircuitOpened,
+		"Holding deliveries to %s for %s after %d failures in a row", redactURL(url), cooldown, failures)
+}
+
+// circuitClosed records that deliveries to the webhook succeed again.
+func (e *eventRecorder) circuitClosed(url string) {
+	if e == nil {
+		return
+	}
+	e.recorder.Eventf(e.ref, v1.EventTypeNormal, EventCircuitClosed, "Delivery to %s succeeded, resuming deliveries", redactURL(url))
+}
+
+// selfUpdate records that k8svent is restarting to update itself.
+func (e *eventRecorder) selfUpdate(image string, digest string) {
+	if e == nil {
+		return
+	}
+	e.recorder.Eventf(e.ref, v1.EventTypeNormal, EventSelfUpdate,
+		"New %s image %s detected, restarting to update", image, digest)
+}
+
+// updateAvailable records that a new release was detected but
+// k8svent is not restarting to update, and why.
+func (e *eventRecorder) updateAvailable(image string, digest string, reason string) {
+	if e == nil {
+		return
+	}
+	e.recorder.Eventf(e.ref, v1.EventTypeNormal, EventUpdateAvailable,
+		"New %s image %s available, not restarting: %s", image, digest, reason)
+}
+
+// updateUnverified records that a new image is not installed because
+// its signature could not be verified.
+func (e *eventRecorder) updateUnverified(image string, digest string, err error) {
+	if e == nil {
+		return
+	}
+	e.recorder.Eventf(e.ref, v1.EventTypeWarning, EventUpdateUnverified,
+		"New %s image %s not installed, signature verification failed: %v", image, digest, err)
+}
+
+// forbidden records that RBAC denied access to a resource if err is a
+// Forbidden error.  It returns true if it was.
+func (e *eventRecorder) forbidden(verb string, resource string, namespace string, err error) bool {
+	if !apierrors.IsForbidden(err) {
+		return false
+	}
+	if e == nil {
+		return true
+	}
+	scope := "all namespaces"
+	if namespace != "" {
+		scope = "namespace " + namespace
+	}
+	e.recorder.Eventf(e.ref, v1.EventTypeWarning, EventForbidden, "Not allowed to %s %s in %s: %v", verb, resource, scope, err)
+	return true
+}
+
+// flush waits for recorded events to be written and stops recording.
+func (e *eventRecorder) flush() {
+	if e == nil {
+		return
+	}
+	time.Sleep(eventFlushDelay)
+	e.broadcaster.Shutdown()
+}
@@ -0,0 +1,64 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+// podFilter selects the pods that are sent to the webhooks by
+// namespace.  Label selectors are applied when listing pods.
+type podFilter struct {
+	// include, if not empty, contains the only namespaces whose pods
+	// are sent.
+	include map[string]bool
+	// exclude contains namespaces whose pods are not sent.
+	exclude map[string]bool
+}
+
+// newPodFilter creates a pod filter from the filter configuration.
+func newPodFilter(filters Filters) *podFilter {
+	f := &podFilter{
+		include: map[string]bool{},
+		exclude: map[string]bool{},
+	}
+	for _, ns := range filters.Namespaces {
+		f.include[ns] = true
+	}
+	for _, ns := range filters.ExcludeNamespaces {
+		f.exclude[ns] = true
+	}
+	return f
+}
+
+// matches returns true if pod passes the filter.
+func (f *podFilter) matches(pod v1.Pod) bool {
+	ns := pod.ObjectMeta.Namespace
+	if len(f.include) > 0 && !f.include[ns] {
+		return false
+	}
+	return !f.exclude[ns]
+}
+
+// filter returns the pods that pass the filter.
+func (f *podFilter) filter(pods []v1.Pod) []v1.Pod {
+	filtered := make([]v1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if f.matches(pod) {
+			filtered = append(filtered, pod)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,45 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodFilter(t *testing.T) {
+	pods := []v1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "a"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "b"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "atomist", Name: "c"}},
+	}
+
+	all := newPodFilter(Filters{}).filter(pods)
+	if len(all) != 3 {
+		t.Errorf("empty filter should pass all pods: %d", len(all))
+	}
+
+	excluded := newPodFilter(Filters{ExcludeNamespaces: []string{"kube-system"}}).filter(pods)
+	if len(excluded) != 2 || excluded[0].Name != "a" || excluded[1].Name != "c" {
+		t.Errorf("exclude filter did not remove kube-system pods: %v", excluded)
+	}
+
+	included := newPodFilter(Filters{Namespaces: []string{"atomist", "default"}}).filter(pods)
+	if len(included) != 2 || included[0].Name != "a" || included[1].Name != "c" {
+		t.Errorf("include filter did not select pods: %v", included)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stallTimeout is how long the venting loop can go without
+// attempting to list pods before k8svent is considered not live.  The
+// loop normally attempts to list pods at least every two minutes.
+const stallTimeout = 10 * time.Minute
+
+// failureTimeout is how long the venting loop can go without
+// successfully listing and processing pods before k8svent is
+// considered not live.
+const failureTimeout = 1 * time.Hour
+
+// unreadyTimeout is how long attempts to list pods can keep failing
+// after they last succeeded before k8svent is considered not ready,
+// so a single transient failure does not take it out of service.
+const unreadyTimeout = 5 * time.Minute
+
+// healthResponse is the body of the health check responses.
+type healthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Degraded are the webhook endpoints whose circuit is open.
+	Degraded []string `json:"degraded,omitempty"`
+}
+
+// liveness returns an error if the venting loop has stalled or has
+// not succeeded for too long.
+func (m *ventMetrics) liveness(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lastAttempt := m.lastAttempt
+	if lastAttempt.IsZero() {
+		lastAttempt = m.started
+	}
+	if since := now.Sub(lastAttempt); since > stallTimeout {
+		return fmt.Errorf("venting loop has not run for %s", since.Truncate(time.Second))
+	}
+	lastCycle := m.lastCycle
+	if lastCycle.IsZero() {
+		lastCycle = m.started
+	}
+	if since := now.Sub(lastCycle); since > failureTimeout {
+		return fmt.Errorf("venting loop has not succeeded for %s: %s", since.Truncate(time.Second), m.lastListError)
+	}
+	return nil
+}
+
+// readiness returns an error if the pods have not been listed and
+// processed yet or attempts to list them have failed since they last
+// succeeded for too long.
+func (m *ventMetrics) readiness(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lastCycle.IsZero() {
+		if m.lastListError != "" {
+			return fmt.Errorf("initial sync has not completed: %s", m.lastListError)
+		}
+		return fmt.Errorf("initial sync has not completed")
+	}
+	if since := now.Sub(m.lastCycle); m.lastListError != "" && since > unreadyTimeout {
+		return fmt.Errorf("failed to list pods for %s: %s", since.Truncate(time.Second), m.lastListError)
+	}
+	return nil
+}
+
+// openCircuits returns the redacted URLs of the endpoints whose
+// deliveries are held because they failed too many times in a row,
+// sorted.
+func (r *endpointRegistry) openCircuits() []string {
+	var open []string
+	for u, s := range r.statuses() {
+		if s.circuitOpen {
+			open = append(open, redactURL(u))
+		}
+	}
+	sort.Strings(open)
+	return open
+}
+
+// healthHandler responds with 200 if check returns nil and 503
+// otherwise.  If degraded is not nil and returns any endpoints, they
+// are included in the response and a passing check has the status
+// "degraded".  Failures to respond are logged using log, the global
+// logger if nil.
+func healthHandler(check func() error, degraded func() []string, log *logrus.Entry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := healthResponse{Status: "ok"}
+		code := http.StatusOK
+		if err := check(); err != nil {
+			response = healthResponse{Status: "failed", Error: err.Error()}
+			code = http.StatusServiceUnavailable
+		}
+		if degraded != nil {
+			response.Degraded = degraded()
+			if len(response.Degraded) > 0 && code == http.StatusOK {
+				response.Status = "degraded"
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			entryLogger(log, LogModuleServer).Warnf("Failed to write health check response: %v", err)
+		}
+	})
+}
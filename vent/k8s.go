@@ -15,18 +15,46 @@
 package vent
 
 import (
+	"context"
+	"fmt"
+
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
-// listPods lists all pods in the provided namespace.  Kubernetes
-// convention is that if the namespace is an empty string, pods from
-// all namespaces are returned.
-func listPods(clientset *kubernetes.Clientset, namespace string) ([]v1.Pod, error) {
+// inClusterClients creates the Kubernetes API client set and dynamic
+// client using the service account of the pod k8svent runs in.
+func inClusterClients() (kubernetes.Interface, dynamic.Interface, error) {
+	restConfig, configErr := rest.InClusterConfig()
+	if configErr != nil {
+		return nil, nil, fmt.Errorf("failed to load in-cluster config: %v", configErr)
+	}
+	clientset, clientErr := kubernetes.NewForConfig(restConfig)
+	if clientErr != nil {
+		return nil, nil, fmt.Errorf("failed to create client from config: %v", clientErr)
+	}
+	dynamicClient, dynamicErr := dynamic.NewForConfig(restConfig)
+	if dynamicErr != nil {
+		return nil, nil, fmt.Errorf("failed to create dynamic client from config: %v", dynamicErr)
+	}
+	return clientset, dynamicClient, nil
+}
+
+// listPods lists all pods in the provided namespace matching the
+// label selector.  Kubernetes convention is that if the namespace is
+// an empty string, pods from all namespaces are returned, and if the
+// label selector is empty, all pods are returned.  Listing stops if
+// ctx is done.
+func listPods(ctx context.Context, clientset kubernetes.Interface, namespace string, labelSelector string) ([]v1.Pod, error) {
 	pods := []v1.Pod{}
-	options := metav1.ListOptions{}
+	options := metav1.ListOptions{LabelSelector: labelSelector}
 	for ok := true; ok; ok = (options.Continue != "") {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		podList, listErr := clientset.CoreV1().Pods(namespace).List(options)
 		if listErr != nil {
 			return nil, listErr
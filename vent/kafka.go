@@ -0,0 +1,172 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// kafkaDefaultPort is the Kafka broker port used if the URL has none.
+const kafkaDefaultPort = "9092"
+
+// kafkaTimeout limits connecting to, reading from, and writing to the
+// brokers.
+const kafkaTimeout = 10 * time.Second
+
+// kafkaSink produces messages to a Kafka topic, keyed by pod, with the
+// message header and content type as record headers.  The partition
+// is chosen by hashing the key like the Java client does, so the
+// messages about a pod stay in order.
+type kafkaSink struct {
+	bootstrap string
+	topic     string
+	// dialer connects to the brokers, using TLS and authenticating
+	// if configured.
+	dialer *kafka.Dialer
+	// mu guards writer.
+	mu sync.Mutex
+	// writer produces to the topic, nil until the first send and
+	// after a send fails.
+	writer *kafka.Writer
+}
+
+// newKafkaSink returns a sink producing to the topic in the path of
+// u, kafka://[USER:PASSWORD@]HOST[:PORT]/TOPIC, using HOST:PORT to
+// bootstrap.  The query parameter tls=true connects using TLS.  The
+// user and password authenticate using SASL, with the mechanism in
+// the sasl query parameter, PLAIN if not provided.
+func newKafkaSink(u *url.URL) (Sink, error) {
+	topic := strings.Trim(u.Path, "/")
+	if topic == "" || strings.ContainsAny(topic, " \t\r\n/") {
+		return nil, fmt.Errorf("Kafka URL path must be a topic, not '%s'", u.Path)
+	}
+	bootstrap := u.Host
+	if u.Port() == "" {
+		bootstrap = net.JoinHostPort(u.Hostname(), kafkaDefaultPort)
+	}
+	dialer := &kafka.Dialer{ClientID: Pkg, Timeout: kafkaTimeout, DualStack: true}
+	useTLS, tlsErr := queryBool(u, "tls")
+	if tlsErr != nil {
+		return nil, tlsErr
+	}
+	if useTLS {
+		dialer.TLS = &tls.Config{}
+	}
+	mechanism := u.Query().Get("sasl")
+	if u.User == nil {
+		if mechanism != "" {
+			return nil, fmt.Errorf("SASL mechanism %s requires a user and password", mechanism)
+		}
+	} else {
+		password, _ := u.User.Password()
+		saslMechanism, saslErr := newKafkaSASL(mechanism, u.User.Username(), password)
+		if saslErr != nil {
+			return nil, saslErr
+		}
+		dialer.SASLMechanism = saslMechanism
+	}
+	return &kafkaSink{bootstrap: bootstrap, topic: topic, dialer: dialer}, nil
+}
+
+// newKafkaSASL returns the SASL mechanism named mechanism, PLAIN if
+// empty, authenticating user using password.
+func newKafkaSASL(mechanism string, user string, password string) (sasl.Mechanism, error) {
+	switch strings.ToUpper(mechanism) {
+	case "", "PLAIN":
+		return plain.Mechanism{Username: user, Password: password}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, user, password)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, user, password)
+	}
+	return nil, fmt.Errorf("unsupported SASL mechanism '%s', must be one of PLAIN, SCRAM-SHA-256, SCRAM-SHA-512", mechanism)
+}
+
+// Send produces msg, creating the writer if there is none.  The writer
+// reads the topic metadata and connects to the partition leaders as
+// needed.  If producing fails, the writer is closed so the next send
+// starts afresh.  Retrying is left to the delivery.
+func (s *kafkaSink) Send(ctx context.Context, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writer == nil {
+		s.writer = kafka.NewWriter(kafka.WriterConfig{
+			Brokers:      []string{s.bootstrap},
+			Topic:        s.topic,
+			Dialer:       s.dialer,
+			Balancer:     kafka.Murmur2Balancer{},
+			MaxAttempts:  1,
+			BatchSize:    1,
+			ReadTimeout:  kafkaTimeout,
+			WriteTimeout: kafkaTimeout,
+			RequiredAcks: 1,
+		})
+	}
+	if err := s.writer.WriteMessages(ctx, kafkaMessage(msg)); err != nil {
+		s.writer.Close()
+		s.writer = nil
+		return fmt.Errorf("failed to produce to Kafka topic %s: %v", s.topic, err)
+	}
+	contextLogger(ctx, LogModuleDelivery).WithField("pod", msg.Key).Infof("Produced to Kafka topic '%s'", s.topic)
+	return nil
+}
+
+// kafkaMessage returns the Kafka message for msg, keyed by the message
+// key, with the content type and header as record headers sorted by
+// name.
+func kafkaMessage(msg Message) kafka.Message {
+	headers := map[string]string{}
+	for k, v := range msg.Header {
+		headers[k] = v
+	}
+	if msg.ContentType != "" {
+		headers["content-type"] = msg.ContentType
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	km := kafka.Message{Key: []byte(msg.Key), Value: msg.Body}
+	for _, name := range names {
+		km.Headers = append(km.Headers, kafka.Header{Key: name, Value: []byte(headers[name])})
+	}
+	return km
+}
+
+// Close closes the writer and its broker connections.
+func (s *kafkaSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
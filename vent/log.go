@@ -15,37 +15,332 @@
 package vent
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 )
 
-var logger *logrus.Entry
+// logger is the global logger, used by the commands and by sinks
+// and Venters not given a logger.
+var logger = logrus.NewEntry(logrus.StandardLogger())
 
-// setupLogger creates and configures the global logger.
-func setupLogger(logLevel string) {
-	l := logrus.New()
-	l.SetFormatter(&logrus.JSONFormatter{})
-	level := strings.ToLower(logLevel)
-	if level == "debug" {
-		l.SetLevel(logrus.DebugLevel)
-	} else if level == "error" {
-		l.SetLevel(logrus.ErrorLevel)
-	} else if level == "fatal" {
-		l.SetLevel(logrus.FatalLevel)
-	} else if level == "panic" {
-		l.SetLevel(logrus.PanicLevel)
-	} else if level == "trace" {
-		l.SetLevel(logrus.TraceLevel)
-	} else if level == "warn" {
-		l.SetLevel(logrus.WarnLevel)
-	} else {
-		l.SetLevel(logrus.InfoLevel)
+// Log output formats.
+const (
+	// LogFormatJSON outputs every log message as a JSON object, the
+	// default.
+	LogFormatJSON = "json"
+	// LogFormatText outputs human-readable, colored log messages when
+	// writing to a terminal and logfmt otherwise.
+	LogFormatText = "text"
+	// LogFormatLogfmt outputs every log message as logfmt key=value
+	// pairs.
+	LogFormatLogfmt = "logfmt"
+)
+
+// LogFormats are all the log output formats.
+var LogFormats = []string{LogFormatJSON, LogFormatText, LogFormatLogfmt}
+
+// Logging modules whose level can be set separately using
+// Config.LogLevels.
+const (
+	// LogModuleDelivery logs sending payloads to webhooks.
+	LogModuleDelivery = "delivery"
+	// LogModulePods logs processing pods.
+	LogModulePods = "pods"
+	// LogModuleRouting logs adding webhooks from annotations and
+	// VentSinks.
+	LogModuleRouting = "routing"
+	// LogModuleConfig logs loading and reloading the configuration.
+	LogModuleConfig = "config"
+	// LogModuleRelease logs checking for new releases.
+	LogModuleRelease = "release"
+	// LogModuleServer logs the metrics and health check server.
+	LogModuleServer = "server"
+	// LogModuleTracing logs exporting traces.
+	LogModuleTracing = "tracing"
+)
+
+// LogModules are all the logging modules.
+var LogModules = []string{
+	LogModuleDelivery,
+	LogModulePods,
+	LogModuleRouting,
+	LogModuleConfig,
+	LogModuleRelease,
+	LogModuleServer,
+	LogModuleTracing,
+}
+
+// moduleField is the log field containing the logging module.
+const moduleField = "module"
+
+// logLevels holds the configured log levels and any runtime override.
+// It is safe for concurrent use.
+type logLevels struct {
+	mu sync.RWMutex
+	// level is the configured level of messages not overridden by a
+	// module level.
+	level logrus.Level
+	// modules are the configured levels of modules.
+	modules map[string]logrus.Level
+	// override, if not nil, replaces level and all module levels.
+	override *logrus.Level
+	// logger, if not nil, is the logger whose level is kept at the
+	// most verbose level of any module.
+	logger *logrus.Logger
+}
+
+// levels are the current log levels of the global logger.
+var levels = &logLevels{level: logrus.InfoLevel}
+
+// enabled returns true if messages at level for module should be
+// output.
+func (l *logLevels) enabled(module string, level logrus.Level) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.override != nil {
+		return level <= *l.override
+	}
+	if moduleLevel, ok := l.modules[module]; ok {
+		return level <= moduleLevel
+	}
+	return level <= l.level
+}
+
+// max returns the most verbose level of all modules.
+func (l *logLevels) max() logrus.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.override != nil {
+		return *l.override
+	}
+	max := l.level
+	for _, level := range l.modules {
+		if level > max {
+			max = level
+		}
+	}
+	return max
+}
+
+// current returns the level of messages not in a module, including
+// any runtime override.
+func (l *logLevels) current() logrus.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.override != nil {
+		return *l.override
+	}
+	return l.level
+}
+
+// moduleFormatter drops messages whose module is not enabled at their
+// level before formatting them.
+type moduleFormatter struct {
+	formatter logrus.Formatter
+	levels    *logLevels
+}
+
+func (f *moduleFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	module, _ := entry.Data[moduleField].(string)
+	if !f.levels.enabled(module, entry.Level) {
+		return nil, nil
+	}
+	return f.formatter.Format(entry)
+}
+
+// moduleLogger returns the global logger for messages of module.
+func moduleLogger(module string) *logrus.Entry {
+	return logger.WithField(moduleField, module)
+}
+
+// entryLogger returns log, or the global logger if log is nil, for
+// messages of module.
+func entryLogger(log *logrus.Entry, module string) *logrus.Entry {
+	if log == nil {
+		return moduleLogger(module)
+	}
+	return log.WithField(moduleField, module)
+}
+
+// loggerKey is the context key of the logger.
+type loggerKey struct{}
+
+// withLogger returns a context in which contextLogger returns log.
+// If log is nil, ctx is returned.
+func withLogger(ctx context.Context, log *logrus.Entry) context.Context {
+	if log == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// contextLogger returns the logger in ctx, or the global logger if ctx
+// has none, for messages of module.
+func contextLogger(ctx context.Context, module string) *logrus.Entry {
+	log, _ := ctx.Value(loggerKey{}).(*logrus.Entry)
+	return entryLogger(log, module)
+}
+
+// setupLogger creates and configures the global logger.  It returns
+// an error if the format or any level is invalid.
+func setupLogger(config Config) error {
+	l, err := newLogger(config, levels)
+	if err != nil {
+		return err
 	}
+	logger = l
+	return nil
+}
+
+// newLogger creates a logger using the logging configuration whose
+// messages are output at the levels in lv, which are set to the
+// configured levels.  It returns an error if the format or any level
+// is invalid.
+func newLogger(config Config, lv *logLevels) (*logrus.Entry, error) {
+	formatter, formatErr := newLogFormatter(config.LogFormat)
+	if formatErr != nil {
+		return nil, formatErr
+	}
+	l := logrus.New()
+	l.SetFormatter(&moduleFormatter{formatter: formatter, levels: lv})
 	fields := logrus.Fields{"service": Pkg}
 	if host, hostErr := os.Hostname(); hostErr == nil {
 		fields["host"] = host
 	}
-	logger = l.WithFields(fields)
+	lv.mu.Lock()
+	lv.logger = l
+	lv.mu.Unlock()
+	if err := lv.set(config.LogLevel, config.LogLevels); err != nil {
+		return nil, err
+	}
+	return l.WithFields(fields), nil
+}
+
+// newLogFormatter returns the logrus formatter for the log format.
+func newLogFormatter(format string) (logrus.Formatter, error) {
+	switch strings.ToLower(format) {
+	case "", LogFormatJSON:
+		return &logrus.JSONFormatter{}, nil
+	case LogFormatText:
+		return &logrus.TextFormatter{FullTimestamp: true, PadLevelText: true}, nil
+	case LogFormatLogfmt:
+		return &logrus.TextFormatter{DisableColors: true, FullTimestamp: true, QuoteEmptyFields: true}, nil
+	}
+	return nil, fmt.Errorf("invalid log format '%s', must be one of %s", format, strings.Join(LogFormats, ", "))
+}
+
+// parseLogLevel returns the logrus level for logLevel, info if it is
+// empty, or an error if it is not a valid level.
+func parseLogLevel(logLevel string) (logrus.Level, error) {
+	if logLevel == "" {
+		return logrus.InfoLevel, nil
+	}
+	level, err := logrus.ParseLevel(logLevel)
+	if err != nil {
+		return level, fmt.Errorf("invalid log level '%s'", logLevel)
+	}
+	return level, nil
+}
+
+// setLogLevels changes the level of the global logger and the levels
+// of its modules, returning an error and changing nothing if any
+// level is invalid.  Any runtime override is kept.
+func setLogLevels(logLevel string, moduleLevels map[string]string) error {
+	return levels.set(logLevel, moduleLevels)
+}
+
+// overrideLogLevel sets the level of all messages of the global
+// logger, ignoring the configured levels, until resetLogLevel is
+// called.
+func overrideLogLevel(level logrus.Level) {
+	levels.overrideLevel(level)
+}
+
+// resetLogLevel removes any override of the global logger, restoring
+// the configured levels.
+func resetLogLevel() {
+	levels.reset()
+}
+
+// set changes the level and the levels of modules, returning an error
+// and changing nothing if any level is invalid.  Any runtime override
+// is kept.
+func (l *logLevels) set(logLevel string, moduleLevels map[string]string) error {
+	level, levelErr := parseLogLevel(logLevel)
+	if levelErr != nil {
+		return levelErr
+	}
+	modules := map[string]logrus.Level{}
+	for module, moduleLevel := range moduleLevels {
+		ml, err := parseLogLevel(moduleLevel)
+		if err != nil {
+			return fmt.Errorf("module %s: %v", module, err)
+		}
+		modules[module] = ml
+	}
+	l.mu.Lock()
+	l.level = level
+	l.modules = modules
+	l.mu.Unlock()
+	l.apply()
+	return nil
+}
+
+// overrideLevel sets the level of all messages, ignoring the
+// configured levels, until reset is called.
+func (l *logLevels) overrideLevel(level logrus.Level) {
+	l.mu.Lock()
+	l.override = &level
+	l.mu.Unlock()
+	l.apply()
+}
+
+// reset removes any override, restoring the configured levels.
+func (l *logLevels) reset() {
+	l.mu.Lock()
+	l.override = nil
+	l.mu.Unlock()
+	l.apply()
+}
+
+// apply sets the level of the logger to the most verbose level of any
+// module so the module formatter sees every message that may be
+// output.
+func (l *logLevels) apply() {
+	max := l.max()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.logger != nil {
+		l.logger.SetLevel(max)
+	}
+}
+
+// changeLogLevelOnSignal makes the log level more verbose, up to
+// trace, every time k8svent receives SIGUSR1 and restores the
+// configured levels when it receives SIGUSR2.
+func changeLogLevelOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR2 {
+				resetLogLevel()
+				logger.Infof("Received %v, restored configured log levels", sig)
+				continue
+			}
+			level := levels.current()
+			if level < logrus.TraceLevel {
+				level++
+			}
+			overrideLogLevel(level)
+			logger.Infof("Received %v, changed log level to %s", sig, level)
+		}
+	}()
 }
@@ -0,0 +1,113 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSetupLogger(t *testing.T) {
+	defer resetLogLevel()
+
+	if err := setupLogger(Config{LogLevel: "loud"}); err == nil {
+		t.Error("invalid log level did not return error")
+	}
+	if err := setupLogger(Config{LogFormat: "xml"}); err == nil {
+		t.Error("invalid log format did not return error")
+	}
+	if err := setupLogger(Config{LogLevels: map[string]string{LogModuleDelivery: "loud"}}); err == nil {
+		t.Error("invalid module log level did not return error")
+	}
+
+	var out bytes.Buffer
+	if err := setupLogger(Config{LogFormat: LogFormatLogfmt}); err != nil {
+		t.Fatalf("failed to set up logfmt logger: %v", err)
+	}
+	logger.Logger.SetOutput(&out)
+	logger.WithField("pod", "ns/name").Info("Posted")
+	if line := out.String(); !strings.Contains(line, ` level=info msg=Posted `) || !strings.Contains(line, ` pod=ns/name `) {
+		t.Errorf("logfmt output not as expected: %s", line)
+	}
+
+	out.Reset()
+	if err := setupLogger(Config{}); err != nil {
+		t.Fatalf("failed to set up JSON logger: %v", err)
+	}
+	logger.Logger.SetOutput(&out)
+	logger.Info("Posted")
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Errorf("default output is not JSON: %v: %s", err, out.String())
+	} else if entry["msg"] != "Posted" || entry["service"] != Pkg {
+		t.Errorf("JSON output not as expected: %v", entry)
+	}
+}
+
+func TestModuleLogLevels(t *testing.T) {
+	defer func() {
+		resetLogLevel()
+		_ = setLogLevels("", nil)
+	}()
+
+	config := Config{LogLevel: "warn", LogLevels: map[string]string{LogModuleDelivery: "debug"}}
+	if err := setupLogger(config); err != nil {
+		t.Fatalf("failed to set up logger: %v", err)
+	}
+	var out bytes.Buffer
+	logger.Logger.SetOutput(&out)
+	if logger.Logger.GetLevel() != logrus.DebugLevel {
+		t.Errorf("logger level is not most verbose module level: %s", logger.Logger.GetLevel())
+	}
+
+	logMessages := func() string {
+		out.Reset()
+		logger.Debug("root debug")
+		logger.Warn("root warn")
+		moduleLogger(LogModuleDelivery).Debug("delivery debug")
+		moduleLogger(LogModuleDelivery).Trace("delivery trace")
+		moduleLogger(LogModulePods).Info("pods info")
+		var messages []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err == nil {
+				messages = append(messages, entry["msg"].(string))
+			}
+		}
+		return strings.Join(messages, ",")
+	}
+
+	if m := logMessages(); m != "root warn,delivery debug" {
+		t.Errorf("configured levels not applied: %s", m)
+	}
+	overrideLogLevel(logrus.TraceLevel)
+	if m := logMessages(); m != "root debug,root warn,delivery debug,delivery trace,pods info" {
+		t.Errorf("override level not applied: %s", m)
+	}
+	resetLogLevel()
+	if m := logMessages(); m != "root warn,delivery debug" {
+		t.Errorf("configured levels not restored: %s", m)
+	}
+	if err := setLogLevels("error", nil); err != nil {
+		t.Fatalf("failed to set log levels: %v", err)
+	}
+	if m := logMessages(); m != "" {
+		t.Errorf("changed levels not applied: %s", m)
+	}
+}
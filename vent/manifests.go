@@ -0,0 +1,513 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultManifestNamespace is the namespace k8svent is deployed in by
+// the rendered manifests if none is provided.
+const DefaultManifestNamespace = "k8svent"
+
+// Defaults for the resource requests and limits of the rendered
+// k8svent container.
+const (
+	DefaultManifestCPU    = "100m"
+	DefaultManifestMemory = "200Mi"
+)
+
+// manifestConfigDir is where the configuration Secret is mounted in
+// the rendered k8svent container.
+const manifestConfigDir = "/etc/k8svent"
+
+// manifestSpoolFile is the spool file of the rendered k8svent
+// container if the configuration provides none.  It is on the tmp
+// emptyDir volume, so the spool is lost when the pod is replaced.
+const manifestSpoolFile = "/tmp/k8svent-spool.json"
+
+// workspaceIDLabel is the label identifying the Atomist workspace
+// k8svent sends pods to.
+const workspaceIDLabel = "atomist.com/workspaceId"
+
+// ManifestOptions configure the deployment of k8svent rendered by
+// Manifests.  The configuration rendered into its Secret determines
+// the RBAC it is granted.
+type ManifestOptions struct {
+	// Namespace is the namespace k8svent is deployed in,
+	// DefaultManifestNamespace if empty.
+	Namespace string
+	// Image is the k8svent container image.  If empty, the update
+	// image is used or, if none is configured, DefaultImage.
+	Image string
+	// WorkspaceID, if not empty, is added to the resources as the
+	// atomist.com/workspaceId label.
+	WorkspaceID string
+	// CPU is the CPU request and limit of the container,
+	// DefaultManifestCPU if empty.
+	CPU string
+	// Memory is the memory request and limit of the container,
+	// DefaultManifestMemory if empty.
+	Memory string
+	// VentSinks grants access to VentSink resources.  VentSinks are
+	// cluster-scoped, so they are only available when pods in all
+	// namespaces are watched.
+	VentSinks bool
+}
+
+// sourceRules are the rules each source needs in the namespaces it
+// watches.  Watching a new kind of resource requires adding it here.
+// Pods are listed every cycle rather than watched, and the send
+// command gets them.
+var sourceRules = map[string][]rbacv1.PolicyRule{
+	PodSource: {{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list"}}},
+}
+
+// manifestGrant is a rule granted to k8svent in namespace or, if
+// namespace is empty, in all namespaces.
+type manifestGrant struct {
+	namespace string
+	rule      rbacv1.PolicyRule
+}
+
+// Manifests writes the Namespace, ServiceAccount, RBAC, Secret, and
+// Deployment resources running k8svent with config to out as YAML.
+// The configuration, and the encryption and verification keys it
+// refers to, are rendered into the Secret, which the Deployment mounts
+// as its configuration file.  The RBAC grants exactly what the
+// enabled features need: cluster-wide if config watches all
+// namespaces, otherwise only in the watched namespace.
+func Manifests(config Config, opts ManifestOptions, out io.Writer) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = DefaultManifestNamespace
+	}
+	if opts.Image == "" {
+		opts.Image = config.Update.Image
+	}
+	if opts.Image == "" {
+		opts.Image = DefaultImage + ":latest"
+	}
+	if opts.CPU == "" {
+		opts.CPU = DefaultManifestCPU
+	}
+	if opts.Memory == "" {
+		opts.Memory = DefaultManifestMemory
+	}
+
+	secret, secretErr := manifestSecret(config, opts)
+	if secretErr != nil {
+		return secretErr
+	}
+	deployment, deploymentErr := manifestDeployment(config, opts)
+	if deploymentErr != nil {
+		return deploymentErr
+	}
+	resources := []interface{}{
+		&v1.Namespace{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+			ObjectMeta: metav1.ObjectMeta{Name: opts.Namespace, Labels: manifestLabels(opts, "namespace")},
+		},
+		&v1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: manifestMeta(opts, "service-account", opts.Namespace),
+		},
+	}
+	resources = append(resources, manifestRBAC(opts, rbacGrants(config, opts))...)
+	resources = append(resources, secret, deployment)
+
+	for i, r := range resources {
+		doc, docErr := manifestYAML(r)
+		if docErr != nil {
+			return docErr
+		}
+		if i > 0 {
+			if _, err := io.WriteString(out, "---\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := out.Write(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manifestMeta returns the metadata of a k8svent resource.
+func manifestMeta(opts ManifestOptions, component string, namespace string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      Pkg,
+		Namespace: namespace,
+		Labels:    manifestLabels(opts, component),
+	}
+}
+
+// manifestLabels returns the labels of a k8svent resource.
+func manifestLabels(opts ManifestOptions, component string) map[string]string {
+	labels := map[string]string{
+		"app.kubernetes.io/component": component,
+		"app.kubernetes.io/name":      Pkg,
+		"app.kubernetes.io/part-of":   Pkg,
+	}
+	if opts.WorkspaceID != "" {
+		labels[workspaceIDLabel] = opts.WorkspaceID
+	}
+	return labels
+}
+
+// rbacGrants returns the rules k8svent needs to run with config.
+func rbacGrants(config Config, opts ManifestOptions) []manifestGrant {
+	var grants []manifestGrant
+	grant := func(namespace string, group string, resource string, names []string, verbs ...string) {
+		grants = append(grants, manifestGrant{namespace: namespace, rule: rbacv1.PolicyRule{
+			APIGroups:     []string{group},
+			Resources:     []string{resource},
+			ResourceNames: names,
+			Verbs:         verbs,
+		}})
+	}
+
+	watched := config.Namespace
+	sources := config.Sources
+	if len(sources) == 0 {
+		sources = []string{PodSource}
+	}
+	for _, source := range sources {
+		for _, rule := range sourceRules[source] {
+			grants = append(grants, manifestGrant{namespace: watched, rule: rule})
+		}
+	}
+
+	// Kubernetes events are recorded about the k8svent pod.
+	grant(opts.Namespace, "", "events", nil, "create", "patch")
+	if watched != "" && watched != opts.Namespace {
+		grant(opts.Namespace, "", "pods", nil, "get")
+	}
+
+	if !config.IgnoreAnnotations && watched == "" {
+		// Reading a namespace requires a cluster role, so namespace
+		// annotations are only used when watching all namespaces.
+		grant("", "", "namespaces", nil, "list")
+	}
+	sinks := opts.VentSinks && watched == ""
+	if sinks {
+		grant("", VentSinkResource.Group, VentSinkResource.Resource, nil, "list", "watch")
+		grant("", VentSinkResource.Group, VentSinkResource.Resource+"/status", nil, "update")
+	}
+	// Webhook secrets are only read in the namespaces that opt in,
+	// and only the one secret annotations may reference.
+	if !config.IgnoreAnnotations || sinks {
+		for _, ns := range config.WebhookSecretNamespaces {
+			grant(ns, "", "secrets", []string{WebhookSecretName}, "get")
+		}
+	}
+
+	if config.Update.Policy != UpdatePolicyOff && config.Update.PullSecret != "" {
+		if ns, name, err := parsePullSecretRef(config.Update.PullSecret, opts.Namespace); err == nil {
+			grant(ns, "", "secrets", []string{name}, "get")
+		}
+	}
+	return grants
+}
+
+// manifestRBAC returns a ClusterRole and ClusterRoleBinding for the
+// cluster-wide grants and a Role and RoleBinding for the grants in
+// each namespace.
+func manifestRBAC(opts ManifestOptions, grants []manifestGrant) []interface{} {
+	var namespaces []string
+	rules := map[string][]rbacv1.PolicyRule{}
+	for _, g := range grants {
+		if _, ok := rules[g.namespace]; !ok {
+			namespaces = append(namespaces, g.namespace)
+		}
+		rules[g.namespace] = mergeRule(rules[g.namespace], g.rule)
+	}
+
+	subjects := []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: Pkg, Namespace: opts.Namespace}}
+	var resources []interface{}
+	for _, ns := range namespaces {
+		if ns == "" {
+			resources = append(resources,
+				&rbacv1.ClusterRole{
+					TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+					ObjectMeta: manifestMeta(opts, "role", ""),
+					Rules:      rules[ns],
+				},
+				&rbacv1.ClusterRoleBinding{
+					TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+					ObjectMeta: manifestMeta(opts, "role-binding", ""),
+					RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: Pkg},
+					Subjects:   subjects,
+				},
+			)
+			continue
+		}
+		resources = append(resources,
+			&rbacv1.Role{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+				ObjectMeta: manifestMeta(opts, "role", ns),
+				Rules:      rules[ns],
+			},
+			&rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+				ObjectMeta: manifestMeta(opts, "role-binding", ns),
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: Pkg},
+				Subjects:   subjects,
+			},
+		)
+	}
+	return resources
+}
+
+// mergeRule adds the verbs of rule to the rule in rules for the same
+// resources, or appends rule if there is none.
+func mergeRule(rules []rbacv1.PolicyRule, rule rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	key := func(r rbacv1.PolicyRule) string {
+		k, _ := json.Marshal([][]string{r.APIGroups, r.Resources, r.ResourceNames})
+		return string(k)
+	}
+	for i, r := range rules {
+		if key(r) != key(rule) {
+			continue
+		}
+		verbs := map[string]bool{}
+		for _, verb := range r.Verbs {
+			verbs[verb] = true
+		}
+		for _, verb := range rule.Verbs {
+			if !verbs[verb] {
+				rules[i].Verbs = append(rules[i].Verbs, verb)
+			}
+		}
+		return rules
+	}
+	return append(rules, rule)
+}
+
+// manifestSecret returns the Secret containing the configuration and
+// the keys it refers to, with the paths of the keys changed to where
+// the Secret is mounted.
+func manifestSecret(config Config, opts ManifestOptions) (*v1.Secret, error) {
+	data := map[string]string{}
+	addFile := func(key string, file string) (string, error) {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		data[key] = string(content)
+		return path.Join(manifestConfigDir, key), nil
+	}
+
+	webhooks := make([]Webhook, len(config.Webhooks))
+	copy(webhooks, config.Webhooks)
+	config.Webhooks = webhooks
+	for i, hook := range config.Webhooks {
+		if hook.EncryptionKey == "" {
+			continue
+		}
+		file, err := addFile(fmt.Sprintf("encryption-key-%d.pem", i), hook.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Webhooks[i].EncryptionKey = file
+	}
+	if config.Update.PublicKey != "" {
+		file, err := addFile("cosign.pub", config.Update.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Update.PublicKey = file
+	}
+	if config.SpoolFile == "" {
+		config.SpoolFile = manifestSpoolFile
+	}
+	configYAML, yamlErr := yaml.Marshal(config)
+	if yamlErr != nil {
+		return nil, fmt.Errorf("failed to render configuration: %v", yamlErr)
+	}
+	data["config.yaml"] = string(configYAML)
+
+	return &v1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: manifestMeta(opts, "secret", opts.Namespace),
+		Type:       v1.SecretTypeOpaque,
+		StringData: data,
+	}, nil
+}
+
+// manifestDeployment returns the Deployment running k8svent with the
+// configuration in its Secret.
+func manifestDeployment(config Config, opts ManifestOptions) (*appsv1.Deployment, error) {
+	cpu, cpuErr := resource.ParseQuantity(opts.CPU)
+	if cpuErr != nil {
+		return nil, fmt.Errorf("invalid CPU '%s': %v", opts.CPU, cpuErr)
+	}
+	memory, memoryErr := resource.ParseQuantity(opts.Memory)
+	if memoryErr != nil {
+		return nil, fmt.Errorf("invalid memory '%s': %v", opts.Memory, memoryErr)
+	}
+	listen := config.Listen
+	if listen == "" {
+		listen = DefaultListen
+	}
+	_, portString, splitErr := net.SplitHostPort(listen)
+	if splitErr != nil {
+		return nil, fmt.Errorf("invalid listen address '%s': %v", listen, splitErr)
+	}
+	port, portErr := strconv.Atoi(portString)
+	if portErr != nil {
+		return nil, fmt.Errorf("invalid listen port '%s': %v", portString, portErr)
+	}
+
+	selector := map[string]string{"app.kubernetes.io/name": Pkg}
+	if opts.WorkspaceID != "" {
+		selector[workspaceIDLabel] = opts.WorkspaceID
+	}
+	replicas := int32(1)
+	maxSurge := intstr.FromInt(1)
+	maxUnavailable := intstr.FromInt(0)
+	falseValue := false
+	trueValue := true
+	id := int64(2866)
+	gracePeriod := int64(30)
+	fieldEnv := func(name string, fieldPath string) v1.EnvVar {
+		return v1.EnvVar{Name: name, ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: fieldPath}}}
+	}
+	probe := func(path string, initialDelay int32, period int32) *v1.Probe {
+		return &v1.Probe{
+			Handler:             v1.Handler{HTTPGet: &v1.HTTPGetAction{Path: path, Port: intstr.FromString("http")}},
+			InitialDelaySeconds: initialDelay,
+			PeriodSeconds:       period,
+			TimeoutSeconds:      5,
+			FailureThreshold:    3,
+		}
+	}
+	resources := v1.ResourceList{v1.ResourceCPU: cpu, v1.ResourceMemory: memory}
+
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "Deployment"},
+		ObjectMeta: manifestMeta(opts, "application", opts.Namespace),
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: selector},
+			Strategy: appsv1.DeploymentStrategy{
+				Type:          appsv1.RollingUpdateDeploymentStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateDeployment{MaxSurge: &maxSurge, MaxUnavailable: &maxUnavailable},
+			},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"prometheus.io/port":   portString,
+						"prometheus.io/scrape": "true",
+					},
+					Labels: manifestLabels(opts, "application"),
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  Pkg,
+						Image: opts.Image,
+						Args:  []string{"--config=" + path.Join(manifestConfigDir, "config.yaml")},
+						Env: []v1.EnvVar{
+							fieldEnv(podNameEnv, "metadata.name"),
+							fieldEnv(podNamespaceEnv, "metadata.namespace"),
+							{Name: "TMPDIR", Value: "/tmp"},
+						},
+						ImagePullPolicy: v1.PullAlways,
+						LivenessProbe:   probe("/healthz", 10, 30),
+						ReadinessProbe:  probe("/readyz", 0, 10),
+						Ports:           []v1.ContainerPort{{Name: "http", ContainerPort: int32(port), Protocol: v1.ProtocolTCP}},
+						Resources:       v1.ResourceRequirements{Limits: resources, Requests: resources},
+						SecurityContext: &v1.SecurityContext{
+							AllowPrivilegeEscalation: &falseValue,
+							Privileged:               &falseValue,
+							ReadOnlyRootFilesystem:   &trueValue,
+						},
+						VolumeMounts: []v1.VolumeMount{
+							{Name: "config", MountPath: manifestConfigDir, ReadOnly: true},
+							{Name: "tmp", MountPath: "/tmp"},
+						},
+					}},
+					SecurityContext: &v1.PodSecurityContext{
+						FSGroup:      &id,
+						RunAsGroup:   &id,
+						RunAsNonRoot: &trueValue,
+						RunAsUser:    &id,
+					},
+					ServiceAccountName:            Pkg,
+					TerminationGracePeriodSeconds: &gracePeriod,
+					Volumes: []v1.Volume{
+						{Name: "config", VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: Pkg}}},
+						{Name: "tmp", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// manifestYAML renders the resource as YAML, omitting the empty
+// creation timestamps, specs, and statuses Kubernetes types marshal.
+func manifestYAML(r interface{}) ([]byte, error) {
+	j, jsonErr := json.Marshal(r)
+	if jsonErr != nil {
+		return nil, fmt.Errorf("failed to render resource: %v", jsonErr)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(j, &obj); err != nil {
+		return nil, fmt.Errorf("failed to render resource: %v", err)
+	}
+	pruneManifest(obj)
+	return yaml.Marshal(obj)
+}
+
+// pruneManifest removes null creation timestamps and empty specs and
+// statuses from obj and the objects it contains.
+func pruneManifest(obj map[string]interface{}) {
+	for k, value := range obj {
+		switch val := value.(type) {
+		case nil:
+			if k == "creationTimestamp" {
+				delete(obj, k)
+			}
+		case map[string]interface{}:
+			pruneManifest(val)
+			if (k == "spec" || k == "status") && len(val) == 0 {
+				delete(obj, k)
+			}
+		case []interface{}:
+			for _, item := range val {
+				if m, ok := item.(map[string]interface{}); ok {
+					pruneManifest(m)
+				}
+			}
+		}
+	}
+}
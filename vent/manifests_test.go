@@ -0,0 +1,394 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+// manifestDocs renders the manifests and returns each resource as
+// "Kind namespace/name" mapped to its YAML.
+func manifestDocs(t *testing.T, config Config, opts ManifestOptions) ([]string, map[string][]byte) {
+	var out bytes.Buffer
+	if err := Manifests(config, opts, &out); err != nil {
+		t.Fatalf("failed to render manifests: %v", err)
+	}
+	var names []string
+	docs := map[string][]byte{}
+	for _, doc := range strings.Split(out.String(), "\n---\n") {
+		var meta struct {
+			Kind     string `json:"kind"`
+			Metadata struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+		}
+		if err := yaml.Unmarshal([]byte(doc), &meta); err != nil {
+			t.Fatalf("failed to parse manifest: %v\n%s", err, doc)
+		}
+		name := fmt.Sprintf("%s %s/%s", meta.Kind, meta.Metadata.Namespace, meta.Metadata.Name)
+		names = append(names, name)
+		docs[name] = []byte(doc)
+	}
+	return names, docs
+}
+
+// manifestRules returns the rules of the Role or ClusterRole.
+func manifestRules(t *testing.T, doc []byte) []rbacv1.PolicyRule {
+	var role rbacv1.ClusterRole
+	if err := yaml.Unmarshal(doc, &role); err != nil {
+		t.Fatalf("failed to parse role: %v", err)
+	}
+	return role.Rules
+}
+
+func TestManifests(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "k8svent-manifests")
+	if dirErr != nil {
+		t.Fatalf("failed to create temporary directory: %v", dirErr)
+	}
+	defer os.RemoveAll(dir)
+	key, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("failed to generate key: %v", keyErr)
+	}
+	keyFile := writePublicKey(t, dir, "cosign.pub", key.Public())
+
+	t.Run("cluster-wide", func(t *testing.T) {
+		config := Config{
+			Webhooks:                []Webhook{{URL: "https://example.com/hook"}},
+			WebhookSecretNamespaces: []string{"my-team"},
+			Update:                  Update{PullSecret: "regcred", PublicKey: keyFile},
+		}
+		names, docs := manifestDocs(t, config, ManifestOptions{WorkspaceID: "T29E48P34", VentSinks: true})
+		expected := []string{
+			"Namespace /k8svent",
+			"ServiceAccount k8svent/k8svent",
+			"ClusterRole /k8svent",
+			"ClusterRoleBinding /k8svent",
+			"Role k8svent/k8svent",
+			"RoleBinding k8svent/k8svent",
+			"Role my-team/k8svent",
+			"RoleBinding my-team/k8svent",
+			"Secret k8svent/k8svent",
+			"Deployment k8svent/k8svent",
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Fatalf("resources %v rather than %v", names, expected)
+		}
+		clusterRules := manifestRules(t, docs["ClusterRole /k8svent"])
+		expectedRules := []rbacv1.PolicyRule{
+			{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list"}},
+			{APIGroups: []string{""}, Resources: []string{"namespaces"}, Verbs: []string{"list"}},
+			{APIGroups: []string{"k8svent.atomist.com"}, Resources: []string{"ventsinks"}, Verbs: []string{"list", "watch"}},
+			{APIGroups: []string{"k8svent.atomist.com"}, Resources: []string{"ventsinks/status"}, Verbs: []string{"update"}},
+		}
+		if !reflect.DeepEqual(clusterRules, expectedRules) {
+			t.Errorf("cluster rules not as expected: %+v", clusterRules)
+		}
+		rules := manifestRules(t, docs["Role k8svent/k8svent"])
+		expectedRules = []rbacv1.PolicyRule{
+			{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"create", "patch"}},
+			{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"regcred"}, Verbs: []string{"get"}},
+		}
+		if !reflect.DeepEqual(rules, expectedRules) {
+			t.Errorf("namespace rules not as expected: %+v", rules)
+		}
+		rules = manifestRules(t, docs["Role my-team/k8svent"])
+		expectedRules = []rbacv1.PolicyRule{
+			{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{WebhookSecretName}, Verbs: []string{"get"}},
+		}
+		if !reflect.DeepEqual(rules, expectedRules) {
+			t.Errorf("webhook secret rules not as expected: %+v", rules)
+		}
+
+		var secret v1.Secret
+		if err := yaml.Unmarshal(docs["Secret k8svent/k8svent"], &secret); err != nil {
+			t.Fatalf("failed to parse secret: %v", err)
+		}
+		var rendered Config
+		if err := yaml.Unmarshal([]byte(secret.StringData["config.yaml"]), &rendered); err != nil {
+			t.Fatalf("failed to parse rendered configuration: %v", err)
+		}
+		if rendered.Update.PublicKey != "/etc/k8svent/cosign.pub" || rendered.SpoolFile != "/tmp/k8svent-spool.json" ||
+			len(rendered.Webhooks) != 1 || !strings.Contains(secret.StringData["cosign.pub"], "PUBLIC KEY") {
+			t.Errorf("secret not as expected: %+v", secret.StringData)
+		}
+
+		var deployment appsv1.Deployment
+		if err := yaml.Unmarshal(docs["Deployment k8svent/k8svent"], &deployment); err != nil {
+			t.Fatalf("failed to parse deployment: %v", err)
+		}
+		container := deployment.Spec.Template.Spec.Containers[0]
+		if container.Image != "atomist/k8svent:latest" || container.Args[0] != "--config=/etc/k8svent/config.yaml" ||
+			deployment.Spec.Selector.MatchLabels[workspaceIDLabel] != "T29E48P34" {
+			t.Errorf("deployment not as expected: %+v", deployment)
+		}
+	})
+
+	t.Run("namespaced", func(t *testing.T) {
+		config := Config{
+			Namespace:         "wilco",
+			IgnoreAnnotations: true,
+			Listen:            ":9090",
+			Update:            Update{Image: "ghcr.io/atomist/k8svent:1.2", PullSecret: "regcred"},
+		}
+		names, docs := manifestDocs(t, config, ManifestOptions{Namespace: "vent", CPU: "50m", VentSinks: true})
+		expected := []string{
+			"Namespace /vent",
+			"ServiceAccount vent/k8svent",
+			"Role wilco/k8svent",
+			"RoleBinding wilco/k8svent",
+			"Role vent/k8svent",
+			"RoleBinding vent/k8svent",
+			"Secret vent/k8svent",
+			"Deployment vent/k8svent",
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Fatalf("resources %v rather than %v", names, expected)
+		}
+		rules := manifestRules(t, docs["Role wilco/k8svent"])
+		expectedRules := []rbacv1.PolicyRule{
+			{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list"}},
+		}
+		if !reflect.DeepEqual(rules, expectedRules) {
+			t.Errorf("watched namespace rules not as expected: %+v", rules)
+		}
+		rules = manifestRules(t, docs["Role vent/k8svent"])
+		expectedRules = []rbacv1.PolicyRule{
+			{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"create", "patch"}},
+			{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}},
+			{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"regcred"}, Verbs: []string{"get"}},
+		}
+		if !reflect.DeepEqual(rules, expectedRules) {
+			t.Errorf("deployment namespace rules not as expected: %+v", rules)
+		}
+
+		var binding rbacv1.RoleBinding
+		if err := yaml.Unmarshal(docs["RoleBinding wilco/k8svent"], &binding); err != nil {
+			t.Fatalf("failed to parse role binding: %v", err)
+		}
+		if binding.Subjects[0].Namespace != "vent" || binding.RoleRef.Kind != "Role" {
+			t.Errorf("role binding not as expected: %+v", binding)
+		}
+		var deployment appsv1.Deployment
+		if err := yaml.Unmarshal(docs["Deployment vent/k8svent"], &deployment); err != nil {
+			t.Fatalf("failed to parse deployment: %v", err)
+		}
+		container := deployment.Spec.Template.Spec.Containers[0]
+		if container.Image != "ghcr.io/atomist/k8svent:1.2" || container.Ports[0].ContainerPort != 9090 ||
+			container.Resources.Limits.Cpu().String() != "50m" || container.Resources.Requests.Memory().String() != "200Mi" {
+			t.Errorf("container not as expected: %+v", container)
+		}
+	})
+
+	for _, tt := range []struct {
+		name   string
+		config Config
+		opts   ManifestOptions
+	}{
+		{name: "invalid config", config: Config{LogLevel: "loud"}},
+		{name: "invalid CPU", opts: ManifestOptions{CPU: "lots"}},
+		{name: "missing key", config: Config{Webhooks: []Webhook{{URL: "https://example.com/hook", EncryptionKey: dir + "/none.pem"}}}},
+	} {
+		if err := Manifests(tt.config, tt.opts, ioutil.Discard); err == nil {
+			t.Errorf("rendering manifests with %s did not fail", tt.name)
+		}
+	}
+}
+
+// ruleAllows returns true if any of rules allows verb on the resource
+// of the API group named name.
+func ruleAllows(rules []rbacv1.PolicyRule, verb string, group string, resource string, name string) bool {
+	contains := func(values []string, value string) bool {
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rule := range rules {
+		if contains(rule.APIGroups, group) && contains(rule.Resources, resource) && contains(rule.Verbs, verb) &&
+			(len(rule.ResourceNames) == 0 || contains(rule.ResourceNames, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestManifestRulesMatchAPICalls(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "manifests")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	defer os.Unsetenv(podNameEnv)
+	defer os.Unsetenv(podNamespaceEnv)
+	os.Setenv(podNameEnv, "k8svent-0")
+	os.Setenv(podNamespaceEnv, DefaultManifestNamespace)
+
+	for _, tt := range []struct {
+		name   string
+		config Config
+		// denied are the calls k8svent makes but is not granted,
+		// whose failure is tolerated.
+		denied []string
+	}{
+		{
+			name:   "cluster-wide",
+			config: Config{WebhookSecretNamespaces: []string{"wilco"}, Update: Update{PullSecret: "regcred"}},
+		},
+		{
+			name:   "namespaced",
+			config: Config{Namespace: "wilco", WebhookSecretNamespaces: []string{"wilco"}, Update: Update{PullSecret: "regcred"}},
+			// namespace annotations need a cluster role
+			denied: []string{"get namespaces wilco"},
+		},
+		{
+			name:   "namespaced without annotations",
+			config: Config{Namespace: "wilco", IgnoreAnnotations: true, Update: Update{Policy: UpdatePolicyNotify}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.Webhooks = []Webhook{{URL: server.URL + "/webhook"}}
+			_, docs := manifestDocs(t, config, ManifestOptions{})
+			clusterRules := manifestRules(t, docs["ClusterRole /k8svent"])
+			namespaceRules := func(namespace string) []rbacv1.PolicyRule {
+				if doc, ok := docs["Role "+namespace+"/k8svent"]; ok {
+					return manifestRules(t, doc)
+				}
+				return nil
+			}
+
+			clientset := fake.NewSimpleClientset(
+				&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "wilco"}},
+				&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "wilco", Name: "jeff"}},
+				&v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Namespace: DefaultManifestNamespace, Name: "k8svent-0"},
+					Spec:       v1.PodSpec{Containers: []v1.Container{{Name: Pkg, Image: DefaultImage + ":latest"}}},
+				},
+				&v1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "wilco", Name: WebhookSecretName},
+					Data:       map[string][]byte{"secret": []byte("Wilco")},
+				},
+				&v1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: DefaultManifestNamespace, Name: "regcred"},
+					Data:       map[string][]byte{v1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+				},
+			)
+
+			// the API calls of a cycle, the send command, events, and
+			// checking for a new release
+			ctx := context.Background()
+			if _, err := listPods(ctx, clientset, config.Namespace, ""); err != nil {
+				t.Errorf("failed to list pods: %v", err)
+			}
+			router := newWebhookRouter(clientset, config, nil, nil)
+			if !config.IgnoreAnnotations {
+				if _, err := router.readSecret(secretRef{namespace: "wilco", name: WebhookSecretName, key: "secret"}); err != nil {
+					t.Errorf("failed to read secret: %v", err)
+				}
+			}
+			v := newVenter()
+			if err := v.setConfig(config); err != nil {
+				t.Fatalf("failed to set configuration: %v", err)
+			}
+			if _, err := v.send(ctx, clientset, nil, "wilco/jeff", false); err != nil {
+				t.Errorf("failed to send pod: %v", err)
+			}
+			if ref := selfReference(clientset); ref == nil {
+				t.Error("failed to get k8svent pod")
+			}
+			if config.Update.PullSecret != "" {
+				if _, err := readPullSecret(clientset, config.Update.PullSecret, selfNamespace(), "docker.io"); err != nil {
+					t.Errorf("failed to read pull secret: %v", err)
+				}
+			}
+
+			var denied []string
+			used := map[string]bool{}
+			for _, action := range clientset.Actions() {
+				resource := action.GetResource()
+				name := ""
+				switch a := action.(type) {
+				case k8stesting.GetAction:
+					name = a.GetName()
+				case k8stesting.PatchAction:
+					name = a.GetName()
+				}
+				namespace := action.GetNamespace()
+				used[action.GetVerb()+" "+resource.Resource+" "+namespace] = true
+				used[action.GetVerb()+" "+resource.Resource+" *"] = true
+				if !ruleAllows(clusterRules, action.GetVerb(), resource.Group, resource.Resource, name) &&
+					!ruleAllows(namespaceRules(namespace), action.GetVerb(), resource.Group, resource.Resource, name) {
+					call := action.GetVerb() + " " + resource.Resource + " " + strings.Trim(namespace+"/"+name, "/")
+					if len(denied) == 0 || denied[len(denied)-1] != call {
+						denied = append(denied, call)
+					}
+				}
+			}
+			if !reflect.DeepEqual(denied, tt.denied) {
+				t.Errorf("API calls %v not granted rather than %v", denied, tt.denied)
+			}
+
+			// events are recorded by a broadcaster, not exercised here
+			for doc, rules := range map[string][]rbacv1.PolicyRule{
+				"ClusterRole /k8svent": clusterRules,
+				"Role wilco/k8svent":   namespaceRules("wilco"),
+				"Role k8svent/k8svent": namespaceRules(DefaultManifestNamespace),
+			} {
+				namespace := "*"
+				if strings.HasPrefix(doc, "Role ") {
+					namespace = strings.Split(strings.TrimPrefix(doc, "Role "), "/")[0]
+				}
+				for _, rule := range rules {
+					for _, resource := range rule.Resources {
+						if resource == "events" {
+							continue
+						}
+						for _, verb := range rule.Verbs {
+							if !used[verb+" "+resource+" "+namespace] {
+								t.Errorf("%s grants %s %s, which is never used", doc, verb, resource)
+							}
+						}
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the delivery
+// latency histogram buckets.  Deliveries include retries, so the
+// buckets extend to the maximum retry time.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+
+// Results of the release check.  A release is available if it was
+// detected but not installed because of the update policy and
+// unverified if it does not have a valid signature.
+const (
+	releaseCurrent    = "current"
+	releaseUpdated    = "updated"
+	releaseAvailable  = "available"
+	releaseUnverified = "unverified"
+	releaseError      = "error"
+)
+
+// releaseResults are the results of the release check.
+var releaseResults = []string{releaseCurrent, releaseUpdated, releaseAvailable, releaseUnverified, releaseError}
+
+// histogram is a cumulative histogram of observations.  It is not
+// safe for concurrent use.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// observe adds the value to the histogram.
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// merge adds the observations in o to the histogram.
+func (h *histogram) merge(o histogram) {
+	if o.counts == nil {
+		return
+	}
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+// buckets returns the cumulative count of each bucket by upper bound.
+func (h histogram) buckets() map[float64]uint64 {
+	buckets := make(map[float64]uint64, len(latencyBuckets))
+	for i, bound := range latencyBuckets {
+		if h.counts != nil {
+			buckets[bound] = h.counts[i]
+		} else {
+			buckets[bound] = 0
+		}
+	}
+	return buckets
+}
+
+// ventMetrics holds the metrics not specific to a webhook endpoint and
+// the state the health checks use.  It is safe for concurrent use and
+// all methods can be called on a nil ventMetrics.
+type ventMetrics struct {
+	mu            sync.Mutex
+	started       time.Time
+	lastListError string
+	lastAttempt   time.Time
+	lastCycle     time.Time
+
+	buildInfo        *prometheus.GaugeVec
+	podsObserved     prometheus.Gauge
+	podsProcessed    *prometheus.CounterVec
+	listErrors       prometheus.Counter
+	sinceLastCycle   prometheus.GaugeFunc
+	releaseChecks    *prometheus.CounterVec
+	releaseSuccess   prometheus.Gauge
+	releaseCheckTime prometheus.Gauge
+}
+
+// newVentMetrics creates empty metrics.
+func newVentMetrics() *ventMetrics {
+	m := &ventMetrics{
+		started: time.Now(),
+		buildInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "k8svent_build_info",
+			Help: "Version of k8svent.",
+		}, []string{"version"}),
+		podsObserved: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "k8svent_pods_observed",
+			Help: "Number of pods observed in the last cycle.",
+		}),
+		podsProcessed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "k8svent_pods_processed_total",
+			Help: "Number of pods processed by event.",
+		}, []string{"event"}),
+		listErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "k8svent_list_errors_total",
+			Help: "Number of failures to list pods.",
+		}),
+		releaseChecks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "k8svent_release_checks_total",
+			Help: "Number of checks for a new release by result.",
+		}, []string{"result"}),
+		releaseSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "k8svent_release_check_success",
+			Help: "Whether the last check for a new release succeeded.",
+		}),
+		releaseCheckTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "k8svent_release_check_timestamp_seconds",
+			Help: "Unix time of the last check for a new release.",
+		}),
+	}
+	m.sinceLastCycle = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "k8svent_seconds_since_last_successful_cycle",
+		Help: "Seconds since pods were last listed and processed, -1 if they never have been.",
+	}, m.secondsSinceLastCycle)
+	m.buildInfo.WithLabelValues(Version).Set(1)
+	// export zeros for every label value before they are counted
+	for _, event := range PodEvents {
+		m.podsProcessed.WithLabelValues(string(event))
+	}
+	for _, result := range releaseResults {
+		m.releaseChecks.WithLabelValues(result)
+	}
+	return m
+}
+
+// collectors returns the Prometheus collectors of the metrics.
+func (m *ventMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.buildInfo, m.podsObserved, m.podsProcessed, m.listErrors, m.sinceLastCycle,
+		m.releaseChecks, m.releaseSuccess, m.releaseCheckTime,
+	}
+}
+
+// secondsSinceLastCycle returns the seconds since the last successful
+// cycle, -1 if there has been none.
+func (m *ventMetrics) secondsSinceLastCycle() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lastCycle.IsZero() {
+		return -1
+	}
+	return time.Since(m.lastCycle).Seconds()
+}
+
+// cycle records a successful cycle that observed the provided number
+// of pods.
+func (m *ventMetrics) cycle(observed int) {
+	if m == nil {
+		return
+	}
+	m.podsObserved.Set(float64(observed))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastCycle = time.Now()
+	m.lastAttempt = m.lastCycle
+	m.lastListError = ""
+}
+
+// processed records that a pod was processed for event.
+func (m *ventMetrics) processed(event PodEvent) {
+	if m == nil {
+		return
+	}
+	m.podsProcessed.WithLabelValues(string(event)).Inc()
+}
+
+// listError records a failure to list pods.
+func (m *ventMetrics) listError(err error) {
+	if m == nil {
+		return
+	}
+	m.listErrors.Inc()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastListError = err.Error()
+	m.lastAttempt = time.Now()
+}
+
+// releaseCheck records the result of a release check.
+func (m *ventMetrics) releaseCheck(result string) {
+	if m == nil {
+		return
+	}
+	m.releaseChecks.WithLabelValues(result).Inc()
+	m.releaseCheckTime.SetToCurrentTime()
+	if result == releaseError {
+		m.releaseSuccess.Set(0)
+	} else {
+		m.releaseSuccess.Set(1)
+	}
+}
+
+// newMetricsRegistry returns a registry with the metrics, the state
+// of the endpoints, and the Go runtime and process metrics.
+func newMetricsRegistry(m *ventMetrics, endpoints *endpointRegistry) *prometheus.Registry {
+	if m == nil {
+		m = newVentMetrics()
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m.collectors()...)
+	registry.MustRegister(
+		newEndpointCollector(endpoints),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return registry
+}
+
+// metricsHandler serves the metrics and the state of the endpoints in
+// the Prometheus exposition format.  Errors gathering or writing the
+// metrics are logged using log, the global logger if nil.
+func metricsHandler(m *ventMetrics, endpoints *endpointRegistry, log *logrus.Entry) http.Handler {
+	return promhttp.HandlerFor(newMetricsRegistry(m, endpoints), promhttp.HandlerOpts{ErrorLog: metricsErrorLog{log: log}})
+}
+
+// metricsErrorLog logs errors gathering or writing metrics to the
+// server log module.
+type metricsErrorLog struct {
+	log *logrus.Entry
+}
+
+// Println logs v as a warning.
+func (l metricsErrorLog) Println(v ...interface{}) {
+	entryLogger(l.log, LogModuleServer).Warnln(v...)
+}
+
+// endpointCollector collects the state of the webhook endpoints when
+// the metrics are scraped.
+type endpointCollector struct {
+	endpoints *endpointRegistry
+	sent      *prometheus.Desc
+	failed    *prometheus.Desc
+	retries   *prometheus.Desc
+	queue     *prometheus.Desc
+	latency   *prometheus.Desc
+}
+
+// newEndpointCollector creates a collector of the state of endpoints.
+func newEndpointCollector(endpoints *endpointRegistry) *endpointCollector {
+	labels := []string{"endpoint"}
+	return &endpointCollector{
+		endpoints: endpoints,
+		sent:      prometheus.NewDesc("k8svent_webhook_sent_total", "Number of payloads delivered to the endpoint.", labels, nil),
+		failed:    prometheus.NewDesc("k8svent_webhook_failed_total", "Number of payloads that could not be delivered to the endpoint.", labels, nil),
+		retries:   prometheus.NewDesc("k8svent_webhook_retries_total", "Number of retried attempts to deliver payloads to the endpoint.", labels, nil),
+		queue:     prometheus.NewDesc("k8svent_webhook_queue_depth", "Number of deliveries to the endpoint not yet completed.", labels, nil),
+		latency:   prometheus.NewDesc("k8svent_webhook_delivery_duration_seconds", "Time to deliver a payload to the endpoint, including retries.", labels, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *endpointCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sent
+	ch <- c.failed
+	ch <- c.retries
+	ch <- c.queue
+	ch <- c.latency
+}
+
+// Collect implements prometheus.Collector.
+func (c *endpointCollector) Collect(ch chan<- prometheus.Metric) {
+	for endpoint, s := range endpointMetrics(c.endpoints) {
+		ch <- prometheus.MustNewConstMetric(c.sent, prometheus.CounterValue, float64(s.sent), endpoint)
+		ch <- prometheus.MustNewConstMetric(c.failed, prometheus.CounterValue, float64(s.failed), endpoint)
+		ch <- prometheus.MustNewConstMetric(c.retries, prometheus.CounterValue, float64(s.retries), endpoint)
+		ch <- prometheus.MustNewConstMetric(c.queue, prometheus.GaugeValue, float64(s.pending), endpoint)
+		ch <- prometheus.MustNewConstHistogram(c.latency, s.latency.count, s.latency.sum, s.latency.buckets(), endpoint)
+	}
+}
+
+// endpointMetrics returns the state of the endpoints by redacted
+// URL, combining the state of endpoints whose URLs only differ in
+// their redacted parts.
+func endpointMetrics(endpoints *endpointRegistry) map[string]endpointStatus {
+	metrics := map[string]endpointStatus{}
+	for u, s := range endpoints.statuses() {
+		endpoint := redactURL(u)
+		m, ok := metrics[endpoint]
+		if !ok {
+			metrics[endpoint] = s
+			continue
+		}
+		m.pending += s.pending
+		m.sent += s.sent
+		m.failed += s.failed
+		m.retries += s.retries
+		m.latency.merge(s.latency)
+		metrics[endpoint] = m
+	}
+	return metrics
+}
+
+// redactURL removes the user information, query, and fragment from
+// the URL since they may contain credentials.
+func redactURL(webhookURL string) string {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return "invalid"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
@@ -0,0 +1,143 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsDefaultPort is the NATS client port used if the URL has none.
+const natsDefaultPort = "4222"
+
+// natsTimeout limits connecting and publishing when the context has
+// no deadline.
+const natsTimeout = 10 * time.Second
+
+// natsSink publishes messages to a NATS subject, with the message
+// header and content type as NATS headers.  Each publish is flushed so
+// errors reported by the server fail the send.
+type natsSink struct {
+	// server is the server URL, without the subject.
+	server  string
+	subject string
+	options []nats.Option
+	// mu guards conn, one publish at a time.
+	mu   sync.Mutex
+	conn *nats.Conn
+}
+
+// newNATSSink returns a sink publishing to the subject in the path of
+// u, nats://[USER[:PASSWORD]@]HOST[:PORT]/SUBJECT[?tls=true].  A user
+// without a password is used as the authentication token.
+func newNATSSink(u *url.URL) (Sink, error) {
+	subject := strings.Trim(u.Path, "/")
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n/") {
+		return nil, fmt.Errorf("NATS URL path must be a subject, not '%s'", u.Path)
+	}
+	useTLS, tlsErr := queryBool(u, "tls")
+	if tlsErr != nil {
+		return nil, tlsErr
+	}
+	server := &url.URL{Scheme: "nats", User: u.User, Host: u.Host}
+	if u.Port() == "" {
+		server.Host = net.JoinHostPort(u.Hostname(), natsDefaultPort)
+	}
+	s := &natsSink{
+		server:  server.String(),
+		subject: subject,
+		options: []nats.Option{
+			nats.Name(Pkg),
+			nats.Timeout(natsTimeout),
+			// fail publishes while reconnecting rather than
+			// buffering them, so they are retried
+			nats.ReconnectBufSize(-1),
+			nats.ErrorHandler(func(conn *nats.Conn, sub *nats.Subscription, err error) {
+				moduleLogger(LogModuleDelivery).Warnf("NATS server %s reported an error: %v", conn.ConnectedUrlRedacted(), err)
+			}),
+		},
+	}
+	if useTLS {
+		s.options = append(s.options, nats.Secure(&tls.Config{ServerName: u.Hostname()}))
+	}
+	return s, nil
+}
+
+// Send publishes msg, connecting to the server if not connected, and
+// flushes the connection.  Errors the server reports for the publish
+// fail the send.
+func (s *natsSink) Send(ctx context.Context, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, natsTimeout)
+		defer cancel()
+	}
+	if s.conn == nil || s.conn.IsClosed() {
+		conn, connErr := nats.Connect(s.server, s.options...)
+		if connErr != nil {
+			return fmt.Errorf("failed to connect to NATS server %s: %v", redactURL(s.server), connErr)
+		}
+		s.conn = conn
+	}
+	previous := s.conn.LastError()
+	if err := s.conn.PublishMsg(natsMessage(s.subject, msg)); err != nil {
+		return fmt.Errorf("failed to publish to NATS subject %s: %v", s.subject, err)
+	}
+	if err := s.conn.FlushWithContext(ctx); err != nil {
+		return fmt.Errorf("failed to publish to NATS subject %s: %v", s.subject, err)
+	}
+	// errors are recorded when the server reports them, before the
+	// flush completes
+	if err := s.conn.LastError(); err != nil && err != previous {
+		return fmt.Errorf("failed to publish to NATS subject %s: %v", s.subject, err)
+	}
+	contextLogger(ctx, LogModuleDelivery).WithField("pod", msg.Key).Infof("Published to NATS subject '%s'", s.subject)
+	return nil
+}
+
+// Close closes the connection to the server, if any.
+func (s *natsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return nil
+}
+
+// natsMessage returns the NATS message publishing msg to subject, with
+// the message content type and header as NATS headers.
+func natsMessage(subject string, msg Message) *nats.Msg {
+	m := nats.NewMsg(subject)
+	m.Data = msg.Body
+	if msg.ContentType != "" {
+		m.Header.Set("content-type", msg.ContentType)
+	}
+	for name, value := range msg.Header {
+		m.Header.Set(name, value)
+	}
+	return m
+}
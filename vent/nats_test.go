@@ -0,0 +1,229 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// natsPublished is a message received by fakeNATS.
+type natsPublished struct {
+	subject string
+	header  string
+	payload string
+}
+
+// natsConnect is the part of the CONNECT message checked.
+type natsConnect struct {
+	Headers   bool   `json:"headers"`
+	Name      string `json:"name"`
+	User      string `json:"user"`
+	Pass      string `json:"pass"`
+	AuthToken string `json:"auth_token"`
+}
+
+// fakeNATS is a NATS server accepting CONNECT, HPUB, and PING.
+type fakeNATS struct {
+	listener net.Listener
+	// mu guards the fields below.
+	mu sync.Mutex
+	// reject, if not empty, is the error returned for publishes.
+	reject    string
+	connects  []natsConnect
+	published []natsPublished
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &fakeNATS{listener: l}
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"headers\":true,\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CONNECT":
+			var c natsConnect
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")), &c); err != nil {
+				fmt.Fprintf(conn, "-ERR 'Invalid CONNECT'\r\n")
+				return
+			}
+			s.mu.Lock()
+			s.connects = append(s.connects, c)
+			s.mu.Unlock()
+		case "HPUB":
+			var headerLen, totalLen int
+			if len(fields) != 4 {
+				return
+			}
+			fmt.Sscan(fields[2], &headerLen)
+			fmt.Sscan(fields[3], &totalLen)
+			data := make([]byte, totalLen+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			s.mu.Lock()
+			if s.reject != "" {
+				fmt.Fprintf(conn, "-ERR '%s'\r\n", s.reject)
+				s.mu.Unlock()
+				continue
+			}
+			s.published = append(s.published, natsPublished{
+				subject: fields[1],
+				header:  string(data[:headerLen]),
+				payload: string(data[headerLen:totalLen]),
+			})
+			s.mu.Unlock()
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		}
+	}
+}
+
+func TestNATSSink(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "nats")
+
+	server := newFakeNATS(t)
+	defer server.listener.Close()
+
+	u, _ := url.Parse("nats://k8svent:s3cr3t@" + server.listener.Addr().String() + "/k8svent.pods")
+	sink, sinkErr := newNATSSink(u)
+	if sinkErr != nil {
+		t.Fatalf("failed to create NATS sink: %v", sinkErr)
+	}
+	msg := Message{
+		Key:         "some/pod",
+		Body:        []byte(`{"pod":{}}`),
+		ContentType: "application/json",
+		Header:      map[string]string{DeliveryHeader: "abc123", SignatureHeader: "sha256=def"},
+	}
+	for i := 0; i < 2; i++ {
+		if err := sink.Send(context.Background(), msg); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	server.mu.Lock()
+	if len(server.connects) != 1 {
+		t.Errorf("expected 1 connection, got %d", len(server.connects))
+	} else if c := server.connects[0]; c.User != "k8svent" || c.Pass != "s3cr3t" || !c.Headers || c.Name != Pkg {
+		t.Errorf("unexpected CONNECT: %+v", c)
+	}
+	if len(server.published) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(server.published))
+	}
+	p := server.published[0]
+	server.mu.Unlock()
+	if p.subject != "k8svent.pods" {
+		t.Errorf("published to subject %s", p.subject)
+	}
+	eHeader := "NATS/1.0\r\ncontent-type: application/json\r\nx-k8svent-delivery: abc123\r\nx-k8svent-signature: sha256=def\r\n\r\n"
+	if p.header != eHeader {
+		t.Errorf("header %q != %q", p.header, eHeader)
+	}
+	if p.payload != string(msg.Body) {
+		t.Errorf("payload %s != %s", p.payload, msg.Body)
+	}
+
+	server.mu.Lock()
+	server.reject = "Permissions Violation for Publish to k8svent.pods"
+	server.mu.Unlock()
+	if err := sink.Send(context.Background(), msg); err == nil || !strings.Contains(err.Error(), "Permissions Violation") {
+		t.Errorf("expected server error, got %v", err)
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Errorf("failed to close sink: %v", err)
+	}
+	server.mu.Lock()
+	server.reject = ""
+	server.mu.Unlock()
+	if err := sink.Send(context.Background(), msg); err != nil {
+		t.Errorf("failed to publish after closing: %v", err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.connects) != 2 {
+		t.Errorf("expected closed sink to reconnect, got %d connections", len(server.connects))
+	}
+}
+
+func TestNewNATSSink(t *testing.T) {
+	for _, tt := range []struct {
+		url     string
+		server  string
+		options int
+		err     bool
+	}{
+		{"nats://nats/k8svent.pods", "nats://nats:4222", 4, false},
+		{"nats://t0k3n@nats:4223/pods", "nats://t0k3n@nats:4223", 4, false},
+		{"nats://nats/pods?tls=true", "nats://nats:4222", 5, false},
+		{"nats://nats", "", 0, true},
+		{"nats://nats/k8svent/pods", "", 0, true},
+		{"nats://nats/pods?tls=maybe", "", 0, true},
+	} {
+		u, _ := url.Parse(tt.url)
+		sink, err := newNATSSink(u)
+		if tt.err {
+			if err == nil {
+				t.Errorf("expected error for %s", tt.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", tt.url, err)
+			continue
+		}
+		s := sink.(*natsSink)
+		if s.server != tt.server || len(s.options) != tt.options {
+			t.Errorf("%s has server %s and %d options", tt.url, s.server, len(s.options))
+		}
+	}
+}
@@ -15,10 +15,34 @@
 package vent
 
 import (
+	"context"
+	"time"
+
 	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
 )
 
+// PodEvent is the reason a pod is sent to the webhooks.
+type PodEvent string
+
+// Pod events.
+const (
+	// PodNew is sent for pods not seen before.
+	PodNew PodEvent = "new"
+	// PodChanged is sent for pods whose state has changed.
+	PodChanged PodEvent = "changed"
+	// PodUnhealthy is sent for pods whose state has not changed but
+	// are not healthy.
+	PodUnhealthy PodEvent = "unhealthy"
+	// PodDeleted is sent for pods that no longer exist.
+	PodDeleted PodEvent = "deleted"
+)
+
+// PodEvents are all the pod events.
+var PodEvents = []PodEvent{PodNew, PodChanged, PodUnhealthy, PodDeleted}
+
 // processPodsArgs provides the argument fo processPods.
 type processPodsArgs struct {
 	// pods are the pods to process.
@@ -26,36 +50,61 @@ type processPodsArgs struct {
 	// lastPods are the last set of pods processed.
 	lastPods map[string]v1.Pod
 	// processor is the function that processes each individual pod
-	// that is determined to be either new or unhealthy.
-	processor func(v1.Pod) error
+	// that is determined to be either new, changed, unhealthy, or
+	// deleted.
+	processor func(context.Context, v1.Pod, PodEvent) error
+	// healthy decides whether a pod whose state is unchanged is
+	// healthy, podHealthy if nil.
+	healthy func(v1.Pod) bool
 }
 
 // processPods iterates through the provided pods and processes those
 // that do not have an identical pod in lastPods or are not healthy.
-// It returns a map of successfully processed pods.
-func processPods(args *processPodsArgs) map[string]v1.Pod {
+// It returns a map of successfully processed pods.  If ctx has a
+// tracer, processing is recorded as a trace.  If ctx is done, no more
+// pods are processed.
+func processPods(ctx context.Context, args *processPodsArgs) map[string]v1.Pod {
+	ctx, span := startSpan(ctx, "processPods", trace.SpanKindInternal)
+	defer span.End()
+	span.SetAttributes(attribute.Int("pods", len(args.pods)))
+	healthy := args.healthy
+	if healthy == nil {
+		healthy = podHealthy
+	}
 	newPods := map[string]v1.Pod{}
 	for _, pod := range args.pods {
+		if ctx.Err() != nil {
+			contextLogger(ctx, LogModulePods).Info("Stopping processing pods")
+			return newPods
+		}
 		slug := podSlug(pod)
-		log := logger.WithField("pod", slug)
+		log := contextLogger(ctx, LogModulePods).WithField("pod", slug)
 		newPods[slug] = pod
+		event := PodNew
 		if lastPod, ok := args.lastPods[slug]; ok {
 			delete(args.lastPods, slug)
-			if podHealthy(pod) && cmp.Diff(pod, lastPod) == "" {
+			if cmp.Diff(pod, lastPod) != "" {
+				event = PodChanged
+			} else if healthy(pod) {
 				log.Debug("Pod is healthy and state is unchanged")
 				continue
+			} else {
+				event = PodUnhealthy
 			}
 		}
-		if err := args.processor(pod); err != nil {
+		if err := args.processor(ctx, pod, event); err != nil {
 			log.Errorf("Failed to process pod: %v", err)
 			delete(newPods, slug)
 			continue
 		}
 	}
 	for slug, deletedPod := range args.lastPods {
-		log := logger.WithField("pod", slug)
+		if ctx.Err() != nil {
+			return newPods
+		}
+		log := contextLogger(ctx, LogModulePods).WithField("pod", slug)
 		deletedPod.Status.Phase = "Deleted"
-		if err := args.processor(deletedPod); err != nil {
+		if err := args.processor(ctx, deletedPod, PodDeleted); err != nil {
 			log.Errorf("Failed to process pod: %v", err)
 			continue
 		}
@@ -120,10 +169,26 @@ func containerHealthy(containerStatus v1.ContainerStatus, init bool) bool {
 	return true
 }
 
-// ProcessPods iterates through the pods and calls PostToWebhooks for
-// each.
-func (v *Venter) processPod(pod v1.Pod) error {
-	payload := webhookPayload{Pod: pod}
-	postToWebhooks(v.urls, &payload, v.secret)
+// trackedPod is the last state of a pod sent to the webhooks.
+type trackedPod struct {
+	// Pod is the pod as it was last sent.
+	Pod v1.Pod `json:"pod"`
+	// Event is why the pod was last sent.
+	Event PodEvent `json:"event"`
+	// Sent is when the pod was last sent.
+	Sent time.Time `json:"sent"`
+}
+
+// processPod sends the pod for event to its webhooks and the custom
+// sinks.
+func (v *Venter) processPod(ctx context.Context, pod v1.Pod, event PodEvent) error {
+	v.metrics.processed(event)
+	last := v.track(pod, event)
+	if v.dryRun == nil {
+		v.recorder.record(pod, event)
+	}
+	payload := webhookPayload{Pod: pod, event: event}
+	v.deliver(ctx, v.podWebhooks(pod), &payload, last)
+	v.sendToSinks(ctx, &payload)
 	return nil
 }
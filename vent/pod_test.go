@@ -15,11 +15,13 @@
 package vent
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/sirupsen/logrus/hooks/test"
 	v1 "k8s.io/api/core/v1"
 )
@@ -47,7 +49,7 @@ func TestProcessPods(t *testing.T) {
 		lastPods:  map[string]v1.Pod{},
 		processor: p0.testProcessor,
 	}
-	n0 := processPods(a0)
+	n0 := processPods(context.Background(), a0)
 	if len(n0) != 0 {
 		t.Errorf("Expected no pods but got some: %v", n0)
 	}
@@ -75,7 +77,7 @@ func TestProcessPods(t *testing.T) {
 		lastPods:  map[string]v1.Pod{},
 		processor: p1.testProcessor,
 	}
-	n1 := processPods(a1)
+	n1 := processPods(context.Background(), a1)
 	if len(n1) != 1 {
 		t.Errorf("Expected one pod but got %d: %v", len(n1), n1)
 	}
@@ -101,7 +103,7 @@ func TestProcessPods(t *testing.T) {
 		lastPods:  map[string]v1.Pod{"brian-fallon/local-honey-0": pods[0]},
 		processor: p2.testProcessor,
 	}
-	n2 := processPods(a2)
+	n2 := processPods(context.Background(), a2)
 	if len(n2) != 1 {
 		t.Errorf("Expected one pod but got %d: %v", len(n2), n2)
 	}
@@ -124,7 +126,7 @@ func TestProcessPods(t *testing.T) {
 		lastPods:  map[string]v1.Pod{"brian-fallon/local-honey-0": pods[0]},
 		processor: p3.testProcessor,
 	}
-	n3 := processPods(a3)
+	n3 := processPods(context.Background(), a3)
 	if len(n3) != 0 {
 		t.Errorf("Expected no pods but got %d: %v", len(n3), n3)
 	}
@@ -151,7 +153,7 @@ func TestProcessPods(t *testing.T) {
 		},
 		processor: p4.testProcessor,
 	}
-	n4 := processPods(a4)
+	n4 := processPods(context.Background(), a4)
 	if len(n4) != 3 {
 		t.Errorf("Expected no pods but got %d: %v", len(n4), n4)
 	}
@@ -170,6 +172,34 @@ func TestProcessPods(t *testing.T) {
 	if podSlug(p4.deletedPods[0]) != "brian-fallon/local-honey-3" {
 		t.Errorf("Expected deleted pod to be 'brian-fallon/local-honey': %s", podSlug(p4.deletedPods[0]))
 	}
+	expectedEvents := []PodEvent{PodUnhealthy, PodNew, PodDeleted}
+	if d := cmp.Diff(p4.events, expectedEvents); d != "" {
+		t.Errorf("Pod events not as expected: %s", d)
+	}
+
+	changed := pods[0].DeepCopy()
+	changed.ObjectMeta.Labels = map[string]string{"changed": "true"}
+	p5 := &testPods{}
+	processPods(context.Background(), &processPodsArgs{
+		pods:      []v1.Pod{*changed},
+		lastPods:  map[string]v1.Pod{"brian-fallon/local-honey-0": pods[0]},
+		processor: p5.testProcessor,
+	})
+	if len(p5.events) != 1 || p5.events[0] != PodChanged {
+		t.Errorf("Expected changed event but got: %v", p5.events)
+	}
+
+	stopped, stop := context.WithCancel(context.Background())
+	stop()
+	p6 := &testPods{}
+	processPods(stopped, &processPodsArgs{
+		pods:      pods,
+		lastPods:  map[string]v1.Pod{"brian-fallon/local-honey-3": pods[0]},
+		processor: p6.testProcessor,
+	})
+	if len(p6.events) != 0 {
+		t.Errorf("Expected no pods processed after stopping but got: %v", p6.events)
+	}
 }
 
 func loadPods(podFile string) (o []v1.Pod, e error) {
@@ -188,9 +218,11 @@ func loadPods(podFile string) (o []v1.Pod, e error) {
 type testPods struct {
 	deletedPods []v1.Pod
 	sentPods    []v1.Pod
+	events      []PodEvent
 }
 
-func (p *testPods) testProcessor(pod v1.Pod) error {
+func (p *testPods) testProcessor(ctx context.Context, pod v1.Pod, event PodEvent) error {
+	p.events = append(p.events, event)
 	if pod.Status.Phase == "Deleted" {
 		p.deletedPods = append(p.deletedPods, pod)
 	} else {
@@ -0,0 +1,205 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// recordedPayload is a line of a recording.  It is a webhook payload,
+// like the entries of testdata/vent.json, with when and why it was
+// sent.
+type recordedPayload struct {
+	// Timestamp is when the payload was sent.
+	Timestamp time.Time `json:"timestamp"`
+	// Event is why the pod was sent.
+	Event PodEvent `json:"event"`
+	// Pod is the pod sent.
+	Pod v1.Pod `json:"pod"`
+}
+
+// recorder appends every payload sent to a recording file as a JSON
+// line.  It is safe for concurrent use.
+type recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	// log logs failures to record, the global logger if nil.
+	log *logrus.Entry
+}
+
+// openRecorder opens the recording file for appending, creating it
+// readable only by its owner if it does not exist, since recorded pods
+// may include secrets in their environment.  Failures to record are
+// logged using log.
+func openRecorder(recordFile string, log *logrus.Entry) (*recorder, error) {
+	file, openErr := os.OpenFile(recordFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if openErr != nil {
+		return nil, fmt.Errorf("failed to open recording file %s: %v", recordFile, openErr)
+	}
+	return &recorder{file: file, log: log}, nil
+}
+
+// record appends the pod sent for event to the recording.  Failures
+// are logged.  If r is nil, nothing is recorded.
+func (r *recorder) record(pod v1.Pod, event PodEvent) {
+	if r == nil {
+		return
+	}
+	line, jsonErr := json.Marshal(recordedPayload{Timestamp: time.Now().UTC(), Event: event, Pod: pod})
+	if jsonErr != nil {
+		entryLogger(r.log, LogModulePods).Errorf("Failed to marshal recorded payload for %s: %v", podSlug(pod), jsonErr)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		entryLogger(r.log, LogModulePods).Errorf("Failed to record payload for %s: %v", podSlug(pod), err)
+	}
+}
+
+// close closes the recording file.  If r is nil, it does nothing.
+func (r *recorder) close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// ReplaySummary is the outcome of replaying a recording.
+type ReplaySummary struct {
+	// Payloads is the number of payloads in the recording.
+	Payloads int
+	// Sent is the number of deliveries that succeeded, one for each
+	// payload and webhook.
+	Sent int
+	// Failed is the number of deliveries that failed.
+	Failed int
+}
+
+// Replay reads a recording made using the record configuration, or a
+// JSON array of webhook payloads like testdata/vent.json, and sends its
+// payloads, in order, to the configured webhooks.  The
+// payloads are encrypted and signed as they would be by k8svent and
+// are sent at the recorded pace divided by speed.  If speed is not
+// positive, payloads are sent without delay.  Replaying stops when ctx
+// is done.
+func Replay(ctx context.Context, config Config, in io.Reader, speed float64) (ReplaySummary, error) {
+	summary := ReplaySummary{}
+	if err := setupLogger(config); err != nil {
+		return summary, fmt.Errorf("invalid logging configuration: %v", err)
+	}
+	hooks, hooksErr := newWebhooks(config.Webhooks, config.Secret)
+	if hooksErr != nil {
+		return summary, hooksErr
+	}
+	if len(hooks) == 0 {
+		return summary, fmt.Errorf("no webhooks to replay to")
+	}
+	sinks := newSinkCache()
+	defer sinks.close()
+	for i := range hooks {
+		hooks[i].sinks = sinks
+	}
+	decoder, array, decoderErr := newRecordingDecoder(in)
+	if decoderErr != nil {
+		return summary, decoderErr
+	}
+	var start, first time.Time
+	for {
+		if array && !decoder.More() {
+			if _, err := decoder.Token(); err != nil {
+				return summary, fmt.Errorf("failed to parse end of payload array: %v", err)
+			}
+			return summary, nil
+		}
+		var recorded recordedPayload
+		if err := decoder.Decode(&recorded); err == io.EOF && !array {
+			return summary, nil
+		} else if err != nil {
+			return summary, fmt.Errorf("failed to parse payload %d of recording: %v", summary.Payloads+1, err)
+		}
+		summary.Payloads++
+		if start.IsZero() {
+			start, first = time.Now(), recorded.Timestamp
+		} else if speed > 0 {
+			offset := time.Duration(float64(recorded.Timestamp.Sub(first)) / speed)
+			select {
+			case <-ctx.Done():
+				return summary, ctx.Err()
+			case <-time.After(time.Until(start.Add(offset))):
+			}
+		}
+		slug := podSlug(recorded.Pod)
+		payload := webhookPayload{Pod: recorded.Pod, event: recorded.Event}
+		for _, hook := range hooks {
+			if ctx.Err() != nil {
+				return summary, ctx.Err()
+			}
+			body, formatErr := formatPayload(&payload, hook.format)
+			if formatErr != nil {
+				return summary, fmt.Errorf("failed to marshal payload %d: %v", summary.Payloads, formatErr)
+			}
+			if err := postToWebhook(ctx, slug, hook, body); err != nil {
+				logger.Errorf("Failed to replay payload %d to '%s': %v", summary.Payloads, redactURL(hook.url), err)
+				summary.Failed++
+				continue
+			}
+			summary.Sent++
+		}
+	}
+}
+
+// newRecordingDecoder returns a decoder of the payloads read from in
+// and whether they are the elements of a JSON array, like
+// testdata/vent.json, rather than a recording of JSON lines.  If they
+// are in an array, its opening bracket has been read.  Payloads without
+// a timestamp are sent without delay.
+func newRecordingDecoder(in io.Reader) (*json.Decoder, bool, error) {
+	reader := bufio.NewReader(in)
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			return json.NewDecoder(reader), false, nil
+		} else if err != nil {
+			return nil, false, fmt.Errorf("failed to read recording: %v", err)
+		}
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+		if err := reader.UnreadByte(); err != nil {
+			return nil, false, fmt.Errorf("failed to read recording: %v", err)
+		}
+		decoder := json.NewDecoder(reader)
+		if b != '[' {
+			return decoder, false, nil
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, false, fmt.Errorf("failed to parse payload array: %v", err)
+		}
+		return decoder, true, nil
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRecorder(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "record")
+
+	dir, dirErr := ioutil.TempDir("", "k8svent-record")
+	if dirErr != nil {
+		t.Fatalf("failed to create temporary directory: %v", dirErr)
+	}
+	defer os.RemoveAll(dir)
+	recordFile := filepath.Join(dir, "k8svent.jsonl")
+
+	pods, loadErr := loadPods("testdata/vent.json")
+	if loadErr != nil {
+		t.Fatalf("failed to load pods: %v", loadErr)
+	}
+	v := newVenter()
+	for i, pod := range pods[:2] {
+		rec, recErr := openRecorder(recordFile, nil)
+		if recErr != nil {
+			t.Fatalf("failed to open recorder: %v", recErr)
+		}
+		v.recorder = rec
+		if err := v.processPod(context.Background(), pod, []PodEvent{PodNew, PodChanged}[i]); err != nil {
+			t.Fatalf("failed to process pod: %v", err)
+		}
+		if err := rec.close(); err != nil {
+			t.Fatalf("failed to close recorder: %v", err)
+		}
+	}
+
+	v.dryRun = newDryRun(ioutil.Discard)
+	rec, recErr := openRecorder(recordFile, nil)
+	if recErr != nil {
+		t.Fatalf("failed to open recorder: %v", recErr)
+	}
+	v.recorder = rec
+	if err := v.processPod(context.Background(), pods[2], PodNew); err != nil {
+		t.Fatalf("failed to process pod: %v", err)
+	}
+	if err := rec.close(); err != nil {
+		t.Fatalf("failed to close recorder: %v", err)
+	}
+
+	info, statErr := os.Stat(recordFile)
+	if statErr != nil {
+		t.Fatalf("failed to stat recording: %v", statErr)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("recording file mode is %o rather than 600", mode)
+	}
+	file, openErr := os.Open(recordFile)
+	if openErr != nil {
+		t.Fatalf("failed to open recording: %v", openErr)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	var recorded []recordedPayload
+	for scanner.Scan() {
+		var line recordedPayload
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("recording line is not a payload: %v", err)
+		}
+		recorded = append(recorded, line)
+	}
+	if len(recorded) != 2 {
+		t.Fatalf("recorded %d payloads rather than 2, dry runs should not be recorded", len(recorded))
+	}
+	for i, line := range recorded {
+		if podSlug(line.Pod) != podSlug(pods[i]) || line.Timestamp.IsZero() {
+			t.Errorf("recorded payload %d not as expected: %s at %s", i, podSlug(line.Pod), line.Timestamp)
+		}
+	}
+	if recorded[0].Event != PodNew || recorded[1].Event != PodChanged {
+		t.Errorf("recorded events not as expected: %s, %s", recorded[0].Event, recorded[1].Event)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var mu sync.Mutex
+	received := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		signature, _ := generateSignature(body, "Husker")
+		if r.Header.Get("x-atomist-signature") != signature {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		var payload webhookPayload
+		_ = json.Unmarshal(body, &payload)
+		mu.Lock()
+		received = append(received, payload.Pod.Name)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	start := time.Date(2020, 5, 17, 10, 0, 0, 0, time.UTC)
+	var recording strings.Builder
+	for i, name := range []string{"zen", "arcade", "candy"} {
+		line, _ := json.Marshal(recordedPayload{
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			Event:     PodChanged,
+			Pod:       v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "du", Name: name}},
+		})
+		recording.Write(append(line, '\n'))
+	}
+	config := Config{LogLevel: "error", Secret: "Husker", Webhooks: []Webhook{{URL: server.URL}, {URL: server.URL + "/du"}}}
+
+	began := time.Now()
+	summary, err := Replay(context.Background(), config, strings.NewReader(recording.String()), 10)
+	elapsed := time.Since(began)
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if summary.Payloads != 3 || summary.Sent != 6 || summary.Failed != 0 {
+		t.Errorf("summary not as expected: %+v", summary)
+	}
+	if strings.Join(received, ",") != "zen,zen,arcade,arcade,candy,candy" {
+		t.Errorf("received pods not as expected: %v", received)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("replay at ten times speed took %s", elapsed)
+	}
+
+	began = time.Now()
+	if _, err := Replay(context.Background(), config, strings.NewReader(recording.String()), 0); err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if elapsed := time.Since(began); elapsed > 150*time.Millisecond {
+		t.Errorf("replay without delay took %s", elapsed)
+	}
+
+	if _, err := Replay(context.Background(), config, strings.NewReader(`{"pod":`), 0); err == nil {
+		t.Error("replaying truncated recording did not fail")
+	}
+}
+
+func TestReplayPayloadArray(t *testing.T) {
+	var mu sync.Mutex
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received++
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	file, openErr := os.Open("testdata/vent.json")
+	if openErr != nil {
+		t.Fatalf("failed to open payloads: %v", openErr)
+	}
+	defer file.Close()
+	pods, loadErr := loadPods("testdata/vent.json")
+	if loadErr != nil {
+		t.Fatalf("failed to load pods: %v", loadErr)
+	}
+	config := Config{LogLevel: "error", Webhooks: []Webhook{{URL: server.URL}}}
+	summary, err := Replay(context.Background(), config, file, 1)
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if summary.Payloads != len(pods) || summary.Sent != len(pods) || summary.Failed != 0 || received != len(pods) {
+		t.Errorf("summary not as expected for %d pods: %+v, %d received", len(pods), summary, received)
+	}
+
+	if _, err := Replay(context.Background(), config, strings.NewReader(`[{"pod":{}}`), 0); err == nil {
+		t.Error("replaying unterminated payload array did not fail")
+	}
+}
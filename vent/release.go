@@ -15,47 +15,394 @@
 package vent
 
 import (
-	"os"
+	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/blang/semver"
+	"k8s.io/client-go/kubernetes"
 )
 
+// Policies for updating k8svent when a new release is detected.
+const (
+	// UpdatePolicyRestart exits so Kubernetes restarts k8svent with
+	// the new image, if the new version satisfies the constraint and
+	// it is within the maintenance window.
+	UpdatePolicyRestart = "restart"
+	// UpdatePolicyNotify only logs, counts, and records an Event for
+	// new releases.
+	UpdatePolicyNotify = "notify"
+	// UpdatePolicyOff disables checking for new releases.
+	UpdatePolicyOff = "off"
+)
+
+// UpdatePolicies are the supported update policies.
+var UpdatePolicies = []string{UpdatePolicyRestart, UpdatePolicyNotify, UpdatePolicyOff}
+
+// maxVersionLookups is the maximum number of version tags whose
+// digests are compared to a new digest to find its version.
+const maxVersionLookups = 10
+
+// releaseChecker checks for new k8svent releases and decides whether
+// to restart to update according to the update policy.
+type releaseChecker struct {
+	metrics   *ventMetrics
+	events    *eventRecorder
+	clientset kubernetes.Interface
+	config    func() Config
+	// current is the running version, nil if it is not a semantic
+	// version.
+	current *semver.Version
+	// defaultTag is the tag checked if the image has none.
+	defaultTag string
+	now        func() time.Time
+	// image and digest are the image checked and its digest when
+	// checking started.
+	image  string
+	digest string
+	// notified is the last new digest notified about.
+	notified string
+	// verified is the last new digest whose signature was verified.
+	verified string
+	// alerted is the last new digest whose signature could not be
+	// verified.
+	alerted string
+	off     bool
+}
+
+// newReleaseChecker creates a release checker for the running
+// version.
+func newReleaseChecker(m *ventMetrics, events *eventRecorder, clientset kubernetes.Interface, config func() Config) *releaseChecker {
+	c := &releaseChecker{
+		metrics:    m,
+		events:     events,
+		clientset:  clientset,
+		config:     config,
+		defaultTag: "next",
+		now:        time.Now,
+	}
+	if v, vErr := semver.Make(Version); vErr == nil {
+		c.current = &v
+		c.defaultTag = versionTag(v)
+	} else {
+		moduleLogger(LogModuleRelease).Warnf("Version '%s' could not be made into a semantic version: %v", Version, vErr)
+	}
+	return c
+}
+
 // initiateReleaseCheck starts a go routine to periodically check for
-// a new release.
-func initiateReleaseCheck() {
+// a new release until ctx is done, recording the result of each check
+// in m.  The image checked, the registry credentials, and the update
+// policy are taken from the current configuration, returned by config,
+// each time, reading pull secrets using clientset.  To update, a
+// Kubernetes Event is recorded using events and restart is called,
+// which should shut k8svent down gracefully.
+func initiateReleaseCheck(ctx context.Context, m *ventMetrics, events *eventRecorder, clientset kubernetes.Interface, config func() Config, restart func()) {
+	c := newReleaseChecker(m, events, clientset, config)
 	go func() {
-		tag := "next"
-		if v, vErr := semver.Make(Version); vErr == nil {
-			tag = versionTag(v)
-		} else {
-			logger.Warnf("Version '%s' could not be made into a semantic version: %v", Version, vErr)
-		}
-		logger.Infof("Using Docker image tag '%s' for digest check", tag)
 		rest := 0 * time.Second
-		lastDigest := ""
 		for {
-			time.Sleep(rest)
-			digest, digestErr := getDockerTagDigest(tag)
-			if digestErr != nil {
-				logger.Errorf("Failed to get Docker image digest for tag %s: %v", tag, digestErr)
-				rest = 1 * time.Hour
-				continue
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(rest):
 			}
-			if lastDigest == "" {
-				lastDigest = digest
+			var update bool
+			update, rest = c.check()
+			if update {
+				events.selfUpdate(c.image, c.notified)
+				restart()
+				return
 			}
-			if digest != lastDigest {
-				logger.Info("New version detected, exiting")
-				os.Exit(0)
-			} else {
-				logger.Info("No new version detected")
-			}
-			rest = tagDuration(tag)
 		}
 	}()
 }
 
+// check checks for a new release once.  It returns true if k8svent
+// should restart to update and how long to wait before checking
+// again.
+func (c *releaseChecker) check() (bool, time.Duration) {
+	log := moduleLogger(LogModuleRelease)
+	update := c.config().Update
+	if update.Policy == UpdatePolicyOff {
+		if !c.off {
+			log.Info("Update policy is off, not checking for new releases")
+			c.off = true
+		}
+		return false, tagDuration(c.defaultTag)
+	}
+	c.off = false
+
+	image, imageErr := newReleaseImage(c.clientset, update, c.defaultTag)
+	digest := ""
+	if imageErr == nil {
+		digest, imageErr = image.digest()
+	}
+	if imageErr != nil {
+		log.Errorf("Failed to get digest of update image: %v", imageErr)
+		c.metrics.releaseCheck(releaseError)
+		return false, 1 * time.Hour
+	}
+	name := fmt.Sprintf("%s/%s:%s", image.ref.registry, image.ref.repository, image.tag)
+	if name != c.image {
+		log.Infof("Using image %s for digest check", name)
+		c.image = name
+		c.digest = digest
+		c.notified = ""
+		c.verified = ""
+		c.alerted = ""
+	}
+	rest := tagDuration(image.tag)
+	if digest == c.digest {
+		c.metrics.releaseCheck(releaseCurrent)
+		log.Info("No new version detected")
+		return false, rest
+	}
+
+	if verifyErr := c.verify(update, image, digest); verifyErr != nil {
+		c.metrics.releaseCheck(releaseUnverified)
+		if c.alerted != digest {
+			log.Errorf("New version of %s has no valid signature, not restarting: %v", name, verifyErr)
+			c.events.updateUnverified(name, digest, verifyErr)
+			c.alerted = digest
+		} else {
+			log.Debugf("New version of %s still has no valid signature: %v", name, verifyErr)
+		}
+		return false, rest
+	}
+
+	reason, wait := c.deferral(update, image, digest)
+	if reason == "" {
+		c.metrics.releaseCheck(releaseUpdated)
+		log.Info("New version detected, restarting")
+		c.notified = digest
+		return true, 0
+	}
+	c.metrics.releaseCheck(releaseAvailable)
+	if c.notified != digest {
+		log.Infof("New version of %s detected, not restarting: %s", name, reason)
+		c.events.updateAvailable(name, digest, reason)
+		c.notified = digest
+	} else {
+		log.Debugf("New version of %s still not installed: %s", name, reason)
+	}
+	if wait > 0 && wait < rest {
+		rest = wait
+	}
+	return false, rest
+}
+
+// verify checks the signature of the image with the new digest if a
+// public key is configured, returning an error if it is not valid.
+// Signatures are checked again on every check until one is valid,
+// since they may be pushed after the image.
+func (c *releaseChecker) verify(update Update, image *releaseImage, digest string) error {
+	if update.PublicKey == "" || c.verified == digest {
+		return nil
+	}
+	key, keyErr := loadVerificationKey(update.PublicKey)
+	if keyErr != nil {
+		return keyErr
+	}
+	if err := verifyImageSignature(image, digest, key); err != nil {
+		return err
+	}
+	moduleLogger(LogModuleRelease).Infof("Verified signature of %s", digest)
+	c.verified = digest
+	return nil
+}
+
+// deferral returns why the image with the new digest should not be
+// installed now, an empty string if it should.  If installing is
+// deferred until the maintenance window, the time until it opens is
+// also returned.
+func (c *releaseChecker) deferral(update Update, image *releaseImage, digest string) (string, time.Duration) {
+	if update.Policy == UpdatePolicyNotify {
+		return "update policy is notify", 0
+	}
+	if update.Constraint != "" {
+		if c.current == nil {
+			return fmt.Sprintf("running version '%s' is not a semantic version", Version), 0
+		}
+		allowed, constraintErr := versionConstraint(update.Constraint, *c.current)
+		if constraintErr != nil {
+			return constraintErr.Error(), 0
+		}
+		version, versionErr := c.releaseVersion(image, digest)
+		if versionErr != nil {
+			return fmt.Sprintf("unable to determine version of new image: %v", versionErr), 0
+		}
+		if !allowed(version) {
+			return fmt.Sprintf("version %s does not satisfy constraint '%s'", version, update.Constraint), 0
+		}
+	}
+	if update.Window.Start != "" {
+		open, wait, windowErr := update.Window.check(c.now())
+		if windowErr != nil {
+			return windowErr.Error(), 0
+		}
+		if !open {
+			return fmt.Sprintf("outside maintenance window, which opens in %s", wait.Round(time.Minute)), wait
+		}
+	}
+	return "", 0
+}
+
+// releaseVersion finds the version of the image with digest by
+// comparing it to the digests of the newest version tags newer than
+// the running version.  If the running version is a release, only
+// release versions are considered.
+func (c *releaseChecker) releaseVersion(image *releaseImage, digest string) (semver.Version, error) {
+	tags, tagsErr := image.tags()
+	if tagsErr != nil {
+		return semver.Version{}, tagsErr
+	}
+	var versions []semver.Version
+	tagVersions := map[string]string{}
+	for _, tag := range tags {
+		v, vErr := semver.ParseTolerant(tag)
+		if vErr != nil || !v.GT(*c.current) || (isRelease(*c.current) && !isRelease(v)) {
+			continue
+		}
+		if _, seen := tagVersions[v.String()]; !seen {
+			versions = append(versions, v)
+		}
+		tagVersions[v.String()] = tag
+	}
+	semver.Sort(versions)
+	for i := len(versions) - 1; i >= 0 && i >= len(versions)-maxVersionLookups; i-- {
+		tagDigest, digestErr := image.tagDigest(tagVersions[versions[i].String()])
+		if digestErr != nil {
+			return semver.Version{}, digestErr
+		}
+		if tagDigest == digest {
+			return versions[i], nil
+		}
+	}
+	return semver.Version{}, fmt.Errorf("no version tag newer than %s has digest %s", c.current, digest)
+}
+
+// versionConstraint returns a function reporting whether a version
+// satisfies the constraint relative to the current version.  The
+// constraint is "patch", allowing versions with the same major and
+// minor version, "minor", allowing versions with the same major
+// version, "major", allowing any version, or a semantic version range
+// like ">=0.18.0 <1.0.0".
+func versionConstraint(constraint string, current semver.Version) (func(semver.Version) bool, error) {
+	switch constraint {
+	case "patch":
+		return func(v semver.Version) bool { return v.Major == current.Major && v.Minor == current.Minor }, nil
+	case "minor":
+		return func(v semver.Version) bool { return v.Major == current.Major }, nil
+	case "major", "":
+		return func(v semver.Version) bool { return true }, nil
+	}
+	r, rangeErr := semver.ParseRange(constraint)
+	if rangeErr != nil {
+		return nil, fmt.Errorf("invalid constraint '%s', must be patch, minor, major, or a version range: %v", constraint, rangeErr)
+	}
+	return func(v semver.Version) bool { return r(v) }, nil
+}
+
+// weekdays maps the names of days to weekdays.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseWeekday parses a day name, e.g., "sat" or "Saturday".
+func parseWeekday(day string) (time.Weekday, error) {
+	d := strings.ToLower(day)
+	if len(d) >= 3 {
+		if w, ok := weekdays[d[:3]]; ok && strings.HasPrefix(strings.ToLower(w.String()), d) {
+			return w, nil
+		}
+	}
+	return time.Sunday, fmt.Errorf("invalid day '%s'", day)
+}
+
+// parseClock parses a time of day, HH:MM, returning the hour and
+// minute.
+func parseClock(clock string) (int, int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time of day '%s', must be HH:MM", clock)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// validate checks the maintenance window, whose field path is path.
+func (w MaintenanceWindow) validate(path string) ConfigErrors {
+	var errs ConfigErrors
+	if w.Start == "" {
+		if w.End != "" || len(w.Days) > 0 || w.TimeZone != "" {
+			errs = append(errs, FieldError{path + ".start", "start is required"})
+		}
+		return errs
+	}
+	if _, _, err := parseClock(w.Start); err != nil {
+		errs = append(errs, FieldError{path + ".start", err.Error()})
+	}
+	if _, _, err := parseClock(w.End); err != nil {
+		errs = append(errs, FieldError{path + ".end", err.Error()})
+	}
+	for i, day := range w.Days {
+		if _, err := parseWeekday(day); err != nil {
+			errs = append(errs, FieldError{fmt.Sprintf("%s.days[%d]", path, i), err.Error()})
+		}
+	}
+	if _, err := time.LoadLocation(w.TimeZone); err != nil {
+		errs = append(errs, FieldError{path + ".timeZone", fmt.Sprintf("unknown time zone '%s'", w.TimeZone)})
+	}
+	return errs
+}
+
+// check returns true if now is within the maintenance window.  If it
+// is not, it also returns how long until the window next opens.
+func (w MaintenanceWindow) check(now time.Time) (bool, time.Duration, error) {
+	startHour, startMinute, startErr := parseClock(w.Start)
+	if startErr != nil {
+		return false, 0, startErr
+	}
+	endHour, endMinute, endErr := parseClock(w.End)
+	if endErr != nil {
+		return false, 0, endErr
+	}
+	loc, locErr := time.LoadLocation(w.TimeZone)
+	if locErr != nil {
+		return false, 0, fmt.Errorf("unknown time zone '%s'", w.TimeZone)
+	}
+	days := map[time.Weekday]bool{}
+	for _, day := range w.Days {
+		d, dayErr := parseWeekday(day)
+		if dayErr != nil {
+			return false, 0, dayErr
+		}
+		days[d] = true
+	}
+	now = now.In(loc)
+	// windows start on the configured days and may end the next day
+	for offset := -1; offset <= 7; offset++ {
+		day := now.AddDate(0, 0, offset)
+		if len(days) > 0 && !days[day.Weekday()] {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), startHour, startMinute, 0, 0, loc)
+		end := time.Date(day.Year(), day.Month(), day.Day(), endHour, endMinute, 0, 0, loc)
+		if !end.After(start) {
+			end = end.AddDate(0, 0, 1)
+		}
+		if !now.Before(start) && now.Before(end) {
+			return true, 0, nil
+		}
+		if start.After(now) {
+			return false, start.Sub(now), nil
+		}
+	}
+	return false, 0, fmt.Errorf("maintenance window never opens")
+}
+
 // versionTag returns the Docker image tag that maps to the provided
 // version.  Specifically, it returns "latest" for release versions
 // and "next" for pre-release versions.
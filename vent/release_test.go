@@ -15,10 +15,17 @@
 package vent
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/blang/semver"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus/hooks/test"
 )
 
 func TestVersionTag(t *testing.T) {
@@ -53,3 +60,188 @@ func TestTagDuration(t *testing.T) {
 		t.Errorf("expected next duration to be 4 hours: %v", nd)
 	}
 }
+
+func TestVersionConstraint(t *testing.T) {
+	current := semver.MustParse("0.17.1")
+	tests := []struct {
+		constraint string
+		version    string
+		expected   bool
+	}{
+		{"patch", "0.17.2", true},
+		{"patch", "0.18.0", false},
+		{"minor", "0.18.0", true},
+		{"minor", "1.0.0", false},
+		{"major", "1.0.0", true},
+		{">=0.17.0 <0.19.0", "0.18.3", true},
+		{">=0.17.0 <0.19.0", "0.19.0", false},
+	}
+	for _, tt := range tests {
+		allowed, err := versionConstraint(tt.constraint, current)
+		if err != nil {
+			t.Errorf("failed to parse constraint '%s': %v", tt.constraint, err)
+			continue
+		}
+		if allowed(semver.MustParse(tt.version)) != tt.expected {
+			t.Errorf("constraint '%s' allowing %s was not %v", tt.constraint, tt.version, tt.expected)
+		}
+	}
+	if _, err := versionConstraint("sometimes", current); err == nil {
+		t.Error("invalid constraint was parsed")
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	// 2020-06-06 is a Saturday
+	saturday := time.Date(2020, 6, 6, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		window  MaintenanceWindow
+		now     time.Time
+		open    bool
+		opensIn time.Duration
+	}{
+		{"inside", MaintenanceWindow{Start: "02:00", End: "04:00"}, saturday.Add(3 * time.Hour), true, 0},
+		{"before", MaintenanceWindow{Start: "02:00", End: "04:00"}, saturday.Add(90 * time.Minute), false, 30 * time.Minute},
+		{"after", MaintenanceWindow{Start: "02:00", End: "04:00"}, saturday.Add(4 * time.Hour), false, 22 * time.Hour},
+		{"past midnight", MaintenanceWindow{Days: []string{"fri"}, Start: "23:00", End: "01:00"}, saturday.Add(30 * time.Minute), true, 0},
+		{"next week", MaintenanceWindow{Days: []string{"Friday"}, Start: "23:00", End: "01:00"}, saturday.Add(2 * time.Hour), false, 6*24*time.Hour + 21*time.Hour},
+		{"time zone", MaintenanceWindow{Start: "02:00", End: "04:00", TimeZone: "Etc/GMT-2"}, saturday.Add(5 * time.Hour), false, 19 * time.Hour},
+	}
+	for _, tt := range tests {
+		open, opensIn, err := tt.window.check(tt.now)
+		if err != nil {
+			t.Errorf("%s: failed to check window: %v", tt.name, err)
+			continue
+		}
+		if open != tt.open || opensIn != tt.opensIn {
+			t.Errorf("%s: window open %v in %s rather than %v in %s", tt.name, open, opensIn, tt.open, tt.opensIn)
+		}
+	}
+
+	errs := MaintenanceWindow{Days: []string{"someday"}, Start: "2am", End: "25:00", TimeZone: "Mars/Olympus"}.validate("window")
+	fields := make([]string, len(errs))
+	for i, e := range errs {
+		fields[i] = e.Field
+	}
+	if strings.Join(fields, " ") != "window.start window.end window.days[0] window.timeZone" {
+		t.Errorf("window errors not as expected: %v", errs)
+	}
+}
+
+// releaseRegistry is a registry stand-in whose tags and digests can
+// be changed.
+type releaseRegistry struct {
+	mu      sync.Mutex
+	digests map[string]string
+	// manifests and blobs, if not nil, are the content of manifests
+	// by tag and of blobs by digest.
+	manifests map[string][]byte
+	blobs     map[string][]byte
+	requests  int
+}
+
+func (r *releaseRegistry) set(tag string, digest string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.digests[tag] = digest
+}
+
+func (r *releaseRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if req.URL.Path == "/v2/atomist/k8svent/tags/list" {
+		var tags []string
+		for tag := range r.digests {
+			tags = append(tags, tag)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": "atomist/k8svent", "tags": tags})
+		return
+	}
+	if blob, ok := r.blobs[strings.TrimPrefix(req.URL.Path, "/v2/atomist/k8svent/blobs/")]; ok {
+		_, _ = w.Write(blob)
+		return
+	}
+	tag := strings.TrimPrefix(req.URL.Path, "/v2/atomist/k8svent/manifests/")
+	if manifest, ok := r.manifests[tag]; ok {
+		_, _ = w.Write(manifest)
+		return
+	}
+	digest, ok := r.digests[tag]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Docker-Content-Digest", digest)
+}
+
+func TestReleaseChecker(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "release")
+
+	registry := &releaseRegistry{digests: map[string]string{
+		"0.17.0": "sha256:0170",
+		"0.17.1": "sha256:0171",
+		"latest": "sha256:0171",
+	}}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	events, fakeRecorder := newFakeEventRecorder()
+	update := Update{Image: strings.TrimPrefix(server.URL, "http://") + "/atomist/k8svent", Insecure: true}
+	current := semver.MustParse("0.17.1")
+	saturday := time.Date(2020, 6, 6, 0, 0, 0, 0, time.UTC)
+	c := &releaseChecker{
+		metrics:    newVentMetrics(),
+		events:     events,
+		config:     func() Config { return Config{Update: update} },
+		current:    &current,
+		defaultTag: "latest",
+		now:        func() time.Time { return saturday.Add(90 * time.Minute) },
+	}
+
+	if restart, rest := c.check(); restart || rest != 24*time.Hour {
+		t.Errorf("first check returned %v %s", restart, rest)
+	}
+
+	registry.set("0.18.0-rc.1", "sha256:0180rc1")
+	registry.set("0.18.0", "sha256:0180")
+	registry.set("latest", "sha256:0180")
+	update.Constraint = "patch"
+	for i := 0; i < 2; i++ {
+		if restart, _ := c.check(); restart {
+			t.Error("restarted for version not satisfying constraint")
+		}
+	}
+	recorded := recordedEvents(fakeRecorder)
+	if len(recorded) != 1 || !strings.Contains(recorded[0], "UpdateAvailable") ||
+		!strings.Contains(recorded[0], "version 0.18.0 does not satisfy constraint 'patch'") {
+		t.Errorf("events not as expected: %v", recorded)
+	}
+
+	update.Constraint = "minor"
+	update.Window = MaintenanceWindow{Start: "02:00", End: "04:00"}
+	if restart, rest := c.check(); restart || rest != 30*time.Minute {
+		t.Errorf("check outside maintenance window returned %v %s", restart, rest)
+	}
+	c.now = func() time.Time { return saturday.Add(150 * time.Minute) }
+	if restart, _ := c.check(); !restart {
+		t.Error("did not restart for version satisfying constraint inside maintenance window")
+	}
+
+	update.Policy = UpdatePolicyNotify
+	if restart, _ := c.check(); restart {
+		t.Error("restarted with notify policy")
+	}
+
+	update.Policy = UpdatePolicyOff
+	requests := registry.requests
+	if restart, _ := c.check(); restart || registry.requests != requests {
+		t.Errorf("checked registry with policy off: %v %d", restart, registry.requests-requests)
+	}
+	if testutil.ToFloat64(c.metrics.releaseChecks.WithLabelValues(releaseAvailable)) != 4 ||
+		testutil.ToFloat64(c.metrics.releaseChecks.WithLabelValues(releaseUpdated)) != 1 {
+		t.Errorf("release checks not as expected: %v", c.metrics.releaseChecks)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ConfigLoader loads the complete configuration, e.g., by reading
+// the configuration file and applying command-line options.
+type ConfigLoader func() (Config, error)
+
+// reloadDelay is how long to wait after a change to the configuration
+// file before reloading it, so a burst of file system events results
+// in a single reload.
+const reloadDelay = 1 * time.Second
+
+// reloadOnSignal calls reload every time the process receives SIGHUP.
+func reloadOnSignal(reload func()) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			moduleLogger(LogModuleConfig).Info("Received SIGHUP, reloading configuration")
+			reload()
+		}
+	}()
+}
+
+// watchConfig watches configFile and calls reload when its contents
+// change.  The directory containing the file is watched rather than
+// the file itself so changes made by replacing the file, including
+// the symbolic link swap Kubernetes uses to update mounted
+// ConfigMaps, are detected.  It returns a function that stops
+// watching.
+func watchConfig(configFile string, reload func()) (func(), error) {
+	watcher, watcherErr := fsnotify.NewWatcher()
+	if watcherErr != nil {
+		return nil, watcherErr
+	}
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	lastContents, _ := ioutil.ReadFile(configFile)
+	done := make(chan struct{})
+	go func() {
+		log := moduleLogger(LogModuleConfig)
+		var timer <-chan time.Time
+		for {
+			select {
+			case <-done:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				log.Tracef("Configuration directory event: %s", event)
+				timer = time.After(reloadDelay)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warnf("Error watching configuration file %s: %v", configFile, err)
+			case <-timer:
+				timer = nil
+				contents, readErr := ioutil.ReadFile(configFile)
+				if readErr != nil {
+					log.Warnf("Failed to read configuration file %s: %v", configFile, readErr)
+					continue
+				}
+				if bytes.Equal(contents, lastContents) {
+					continue
+				}
+				lastContents = contents
+				log.Infof("Configuration file %s changed, reloading configuration", configFile)
+				reload()
+			}
+		}
+	}()
+	stop := func() {
+		close(done)
+		watcher.Close()
+	}
+	return stop, nil
+}
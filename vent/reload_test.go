@@ -0,0 +1,121 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestVenterReload(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "reload")
+
+	v := &Venter{}
+	initial := Config{Webhooks: []Webhook{{URL: "https://one.com/webhook"}}}
+	if err := v.setConfig(initial); err != nil {
+		t.Fatalf("failed to set valid configuration: %v", err)
+	}
+
+	v.reload(func() (Config, error) {
+		return Config{Webhooks: []Webhook{{URL: "ftp://two.com/webhook"}}}, nil
+	})
+	if hooks := v.podWebhooks(v1.Pod{}); len(hooks) != 1 || hooks[0].url != "https://one.com/webhook" {
+		t.Errorf("invalid configuration replaced current configuration: %v", hooks)
+	}
+
+	v.reload(func() (Config, error) { return Config{}, errors.New("cannot read file") })
+	if hooks := v.podWebhooks(v1.Pod{}); len(hooks) != 1 || hooks[0].url != "https://one.com/webhook" {
+		t.Errorf("failed load replaced current configuration: %v", hooks)
+	}
+
+	v.reload(func() (Config, error) {
+		return Config{
+			Namespace: "atomist",
+			Webhooks:  []Webhook{{URL: "https://two.com/webhook"}, {URL: "https://three.com/webhook"}},
+		}, nil
+	})
+	if hooks := v.podWebhooks(v1.Pod{}); len(hooks) != 2 || hooks[0].url != "https://two.com/webhook" {
+		t.Errorf("valid configuration was not applied: %v", hooks)
+	}
+	if ns := v.currentConfig().Namespace; ns != "atomist" {
+		t.Errorf("namespace was not updated: %s", ns)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "reload")
+
+	dir, dirErr := ioutil.TempDir("", "k8svent-reload")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dir)
+
+	// mimic the layout of a mounted ConfigMap
+	writeData := func(name, contents string) {
+		dataDir := filepath.Join(dir, name)
+		if err := os.Mkdir(dataDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dataDir, "k8svent.yaml"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tmpLink := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(name, tmpLink); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmpLink, filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeData("..1", "logLevel: info\n")
+	configFile := filepath.Join(dir, "k8svent.yaml")
+	if err := os.Symlink(filepath.Join("..data", "k8svent.yaml"), configFile); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := make(chan struct{}, 10)
+	stop, watchErr := watchConfig(configFile, func() { reloaded <- struct{}{} })
+	if watchErr != nil {
+		t.Fatalf("failed to watch configuration: %v", watchErr)
+	}
+	defer stop()
+
+	writeData("..2", "logLevel: debug\n")
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("configuration was not reloaded after ConfigMap update")
+	}
+
+	// touching the data without changing it should not reload
+	if err := os.Chtimes(filepath.Join(dir, "..2", "k8svent.yaml"), time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloaded:
+		t.Error("configuration was reloaded when contents did not change")
+	case <-time.After(reloadDelay + 500*time.Millisecond):
+	}
+}
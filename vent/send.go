@@ -0,0 +1,173 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// EndpointSummary is the outcome of sending pods to a webhook
+// endpoint once.
+type EndpointSummary struct {
+	// URL is the webhook endpoint.
+	URL string
+	// Sent is the number of pods delivered.
+	Sent uint64
+	// Failed is the number of pods that could not be delivered.
+	Failed uint64
+	// Abandoned is the number of deliveries not completed before
+	// sending was interrupted.
+	Abandoned int
+	// LastError is the error of the last failed delivery.
+	LastError string
+}
+
+// DeliverySummary is the outcome of sending pods once, e.g., using
+// Snapshot or Send.
+type DeliverySummary struct {
+	// Pods is the number of pods sent.
+	Pods int
+	// Endpoints are the outcomes for each webhook endpoint sent
+	// to, sorted by URL.
+	Endpoints []EndpointSummary
+}
+
+// Failed returns true if any delivery failed or was abandoned.
+func (s DeliverySummary) Failed() bool {
+	for _, e := range s.Endpoints {
+		if e.Failed > 0 || e.Abandoned > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Send gets the pod identified by slug, NAMESPACE/NAME, and sends it
+// as changed to its webhooks, including those added by annotations
+// and VentSinks, using the normal signing and retries.  The filters
+// are not applied.  If deleted is true, the pod is sent as deleted
+// with the phase "Deleted", like pods that no longer exist; if the pod
+// does not exist, only its namespace and name are sent.  Send waits
+// for the deliveries to complete and returns a summary of their
+// outcome.  Deliveries still pending when ctx is done are abandoned.
+func Send(ctx context.Context, config Config, slug string, deleted bool) (DeliverySummary, error) {
+	v, clientset, sinks, done, setupErr := newOneShotVenter(config, true)
+	if setupErr != nil {
+		return DeliverySummary{}, setupErr
+	}
+	defer done()
+	return v.send(ctx, clientset, sinks, slug, deleted)
+}
+
+// send gets and sends the pod, see Send.
+func (v *Venter) send(ctx context.Context, clientset kubernetes.Interface, sinks []*ventSink, slug string, deleted bool) (DeliverySummary, error) {
+	parts := strings.Split(slug, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return DeliverySummary{}, fmt.Errorf("pod '%s' is not of the form NAMESPACE/NAME", slug)
+	}
+	pod, getErr := clientset.CoreV1().Pods(parts[0]).Get(parts[1], metav1.GetOptions{})
+	if errors.IsNotFound(getErr) && deleted {
+		pod = &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: parts[0], Name: parts[1]}}
+	} else if getErr != nil {
+		return DeliverySummary{}, fmt.Errorf("failed to get pod %s: %v", slug, getErr)
+	}
+	event := PodChanged
+	if deleted {
+		pod.Status.Phase = "Deleted"
+		event = PodDeleted
+	}
+	return v.sendPods(ctx, clientset, sinks, []v1.Pod{*pod}, event), nil
+}
+
+// newOneShotVenter sets up logging and creates a Venter and the
+// Kubernetes API clients for sending pods once rather than
+// continuously.  If sinks is true, the current VentSinks are loaded.
+// In a dry run, payloads are printed to standard output rather than
+// sent.  Call done when finished with the Venter to close the sinks.
+func newOneShotVenter(config Config, sinks bool) (*Venter, kubernetes.Interface, []*ventSink, func(), error) {
+	if err := setupLogger(config); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("invalid logging configuration: %v", err)
+	}
+	v := newVenter()
+	if err := v.setConfig(config); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if config.DryRun {
+		v.dryRun = newDryRun(os.Stdout)
+	}
+	clientset, dynamicClient, clientErr := inClusterClients()
+	if clientErr != nil {
+		return nil, nil, nil, nil, clientErr
+	}
+	stop := make(chan struct{})
+	done := func() {
+		close(stop)
+		v.closeSinks()
+	}
+	if !sinks {
+		return v, clientset, nil, done, nil
+	}
+	watcher := newSinkWatcher(dynamicClient, nil)
+	if err := watcher.start(stop); err != nil {
+		logger.Infof("VentSinks are not available, ignoring them: %v", err)
+		return v, clientset, nil, done, nil
+	}
+	return v, clientset, watcher.current(), done, nil
+}
+
+// sendPods sends the pods for event to their webhooks and waits until
+// the deliveries complete or ctx is done, abandoning those still
+// pending.  It returns the outcome of the deliveries.
+func (v *Venter) sendPods(ctx context.Context, clientset kubernetes.Interface, sinks []*ventSink, pods []v1.Pod, event PodEvent) DeliverySummary {
+	config := v.currentConfig()
+	v.setRouter(newWebhookRouter(clientset, config, sinks, nil))
+	deliveryCtx, abandon := context.WithCancel(context.Background())
+	defer abandon()
+	v.logger().Infof("Sending %d pods", len(pods))
+	for _, pod := range pods {
+		if ctx.Err() != nil {
+			break
+		}
+		payload := webhookPayload{Pod: pod, event: event}
+		v.deliver(deliveryCtx, v.podWebhooks(pod), &payload, nil)
+	}
+	if !v.endpoints.drain(ctx) {
+		v.logger().Warnf("Abandoning %d pending deliveries", v.endpoints.pendingCount())
+	}
+
+	statuses := v.endpoints.statuses()
+	abandon()
+	summary := DeliverySummary{Pods: len(pods)}
+	for url, status := range statuses {
+		summary.Endpoints = append(summary.Endpoints, EndpointSummary{
+			URL:       redactURL(url),
+			Sent:      status.sent,
+			Failed:    status.failed,
+			Abandoned: status.pending,
+			LastError: status.lastError,
+		})
+	}
+	sort.Slice(summary.Endpoints, func(i, j int) bool { return summary.Endpoints[i].URL < summary.Endpoints[j].URL })
+	return summary
+}
@@ -0,0 +1,94 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSend(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "send")
+
+	var mu sync.Mutex
+	var received []webhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		received = append(received, payload)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kube-dns"},
+			Status:     v1.PodStatus{Phase: v1.PodRunning},
+		},
+	)
+	config := Config{
+		Webhooks: []Webhook{{URL: server.URL + "/webhook"}},
+		Filters:  Filters{ExcludeNamespaces: []string{"kube-system"}},
+	}
+
+	tests := []struct {
+		slug    string
+		deleted bool
+		phase   v1.PodPhase
+	}{
+		{slug: "kube-system/kube-dns", phase: v1.PodRunning},
+		{slug: "kube-system/kube-dns", deleted: true, phase: "Deleted"},
+		{slug: "kube-system/coredns", deleted: true, phase: "Deleted"},
+	}
+	for _, tt := range tests {
+		received = nil
+		v := newVenter()
+		if err := v.setConfig(config); err != nil {
+			t.Fatalf("failed to set configuration: %v", err)
+		}
+		summary, err := v.send(context.Background(), clientset, nil, tt.slug, tt.deleted)
+		if err != nil {
+			t.Errorf("failed to send %s: %v", tt.slug, err)
+			continue
+		}
+		if summary.Pods != 1 || len(summary.Endpoints) != 1 || summary.Endpoints[0].Sent != 1 || summary.Failed() {
+			t.Errorf("summary of sending %s not as expected: %+v", tt.slug, summary)
+		}
+		if len(received) != 1 || podSlug(received[0].Pod) != tt.slug || received[0].Pod.Status.Phase != tt.phase {
+			t.Errorf("received payloads for %s not as expected: %+v", tt.slug, received)
+		}
+	}
+
+	for _, slug := range []string{"kube-system/coredns", "kube-dns", "kube-system/", "a/b/c"} {
+		v := newVenter()
+		if err := v.setConfig(config); err != nil {
+			t.Fatalf("failed to set configuration: %v", err)
+		}
+		if _, err := v.send(context.Background(), clientset, nil, slug, false); err == nil {
+			t.Errorf("sending %s did not fail", slug)
+		}
+	}
+}
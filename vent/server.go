@@ -0,0 +1,83 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultListen is the address the k8svent HTTP server, providing
+// metrics, health checks, and the admin API, listens on if none is
+// configured.
+const DefaultListen = ":8080"
+
+// readHeaderTimeout is how long the k8svent HTTP server waits for the
+// headers of a request, so slow clients cannot hold connections open.
+const readHeaderTimeout = 10 * time.Second
+
+// idleTimeout is how long the k8svent HTTP server keeps idle
+// keep-alive connections open.
+const idleTimeout = 2 * time.Minute
+
+// serverShutdownTimeout is how long the k8svent HTTP server waits for
+// active requests to complete when shutting down.
+const serverShutdownTimeout = 5 * time.Second
+
+// Handler returns the handler serving the metrics, health checks, and
+// admin API of the Venter.
+func (v *Venter) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(v.metrics, v.endpoints, v.log))
+	mux.Handle("/healthz", healthHandler(func() error { return v.metrics.liveness(time.Now()) }, nil, v.log))
+	mux.Handle("/readyz", healthHandler(func() error { return v.metrics.readiness(time.Now()) }, v.endpoints.openCircuits, v.log))
+	mux.Handle(adminPrefix, v.adminHandler())
+	return mux
+}
+
+// serve starts the k8svent HTTP server listening on addr in a
+// separate go routine and shuts it down when ctx is done.  It returns
+// an error if it cannot listen on addr.
+func serve(ctx context.Context, addr string, handler http.Handler) error {
+	if addr == "" {
+		addr = DefaultListen
+	}
+	listener, listenErr := net.Listen("tcp", addr)
+	if listenErr != nil {
+		return listenErr
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	moduleLogger(LogModuleServer).Infof("Serving HTTP on %s", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			moduleLogger(LogModuleServer).Errorf("HTTP server failed: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			moduleLogger(LogModuleServer).Warnf("Failed to shut down HTTP server: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,195 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// DefaultShutdownGracePeriod is how long k8svent waits for pending
+// deliveries to complete when shutting down if no grace period is
+// configured.  It leaves time to write the spool file, Kubernetes
+// Events, and traces within the default Kubernetes termination grace
+// period of 30 seconds.
+const DefaultShutdownGracePeriod = 20 * time.Second
+
+// drainInterval is how often pending deliveries are counted while
+// draining.
+const drainInterval = 100 * time.Millisecond
+
+// abandonTimeout is how long to wait for abandoned deliveries to stop
+// before spooling them.  Deliveries stop as soon as they are
+// abandoned, so it only limits the wait for stuck sinks.
+const abandonTimeout = 2 * time.Second
+
+// spooledDelivery is a delivery abandoned when k8svent shut down,
+// persisted so it can be sent when k8svent starts again.
+type spooledDelivery struct {
+	// URL is the webhook endpoint.
+	URL string `json:"url"`
+	// Event is why the pod was sent.
+	Event PodEvent `json:"event"`
+	// Pod is the pod being sent.
+	Pod v1.Pod `json:"pod"`
+}
+
+// deliveryContext has the values of another context, e.g., its span,
+// but is only done when its embedded context is.  It lets deliveries
+// outlive the context of the cycle that started them.
+type deliveryContext struct {
+	context.Context
+	values context.Context
+}
+
+// Value returns the value of key in the values context.
+func (c deliveryContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
+// deliveryContext returns the context deliveries started with ctx run
+// in.  It has the values of ctx but is only done when the deliveries
+// are abandoned at shutdown.
+func (v *Venter) deliveryContext(ctx context.Context) context.Context {
+	ctx = withLogger(ctx, v.log)
+	if v.deliveryCtx == nil {
+		return ctx
+	}
+	return deliveryContext{Context: v.deliveryCtx, values: ctx}
+}
+
+// shutdownGracePeriod returns the configured shutdown grace period.
+func (c Config) shutdownGracePeriod() time.Duration {
+	if d, err := time.ParseDuration(c.ShutdownGracePeriod); err == nil {
+		return d
+	}
+	return DefaultShutdownGracePeriod
+}
+
+// drain waits up to the configured grace period for pending
+// deliveries to complete.  It then abandons the remaining deliveries
+// by calling abandon, waits briefly for them to stop, and writes those
+// that did not complete and the unsent spooled deliveries to the spool
+// file, if one is configured.
+func (v *Venter) drain(abandon context.CancelFunc, unsent []spooledDelivery) {
+	config := v.currentConfig()
+	grace := config.shutdownGracePeriod()
+	v.logger().Infof("Waiting up to %s for %d pending deliveries", grace, v.endpoints.pendingCount())
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	v.endpoints.drain(ctx)
+	cancel()
+	abandon()
+	ctx, cancel = context.WithTimeout(context.Background(), abandonTimeout)
+	v.endpoints.drain(ctx)
+	cancel()
+	pending := append(unsent, v.endpoints.unfinished()...)
+	if len(pending) == 0 {
+		v.logger().Info("All deliveries completed")
+		return
+	}
+	if config.SpoolFile == "" {
+		v.logger().Warnf("Abandoning %d pending deliveries, configure a spool file to keep them", len(pending))
+		return
+	}
+	if err := writeSpool(config.SpoolFile, pending); err != nil {
+		v.logger().Errorf("Failed to persist %d pending deliveries: %v", len(pending), err)
+		return
+	}
+	v.logger().Infof("Persisted %d pending deliveries to %s", len(pending), config.SpoolFile)
+}
+
+// writeSpool writes the deliveries to the spool file, replacing it
+// atomically.
+func writeSpool(spoolFile string, deliveries []spooledDelivery) error {
+	data, jsonErr := json.Marshal(deliveries)
+	if jsonErr != nil {
+		return fmt.Errorf("failed to marshal deliveries: %v", jsonErr)
+	}
+	tmp, tmpErr := ioutil.TempFile(filepath.Dir(spoolFile), filepath.Base(spoolFile)+".")
+	if tmpErr != nil {
+		return fmt.Errorf("failed to create spool file: %v", tmpErr)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write spool file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write spool file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), spoolFile); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace spool file %s: %v", spoolFile, err)
+	}
+	return nil
+}
+
+// readSpool reads and removes the spool file.  If it does not exist,
+// there are no spooled deliveries.
+func readSpool(spoolFile string) ([]spooledDelivery, error) {
+	data, readErr := ioutil.ReadFile(spoolFile)
+	if os.IsNotExist(readErr) {
+		return nil, nil
+	} else if readErr != nil {
+		return nil, fmt.Errorf("failed to read spool file %s: %v", spoolFile, readErr)
+	}
+	var deliveries []spooledDelivery
+	if err := json.Unmarshal(data, &deliveries); err != nil {
+		return nil, fmt.Errorf("failed to parse spool file %s: %v", spoolFile, err)
+	}
+	if err := os.Remove(spoolFile); err != nil {
+		return nil, fmt.Errorf("failed to remove spool file %s: %v", spoolFile, err)
+	}
+	return deliveries, nil
+}
+
+// sendSpooled sends the deliveries read from the spool file to the
+// webhooks of their pods with the same URL.  Deliveries of the pods in
+// current are dropped, since the first cycle sends their current
+// state, as are deliveries to webhooks the pod is no longer routed to.
+func (v *Venter) sendSpooled(ctx context.Context, deliveries []spooledDelivery, current []v1.Pod) {
+	resent := map[string]bool{}
+	for _, pod := range current {
+		resent[podSlug(pod)] = true
+	}
+	for _, d := range deliveries {
+		log := v.moduleLogger(LogModuleDelivery).WithField("pod", podSlug(d.Pod))
+		if resent[podSlug(d.Pod)] {
+			log.Infof("Dropping spooled %s delivery to '%s', sending the current state of the pod instead", d.Event, redactURL(d.URL))
+			continue
+		}
+		var hooks []webhook
+		for _, hook := range v.podWebhooks(d.Pod) {
+			if hook.url == d.URL {
+				hooks = append(hooks, hook)
+			}
+		}
+		if len(hooks) == 0 {
+			log.Warnf("Dropping spooled %s delivery to '%s', which is no longer a webhook of the pod", d.Event, redactURL(d.URL))
+			continue
+		}
+		log.Infof("Sending spooled %s delivery to '%s'", d.Event, redactURL(d.URL))
+		payload := webhookPayload{Pod: d.Pod, event: d.Event}
+		v.deliver(ctx, hooks, &payload, nil)
+	}
+}
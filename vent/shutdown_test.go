@@ -0,0 +1,212 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDrain(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "shutdown")
+
+	dir, dirErr := ioutil.TempDir("", "k8svent-spool")
+	if dirErr != nil {
+		t.Fatalf("failed to create temporary directory: %v", dirErr)
+	}
+	defer os.RemoveAll(dir)
+	spoolFile := filepath.Join(dir, "spool.json")
+
+	received := make(chan string, 10)
+	block := make(chan struct{})
+	defer close(block)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		if payload.Pod.Name == "slow" {
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		received <- podSlug(payload.Pod)
+	}))
+	defer server.Close()
+	hookURL := server.URL + "/webhook"
+
+	v := newVenter()
+	deliveryCtx, abandon := context.WithCancel(context.Background())
+	v.deliveryCtx = deliveryCtx
+	if err := v.setConfig(Config{Webhooks: []Webhook{{URL: hookURL}}, ShutdownGracePeriod: "200ms", SpoolFile: spoolFile}); err != nil {
+		t.Fatalf("failed to set configuration: %v", err)
+	}
+	fast := v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "grunge", Name: "fast"}}
+	slow := v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "grunge", Name: "slow"}}
+	for _, pod := range []v1.Pod{fast, slow} {
+		if err := v.processPod(context.Background(), pod, PodNew); err != nil {
+			t.Fatalf("failed to process pod: %v", err)
+		}
+	}
+	unsent := []spooledDelivery{{URL: hookURL, Event: PodDeleted, Pod: v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "grunge", Name: "gone"}}}}
+	v.drain(abandon, unsent)
+
+	select {
+	case slug := <-received:
+		if slug != "grunge/fast" {
+			t.Errorf("received %s rather than grunge/fast", slug)
+		}
+	default:
+		t.Error("fast delivery did not complete while draining")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for v.endpoints.pendingCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := v.endpoints.get(hookURL).status()
+	if status.pending != 0 || status.sent != 1 || status.failed != 0 {
+		t.Errorf("abandoned delivery not as expected: %+v", status)
+	}
+
+	spooled, readErr := readSpool(spoolFile)
+	if readErr != nil {
+		t.Fatalf("failed to read spool: %v", readErr)
+	}
+	if len(spooled) != 2 || spooled[0].Pod.Name != "gone" || spooled[0].Event != PodDeleted ||
+		spooled[1].Pod.Name != "slow" || spooled[1].Event != PodNew || spooled[1].URL != hookURL {
+		t.Errorf("spooled deliveries not as expected: %+v", spooled)
+	}
+	if _, err := os.Stat(spoolFile); !os.IsNotExist(err) {
+		t.Errorf("spool file was not removed: %v", err)
+	}
+
+	restarted := newVenter()
+	if err := restarted.setConfig(Config{Webhooks: []Webhook{{URL: hookURL}}}); err != nil {
+		t.Fatalf("failed to set configuration: %v", err)
+	}
+	spooled = append(spooled, spooledDelivery{URL: "https://nowhere.com/webhook", Event: PodNew, Pod: fast})
+	restarted.sendSpooled(context.Background(), spooled[:1], nil)
+	select {
+	case slug := <-received:
+		if slug != "grunge/gone" {
+			t.Errorf("received %s rather than grunge/gone", slug)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("spooled delivery was not sent")
+	}
+	restarted.sendSpooled(context.Background(), spooled[2:], nil)
+	if _, ok := restarted.endpoints.statuses()["https://nowhere.com/webhook"]; ok {
+		t.Error("spooled delivery to unknown webhook was sent")
+	}
+
+	// the first cycle sends the current state of existing pods, so
+	// their spooled deliveries are stale
+	restarted.sendSpooled(context.Background(), spooled[1:2], []v1.Pod{slow})
+	deadline = time.Now().Add(5 * time.Second)
+	for restarted.endpoints.pendingCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := restarted.endpoints.get(hookURL).status(); status.pending != 0 || status.sent != 1 {
+		t.Errorf("spooled delivery of a pod sent in the first cycle was sent: %+v", status)
+	}
+}
+
+func TestDrainCompletedWhenAbandoned(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "shutdown")
+
+	dir, dirErr := ioutil.TempDir("", "k8svent-spool")
+	if dirErr != nil {
+		t.Fatalf("failed to create temporary directory: %v", dirErr)
+	}
+	defer os.RemoveAll(dir)
+	spoolFile := filepath.Join(dir, "spool.json")
+
+	// deliveries to slow complete just as they are abandoned, those
+	// to stuck fail because they are abandoned
+	started := make(chan string, 2)
+	RegisterSinkScheme("test", func(u *url.URL) (Sink, error) {
+		return SinkFunc(func(ctx context.Context, msg Message) error {
+			started <- u.Path
+			<-ctx.Done()
+			if u.Path == "/slow" {
+				return nil
+			}
+			return ctx.Err()
+		}), nil
+	})
+	defer func() {
+		schemesMu.Lock()
+		delete(schemes, "test")
+		schemesMu.Unlock()
+	}()
+
+	v := newVenter()
+	deliveryCtx, abandon := context.WithCancel(context.Background())
+	v.deliveryCtx = deliveryCtx
+	config := Config{
+		Webhooks:            []Webhook{{URL: "test://queue/slow"}, {URL: "test://queue/stuck"}},
+		ShutdownGracePeriod: "10ms",
+		SpoolFile:           spoolFile,
+	}
+	if err := v.setConfig(config); err != nil {
+		t.Fatalf("failed to set configuration: %v", err)
+	}
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "grunge", Name: "alice"}}
+	if err := v.processPod(context.Background(), pod, PodNew); err != nil {
+		t.Fatalf("failed to process pod: %v", err)
+	}
+	<-started
+	<-started
+	v.drain(abandon, nil)
+
+	spooled, readErr := readSpool(spoolFile)
+	if readErr != nil {
+		t.Fatalf("failed to read spool: %v", readErr)
+	}
+	if len(spooled) != 1 || spooled[0].URL != "test://queue/stuck" {
+		t.Errorf("expected only the stuck delivery to be spooled, spooled %+v", spooled)
+	}
+	if status := v.endpoints.get("test://queue/slow").status(); status.sent != 1 {
+		t.Errorf("delivery completing when abandoned not recorded as sent: %+v", status)
+	}
+}
+
+func TestListPodsStops(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "grunge", Name: "cornell"}})
+	pods, err := listPods(context.Background(), clientset, "", "")
+	if err != nil || len(pods) != 1 {
+		t.Errorf("failed to list pods: %d %v", len(pods), err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := listPods(ctx, clientset, "", ""); err != context.Canceled {
+		t.Errorf("listing pods did not stop: %v", err)
+	}
+}
@@ -16,7 +16,9 @@ package vent
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 )
@@ -31,3 +33,25 @@ func generateSignature(payload []byte, key string) (s string, e error) {
 	sig := hex.EncodeToString(sum)
 	return "sha1=" + sig, nil
 }
+
+// generateDeliverySignature creates a HMAC/SHA-256 signature for the
+// delivery ID, timestamp, and payload using key.  Receivers use it to
+// reject stale and replayed requests.
+func generateDeliverySignature(delivery string, timestamp string, payload []byte, key string) (s string, e error) {
+	mac := hmac.New(sha256.New, []byte(key))
+	for _, part := range [][]byte{[]byte(delivery + "." + timestamp + "."), payload} {
+		if _, err := mac.Write(part); err != nil {
+			return s, fmt.Errorf("failed to write payload to HMAC: %v", err)
+		}
+	}
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// generateDeliveryID returns a random identifier for a delivery.
+func generateDeliveryID() (d string, e error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return d, fmt.Errorf("failed to generate delivery ID: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -28,3 +28,14 @@ func TestGenerateSignature(t *testing.T) {
 		t.Errorf("failed to generate proper signature: '%s' (expected: '%s')", s1, e1)
 	}
 }
+
+func TestGenerateDeliverySignature(t *testing.T) {
+	s1, err := generateDeliverySignature("d3l1v3ry", "1592438400", []byte(`{"jason":"isbell"}`), "The400Unit")
+	if err != nil {
+		t.Errorf("failed to create signature: %v", err)
+	}
+	e1 := "sha256=3b970590bd8ed69a2ee18e584cabec9c7cdaaf5e356717d5c818e705a540e23e"
+	if s1 != e1 {
+		t.Errorf("failed to generate proper signature: '%s' (expected: '%s')", s1, e1)
+	}
+}
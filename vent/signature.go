@@ -0,0 +1,219 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+// Cosign signature conventions.  Signatures of an image digest are
+// stored as the layers of an OCI image manifest tagged with the
+// digest, e.g., sha256-1234.sig, in the same repository.
+const (
+	// cosignSignatureSuffix is appended to the digest to create the
+	// signature tag.
+	cosignSignatureSuffix = ".sig"
+	// cosignPayloadMediaType is the media type of signed payload
+	// layers.
+	cosignPayloadMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// cosignSignatureAnnotation is the layer annotation holding the
+	// base64-encoded signature of the payload.
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// cosignSignatureType is the type of the signed payload.
+	cosignSignatureType = "cosign container image signature"
+)
+
+// ociManifest is the part of an OCI image manifest needed to find
+// signatures.
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// ociDescriptor describes a layer of an OCI image.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// simpleSigningPayload is the payload signed by cosign, identifying
+// the image signed by its digest.
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// ecdsaSignature is an ASN.1-encoded ECDSA signature.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// loadVerificationKey reads the PEM-encoded ECDSA, RSA, or Ed25519
+// public key in keyFile, e.g., a cosign.pub file.
+func loadVerificationKey(keyFile string) (crypto.PublicKey, error) {
+	keyBytes, readErr := ioutil.ReadFile(keyFile)
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read public key file %s: %v", keyFile, readErr)
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key file %s: no PEM data found", keyFile)
+	}
+	key, parseErr := x509.ParsePKIXPublicKey(block.Bytes)
+	if parseErr != nil {
+		return nil, fmt.Errorf("invalid public key file %s: %v", keyFile, parseErr)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid public key file %s: unsupported key type %T", keyFile, key)
+}
+
+// verifyImageSignature verifies that the image with digest has a
+// cosign signature made with the private key of key.  It returns nil
+// if any of the signatures of the digest is valid.
+func verifyImageSignature(image *releaseImage, digest string, key crypto.PublicKey) error {
+	sigTag := strings.Replace(digest, ":", "-", 1) + cosignSignatureSuffix
+	manifestBytes, manifestErr := image.client.manifest(image.ref, sigTag, image.creds)
+	if manifestErr != nil {
+		return fmt.Errorf("failed to get signatures of %s: %v", digest, manifestErr)
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return fmt.Errorf("failed to parse signature manifest %s: %v", sigTag, err)
+	}
+	var errs []string
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != cosignPayloadMediaType {
+			continue
+		}
+		err := verifySignatureLayer(image, layer, digest, key)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no signatures of %s found in %s", digest, sigTag)
+	}
+	return fmt.Errorf("no valid signature of %s: %s", digest, strings.Join(errs, "; "))
+}
+
+// verifySignatureLayer verifies the signature of the payload in the
+// signature layer and that the payload identifies the digest in the
+// repository of image.
+func verifySignatureLayer(image *releaseImage, layer ociDescriptor, digest string, key crypto.PublicKey) error {
+	signature, decodeErr := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+	if decodeErr != nil || len(signature) == 0 {
+		return fmt.Errorf("layer %s has no valid signature annotation", layer.Digest)
+	}
+	payload, blobErr := image.client.blob(image.ref, layer.Digest, image.creds)
+	if blobErr != nil {
+		return blobErr
+	}
+	if err := verifySignature(payload, signature, key); err != nil {
+		return fmt.Errorf("signature of layer %s: %v", layer.Digest, err)
+	}
+	var signed simpleSigningPayload
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return fmt.Errorf("failed to parse signed payload %s: %v", layer.Digest, err)
+	}
+	if signed.Critical.Type != cosignSignatureType {
+		return fmt.Errorf("signed payload %s has unexpected type '%s'", layer.Digest, signed.Critical.Type)
+	}
+	if signed.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signed payload %s is for %s", layer.Digest, signed.Critical.Image.DockerManifestDigest)
+	}
+	if !signedRepository(signed.Critical.Identity.DockerReference, image.ref) {
+		return fmt.Errorf("signed payload %s is for image '%s', not %s/%s", layer.Digest,
+			signed.Critical.Identity.DockerReference, image.ref.registry, image.ref.repository)
+	}
+	return nil
+}
+
+// dockerHubAliases are the other names of the Docker Hub registry
+// used in signed references.
+var dockerHubAliases = map[string]bool{"index.docker.io": true, "registry-1.docker.io": true}
+
+// signedRepository returns true if the docker-reference of a signed
+// payload names the repository of ref.  Tags and digests in the
+// reference are ignored, since the digest is checked separately.
+func signedRepository(reference string, ref imageReference) bool {
+	if i := strings.Index(reference, "@"); i >= 0 {
+		reference = reference[:i]
+	}
+	signed, err := parseImageReference(reference)
+	if err != nil {
+		return false
+	}
+	if dockerHubAliases[signed.registry] {
+		signed.registry = dockerHubRegistry
+		if !strings.Contains(signed.repository, "/") {
+			signed.repository = "library/" + signed.repository
+		}
+	}
+	return signed.registry == ref.registry && signed.repository == ref.repository
+}
+
+// verifySignature verifies the signature of the SHA-256 digest of
+// payload using key.
+func verifySignature(payload []byte, signature []byte, key crypto.PublicKey) error {
+	sum := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		var sig ecdsaSignature
+		if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+			return fmt.Errorf("malformed ECDSA signature")
+		}
+		if !ecdsa.Verify(k, sum[:], sig.R, sig.S) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], signature); err != nil {
+			if pssErr := rsa.VerifyPSS(k, crypto.SHA256, sum[:], signature, nil); pssErr != nil {
+				return fmt.Errorf("invalid RSA signature")
+			}
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, signature) {
+			return fmt.Errorf("invalid Ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
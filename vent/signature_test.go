@@ -0,0 +1,206 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// cosignSign adds a cosign signature of digest by key to the
+// registry stand-in, whose payload identifies signedDigest in the
+// repository reference.
+func cosignSign(t *testing.T, registry *releaseRegistry, key crypto.Signer, digest string, reference string, signedDigest string) {
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"%s"},`+
+		`"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`, reference, signedDigest))
+	sum := sha256.Sum256(payload)
+	var opts crypto.SignerOpts = crypto.SHA256
+	signature, signErr := key.Sign(rand.Reader, sum[:], opts)
+	if signErr != nil {
+		t.Fatalf("failed to sign payload: %v", signErr)
+	}
+	layerDigest := "sha256:" + hex.EncodeToString(sum[:])
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"layers": []map[string]interface{}{{
+			"mediaType":   cosignPayloadMediaType,
+			"digest":      layerDigest,
+			"size":        len(payload),
+			"annotations": map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+		}},
+	})
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.manifests == nil {
+		registry.manifests = map[string][]byte{}
+		registry.blobs = map[string][]byte{}
+	}
+	registry.manifests[strings.Replace(digest, ":", "-", 1)+".sig"] = manifest
+	registry.blobs[layerDigest] = payload
+}
+
+// writePublicKey writes the PEM-encoded public key to a file in dir.
+func writePublicKey(t *testing.T, dir string, name string, key crypto.PublicKey) string {
+	der, derErr := x509.MarshalPKIXPublicKey(key)
+	if derErr != nil {
+		t.Fatalf("failed to marshal public key: %v", derErr)
+	}
+	keyFile := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write public key: %v", err)
+	}
+	return keyFile
+}
+
+func TestVerifyImageSignature(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	registry := &releaseRegistry{digests: map[string]string{}}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	repository := strings.TrimPrefix(server.URL, "http://") + "/atomist/k8svent"
+	image, imageErr := newReleaseImage(nil, Update{Image: repository, Insecure: true}, "latest")
+	if imageErr != nil {
+		t.Fatalf("failed to create image: %v", imageErr)
+	}
+
+	cosignSign(t, registry, ecKey, "sha256:aaaa", repository, "sha256:aaaa")
+	cosignSign(t, registry, rsaKey, "sha256:bbbb", repository+":0.18.0", "sha256:bbbb")
+	cosignSign(t, registry, ecKey, "sha256:cccc", repository, "sha256:aaaa")
+	cosignSign(t, registry, ecKey, "sha256:eeee", "atomist/k8svent", "sha256:eeee")
+	tests := []struct {
+		name   string
+		digest string
+		key    crypto.PublicKey
+		valid  bool
+	}{
+		{"ECDSA", "sha256:aaaa", ecKey.Public(), true},
+		{"RSA", "sha256:bbbb", rsaKey.Public(), true},
+		{"other key", "sha256:aaaa", otherKey.Public(), false},
+		{"other digest", "sha256:cccc", ecKey.Public(), false},
+		{"unsigned", "sha256:dddd", ecKey.Public(), false},
+		{"other image", "sha256:eeee", ecKey.Public(), false},
+	}
+	for _, tt := range tests {
+		err := verifyImageSignature(image, tt.digest, tt.key)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: verification result not as expected: %v", tt.name, err)
+		}
+	}
+}
+
+func TestSignedRepository(t *testing.T) {
+	hub, _ := parseImageReference("atomist/k8svent")
+	ghcr, _ := parseImageReference("ghcr.io/atomist/k8svent:1.2")
+	library, _ := parseImageReference("busybox")
+	tests := []struct {
+		reference string
+		ref       imageReference
+		expected  bool
+	}{
+		{"index.docker.io/atomist/k8svent", hub, true},
+		{"docker.io/atomist/k8svent:latest", hub, true},
+		{"atomist/k8svent@sha256:aaaa", hub, true},
+		{"index.docker.io/busybox", library, true},
+		{"ghcr.io/atomist/k8svent", ghcr, true},
+		{"ghcr.io/atomist/k8svent", hub, false},
+		{"index.docker.io/evil/k8svent", hub, false},
+		{"", hub, false},
+	}
+	for _, tt := range tests {
+		if signedRepository(tt.reference, tt.ref) != tt.expected {
+			t.Errorf("reference '%s' naming %s was not %v", tt.reference, tt.ref, tt.expected)
+		}
+	}
+}
+
+func TestReleaseCheckerVerifiesSignature(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "signature")
+
+	dir, dirErr := ioutil.TempDir("", "k8svent-signature")
+	if dirErr != nil {
+		t.Fatalf("failed to create temporary directory: %v", dirErr)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyFile := writePublicKey(t, dir, "cosign.pub", key.Public())
+
+	registry := &releaseRegistry{digests: map[string]string{"latest": "sha256:0171"}}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	events, fakeRecorder := newFakeEventRecorder()
+	repository := strings.TrimPrefix(server.URL, "http://") + "/atomist/k8svent"
+	update := Update{Image: repository, Insecure: true, PublicKey: keyFile}
+	if err := (Config{Update: update}).Validate(); err != nil {
+		t.Fatalf("configuration with public key is invalid: %v", err)
+	}
+	current := semver.MustParse("0.17.1")
+	c := &releaseChecker{
+		metrics:    newVentMetrics(),
+		events:     events,
+		config:     func() Config { return Config{Update: update} },
+		current:    &current,
+		defaultTag: "latest",
+		now:        time.Now,
+	}
+	if restart, _ := c.check(); restart {
+		t.Fatal("restarted on first check")
+	}
+
+	registry.set("latest", "sha256:0180")
+	for i := 0; i < 2; i++ {
+		if restart, _ := c.check(); restart {
+			t.Error("restarted for unsigned image")
+		}
+	}
+	recorded := recordedEvents(fakeRecorder)
+	if len(recorded) != 1 || !strings.HasPrefix(recorded[0], "Warning UpdateUnverified") {
+		t.Errorf("events not as expected: %v", recorded)
+	}
+	if testutil.ToFloat64(c.metrics.releaseChecks.WithLabelValues(releaseUnverified)) != 2 {
+		t.Errorf("unverified checks not as expected: %v", c.metrics.releaseChecks)
+	}
+
+	cosignSign(t, registry, key, "sha256:0180", repository, "sha256:0180")
+	if restart, _ := c.check(); !restart {
+		t.Error("did not restart for signed image")
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// VentSinkResource is the group, version, and resource of the
+// cluster-scoped VentSink custom resource.
+var VentSinkResource = schema.GroupVersionResource{
+	Group:    "k8svent.atomist.com",
+	Version:  "v1alpha1",
+	Resource: "ventsinks",
+}
+
+// VentSinkSpec is the desired state of a VentSink, a webhook
+// subscription to pods.
+type VentSinkSpec struct {
+	// URL is the webhook endpoint.
+	URL string `json:"url"`
+	// SecretRef, if not nil, references the Kubernetes secret key
+	// whose value is used to sign payloads.
+	SecretRef *SecretKeyReference `json:"secretRef,omitempty"`
+	// NamespaceSelector, if not nil, restricts the pods sent to
+	// those in namespaces whose labels match.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Selector, if not nil, restricts the pods sent to those whose
+	// labels match.
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// EventTypes, if not empty, restricts the pod events sent.
+	EventTypes []PodEvent `json:"eventTypes,omitempty"`
+	// Format is the payload format, FormatJSON if empty.
+	Format string `json:"format,omitempty"`
+}
+
+// SecretKeyReference references a key in a Kubernetes secret.
+type SecretKeyReference struct {
+	// Namespace of the secret.
+	Namespace string `json:"namespace"`
+	// Name of the secret.
+	Name string `json:"name"`
+	// Key in the secret data, "secret" if empty.
+	Key string `json:"key,omitempty"`
+}
+
+// VentSinkStatus is the observed state of a VentSink.
+type VentSinkStatus struct {
+	// ObservedGeneration is the generation of the spec this status
+	// describes.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Ready is true if the spec is valid and pods are being sent.
+	Ready bool `json:"ready"`
+	// Message describes why the sink is not ready.
+	Message string `json:"message,omitempty"`
+	// LastSuccessTime is when a payload was last delivered.
+	LastSuccessTime *metav1.Time `json:"lastSuccessTime,omitempty"`
+	// LastError is the error of the last failed delivery.
+	LastError string `json:"lastError,omitempty"`
+	// LastErrorTime is when the last delivery failed.
+	LastErrorTime *metav1.Time `json:"lastErrorTime,omitempty"`
+	// QueueDepth is the number of deliveries not yet completed,
+	// including those being retried.
+	QueueDepth int `json:"queueDepth"`
+}
+
+// ventSink is a parsed VentSink.  It is not modified after it is
+// created.
+type ventSink struct {
+	name       string
+	generation int64
+	// obj is the resource the sink was parsed from.
+	obj *unstructured.Unstructured
+	// hook is the webhook, without its secret.
+	hook              webhook
+	secret            *secretRef
+	namespaceSelector labels.Selector
+	selector          labels.Selector
+	// err, if not nil, is why the spec is invalid.
+	err error
+}
+
+// parseVentSink converts the VentSink resource into a sink.  If the
+// spec is invalid, the returned sink has a non-nil err.
+func parseVentSink(obj *unstructured.Unstructured) *ventSink {
+	s := &ventSink{
+		name:       obj.GetName(),
+		generation: obj.GetGeneration(),
+		obj:        obj,
+	}
+	var spec VentSinkSpec
+	specObj, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(specObj, &spec); err != nil {
+		s.err = fmt.Errorf("invalid spec: %v", err)
+		return s
+	}
+	if msg := validateRemoteWebhookURL(spec.URL); msg != "" {
+		s.err = fmt.Errorf("spec.url: %s", msg)
+		return s
+	}
+	s.hook = webhook{url: spec.URL, format: spec.Format}
+	switch spec.Format {
+	case "", FormatJSON, FormatCloudEvents:
+	default:
+		s.err = fmt.Errorf("spec.format: unsupported format '%s', must be '%s' or '%s'", spec.Format,
+			FormatJSON, FormatCloudEvents)
+		return s
+	}
+	if len(spec.EventTypes) > 0 {
+		s.hook.events = map[PodEvent]bool{}
+		for _, event := range spec.EventTypes {
+			if !validPodEvent(event) {
+				s.err = fmt.Errorf("spec.eventTypes: unsupported event type '%s'", event)
+				return s
+			}
+			s.hook.events[event] = true
+		}
+	}
+	if spec.SecretRef != nil {
+		if spec.SecretRef.Namespace == "" || spec.SecretRef.Name == "" {
+			s.err = fmt.Errorf("spec.secretRef: namespace and name are required")
+			return s
+		}
+		s.secret = &secretRef{
+			namespace: spec.SecretRef.Namespace,
+			name:      spec.SecretRef.Name,
+			key:       spec.SecretRef.Key,
+		}
+		if s.secret.key == "" {
+			s.secret.key = defaultSecretKey
+		}
+	}
+	var selectorErr error
+	if s.namespaceSelector, selectorErr = labelSelector(spec.NamespaceSelector); selectorErr != nil {
+		s.err = fmt.Errorf("spec.namespaceSelector: %v", selectorErr)
+		return s
+	}
+	if s.selector, selectorErr = labelSelector(spec.Selector); selectorErr != nil {
+		s.err = fmt.Errorf("spec.selector: %v", selectorErr)
+		return s
+	}
+	return s
+}
+
+// labelSelector converts the label selector, returning a selector
+// matching everything if it is nil.
+func labelSelector(selector *metav1.LabelSelector) (labels.Selector, error) {
+	if selector == nil {
+		return labels.Everything(), nil
+	}
+	return metav1.LabelSelectorAsSelector(selector)
+}
+
+// validPodEvent returns true if event is a known pod event.
+func validPodEvent(event PodEvent) bool {
+	for _, e := range PodEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if pod, whose namespace has the provided
+// labels, should be sent to the sink.  If nsKnown is false, the
+// namespace labels are unknown and sinks with a namespace selector do
+// not match.
+func (s *ventSink) matches(pod v1.Pod, nsLabels map[string]string, nsKnown bool) bool {
+	if s.err != nil {
+		return false
+	}
+	if !s.namespaceSelector.Empty() && (!nsKnown || !s.namespaceSelector.Matches(labels.Set(nsLabels))) {
+		return false
+	}
+	return s.selector.Matches(labels.Set(pod.ObjectMeta.Labels))
+}
+
+// sinkWatcher keeps the VentSinks current by watching the VentSink
+// resources.  It is safe for concurrent use.
+type sinkWatcher struct {
+	client dynamic.Interface
+	mu     sync.Mutex
+	sinks  map[string]*ventSink
+	// synced is the generation of each sink all current pods have
+	// been sent to.
+	synced map[string]int64
+	// statuses are the last status written for each sink.
+	statuses map[string]VentSinkStatus
+	// changed receives a value when a sink is added or its spec
+	// changes.
+	changed chan struct{}
+	// log logs changes of the sinks, the global logger if nil.
+	log *logrus.Entry
+}
+
+// newSinkWatcher creates a sink watcher using client, logging changes
+// of the sinks using log, the global logger if nil.
+func newSinkWatcher(client dynamic.Interface, log *logrus.Entry) *sinkWatcher {
+	return &sinkWatcher{
+		client:   client,
+		log:      log,
+		sinks:    map[string]*ventSink{},
+		synced:   map[string]int64{},
+		statuses: map[string]VentSinkStatus{},
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+// start checks that VentSinks can be listed and starts watching
+// them, returning once the current VentSinks have been loaded.  It
+// returns an error if the VentSink custom resource definition is not
+// installed or k8svent is not allowed to list VentSinks.
+func (w *sinkWatcher) start(stop <-chan struct{}) error {
+	if _, err := w.client.Resource(VentSinkResource).List(metav1.ListOptions{Limit: 1}); err != nil {
+		return err
+	}
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(w.client, 10*time.Minute)
+	informer := factory.ForResource(VentSinkResource).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.update,
+		UpdateFunc: func(_, obj interface{}) { w.update(obj) },
+		DeleteFunc: w.remove,
+	})
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+		return fmt.Errorf("failed to load VentSinks")
+	}
+	return nil
+}
+
+// update adds or replaces the sink parsed from obj.
+func (w *sinkWatcher) update(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	sink := parseVentSink(u)
+	w.mu.Lock()
+	previous, exists := w.sinks[sink.name]
+	w.sinks[sink.name] = sink
+	w.mu.Unlock()
+	if exists && previous.generation == sink.generation {
+		return
+	}
+	if sink.err != nil {
+		entryLogger(w.log, LogModuleRouting).Warnf("VentSink %s is invalid: %v", sink.name, sink.err)
+	} else {
+		entryLogger(w.log, LogModuleRouting).Infof("Updated VentSink %s sending to '%s'", sink.name, sink.hook.url)
+	}
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// remove deletes the sink for obj.
+func (w *sinkWatcher) remove(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.sinks, u.GetName())
+	delete(w.synced, u.GetName())
+	delete(w.statuses, u.GetName())
+	entryLogger(w.log, LogModuleRouting).Infof("Removed VentSink %s", u.GetName())
+}
+
+// current returns the current sinks sorted by name.  It is safe to
+// call on a nil sinkWatcher.
+func (w *sinkWatcher) current() []*ventSink {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sinks := make([]*ventSink, 0, len(w.sinks))
+	for _, sink := range w.sinks {
+		sinks = append(sinks, sink)
+	}
+	sort.Slice(sinks, func(i, j int) bool { return sinks[i].name < sinks[j].name })
+	return sinks
+}
+
+// changes returns the channel signaling sink changes, nil if w is
+// nil.
+func (w *sinkWatcher) changes() <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+	return w.changed
+}
+
+// unsynced returns the valid sinks that have not been sent all
+// current pods since they were created or their spec changed.
+func (w *sinkWatcher) unsynced() []*ventSink {
+	var sinks []*ventSink
+	for _, sink := range w.current() {
+		w.mu.Lock()
+		generation, ok := w.synced[sink.name]
+		w.mu.Unlock()
+		if sink.err == nil && (!ok || generation != sink.generation) {
+			sinks = append(sinks, sink)
+		}
+	}
+	return sinks
+}
+
+// markSynced records that all current pods have been sent to sink.
+func (w *sinkWatcher) markSynced(sink *ventSink) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.synced[sink.name] = sink.generation
+}
+
+// updateStatuses writes the status of every sink whose status has
+// changed using the delivery state in endpoints.
+func (w *sinkWatcher) updateStatuses(endpoints *endpointRegistry) {
+	if w == nil {
+		return
+	}
+	for _, sink := range w.current() {
+		status := sinkStatus(sink, endpoints)
+		w.mu.Lock()
+		last, ok := w.statuses[sink.name]
+		w.mu.Unlock()
+		if ok && reflect.DeepEqual(last, status) {
+			continue
+		}
+		if err := w.writeStatus(sink, status); err != nil {
+			entryLogger(w.log, LogModuleRouting).Warnf("Failed to update status of VentSink %s: %v", sink.name, err)
+			continue
+		}
+		w.mu.Lock()
+		w.statuses[sink.name] = status
+		w.mu.Unlock()
+	}
+}
+
+// sinkStatus creates the status of sink.
+func sinkStatus(sink *ventSink, endpoints *endpointRegistry) VentSinkStatus {
+	status := VentSinkStatus{ObservedGeneration: sink.generation}
+	if sink.err != nil {
+		status.Message = sink.err.Error()
+		return status
+	}
+	status.Ready = true
+	s := endpoints.get(sink.hook.url).status()
+	status.QueueDepth = s.pending
+	status.LastError = s.lastError
+	if !s.lastSuccess.IsZero() {
+		t := metav1.NewTime(s.lastSuccess.Truncate(time.Second))
+		status.LastSuccessTime = &t
+	}
+	if !s.lastErrorTime.IsZero() {
+		t := metav1.NewTime(s.lastErrorTime.Truncate(time.Second))
+		status.LastErrorTime = &t
+	}
+	return status
+}
+
+// writeStatus updates the status subresource of the sink.
+func (w *sinkWatcher) writeStatus(sink *ventSink, status VentSinkStatus) error {
+	statusObj, convertErr := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if convertErr != nil {
+		return convertErr
+	}
+	obj := sink.obj.DeepCopy()
+	if err := unstructured.SetNestedField(obj.Object, statusObj, "status"); err != nil {
+		return err
+	}
+	_, updateErr := w.client.Resource(VentSinkResource).UpdateStatus(obj, metav1.UpdateOptions{})
+	return updateErr
+}
@@ -0,0 +1,199 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func ventSinkObject(name string, generation int64, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "k8svent.atomist.com/v1alpha1",
+		"kind":       "VentSink",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec":       spec,
+	}}
+	obj.SetGeneration(generation)
+	return obj
+}
+
+func TestParseVentSink(t *testing.T) {
+	sink := parseVentSink(ventSinkObject("tvd", 3, map[string]interface{}{
+		"url":        "https://tvd.com/webhook",
+		"secretRef":  map[string]interface{}{"namespace": "hooks", "name": "tvd"},
+		"selector":   map[string]interface{}{"matchLabels": map[string]interface{}{"app": "sleep"}},
+		"eventTypes": []interface{}{"new", "deleted"},
+		"format":     "cloudevents",
+	}))
+	if sink.err != nil {
+		t.Fatalf("failed to parse valid sink: %v", sink.err)
+	}
+	if sink.name != "tvd" || sink.generation != 3 {
+		t.Errorf("sink metadata not as expected: %s %d", sink.name, sink.generation)
+	}
+	if sink.hook.url != "https://tvd.com/webhook" || sink.hook.format != FormatCloudEvents {
+		t.Errorf("sink webhook not as expected: %+v", sink.hook)
+	}
+	if d := cmp.Diff(sink.hook.events, map[PodEvent]bool{PodNew: true, PodDeleted: true}); d != "" {
+		t.Errorf("sink events not as expected: %s", d)
+	}
+	if *sink.secret != (secretRef{namespace: "hooks", name: "tvd", key: defaultSecretKey}) {
+		t.Errorf("sink secret not as expected: %+v", sink.secret)
+	}
+	sleep := v1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "sleep"}}}
+	if !sink.matches(sleep, nil, false) {
+		t.Error("sink did not match pod")
+	}
+	if sink.matches(v1.Pod{}, nil, false) {
+		t.Error("sink matched pod without labels")
+	}
+
+	invalid := []map[string]interface{}{
+		{"url": "ftp://tvd.com"},
+		{"url": "https://tvd.com", "format": "xml"},
+		{"url": "https://tvd.com", "eventTypes": []interface{}{"created"}},
+		{"url": "https://tvd.com", "secretRef": map[string]interface{}{"name": "tvd"}},
+		{"url": "https://tvd.com", "selector": map[string]interface{}{
+			"matchExpressions": []interface{}{map[string]interface{}{"key": "app", "operator": "Near"}},
+		}},
+		{"url": int64(1)},
+	}
+	for _, spec := range invalid {
+		if s := parseVentSink(ventSinkObject("bad", 1, spec)); s.err == nil {
+			t.Errorf("invalid sink spec did not return error: %v", spec)
+		} else if s.matches(sleep, nil, false) {
+			t.Errorf("invalid sink matched pod: %v", spec)
+		}
+	}
+}
+
+func TestWebhookRouterSinks(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "sink")
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "prod", Labels: map[string]string{"env": "prod"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "dev", Labels: map[string]string{"env": "dev"}}},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "hooks", Name: "prod"},
+			Data:       map[string][]byte{"secret": []byte("Prod")},
+		},
+	)
+	sinks := []*ventSink{
+		parseVentSink(ventSinkObject("prod", 1, map[string]interface{}{
+			"url":               "https://prod.com/webhook",
+			"secretRef":         map[string]interface{}{"namespace": "hooks", "name": "prod"},
+			"namespaceSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"env": "prod"}},
+		})),
+		parseVentSink(ventSinkObject("missing-secret", 1, map[string]interface{}{
+			"url":       "https://missing.com/webhook",
+			"secretRef": map[string]interface{}{"namespace": "hooks", "name": "missing"},
+		})),
+		parseVentSink(ventSinkObject("all", 1, map[string]interface{}{
+			"url": "https://all.com/webhook",
+		})),
+	}
+	router := newWebhookRouter(clientset, Config{IgnoreAnnotations: true}, sinks, nil)
+	global := []webhook{{url: "https://global.com/webhook"}}
+
+	prodHooks := router.route(v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "a"}}, global)
+	expected := []string{"https://global.com/webhook ", "https://prod.com/webhook Prod", "https://all.com/webhook "}
+	if d := cmp.Diff(webhookStrings(prodHooks), expected); d != "" {
+		t.Errorf("prod webhooks not as expected: %s", d)
+	}
+	devHooks := router.route(v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "a"}}, global)
+	expected = []string{"https://global.com/webhook ", "https://all.com/webhook "}
+	if d := cmp.Diff(webhookStrings(devHooks), expected); d != "" {
+		t.Errorf("dev webhooks not as expected: %s", d)
+	}
+}
+
+func TestSinkWatcher(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "sink")
+
+	obj := ventSinkObject("tvd", 1, map[string]interface{}{"url": "https://tvd.com/webhook"})
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), obj.DeepCopy())
+	w := newSinkWatcher(client, nil)
+
+	w.update(obj)
+	select {
+	case <-w.changes():
+	default:
+		t.Error("adding a sink did not signal a change")
+	}
+	w.update(obj)
+	select {
+	case <-w.changes():
+		t.Error("updating a sink without changing its generation signaled a change")
+	default:
+	}
+	if sinks := w.current(); len(sinks) != 1 || sinks[0].name != "tvd" {
+		t.Fatalf("sinks not as expected: %v", sinks)
+	}
+	unsynced := w.unsynced()
+	if len(unsynced) != 1 {
+		t.Fatalf("expected one unsynced sink: %v", unsynced)
+	}
+	w.markSynced(unsynced[0])
+	if len(w.unsynced()) != 0 {
+		t.Error("synced sink is still unsynced")
+	}
+
+	endpoints := newEndpointRegistry()
+	state := endpoints.get("https://tvd.com/webhook")
+	state.start("ns/a", PodNew)
+	d := state.start("ns/b", PodNew)
+	state.finish(d, errors.New("non-200 response"), time.Second)
+	w.updateStatuses(endpoints)
+	updated, getErr := client.Resource(VentSinkResource).Get("tvd", metav1.GetOptions{})
+	if getErr != nil {
+		t.Fatalf("failed to get sink: %v", getErr)
+	}
+	status, _, _ := unstructured.NestedMap(updated.Object, "status")
+	if status["ready"] != true || status["queueDepth"] != int64(1) || status["lastError"] != "non-200 response" {
+		t.Errorf("status not as expected: %v", status)
+	}
+	if _, ok := status["lastErrorTime"]; !ok {
+		t.Errorf("status has no lastErrorTime: %v", status)
+	}
+
+	changed := ventSinkObject("tvd", 2, map[string]interface{}{"url": "https://tvd.com/v2"})
+	w.update(changed)
+	if len(w.unsynced()) != 1 {
+		t.Error("changed sink is not unsynced")
+	}
+
+	w.remove(changed)
+	if len(w.current()) != 0 {
+		t.Errorf("sink was not removed: %v", w.current())
+	}
+
+	var nilWatcher *sinkWatcher
+	if nilWatcher.current() != nil || nilWatcher.changes() != nil {
+		t.Error("nil watcher should have no sinks or changes")
+	}
+}
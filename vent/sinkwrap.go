@@ -0,0 +1,247 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenk/backoff"
+)
+
+// Delivery metadata header names.
+const (
+	// DeliveryHeader is the header with the ID of the delivery,
+	// unchanged when the delivery is retried.
+	DeliveryHeader = "x-k8svent-delivery"
+	// TimestampHeader is the header with the Unix time the delivery
+	// was attempted.
+	TimestampHeader = "x-k8svent-timestamp"
+	// SignatureHeader is the header with the HMAC/SHA-256 signature of
+	// the delivery ID, timestamp, and body.
+	SignatureHeader = "x-k8svent-signature"
+	// BodySignatureHeader is the header with the HMAC/SHA-1 signature
+	// of the body.
+	BodySignatureHeader = "x-atomist-signature"
+)
+
+// withHeader returns a copy of msg whose header has the provided
+// values in addition to its own.  The header of msg is not modified.
+func withHeader(msg Message, values map[string]string) Message {
+	header := make(map[string]string, len(msg.Header)+len(values))
+	for k, v := range msg.Header {
+		header[k] = v
+	}
+	for k, v := range values {
+		header[k] = v
+	}
+	msg.Header = header
+	return msg
+}
+
+// withDelivery returns msg with a delivery ID, generating one if msg
+// does not have one.
+func withDelivery(msg Message) (Message, error) {
+	if msg.Header[DeliveryHeader] != "" {
+		return msg, nil
+	}
+	delivery, deliveryErr := generateDeliveryID()
+	if deliveryErr != nil {
+		return msg, deliveryErr
+	}
+	return withHeader(msg, map[string]string{DeliveryHeader: delivery}), nil
+}
+
+// signingSink adds the delivery headers and signatures to messages.
+type signingSink struct {
+	sink   Sink
+	secret string
+}
+
+// NewSigningSink returns a sink that adds the delivery ID and
+// timestamp headers to each message before sending it to sink.  If
+// secret is not empty, the body and delivery signatures are added
+// too.  Wrap it in a retrying sink, not the other way around, so each
+// attempt has a fresh timestamp and signature.
+func NewSigningSink(sink Sink, secret string) Sink {
+	return &signingSink{sink: sink, secret: secret}
+}
+
+// Send signs msg and sends it.
+func (s *signingSink) Send(ctx context.Context, msg Message) error {
+	msg, signErr := signMessage(msg, s.secret)
+	if signErr != nil {
+		return signErr
+	}
+	if s.secret != "" {
+		contextLogger(ctx, LogModuleDelivery).Debugf("Signing payload with secret: %s", msg.Header[BodySignatureHeader])
+	}
+	return s.sink.Send(ctx, msg)
+}
+
+// Close closes the wrapped sink.
+func (s *signingSink) Close() error {
+	return s.sink.Close()
+}
+
+// signMessage returns a copy of msg with a delivery ID, if it does
+// not have one, the current timestamp, and, if secret is not empty,
+// the body and delivery signatures.
+func signMessage(msg Message, secret string) (Message, error) {
+	msg, deliveryErr := withDelivery(msg)
+	if deliveryErr != nil {
+		return msg, deliveryErr
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	values := map[string]string{TimestampHeader: timestamp}
+	if secret != "" {
+		signature, signErr := generateSignature(msg.Body, secret)
+		if signErr != nil {
+			return msg, signErr
+		}
+		values[BodySignatureHeader] = signature
+		deliverySignature, deliverySignErr := generateDeliverySignature(msg.Header[DeliveryHeader], timestamp, msg.Body, secret)
+		if deliverySignErr != nil {
+			return msg, deliverySignErr
+		}
+		values[SignatureHeader] = deliverySignature
+	}
+	return withHeader(msg, values), nil
+}
+
+// retrySink retries failed sends with exponential backoff.
+type retrySink struct {
+	sink Sink
+	// beforeRetry, if not nil, is called before each retry.  If it
+	// returns an error, the send fails with that error.
+	beforeRetry func(ctx context.Context) error
+}
+
+// NewRetrySink returns a sink that sends messages to sink, retrying
+// with exponential backoff until it succeeds, it fails with an error
+// wrapped by backoff.Permanent, the backoff gives up, or ctx is done.
+// Every attempt has the same delivery ID.
+func NewRetrySink(sink Sink) Sink {
+	return &retrySink{sink: sink}
+}
+
+// Send sends msg, retrying if it fails.
+func (s *retrySink) Send(ctx context.Context, msg Message) error {
+	msg, deliveryErr := withDelivery(msg)
+	if deliveryErr != nil {
+		return deliveryErr
+	}
+	attempts := 0
+	send := func() error {
+		if attempts > 0 && s.beforeRetry != nil {
+			if err := s.beforeRetry(ctx); err != nil {
+				return backoff.Permanent(err)
+			}
+		}
+		attempts++
+		return s.sink.Send(ctx, msg)
+	}
+	return backoff.Retry(send, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+}
+
+// Close closes the wrapped sink.
+func (s *retrySink) Close() error {
+	return s.sink.Close()
+}
+
+// queuedMessage is a message waiting in a queue and the context it
+// was sent with.
+type queuedMessage struct {
+	ctx context.Context
+	msg Message
+}
+
+// QueueSink sends messages to a sink in the background, in the order
+// they are queued.  Create one using NewQueueSink.
+type QueueSink struct {
+	sink  Sink
+	queue chan queuedMessage
+	done  chan struct{}
+	// mu guards closed and sending to queue.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewQueueSink returns a sink that queues up to size messages and
+// sends them to sink from a background goroutine, so slow sinks do
+// not delay processing pods.  Failures to send queued messages are
+// logged.  Close it to stop the goroutine and close sink.
+func NewQueueSink(sink Sink, size int) *QueueSink {
+	if size < 1 {
+		size = 1
+	}
+	q := &QueueSink{
+		sink:  sink,
+		queue: make(chan queuedMessage, size),
+		done:  make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Send queues msg.  It returns an error if the queue is full or
+// closed.  If ctx is done before msg is sent, it is dropped.
+func (q *QueueSink) Send(ctx context.Context, msg Message) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return fmt.Errorf("queue is closed")
+	}
+	select {
+	case q.queue <- queuedMessage{ctx: ctx, msg: msg}:
+		return nil
+	default:
+		return fmt.Errorf("queue is full, dropping %s message for %s", msg.Event, msg.Key)
+	}
+}
+
+// Close stops queueing messages, waits until the queued messages are
+// sent or dropped, and closes the wrapped sink.
+func (q *QueueSink) Close() error {
+	q.mu.Lock()
+	closed := q.closed
+	if !closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+	<-q.done
+	if closed {
+		return nil
+	}
+	return q.sink.Close()
+}
+
+// run sends queued messages until the queue is closed.
+func (q *QueueSink) run() {
+	defer close(q.done)
+	for m := range q.queue {
+		if m.ctx.Err() != nil {
+			contextLogger(m.ctx, LogModuleDelivery).WithField("pod", m.msg.Key).Warnf("Dropped queued message: %v", m.ctx.Err())
+			continue
+		}
+		if err := q.sink.Send(m.ctx, m.msg); err != nil {
+			contextLogger(m.ctx, LogModuleDelivery).WithField("pod", m.msg.Key).Errorf("Failed to send queued message to sink %T: %v", q.sink, err)
+		}
+	}
+}
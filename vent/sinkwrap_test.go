@@ -0,0 +1,187 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenk/backoff"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestSigningSink(t *testing.T) {
+	var got []Message
+	record := SinkFunc(func(ctx context.Context, msg Message) error {
+		got = append(got, msg)
+		return nil
+	})
+	body := []byte(`{"pod":{}}`)
+	msg := Message{Key: "some/pod", Body: body, Header: map[string]string{"traceparent": "00-abc"}}
+
+	if err := NewSigningSink(record, "Coast2Coast").Send(context.Background(), msg); err != nil {
+		t.Fatalf("failed to send signed message: %v", err)
+	}
+	if err := NewSigningSink(record, "").Send(context.Background(), msg); err != nil {
+		t.Fatalf("failed to send unsigned message: %v", err)
+	}
+	if len(msg.Header) != 1 {
+		t.Errorf("signing modified the message header: %v", msg.Header)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(got))
+	}
+
+	signed := got[0].Header
+	if signed["traceparent"] != "00-abc" {
+		t.Errorf("existing header not kept: %v", signed)
+	}
+	delivery, timestamp := signed[DeliveryHeader], signed[TimestampHeader]
+	if delivery == "" || timestamp == "" {
+		t.Fatalf("delivery headers not added: %v", signed)
+	}
+	eSignature, _ := generateSignature(body, "Coast2Coast")
+	if signed[BodySignatureHeader] != eSignature {
+		t.Errorf("body signature '%s' != '%s'", signed[BodySignatureHeader], eSignature)
+	}
+	eDeliverySignature, _ := generateDeliverySignature(delivery, timestamp, body, "Coast2Coast")
+	if signed[SignatureHeader] != eDeliverySignature {
+		t.Errorf("delivery signature '%s' != '%s'", signed[SignatureHeader], eDeliverySignature)
+	}
+
+	unsigned := got[1].Header
+	if unsigned[DeliveryHeader] == "" || unsigned[TimestampHeader] == "" {
+		t.Errorf("delivery headers not added to unsigned message: %v", unsigned)
+	}
+	if _, ok := unsigned[BodySignatureHeader]; ok {
+		t.Errorf("message without secret signed: %v", unsigned)
+	}
+	if _, ok := unsigned[SignatureHeader]; ok {
+		t.Errorf("message without secret signed: %v", unsigned)
+	}
+}
+
+func TestRetrySink(t *testing.T) {
+	t.Run("retries with the same delivery ID", func(t *testing.T) {
+		var deliveries []string
+		flaky := SinkFunc(func(ctx context.Context, msg Message) error {
+			deliveries = append(deliveries, msg.Header[DeliveryHeader])
+			if len(deliveries) < 2 {
+				return fmt.Errorf("try again")
+			}
+			return nil
+		})
+		if err := NewRetrySink(flaky).Send(context.Background(), Message{Key: "some/pod"}); err != nil {
+			t.Fatalf("retry failed: %v", err)
+		}
+		if len(deliveries) != 2 {
+			t.Fatalf("expected 2 attempts, got %d", len(deliveries))
+		}
+		if deliveries[0] == "" || deliveries[0] != deliveries[1] {
+			t.Errorf("attempts have different delivery IDs: %v", deliveries)
+		}
+	})
+
+	t.Run("permanent errors are not retried", func(t *testing.T) {
+		attempts := 0
+		broken := SinkFunc(func(ctx context.Context, msg Message) error {
+			attempts++
+			return backoff.Permanent(fmt.Errorf("broken"))
+		})
+		if err := NewRetrySink(broken).Send(context.Background(), Message{}); err == nil {
+			t.Error("expected error")
+		}
+		if attempts != 1 {
+			t.Errorf("expected 1 attempt, got %d", attempts)
+		}
+	})
+
+	t.Run("before retry errors stop retries", func(t *testing.T) {
+		attempts := 0
+		failing := SinkFunc(func(ctx context.Context, msg Message) error {
+			attempts++
+			return fmt.Errorf("try again")
+		})
+		s := &retrySink{sink: failing, beforeRetry: func(ctx context.Context) error { return fmt.Errorf("paused") }}
+		if err := s.Send(context.Background(), Message{}); err == nil || err.Error() != "paused" {
+			t.Errorf("expected before retry error, got %v", err)
+		}
+		if attempts != 1 {
+			t.Errorf("expected 1 attempt, got %d", attempts)
+		}
+	})
+
+	t.Run("done context stops retries", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		failing := SinkFunc(func(ctx context.Context, msg Message) error {
+			return fmt.Errorf("try again")
+		})
+		start := time.Now()
+		if err := NewRetrySink(failing).Send(ctx, Message{}); err == nil {
+			t.Error("expected error")
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("retries did not stop when context was done: %s", elapsed)
+		}
+	})
+}
+
+func TestQueueSink(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "queue")
+
+	var mu sync.Mutex
+	var keys []string
+	release := make(chan struct{})
+	slow := SinkFunc(func(ctx context.Context, msg Message) error {
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, msg.Key)
+		return nil
+	})
+	q := NewQueueSink(slow, 2)
+
+	// the first message is taken by the worker, which blocks
+	if err := q.Send(context.Background(), Message{Key: "a"}); err != nil {
+		t.Fatalf("failed to queue message: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(q.queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for _, key := range []string{"b", "c"} {
+		if err := q.Send(context.Background(), Message{Key: key}); err != nil {
+			t.Fatalf("failed to queue message %s: %v", key, err)
+		}
+	}
+	if err := q.Send(context.Background(), Message{Key: "d"}); err == nil {
+		t.Error("expected full queue error")
+	}
+	close(release)
+	q.Close()
+	if err := q.Send(context.Background(), Message{Key: "e"}); err == nil {
+		t.Error("expected closed queue error")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(keys) != "[a b c]" {
+		t.Errorf("queued messages sent as %v, expected [a b c]", keys)
+	}
+}
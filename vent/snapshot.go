@@ -0,0 +1,64 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Snapshot lists the pods once, applies the configured filters, and
+// sends every pod as new to its webhooks, including those added by
+// annotations and VentSinks.  It waits for the deliveries to complete
+// and returns a summary of their outcome.  If out is not nil, the pods
+// are written to out as JSON lines in the webhook payload format
+// rather than sent.  Deliveries still pending when ctx is done are
+// abandoned.
+func Snapshot(ctx context.Context, config Config, out io.Writer) (DeliverySummary, error) {
+	v, clientset, sinks, done, setupErr := newOneShotVenter(config, out == nil)
+	if setupErr != nil {
+		return DeliverySummary{}, setupErr
+	}
+	defer done()
+	return v.snapshot(ctx, clientset, sinks, out)
+}
+
+// snapshot lists, filters, and sends or writes the pods, see Snapshot.
+func (v *Venter) snapshot(ctx context.Context, clientset kubernetes.Interface, sinks []*ventSink, out io.Writer) (DeliverySummary, error) {
+	config := v.currentConfig()
+	pods, listErr := listPods(ctx, clientset, config.Namespace, config.Filters.LabelSelector)
+	if listErr != nil {
+		return DeliverySummary{}, fmt.Errorf("failed to list pods: %v", listErr)
+	}
+	pods = v.filterPods(pods)
+
+	if out != nil {
+		for _, pod := range pods {
+			line, jsonErr := formatPayload(&webhookPayload{Pod: pod, event: PodNew}, FormatJSON)
+			if jsonErr != nil {
+				return DeliverySummary{}, fmt.Errorf("failed to marshal pod %s: %v", podSlug(pod), jsonErr)
+			}
+			if _, err := out.Write(append(line, '\n')); err != nil {
+				return DeliverySummary{}, fmt.Errorf("failed to write pod %s: %v", podSlug(pod), err)
+			}
+		}
+		return DeliverySummary{Pods: len(pods)}, nil
+	}
+
+	return v.sendPods(ctx, clientset, sinks, pods, PodNew), nil
+}
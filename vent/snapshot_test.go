@@ -0,0 +1,124 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSnapshot(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "snapshot")
+
+	var mu sync.Mutex
+	received := []string{}
+	block := make(chan struct{})
+	defer close(block)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		if payload.Pod.Name == "slow" {
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		mu.Lock()
+		received = append(received, podSlug(payload.Pod))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "grunge", Name: "nirvana"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "grunge", Name: "soundgarden"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kube-dns"}},
+	)
+	config := Config{
+		Webhooks: []Webhook{{URL: server.URL + "/webhook"}},
+		Filters:  Filters{ExcludeNamespaces: []string{"kube-system"}},
+	}
+
+	var out bytes.Buffer
+	v := newVenter()
+	if err := v.setConfig(config); err != nil {
+		t.Fatalf("failed to set configuration: %v", err)
+	}
+	summary, err := v.snapshot(context.Background(), clientset, nil, &out)
+	if err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	lines := []string{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var payload webhookPayload
+		if err := json.Unmarshal(scanner.Bytes(), &payload); err != nil {
+			t.Errorf("line is not a payload: %s", scanner.Text())
+		}
+		lines = append(lines, podSlug(payload.Pod))
+	}
+	if summary.Pods != 2 || strings.Join(lines, ",") != "grunge/nirvana,grunge/soundgarden" || len(summary.Endpoints) != 0 {
+		t.Errorf("written snapshot not as expected: %+v %v", summary, lines)
+	}
+
+	v = newVenter()
+	if err := v.setConfig(config); err != nil {
+		t.Fatalf("failed to set configuration: %v", err)
+	}
+	summary, err = v.snapshot(context.Background(), clientset, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to send snapshot: %v", err)
+	}
+	sort.Strings(received)
+	if strings.Join(received, ",") != "grunge/nirvana,grunge/soundgarden" {
+		t.Errorf("received pods not as expected: %v", received)
+	}
+	if len(summary.Endpoints) != 1 || summary.Endpoints[0].Sent != 2 || summary.Failed() {
+		t.Errorf("sent snapshot summary not as expected: %+v", summary)
+	}
+
+	if _, err := clientset.CoreV1().Pods("grunge").Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "grunge", Name: "slow"}}); err != nil {
+		t.Fatalf("failed to create pod: %v", err)
+	}
+	v = newVenter()
+	if err := v.setConfig(config); err != nil {
+		t.Fatalf("failed to set configuration: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	summary, err = v.snapshot(ctx, clientset, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to send snapshot: %v", err)
+	}
+	if len(summary.Endpoints) != 1 || summary.Endpoints[0].Sent != 2 || summary.Endpoints[0].Abandoned != 1 || !summary.Failed() {
+		t.Errorf("interrupted snapshot summary not as expected: %+v", summary)
+	}
+}
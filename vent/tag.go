@@ -15,59 +15,565 @@
 package vent
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultImage is the image checked for new k8svent releases if none
+// is configured.
+const DefaultImage = "atomist/k8svent"
+
+// Docker Hub registry names.
+const (
+	dockerHubRegistry = "docker.io"
+	// dockerHubAPI is the host of the Docker Hub registry API.
+	dockerHubAPI = "registry-1.docker.io"
+	// dockerHubConfigKey is the key of Docker Hub credentials in
+	// Docker configuration files.
+	dockerHubConfigKey = "https://index.docker.io/v1/"
 )
 
-// getDockerAuthToken gets a read-only Docker Hub registry token for
-// the provided repository.
-func getDockerAuthToken(repository string) (t string, e error) {
-	client := &http.Client{}
-	clientID := packageSlug()
-	authURL := "https://auth.docker.io/token?service=registry.docker.io&scope=repository:" + repository +
-		":pull&client_id=" + clientID
-	authReq, authReqErr := http.NewRequest("GET", authURL, nil)
-	if authReqErr != nil {
-		return t, fmt.Errorf("failed to create GET request to %s: %v", authURL, authReqErr)
+// manifestMediaTypes are the manifest types accepted from registries,
+// so the digest of multi-platform images is that of the index.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// imageReference identifies a repository in an OCI registry.
+type imageReference struct {
+	// registry is the registry host, including any port.
+	registry string
+	// repository is the repository path in the registry.
+	repository string
+	// tag, if not empty, is the tag in the reference.
+	tag string
+}
+
+// parseImageReference parses an image reference such as
+// "atomist/k8svent", "ghcr.io/atomist/k8svent:1.2", or
+// "registry.example.com:5000/k8svent".  As with Docker, references
+// whose first component is not a host are Docker Hub repositories.
+// References by digest are not supported.
+func parseImageReference(ref string) (imageReference, error) {
+	var r imageReference
+	if ref == "" {
+		return r, fmt.Errorf("image reference is empty")
+	}
+	if strings.Contains(ref, "@") {
+		return r, fmt.Errorf("image reference '%s' must not contain a digest", ref)
+	}
+	name := ref
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, r.tag = ref[:i], ref[i+1:]
+		if r.tag == "" {
+			return r, fmt.Errorf("image reference '%s' has an empty tag", ref)
+		}
+	}
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		r.registry, r.repository = parts[0], parts[1]
+	} else {
+		r.registry, r.repository = dockerHubRegistry, name
+	}
+	if r.registry == dockerHubRegistry && !strings.Contains(r.repository, "/") {
+		r.repository = "library/" + r.repository
+	}
+	if r.repository == "" || strings.HasPrefix(r.repository, "/") || strings.HasSuffix(r.repository, "/") ||
+		r.repository != strings.ToLower(r.repository) {
+		return r, fmt.Errorf("invalid repository in image reference '%s'", ref)
+	}
+	return r, nil
+}
+
+// apiHost returns the host of the registry API.
+func (r imageReference) apiHost() string {
+	if r.registry == dockerHubRegistry {
+		return dockerHubAPI
+	}
+	return r.registry
+}
+
+func (r imageReference) String() string {
+	s := r.registry + "/" + r.repository
+	if r.tag != "" {
+		s += ":" + r.tag
+	}
+	return s
+}
+
+// registryCredentials are the username and password used to
+// authenticate with a registry.
+type registryCredentials struct {
+	username string
+	password string
+}
+
+// dockerConfig is the content of .dockerconfigjson secrets, whose
+// auths are the content of .dockercfg secrets.
+type dockerConfig struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+// parsePullSecretRef parses a pull secret reference, NAME or
+// NAMESPACE/NAME.  If the reference does not include a namespace,
+// namespace is used.
+func parsePullSecretRef(ref string, namespace string) (string, string, error) {
+	parts := strings.Split(ref, "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return namespace, parts[0], nil
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("invalid pull secret '%s', must be NAME or NAMESPACE/NAME", ref)
+}
+
+// readPullSecret reads the credentials for registry from the
+// imagePullSecret, NAME or NAMESPACE/NAME.  If the secret has no
+// credentials for the registry, nil is returned.
+func readPullSecret(clientset kubernetes.Interface, ref string, namespace string, registry string) (*registryCredentials, error) {
+	ns, name, refErr := parsePullSecretRef(ref, namespace)
+	if refErr != nil {
+		return nil, refErr
+	}
+	secret, getErr := clientset.CoreV1().Secrets(ns).Get(name, metav1.GetOptions{})
+	if getErr != nil {
+		return nil, fmt.Errorf("failed to read pull secret %s/%s: %v", ns, name, getErr)
+	}
+	var auths map[string]dockerConfigEntry
+	if data, ok := secret.Data[v1.DockerConfigJsonKey]; ok {
+		var config dockerConfig
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse pull secret %s/%s: %v", ns, name, err)
+		}
+		auths = config.Auths
+	} else if data, ok := secret.Data[v1.DockerConfigKey]; ok {
+		if err := json.Unmarshal(data, &auths); err != nil {
+			return nil, fmt.Errorf("failed to parse pull secret %s/%s: %v", ns, name, err)
+		}
+	} else {
+		return nil, fmt.Errorf("pull secret %s/%s has neither %s nor %s", ns, name, v1.DockerConfigJsonKey, v1.DockerConfigKey)
+	}
+	for key, entry := range auths {
+		if !registryConfigKeyMatches(key, registry) {
+			continue
+		}
+		creds := &registryCredentials{username: entry.Username, password: entry.Password}
+		if entry.Auth != "" {
+			auth, decodeErr := base64.StdEncoding.DecodeString(entry.Auth)
+			if decodeErr != nil {
+				return nil, fmt.Errorf("failed to decode auth for %s in pull secret %s/%s: %v", key, ns, name, decodeErr)
+			}
+			parts := strings.SplitN(string(auth), ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("auth for %s in pull secret %s/%s is not USERNAME:PASSWORD", key, ns, name)
+			}
+			creds.username, creds.password = parts[0], parts[1]
+		}
+		return creds, nil
+	}
+	return nil, nil
+}
+
+// registryConfigKeyMatches returns true if the key of a Docker
+// configuration entry, a host or URL, refers to registry.
+func registryConfigKeyMatches(key string, registry string) bool {
+	if registry == dockerHubRegistry && (key == dockerHubConfigKey || key == dockerHubRegistry || key == "index.docker.io") {
+		return true
+	}
+	host := key
+	if u, err := url.Parse(key); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return strings.TrimSuffix(host, "/") == registry
+}
+
+// registryClient gets manifest digests and tags from OCI
+// distribution registries, authenticating using bearer tokens or basic
+// auth.
+type registryClient struct {
+	client *http.Client
+	// insecure, if true, makes the client use HTTP rather than
+	// HTTPS.
+	insecure bool
+	// auth is the Authorization header value that satisfied the last
+	// authentication challenge.
+	auth string
+}
+
+// maxTagPages is the maximum number of pages of tags read from a
+// registry.
+const maxTagPages = 20
+
+// newRegistryClient creates a registry client.
+func newRegistryClient(insecure bool) *registryClient {
+	return &registryClient{client: &http.Client{Timeout: 30 * time.Second}, insecure: insecure}
+}
+
+// digest returns the digest of the manifest of ref with tag.  If the
+// registry requires authentication, creds are used, if not nil.
+func (c *registryClient) digest(ref imageReference, tag string, creds *registryCredentials) (string, error) {
+	path := fmt.Sprintf("/v2/%s/manifests/%s", ref.repository, tag)
+	accept := strings.Join(manifestMediaTypes, ", ")
+	resp, respErr := c.request("HEAD", path, accept, ref, creds)
+	if respErr != nil {
+		return "", respErr
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("manifest HEAD %s returned status %d", resp.Request.URL, resp.StatusCode)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// the registry does not return the digest header, so compute it
+	resp, respErr = c.request("GET", path, accept, ref, creds)
+	if respErr != nil {
+		return "", respErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("manifest GET %s returned status %d", resp.Request.URL, resp.StatusCode)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return "", fmt.Errorf("failed to read manifest from %s: %v", resp.Request.URL, readErr)
+	}
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// manifest returns the manifest of ref with tag.
+func (c *registryClient) manifest(ref imageReference, tag string, creds *registryCredentials) ([]byte, error) {
+	return c.get(fmt.Sprintf("/v2/%s/manifests/%s", ref.repository, tag), strings.Join(manifestMediaTypes, ", "), ref, creds)
+}
+
+// blob returns the blob of ref with digest, verifying its content
+// matches the digest.
+func (c *registryClient) blob(ref imageReference, digest string, creds *registryCredentials) ([]byte, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, fmt.Errorf("unsupported blob digest '%s'", digest)
+	}
+	body, getErr := c.get(fmt.Sprintf("/v2/%s/blobs/%s", ref.repository, digest), "*/*", ref, creds)
+	if getErr != nil {
+		return nil, getErr
+	}
+	sum := sha256.Sum256(body)
+	if "sha256:"+hex.EncodeToString(sum[:]) != digest {
+		return nil, fmt.Errorf("content of blob %s does not match its digest", digest)
+	}
+	return body, nil
+}
+
+// get returns the body of the response to a GET request to the
+// registry API path of ref.
+func (c *registryClient) get(path string, accept string, ref imageReference, creds *registryCredentials) ([]byte, error) {
+	resp, respErr := c.request("GET", path, accept, ref, creds)
+	if respErr != nil {
+		return nil, respErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned status %d", resp.Request.URL, resp.StatusCode)
+	}
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", resp.Request.URL, readErr)
+	}
+	return body, nil
+}
+
+// tags returns the tags of the repository of ref, following
+// pagination links.
+func (c *registryClient) tags(ref imageReference, creds *registryCredentials) ([]string, error) {
+	var tags []string
+	path := fmt.Sprintf("/v2/%s/tags/list", ref.repository)
+	for page := 0; path != "" && page < maxTagPages; page++ {
+		resp, respErr := c.request("GET", path, "application/json", ref, creds)
+		if respErr != nil {
+			return nil, respErr
+		}
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		decodeErr := json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("tags GET %s returned status %d", resp.Request.URL, resp.StatusCode)
+		}
+		if decodeErr != nil {
+			return nil, fmt.Errorf("failed to parse tags from %s: %v", resp.Request.URL, decodeErr)
+		}
+		tags = append(tags, list.Tags...)
+		path = nextLink(resp.Header.Get("Link"))
+	}
+	return tags, nil
+}
+
+// nextLink returns the path of the rel="next" link in the Link header,
+// an empty string if there is none.
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 || !strings.Contains(strings.Join(parts[1:], ";"), `rel="next"`) {
+			continue
+		}
+		target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+		if u, err := url.Parse(target); err == nil {
+			return u.RequestURI()
+		}
+	}
+	return ""
+}
+
+// request sends a request to the registry API path of ref.  If the
+// registry challenges the request, it is retried with an authorization
+// satisfying the challenge using creds, if not nil.  The authorization
+// is used for later requests.
+func (c *registryClient) request(method string, path string, accept string, ref imageReference, creds *registryCredentials) (*http.Response, error) {
+	scheme := "https"
+	if c.insecure {
+		scheme = "http"
+	}
+	apiURL := fmt.Sprintf("%s://%s%s", scheme, ref.apiHost(), path)
+	resp, respErr := c.send(method, apiURL, accept, c.auth)
+	if respErr != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, respErr
+	}
+	resp.Body.Close()
+	auth, authErr := c.authorization(resp.Header.Get("WWW-Authenticate"), ref, creds)
+	if authErr != nil {
+		return nil, authErr
+	}
+	c.auth = auth
+	return c.send(method, apiURL, accept, auth)
+}
+
+// send sends the request with the authorization header, if not empty.
+func (c *registryClient) send(method string, apiURL string, accept string, authorization string) (*http.Response, error) {
+	req, reqErr := http.NewRequest(method, apiURL, nil)
+	if reqErr != nil {
+		return nil, fmt.Errorf("failed to create %s request to %s: %v", method, apiURL, reqErr)
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", packageSlug())
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, respErr := c.client.Do(req)
+	if respErr != nil {
+		return nil, fmt.Errorf("failed to %s %s: %v", method, apiURL, respErr)
+	}
+	return resp, nil
+}
+
+// authorization returns the Authorization header value satisfying the
+// challenge of a WWW-Authenticate header.
+func (c *registryClient) authorization(challenge string, ref imageReference, creds *registryCredentials) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if creds == nil {
+			return "", fmt.Errorf("registry %s requires credentials", ref.registry)
+		}
+		return "Basic " + basicAuth(creds), nil
+	case "bearer":
+		return c.token(params, ref, creds)
+	}
+	return "", fmt.Errorf("unsupported authentication challenge from registry %s: '%s'", ref.registry, challenge)
+}
+
+// token gets a pull token for the repository from the token service
+// in the challenge parameters.
+func (c *registryClient) token(params map[string]string, ref imageReference, creds *registryCredentials) (string, error) {
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge from registry %s has no realm", ref.registry)
+	}
+	tokenURL, parseErr := url.Parse(realm)
+	if parseErr != nil {
+		return "", fmt.Errorf("invalid token realm '%s' from registry %s: %v", realm, ref.registry, parseErr)
+	}
+	query := tokenURL.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", "repository:"+ref.repository+":pull")
+	query.Set("client_id", packageSlug())
+	tokenURL.RawQuery = query.Encode()
+
+	req, reqErr := http.NewRequest("GET", tokenURL.String(), nil)
+	if reqErr != nil {
+		return "", fmt.Errorf("failed to create GET request to %s: %v", tokenURL, reqErr)
+	}
+	if creds != nil {
+		req.Header.Set("Authorization", "Basic "+basicAuth(creds))
+	}
+	resp, respErr := c.client.Do(req)
+	if respErr != nil {
+		return "", fmt.Errorf("failed to GET %s: %v", tokenURL, respErr)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request to %s returned status %d", tokenURL.Host, resp.StatusCode)
+	}
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("failed to parse token response from %s: %v", tokenURL.Host, err)
+	}
+	token := tokenResp.Token
+	if token == "" {
+		token = tokenResp.AccessToken
+	}
+	if token == "" {
+		return "", fmt.Errorf("token response from %s contained no token", tokenURL.Host)
+	}
+	return "Bearer " + token, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header with a single
+// challenge, returning the scheme and parameters.
+func parseChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	header = strings.TrimSpace(header)
+	i := strings.Index(header, " ")
+	if i < 0 {
+		return header, params
+	}
+	scheme, rest := header[:i], header[i+1:]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma+1:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
+
+// basicAuth returns the base64-encoded credentials.
+func basicAuth(creds *registryCredentials) string {
+	return base64.StdEncoding.EncodeToString([]byte(creds.username + ":" + creds.password))
+}
+
+// releaseImage is the image checked for new releases.
+type releaseImage struct {
+	ref imageReference
+	// tag is the tag checked.
+	tag    string
+	creds  *registryCredentials
+	client *registryClient
+}
+
+// newReleaseImage returns the configured update image.  If the image
+// reference has no tag, defaultTag is checked.  Registry credentials
+// are read from the configured pull secret using clientset.
+func newReleaseImage(clientset kubernetes.Interface, update Update, defaultTag string) (*releaseImage, error) {
+	image := update.Image
+	if image == "" {
+		image = DefaultImage
 	}
-	authReq.Header.Add("content-type", "application/json")
-	authResp, authRespErr := client.Do(authReq)
-	if authRespErr != nil {
-		return t, fmt.Errorf("failed to GET %s: %v", authURL, authRespErr)
+	ref, refErr := parseImageReference(image)
+	if refErr != nil {
+		return nil, refErr
 	}
-	defer authResp.Body.Close()
-	token, tokenErr := extractPropertyString(authResp, "token")
-	if tokenErr != nil {
-		return t, fmt.Errorf("failed to extract token from %s response: %v", authURL, tokenErr)
+	i := &releaseImage{ref: ref, tag: ref.tag, client: newRegistryClient(update.Insecure)}
+	if i.tag == "" {
+		i.tag = defaultTag
 	}
-	return token, nil
+	if update.PullSecret != "" {
+		if clientset == nil {
+			return nil, fmt.Errorf("unable to read pull secret %s without a Kubernetes client", update.PullSecret)
+		}
+		creds, credsErr := readPullSecret(clientset, update.PullSecret, selfNamespace(), ref.registry)
+		if credsErr != nil {
+			return nil, credsErr
+		}
+		if creds == nil {
+			moduleLogger(LogModuleRelease).Warnf("Pull secret %s has no credentials for registry %s", update.PullSecret, ref.registry)
+		}
+		i.creds = creds
+	}
+	return i, nil
+}
+
+// digest returns the digest of the checked tag.
+func (i *releaseImage) digest() (string, error) {
+	return i.tagDigest(i.tag)
 }
 
-// getDockerTagDigest retrieves the digest for atomist/k8svent:tag.
+// tagDigest returns the digest of tag.
+func (i *releaseImage) tagDigest(tag string) (string, error) {
+	return i.client.digest(i.ref, tag, i.creds)
+}
+
+// tags returns all tags of the image repository.
+func (i *releaseImage) tags() ([]string, error) {
+	return i.client.tags(i.ref, i.creds)
+}
+
+// imageTagDigest returns the tag checked and its digest for the
+// configured update image.  If the image reference has no tag,
+// defaultTag is used.
+func imageTagDigest(clientset kubernetes.Interface, update Update, defaultTag string) (string, string, error) {
+	image, imageErr := newReleaseImage(clientset, update, defaultTag)
+	if imageErr != nil {
+		return defaultTag, "", imageErr
+	}
+	digest, digestErr := image.digest()
+	return image.tag, digest, digestErr
+}
+
+// getDockerTagDigest retrieves the digest for atomist/k8svent:tag
+// from Docker Hub.
 func getDockerTagDigest(tag string) (d string, e error) {
-	repository := "atomist/k8svent"
-	token, tokenErr := getDockerAuthToken(repository)
-	if tokenErr != nil {
-		return d, tokenErr
-	}
-	client := &http.Client{}
-	digestURL := "https://index.docker.io/v2/" + repository + "/manifests/" + tag
-	digestReq, digestReqErr := http.NewRequest("HEAD", digestURL, nil)
-	if digestReqErr != nil {
-		return d, fmt.Errorf("failed to create HEAD request to %s: %v", digestURL, digestReqErr)
-	}
-	digestReq.Header.Add("authorization", "Bearer "+token)
-	digestResp, digestRespErr := client.Do(digestReq)
-	if digestRespErr != nil {
-		return d, fmt.Errorf("failed to HEAD %s: %v", digestURL, digestRespErr)
-	}
-	defer digestResp.Body.Close()
-	digest, digestOK := digestResp.Header[http.CanonicalHeaderKey("docker-content-digest")]
-	if !digestOK {
-		return d, fmt.Errorf("manifest HEAD response did not contain digest header")
-	}
-	if len(digest) < 1 {
-		return d, fmt.Errorf("manifest HEAD response contained empty digest header: %v", digest)
-	}
-	return digest[0], nil
+	ref, refErr := parseImageReference(DefaultImage)
+	if refErr != nil {
+		return d, refErr
+	}
+	return newRegistryClient(false).digest(ref, tag, nil)
 }
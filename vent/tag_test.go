@@ -15,8 +15,19 @@
 package vent
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestGetDockerTagDigest(t *testing.T) {
@@ -31,3 +42,201 @@ func TestGetDockerTagDigest(t *testing.T) {
 		}
 	}
 }
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		ref      string
+		expected string
+		apiHost  string
+	}{
+		{"atomist/k8svent", "docker.io/atomist/k8svent", "registry-1.docker.io"},
+		{"alpine:3.12", "docker.io/library/alpine:3.12", "registry-1.docker.io"},
+		{"ghcr.io/atomist/k8svent:next", "ghcr.io/atomist/k8svent:next", "ghcr.io"},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/k8svent", "123456789012.dkr.ecr.us-east-1.amazonaws.com/k8svent", "123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+		{"registry.local:5000/tools/k8svent:1.2", "registry.local:5000/tools/k8svent:1.2", "registry.local:5000"},
+		{"localhost/k8svent", "localhost/k8svent", "localhost"},
+	}
+	for _, tt := range tests {
+		ref, err := parseImageReference(tt.ref)
+		if err != nil {
+			t.Errorf("failed to parse %s: %v", tt.ref, err)
+			continue
+		}
+		if ref.String() != tt.expected || ref.apiHost() != tt.apiHost {
+			t.Errorf("reference %s parsed as %s at %s rather than %s at %s", tt.ref, ref, ref.apiHost(), tt.expected, tt.apiHost)
+		}
+	}
+	for _, ref := range []string{"", "atomist/k8svent@sha256:abc", "atomist/k8svent:", "Atomist/K8svent", "ghcr.io/"} {
+		if _, err := parseImageReference(ref); err == nil {
+			t.Errorf("invalid reference '%s' was parsed", ref)
+		}
+	}
+}
+
+func TestReadPullSecret(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("robot:s3cr3t"))
+	clientset := fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "k8svent", Name: "regcred"},
+			Type:       v1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				v1.DockerConfigJsonKey: []byte(`{"auths":{"https://index.docker.io/v1/":{"username":"hub","password":"pw"},"ghcr.io":{"auth":"` + auth + `"}}}`),
+			},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "tools", Name: "legacy"},
+			Type:       v1.SecretTypeDockercfg,
+			Data: map[string][]byte{
+				v1.DockerConfigKey: []byte(`{"https://registry.local:5000":{"username":"old","password":"school"}}`),
+			},
+		},
+	)
+	tests := []struct {
+		ref      string
+		registry string
+		expected string
+	}{
+		{"regcred", "docker.io", "hub:pw"},
+		{"regcred", "ghcr.io", "robot:s3cr3t"},
+		{"regcred", "quay.io", ""},
+		{"tools/legacy", "registry.local:5000", "old:school"},
+	}
+	for _, tt := range tests {
+		creds, err := readPullSecret(clientset, tt.ref, "k8svent", tt.registry)
+		if err != nil {
+			t.Errorf("failed to read %s for %s: %v", tt.ref, tt.registry, err)
+			continue
+		}
+		actual := ""
+		if creds != nil {
+			actual = creds.username + ":" + creds.password
+		}
+		if actual != tt.expected {
+			t.Errorf("credentials from %s for %s were '%s' rather than '%s'", tt.ref, tt.registry, actual, tt.expected)
+		}
+	}
+	if _, err := readPullSecret(clientset, "missing", "k8svent", "ghcr.io"); err == nil {
+		t.Error("reading missing pull secret did not fail")
+	}
+}
+
+// registryStandIn serves a manifest for repository k8svent/k8svent tag
+// next, requiring the authentication scheme.
+func registryStandIn(t *testing.T, scheme string, digestHeader bool) (*httptest.Server, *int) {
+	manifest := []byte(`{"schemaVersion":2}`)
+	tokenRequests := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			tokenRequests++
+			if r.URL.Query().Get("scope") != "repository:k8svent/k8svent:pull" || r.URL.Query().Get("service") != "stand-in" {
+				t.Errorf("unexpected token request: %s", r.URL)
+			}
+			if user, pass, ok := r.BasicAuth(); ok && (user != "robot" || pass != "s3cr3t") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"t0k3n"}`)
+			return
+		case "/v2/k8svent/k8svent/manifests/next":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json") {
+			t.Errorf("manifest request does not accept OCI index: %s", r.Header.Get("Accept"))
+		}
+		authorized := false
+		switch scheme {
+		case "bearer":
+			authorized = r.Header.Get("Authorization") == "Bearer t0k3n"
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="stand-in"`, server.URL))
+		case "basic":
+			user, pass, ok := r.BasicAuth()
+			authorized = ok && user == "robot" && pass == "s3cr3t"
+			w.Header().Set("WWW-Authenticate", `Basic realm="stand-in"`)
+		default:
+			authorized = true
+		}
+		if !authorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if digestHeader {
+			w.Header().Set("Docker-Content-Digest", "sha256:1234")
+		}
+		if r.Method == "GET" {
+			_, _ = w.Write(manifest)
+		}
+	}))
+	return server, &tokenRequests
+}
+
+func TestImageTagDigest(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "tag")
+	clientset := fake.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "k8svent", Name: "regcred"},
+		Type:       v1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{},
+	})
+	manifestSum := sha256.Sum256([]byte(`{"schemaVersion":2}`))
+	manifestDigest := "sha256:" + hex.EncodeToString(manifestSum[:])
+
+	tests := []struct {
+		name         string
+		scheme       string
+		digestHeader bool
+		creds        bool
+		tag          string
+		expected     string
+		tokens       int
+	}{
+		{"anonymous token", "bearer", true, false, "", "sha256:1234", 1},
+		{"token with credentials", "bearer", true, true, "", "sha256:1234", 1},
+		{"basic", "basic", true, true, "", "sha256:1234", 0},
+		{"no authentication without digest header", "none", false, false, "", manifestDigest, 0},
+		{"tag in reference", "none", true, false, ":next", "sha256:1234", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, tokenRequests := registryStandIn(t, tt.scheme, tt.digestHeader)
+			defer server.Close()
+			update := Update{Image: strings.TrimPrefix(server.URL, "http://") + "/k8svent/k8svent" + tt.tag, Insecure: true}
+			if tt.creds {
+				auths := fmt.Sprintf(`{"auths":{"%s":{"username":"robot","password":"s3cr3t"}}}`, server.URL)
+				secret := &v1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "k8svent", Name: "regcred"},
+					Type:       v1.SecretTypeDockerConfigJson,
+					Data:       map[string][]byte{v1.DockerConfigJsonKey: []byte(auths)},
+				}
+				if _, err := clientset.CoreV1().Secrets("k8svent").Update(secret); err != nil {
+					t.Fatalf("failed to update secret: %v", err)
+				}
+				update.PullSecret = "k8svent/regcred"
+			}
+			defaultTag := "next"
+			if tt.tag != "" {
+				defaultTag = "latest"
+			}
+			tag, digest, err := imageTagDigest(clientset, update, defaultTag)
+			if err != nil {
+				t.Fatalf("failed to get digest: %v", err)
+			}
+			if tag != "next" || digest != tt.expected {
+				t.Errorf("tag %s digest %s rather than next %s", tag, digest, tt.expected)
+			}
+			if *tokenRequests != tt.tokens {
+				t.Errorf("%d token requests rather than %d", *tokenRequests, tt.tokens)
+			}
+		})
+	}
+
+	server, _ := registryStandIn(t, "basic", true)
+	defer server.Close()
+	update := Update{Image: strings.TrimPrefix(server.URL, "http://") + "/k8svent/k8svent", Insecure: true}
+	if _, _, err := imageTagDigest(clientset, update, "next"); err == nil {
+		t.Error("basic authentication without credentials did not fail")
+	}
+}
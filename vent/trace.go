@@ -0,0 +1,167 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer export settings.
+const (
+	// traceQueueSize is the maximum number of ended spans waiting to
+	// be exported.  Spans ended when the queue is full are dropped.
+	traceQueueSize = 2048
+	// traceBatchSize is the maximum number of spans exported in one
+	// request.
+	traceBatchSize = 512
+	// traceExportInterval is how often spans are exported.
+	traceExportInterval = 5 * time.Second
+	// traceExportTimeout limits each export request.
+	traceExportTimeout = 10 * time.Second
+)
+
+// traceContext propagates spans to webhooks in the W3C traceparent
+// and tracestate headers.
+var traceContext = propagation.TraceContext{}
+
+// traceErrorHandler routes OpenTelemetry errors, like failed exports,
+// to the tracing log module.
+var traceErrorHandler sync.Once
+
+// tracer creates spans and exports them to an OpenTelemetry collector
+// using OTLP/HTTP.  A nil tracer creates no spans.
+type tracer struct {
+	provider *sdktrace.TracerProvider
+}
+
+// newTracer creates a tracer exporting to the OTLP/HTTP collector at
+// the configured endpoint.  If the endpoint does not end in
+// "/v1/traces", it is appended.
+func newTracer(config Tracing) (*tracer, error) {
+	endpoint := config.Endpoint
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = Pkg
+	}
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpointURL(endpoint),
+		otlptracehttp.WithTimeout(traceExportTimeout),
+	}
+	// without headers, those in OTEL_EXPORTER_OTLP_HEADERS are used
+	if len(config.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(config.Headers))
+	}
+	exporter, exporterErr := otlptracehttp.New(context.Background(), options...)
+	if exporterErr != nil {
+		return nil, fmt.Errorf("failed to create trace exporter for %s: %v", redactURL(endpoint), exporterErr)
+	}
+	traceErrorHandler.Do(func() {
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+			moduleLogger(LogModuleTracing).Warnf("Failed to export spans: %v", err)
+		}))
+	})
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithMaxQueueSize(traceQueueSize),
+			sdktrace.WithMaxExportBatchSize(traceBatchSize),
+			sdktrace.WithBatchTimeout(traceExportInterval),
+		),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName),
+			attribute.String("service.version", Version),
+		)),
+	)
+	return &tracer{provider: provider}, nil
+}
+
+// tracerKey is the context key of the tracer.
+type tracerKey struct{}
+
+// withTracer returns a context in which startSpan creates spans using
+// t.  If t is nil, ctx is returned.
+func withTracer(ctx context.Context, t *tracer) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// startSpan starts a span that is a child of the current span in ctx,
+// returning a context containing the new span.  If ctx has no current
+// span, the span starts a new trace using the tracer in ctx.  If ctx
+// has neither, the span records nothing.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	provider := trace.SpanFromContext(ctx).TracerProvider()
+	if t, ok := ctx.Value(tracerKey{}).(*tracer); ok {
+		provider = t.provider
+	}
+	return provider.Tracer(Pkg, trace.WithInstrumentationVersion(Version)).Start(ctx, name, trace.WithSpanKind(kind))
+}
+
+// setSpanError records that the operation of span failed with err.
+// It does nothing if err is nil.
+func setSpanError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// endSpan ends span, with an error status if err is not nil and an OK
+// status otherwise.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		setSpanError(span, err)
+	} else {
+		span.SetStatus(codes.Ok, "")
+	}
+	span.End()
+}
+
+// traceHeaders returns the W3C trace context headers identifying the
+// current span in ctx, none if there is no span.
+func traceHeaders(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(ctx, carrier)
+	return carrier
+}
+
+// shutdown exports all queued spans, waiting until they are sent or
+// ctx is done, and stops the tracer.
+func (t *tracer) shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	if err := t.provider.Shutdown(ctx); err != nil {
+		contextLogger(ctx, LogModuleTracing).Warnf("Failed to export spans on shutdown: %v", err)
+	}
+}
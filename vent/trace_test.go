@@ -0,0 +1,196 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// otlpCollector records the spans exported to it.
+type otlpCollector struct {
+	mu      sync.Mutex
+	spans   map[string]*tracepb.Span
+	paths   []string
+	headers []http.Header
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, readErr := ioutil.ReadAll(r.Body)
+	var req coltracepb.ExportTraceServiceRequest
+	if readErr != nil || proto.Unmarshal(body, &req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths = append(c.paths, r.URL.Path)
+	c.headers = append(c.headers, r.Header)
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				c.spans[s.Name] = s
+			}
+		}
+	}
+	w.Header().Set("content-type", "application/x-protobuf")
+}
+
+func (c *otlpCollector) span(name string) (*tracepb.Span, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.spans[name]
+	return s, ok
+}
+
+func spanAttribute(s *tracepb.Span, key string) string {
+	for _, a := range s.Attributes {
+		if a.Key != key {
+			continue
+		}
+		if i, ok := a.Value.Value.(*commonpb.AnyValue_IntValue); ok {
+			return strconv.FormatInt(i.IntValue, 10)
+		}
+		return a.Value.GetStringValue()
+	}
+	return ""
+}
+
+func TestTracing(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "trace")
+
+	collector := &otlpCollector{spans: map[string]*tracepb.Span{}}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+
+	var mu sync.Mutex
+	var traceparent string
+	webhookTraceparent := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return traceparent
+	}
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparent = r.Header.Get("traceparent")
+		mu.Unlock()
+		w.Header().Set("content-type", "application/json")
+		_, _ = w.Write([]byte(`{"correlation_id":"nada"}`))
+	}))
+	defer webhookServer.Close()
+
+	tr, tracerErr := newTracer(Tracing{Endpoint: collectorServer.URL, ServiceName: "vent-test", Headers: map[string]string{"x-token": "secret"}})
+	if tracerErr != nil {
+		t.Fatalf("failed to create tracer: %v", tracerErr)
+	}
+	hooks := []webhook{{url: webhookServer.URL + "/webhook?token=secret"}}
+	ctx := withTracer(context.Background(), tr)
+	pods := []v1.Pod{{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod"}}}
+	processPods(ctx, &processPodsArgs{
+		pods:     pods,
+		lastPods: map[string]v1.Pod{},
+		processor: func(ctx context.Context, pod v1.Pod, event PodEvent) error {
+			postToWebhooks(ctx, hooks, &webhookPayload{Pod: pod, event: event})
+			return nil
+		},
+	})
+
+	// the postToWebhooks span ends when its deliveries complete
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		flushCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_ = tr.provider.ForceFlush(flushCtx)
+		cancel()
+		if _, ok := collector.span("postToWebhooks"); ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tr.shutdown(shutdownCtx)
+
+	root, rootOk := collector.span("processPods")
+	batch, batchOk := collector.span("postToWebhooks")
+	attempt, attemptOk := collector.span("postToWebhook")
+	if !rootOk || !batchOk || !attemptOk {
+		t.Fatalf("not all spans were exported: %v", collector.spans)
+	}
+	if collector.paths[0] != "/v1/traces" || collector.headers[0].Get("x-token") != "secret" {
+		t.Errorf("spans exported to wrong path or without headers: %s %v", collector.paths[0], collector.headers[0])
+	}
+	if len(root.ParentSpanId) != 0 || !bytes.Equal(batch.ParentSpanId, root.SpanId) || !bytes.Equal(attempt.ParentSpanId, batch.SpanId) {
+		t.Errorf("spans not nested: %+v %+v %+v", root, batch, attempt)
+	}
+	if !bytes.Equal(batch.TraceId, root.TraceId) || !bytes.Equal(attempt.TraceId, root.TraceId) {
+		t.Errorf("spans not in same trace: %x %x %x", root.TraceId, batch.TraceId, attempt.TraceId)
+	}
+	if root.Kind != tracepb.Span_SPAN_KIND_INTERNAL || attempt.Kind != tracepb.Span_SPAN_KIND_CLIENT {
+		t.Errorf("span kinds not as expected: %v %v", root.Kind, attempt.Kind)
+	}
+	if spanAttribute(batch, "pod") != "ns/pod" || spanAttribute(batch, "event") != "new" {
+		t.Errorf("postToWebhooks attributes not as expected: %+v", batch.Attributes)
+	}
+	if spanAttribute(attempt, "correlation_id") != "nada" || spanAttribute(attempt, "http.status_code") != "200" ||
+		spanAttribute(attempt, "attempt") != "1" {
+		t.Errorf("postToWebhook attributes not as expected: %+v", attempt.Attributes)
+	}
+	if endpoint := spanAttribute(attempt, "endpoint"); strings.Contains(endpoint, "secret") {
+		t.Errorf("endpoint attribute not redacted: %s", endpoint)
+	}
+	if attempt.Status.Code != tracepb.Status_STATUS_CODE_OK {
+		t.Errorf("postToWebhook status not OK: %+v", attempt.Status)
+	}
+	expected := "00-" + hex.EncodeToString(root.TraceId) + "-" + hex.EncodeToString(attempt.SpanId) + "-01"
+	if traceparent := webhookTraceparent(); traceparent != expected {
+		t.Errorf("traceparent header not as expected: %s != %s", traceparent, expected)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	ctx, span := startSpan(context.Background(), "nothing", trace.SpanKindInternal)
+	if span.IsRecording() || span.SpanContext().IsValid() {
+		t.Error("span created without tracer")
+	}
+	setSpanError(span, context.Canceled)
+	endSpan(span, nil)
+	if headers := traceHeaders(ctx); len(headers) != 0 {
+		t.Errorf("span without tracer propagated: %v", headers)
+	}
+	var tr *tracer
+	if withTracer(ctx, tr) != ctx {
+		t.Error("nil tracer changed context")
+	}
+	tr.shutdown(ctx)
+}
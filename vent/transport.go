@@ -0,0 +1,393 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SinkFactory opens the sink delivering to a webhook URL.  The URL
+// has already been validated.
+type SinkFactory func(u *url.URL) (Sink, error)
+
+// sinkScheme is a registered webhook URL scheme.
+type sinkScheme struct {
+	open SinkFactory
+	// path is true if URLs of the scheme have a path rather than a
+	// host.
+	path bool
+	// generation changes every time the scheme is registered, so
+	// sinks opened by a previous factory are not reused.
+	generation int
+}
+
+var (
+	// schemesMu guards schemes and schemeGeneration.
+	schemesMu sync.Mutex
+	// schemes are the registered webhook URL schemes.
+	schemes = map[string]sinkScheme{
+		"http":  {open: newHTTPSink},
+		"https": {open: newHTTPSink},
+		"file":  {open: newFileSink, path: true},
+		"kafka": {open: newKafkaSink},
+		"nats":  {open: newNATSSink},
+	}
+	// schemeGeneration is the generation of the last registered
+	// scheme.
+	schemeGeneration int
+)
+
+// RegisterSinkScheme registers the factory opening sinks for webhook
+// URLs with scheme, replacing the factory registered for the scheme,
+// if any.  Sinks the previous factory opened are closed once their
+// deliveries complete.  URLs of the scheme must have a host.
+// Register schemes before creating a Venter, so webhooks using them
+// are valid.
+func RegisterSinkScheme(scheme string, factory SinkFactory) {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	schemeGeneration++
+	schemes[strings.ToLower(scheme)] = sinkScheme{open: factory, generation: schemeGeneration}
+}
+
+// sinkSchemes returns the registered webhook URL schemes, sorted.
+func sinkSchemes() []string {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	names := make([]string, 0, len(schemes))
+	for name := range schemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openSink opens a new sink delivering to webhookURL, returning the
+// generation of its scheme.
+func openSink(webhookURL string) (Sink, int, error) {
+	u, parseErr := url.Parse(webhookURL)
+	if parseErr != nil {
+		return nil, 0, fmt.Errorf("invalid URL %s: %v", redactURL(webhookURL), parseErr)
+	}
+	schemesMu.Lock()
+	scheme, ok := schemes[u.Scheme]
+	schemesMu.Unlock()
+	if !ok {
+		return nil, 0, fmt.Errorf("unsupported webhook URL scheme '%s'", u.Scheme)
+	}
+	sink, openErr := scheme.open(u)
+	if openErr != nil {
+		return nil, 0, fmt.Errorf("failed to open sink for %s: %v", redactURL(webhookURL), openErr)
+	}
+	return sink, scheme.generation, nil
+}
+
+// schemeCurrent returns true if generation is the generation of the
+// scheme of webhookURL.
+func schemeCurrent(webhookURL string, generation int) bool {
+	u, parseErr := url.Parse(webhookURL)
+	if parseErr != nil {
+		return false
+	}
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	scheme, ok := schemes[u.Scheme]
+	return ok && scheme.generation == generation
+}
+
+// cachedSink is a sink in a sinkCache.
+type cachedSink struct {
+	sink Sink
+	// generation is the generation of the scheme that opened the
+	// sink.
+	generation int
+	// users is the number of deliveries using the sink.
+	users int
+	// kept is true while the sink stays open when it has no users.
+	kept bool
+}
+
+// sinkCache holds the sinks opened for webhook URLs so connections
+// are reused.  Every delivery acquires the sink it uses and releases
+// it when done, and a sink is only closed once it is no longer kept
+// and its last user has released it.  It is safe for concurrent use.
+type sinkCache struct {
+	mu    sync.Mutex
+	sinks map[string]*cachedSink
+	// log logs closing sinks, the global logger if nil.  Set it
+	// before the cache is used.
+	log *logrus.Entry
+}
+
+// newSinkCache creates an empty sink cache.
+func newSinkCache() *sinkCache {
+	return &sinkCache{sinks: map[string]*cachedSink{}}
+}
+
+// acquire returns the sink delivering to webhookURL, opening it if it
+// is not open, and the function releasing it.  If c is nil, a new
+// sink is opened and closed when it is released.
+func (c *sinkCache) acquire(webhookURL string) (Sink, func(), error) {
+	if c == nil {
+		sink, _, openErr := openSink(webhookURL)
+		if openErr != nil {
+			return nil, nil, openErr
+		}
+		return sink, func() { sink.Close() }, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.sinks[webhookURL]
+	if ok && !schemeCurrent(webhookURL, cached.generation) {
+		if c.drop(webhookURL, cached) {
+			defer c.closeSink(webhookURL, cached.sink)
+		}
+		ok = false
+	}
+	if !ok {
+		sink, generation, openErr := openSink(webhookURL)
+		if openErr != nil {
+			return nil, nil, openErr
+		}
+		cached = &cachedSink{sink: sink, generation: generation, kept: true}
+		c.sinks[webhookURL] = cached
+	}
+	cached.users++
+	var once sync.Once
+	return cached.sink, func() { once.Do(func() { c.release(webhookURL, cached) }) }, nil
+}
+
+// release records that a user of the cached sink is done with it,
+// closing it if it was its last user and it is no longer kept.
+func (c *sinkCache) release(webhookURL string, cached *cachedSink) {
+	c.mu.Lock()
+	cached.users--
+	closing := cached.users == 0 && !cached.kept
+	c.mu.Unlock()
+	if closing {
+		c.closeSink(webhookURL, cached.sink)
+	}
+}
+
+// drop removes the cached sink so it is no longer reused, returning
+// true if it has no users and should be closed.  Otherwise it is
+// closed when its last user releases it.  c.mu must be held.
+func (c *sinkCache) drop(webhookURL string, cached *cachedSink) bool {
+	if c.sinks[webhookURL] == cached {
+		delete(c.sinks, webhookURL)
+	}
+	cached.kept = false
+	return cached.users == 0
+}
+
+// keep closes the sinks whose webhook URL keep returns false for, all
+// of them if keep is nil, so they are opened again if they are used
+// later.  Sinks still in use are closed when their last user releases
+// them.
+func (c *sinkCache) keep(keep func(webhookURL string) bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	closing := map[string]Sink{}
+	for u, cached := range c.sinks {
+		if (keep == nil || !keep(u)) && c.drop(u, cached) {
+			closing[u] = cached.sink
+		}
+	}
+	c.mu.Unlock()
+	for u, sink := range closing {
+		c.closeSink(u, sink)
+	}
+}
+
+// close closes all the sinks once their users release them.
+func (c *sinkCache) close() {
+	c.keep(nil)
+}
+
+// closeSink closes the sink delivering to webhookURL, logging any
+// error.
+func (c *sinkCache) closeSink(webhookURL string, sink Sink) {
+	log := entryLogger(c.log, LogModuleDelivery)
+	log.Debugf("Closing sink for %s", redactURL(webhookURL))
+	if err := sink.Close(); err != nil {
+		log.Warnf("Failed to close sink for %s: %v", redactURL(webhookURL), err)
+	}
+}
+
+// queryBool returns the boolean value of the query parameter name of
+// u, false if it is not provided.
+func queryBool(u *url.URL, name string) (bool, error) {
+	value := u.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s query parameter '%s', must be true or false", name, value)
+	}
+	return b, nil
+}
+
+// httpSink posts messages to an HTTP endpoint.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+// newHTTPSink returns a sink posting messages to u.
+func newHTTPSink(u *url.URL) (Sink, error) {
+	return &httpSink{url: u.String(), client: &http.Client{}}, nil
+}
+
+// Send posts the body of msg with its header as HTTP headers.  If ctx
+// has a current span, the response status and correlation ID are
+// recorded in it.  Responses other than 2xx are errors.
+func (s *httpSink) Send(ctx context.Context, msg Message) error {
+	log := contextLogger(ctx, LogModuleDelivery).WithField("pod", msg.Key)
+	req, reqErr := newHTTPRequest(ctx, s.url, msg)
+	if reqErr != nil {
+		return reqErr
+	}
+	resp, postErr := s.client.Do(req)
+	if postErr != nil {
+		// The error of the client repeats the URL, which may include
+		// credentials.
+		if urlErr, ok := postErr.(*url.Error); ok {
+			postErr = urlErr.Err
+		}
+		return fmt.Errorf("failed to POST event to %s: %v", redactURL(s.url), postErr)
+	}
+	defer resp.Body.Close()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	corrID, corrErr := extractPropertyString(resp, "correlation_id")
+	if corrErr != nil {
+		log.Warnf("Failed to extract correlation ID from %s response: %v", redactURL(s.url), corrErr)
+	} else if corrID != "" {
+		span.SetAttributes(attribute.String("correlation_id", corrID))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("non-200 response from webhook %s: code:%d,correlation_id:%s", redactURL(s.url), resp.StatusCode, corrID)
+	}
+	log.WithFields(logrus.Fields{
+		"code":           resp.StatusCode,
+		"correlation_id": corrID,
+	}).Infof("Posted to '%s'", redactURL(s.url))
+	return nil
+}
+
+// Close closes the idle connections to the endpoint.
+func (s *httpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// newHTTPRequest creates a POST request of the body of msg to
+// endpoint with the header of msg.
+func newHTTPRequest(ctx context.Context, endpoint string, msg Message) (*http.Request, error) {
+	req, reqErr := http.NewRequest("POST", endpoint, bytes.NewBuffer(msg.Body))
+	if reqErr != nil {
+		if urlErr, ok := reqErr.(*url.Error); ok {
+			reqErr = urlErr.Err
+		}
+		return nil, fmt.Errorf("failed to create POST request to %s: %v", redactURL(endpoint), reqErr)
+	}
+	req = req.WithContext(ctx)
+	if msg.ContentType != "" {
+		req.Header.Add("content-type", msg.ContentType)
+	}
+	for k, v := range msg.Header {
+		req.Header.Add(k, v)
+	}
+	return req, nil
+}
+
+// fileRecord is a line written by a file sink.
+type fileRecord struct {
+	Time        time.Time         `json:"time"`
+	ContentType string            `json:"contentType,omitempty"`
+	Header      map[string]string `json:"header,omitempty"`
+	// Body is the body as JSON if it is valid JSON, otherwise as a
+	// string.
+	Body interface{} `json:"body"`
+}
+
+// fileSink appends messages to a file as JSON lines.
+type fileSink struct {
+	path string
+	// mu serializes writes to the file.
+	mu sync.Mutex
+}
+
+// newFileSink returns a sink appending messages to the file at the
+// path of u.
+func newFileSink(u *url.URL) (Sink, error) {
+	return &fileSink{path: u.Path}, nil
+}
+
+// Send appends msg to the file, creating the file if it does not
+// exist.
+func (s *fileSink) Send(ctx context.Context, msg Message) error {
+	record := fileRecord{
+		Time:        time.Now().UTC(),
+		ContentType: msg.ContentType,
+		Header:      msg.Header,
+		Body:        string(msg.Body),
+	}
+	if json.Valid(msg.Body) {
+		record.Body = json.RawMessage(msg.Body)
+	}
+	line, jsonErr := json.Marshal(record)
+	if jsonErr != nil {
+		return fmt.Errorf("failed to marshal message: %v", jsonErr)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, openErr := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if openErr != nil {
+		return fmt.Errorf("failed to open %s: %v", s.path, openErr)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write to %s: %v", s.path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %v", s.path, err)
+	}
+	contextLogger(ctx, LogModuleDelivery).WithField("pod", msg.Key).Infof("Wrote to '%s'", s.path)
+	return nil
+}
+
+// Close does nothing, the file is opened for each message.
+func (s *fileSink) Close() error {
+	return nil
+}
@@ -15,80 +15,517 @@
 package vent
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"reflect"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 // Venter contains the information used to send pods to webhook
-// endpoints.
+// endpoints.  Its configuration can be replaced while it is running.
+// Create one using NewVenter.
 type Venter struct {
-	secret string
-	urls   []string
+	mu       sync.RWMutex
+	config   Config
+	webhooks []webhook
+	filter   *podFilter
+	// router adds webhooks from pod and namespace annotations and
+	// VentSinks.  It is replaced every cycle.
+	router *webhookRouter
+	// sinks watches the VentSinks, nil if they are not available.
+	sinks *sinkWatcher
+	// endpoints records the deliveries to each webhook endpoint.
+	endpoints *endpointRegistry
+	// sinkCache holds the open sinks of the webhooks.
+	sinkCache *sinkCache
+	// metrics records metrics not specific to an endpoint.
+	metrics *ventMetrics
+	// tracer exports traces of pod processing, nil if tracing is
+	// disabled.
+	tracer *tracer
+	// trackedMu guards tracked.
+	trackedMu sync.Mutex
+	// tracked are the pods last sent by slug.
+	tracked map[string]trackedPod
+	// resync, when signaled, makes the next cycle send all pods.
+	resync chan struct{}
+	// events records Kubernetes Events on the k8svent pod, nil if
+	// the pod cannot be identified.
+	events *eventRecorder
+	// deliveryCtx, if not nil, is done when pending deliveries are
+	// abandoned at shutdown.
+	deliveryCtx context.Context
+	// recorder, if not nil, records every payload sent.
+	recorder *recorder
+	// dryRun, if not nil, prints payloads rather than sending them.
+	dryRun *dryRun
+	// clientset lists the pods.
+	clientset kubernetes.Interface
+	// dynamicClient watches the VentSinks, nil if they are not
+	// watched.
+	dynamicClient dynamic.Interface
+	// customSinks receive every pod event in addition to the
+	// webhooks.
+	customSinks []Sink
+	// customFilter, if not nil, further restricts the pods sent.
+	customFilter Filter
+	// health decides which unchanged pods are sent as unhealthy.
+	health HealthPolicy
+	// interval is how long to wait between listing pods.
+	interval time.Duration
+	// log logs the messages of the Venter, the global logger if nil.
+	log *logrus.Entry
+	// levels are the log levels set by the configuration, nil if
+	// they are controlled by the logger provided in Options.
+	levels *logLevels
+}
+
+// newVenter creates a Venter without any configuration.
+func newVenter() *Venter {
+	return &Venter{
+		endpoints: newEndpointRegistry(),
+		sinkCache: newSinkCache(),
+		metrics:   newVentMetrics(),
+		tracked:   map[string]trackedPod{},
+		resync:    make(chan struct{}, 1),
+		health:    HealthPolicyFunc(podHealthy),
+		interval:  DefaultInterval,
+		levels:    levels,
+	}
+}
+
+// logger returns the logger of the Venter.
+func (v *Venter) logger() *logrus.Entry {
+	if v.log == nil {
+		return logger
+	}
+	return v.log
+}
+
+// moduleLogger returns the logger of the Venter for messages of
+// module.
+func (v *Venter) moduleLogger(module string) *logrus.Entry {
+	return entryLogger(v.log, module)
 }
 
 // Vent sets up and starts the listener for pod events, which posts
-// them to the provided webhooks when it receives them.  It should
-// never return.
-func Vent(urls []string, namespace string, secret string, logLevel string) error {
+// them to the configured webhooks when it receives them.  The
+// configuration is reloaded using load when k8svent receives SIGHUP
+// and, if configFile is not empty, when configFile changes.  When
+// k8svent receives SIGTERM or SIGINT or restarts to update itself, it
+// stops listing pods, waits for pending deliveries to complete within
+// the shutdown grace period, and returns nil.
+func Vent(load ConfigLoader, configFile string) error {
+
+	config, loadErr := load()
+	if loadErr != nil {
+		return loadErr
+	}
 
-	setupLogger(logLevel)
+	if err := setupLogger(config); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid logging configuration: %v\n", Pkg, err)
+		return err
+	}
 
 	logger.Infof("%s version %s starting", Pkg, Version)
 
 	logger.Info("Creating Kubernetes API client set")
-	config, configErr := rest.InClusterConfig()
-	if configErr != nil {
-		logger.Errorf("Failed to load in-cluster config: %v", configErr)
-		return configErr
-	}
-	clientset, clientErr := kubernetes.NewForConfig(config)
+	clientset, dynamicClient, clientErr := inClusterClients()
 	if clientErr != nil {
-		logger.Errorf("Failed to create client from config: %v", clientErr)
+		logger.Errorf("Failed to create Kubernetes API clients: %v", clientErr)
 		return clientErr
 	}
 
+	venter, venterErr := NewVenter(clientset, Options{Config: config, DynamicClient: dynamicClient, Logger: logger})
+	if venterErr != nil {
+		logger.Errorf("Invalid configuration: %v", venterErr)
+		return venterErr
+	}
+	// The levels of the global logger follow the configuration when
+	// it is reloaded and can be changed using the admin API.
+	venter.levels = levels
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	if err := serve(ctx, config.Listen, venter.Handler()); err != nil {
+		logger.Errorf("Failed to start HTTP server: %v", err)
+		return err
+	}
 	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, syscall.SIGTERM)
 	signal.Notify(sigterm, syscall.SIGINT)
 	go func() {
-		<-sigterm
-		logger.Info("Received signal, exiting")
-		os.Exit(0)
+		select {
+		case sig := <-sigterm:
+			logger.Infof("Received %s, shutting down", sig)
+			stop()
+		case <-ctx.Done():
+		}
 	}()
 
-	initiateReleaseCheck()
+	reload := func() { venter.reload(load) }
+	reloadOnSignal(reload)
+	changeLogLevelOnSignal()
+	if configFile != "" {
+		if _, err := watchConfig(configFile, reload); err != nil {
+			logger.Errorf("Failed to watch configuration file %s: %v", configFile, err)
+			return err
+		}
+	}
+
+	initiateReleaseCheck(ctx, venter.metrics, venter.events, clientset, venter.currentConfig, stop)
+
+	return venter.Run(ctx)
+}
+
+// Run lists the pods every interval and sends those that are new,
+// changed, unhealthy, or deleted to their webhooks and the sinks until
+// ctx is done.  It then waits for pending deliveries to complete
+// within the shutdown grace period, spooling those that do not if a
+// spool file is configured, closes the sinks, including those provided
+// in Options, and returns nil.  Run returns an error if it cannot
+// start.  Run may only be called once.
+func (v *Venter) Run(ctx context.Context) error {
+	if v.clientset == nil {
+		return fmt.Errorf("no Kubernetes API client, create the Venter using NewVenter")
+	}
+
+	config := v.currentConfig()
+	if config.Record != "" {
+		rec, recErr := openRecorder(config.Record, v.log)
+		if recErr != nil {
+			v.logger().Errorf("Failed to start recording: %v", recErr)
+			return recErr
+		}
+		v.logger().Infof("Recording payloads to %s", config.Record)
+		v.recorder = rec
+		defer v.recorder.close()
+	}
 
-	venter := &Venter{
-		secret,
-		urls,
+	if v.dynamicClient != nil {
+		sinks := newSinkWatcher(v.dynamicClient, v.log)
+		stopSinks := make(chan struct{})
+		defer close(stopSinks)
+		if err := sinks.start(stopSinks); err != nil {
+			v.events.forbidden("watch", "ventsinks", "", err)
+			v.logger().Infof("VentSinks are not available, ignoring them: %v", err)
+		} else {
+			v.sinks = sinks
+		}
+	}
+
+	deliveryCtx, abandon := context.WithCancel(context.Background())
+	defer abandon()
+	v.deliveryCtx = deliveryCtx
+
+	var spooled []spooledDelivery
+	if config.SpoolFile != "" {
+		var spoolErr error
+		if spooled, spoolErr = readSpool(config.SpoolFile); spoolErr != nil {
+			v.logger().Errorf("Failed to read spooled deliveries: %v", spoolErr)
+		} else if len(spooled) > 0 {
+			v.logger().Infof("Read %d spooled deliveries from %s", len(spooled), config.SpoolFile)
+		}
 	}
 
 	sleepDuration := 0 * time.Second
 	lastPods := map[string]v1.Pod{}
-	logger.Info("Starting to vent")
-	for {
-		time.Sleep(sleepDuration)
+	v.logger().Info("Starting to vent")
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+			continue
+		case <-time.After(sleepDuration):
+		case <-v.sinks.changes():
+			v.logger().Debug("VentSinks changed")
+		case <-v.resync:
+			v.logger().Info("Resyncing, sending all pods")
+			lastPods = map[string]v1.Pod{}
+		}
 
-		pods, listErr := listPods(clientset, namespace)
+		config := v.currentConfig()
+		pods, listErr := listPods(ctx, v.clientset, config.Namespace, config.Filters.LabelSelector)
+		if ctx.Err() != nil {
+			continue
+		}
 		if listErr != nil {
-			logger.Errorf("Failed to list pods: %v", listErr)
+			v.logger().Errorf("Failed to list pods: %v", listErr)
+			v.metrics.listError(listErr)
+			v.events.forbidden("list", "pods", config.Namespace, listErr)
 			sleepDuration = 30 * time.Second
 			continue
 		} else {
-			sleepDuration = 120 * time.Second
+			sleepDuration = v.interval
 		}
 
-		logger.Debugf("Processing %d pods", len(pods))
-		lastPods = processPods(&processPodsArgs{
+		sinkList := v.sinks.current()
+		v.setRouter(newWebhookRouter(v.clientset, config, sinkList, v.log))
+
+		pods = v.filterPods(pods)
+		v.logger().Debugf("Processing %d pods", len(pods))
+		initial := len(lastPods) == 0
+		cycleCtx := withLogger(withTracer(ctx, v.tracer), v.log)
+		if len(spooled) > 0 {
+			v.sendSpooled(cycleCtx, spooled, pods)
+			spooled = nil
+		}
+		previousPods := lastPods
+		lastPods = processPods(cycleCtx, &processPodsArgs{
 			pods:      pods,
 			lastPods:  lastPods,
-			processor: venter.processPod,
+			processor: v.processPod,
+			healthy:   v.health.Healthy,
 		})
+		v.syncSinks(cycleCtx, pods, initial)
+		v.closeUnusedSinks(pods, previousPods)
+		v.metrics.cycle(len(pods))
+		v.sinks.updateStatuses(v.endpoints)
+	}
+
+	v.drain(abandon, spooled)
+	v.closeSinks()
+	tracerCtx, cancel := context.WithTimeout(withLogger(context.Background(), v.log), 5*time.Second)
+	v.tracer.shutdown(tracerCtx)
+	cancel()
+	v.events.flush()
+	v.logger().Info("Shut down")
+	return nil
+}
+
+// setConfig validates the configuration and, if it is valid,
+// atomically replaces the current configuration with it.  Pods being
+// sent when the configuration is replaced are sent to the webhooks
+// of the previous configuration.
+func (v *Venter) setConfig(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	hooks, hooksErr := newWebhooks(config.Webhooks, config.Secret)
+	if hooksErr != nil {
+		return hooksErr
+	}
+	filter := newPodFilter(config.Filters)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.config = config
+	v.webhooks = hooks
+	v.filter = filter
+	if v.levels == nil {
+		return nil
+	}
+	return v.levels.set(config.LogLevel, config.LogLevels)
+}
+
+// reload loads the configuration and applies it.  If the new
+// configuration cannot be loaded or is invalid, the current
+// configuration is kept.
+func (v *Venter) reload(load ConfigLoader) {
+	previous := v.currentConfig()
+	config, loadErr := load()
+	if loadErr == nil {
+		loadErr = v.setConfig(config)
+	}
+	if loadErr != nil {
+		v.logger().Errorf("Failed to reload configuration, keeping current configuration: %v", loadErr)
+		return
+	}
+	v.logger().Infof("Reloaded configuration with %d webhooks", len(config.Webhooks))
+	if config.Listen != previous.Listen {
+		v.logger().Warnf("Changing the listen address requires a restart, still listening on previous address")
+	}
+	if config.LogFormat != previous.LogFormat {
+		v.logger().Warnf("Changing the log format requires a restart, still using previous format")
+	}
+	if config.DryRun != previous.DryRun {
+		v.logger().Warnf("Changing dry run requires a restart, still using previous setting")
+	}
+	if config.Record != previous.Record {
+		v.logger().Warnf("Changing the recording file requires a restart, still recording to previous file")
+	}
+	if !reflect.DeepEqual(config.Tracing, previous.Tracing) {
+		v.logger().Warnf("Changing the tracing configuration requires a restart, still using previous configuration")
+	}
+}
+
+// currentConfig returns the current configuration.
+func (v *Venter) currentConfig() Config {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.config
+}
+
+// podWebhooks returns the webhooks pod should be sent to.
+func (v *Venter) podWebhooks(pod v1.Pod) []webhook {
+	v.mu.RLock()
+	hooks, router := v.webhooks, v.router
+	v.mu.RUnlock()
+	return v.attach(router.route(pod, hooks))
+}
+
+// attach returns a copy of hooks with the state of each endpoint and
+// the cache of open sinks set.
+func (v *Venter) attach(hooks []webhook) []webhook {
+	attached := v.endpoints.attach(hooks)
+	for i := range attached {
+		attached[i].sinks = v.sinkCache
+	}
+	return attached
+}
+
+// closeUnusedSinks closes the sinks and forgets the idle endpoints of
+// webhooks that are no longer configured, annotated on the pods or
+// their namespaces, or added by VentSinks, e.g., after the
+// configuration is reloaded.  The pods sent in the previous cycle are
+// included, so the deletions of pods are not interrupted.
+func (v *Venter) closeUnusedSinks(pods []v1.Pod, previous map[string]v1.Pod) {
+	v.mu.RLock()
+	hooks, router := v.webhooks, v.router
+	v.mu.RUnlock()
+	all := make([]v1.Pod, 0, len(pods)+len(previous))
+	all = append(all, pods...)
+	for _, pod := range previous {
+		all = append(all, pod)
+	}
+	inUse := map[string]bool{}
+	for _, hook := range hooks {
+		inUse[hook.url] = true
+	}
+	for _, u := range router.webhookURLs(all) {
+		inUse[u] = true
+	}
+	keep := func(webhookURL string) bool { return inUse[webhookURL] }
+	v.sinkCache.keep(keep)
+	v.endpoints.evict(keep)
+}
+
+// closeSinks closes the webhook sinks, once their pending deliveries
+// complete, and the custom sinks.
+func (v *Venter) closeSinks() {
+	v.sinkCache.close()
+	for _, sink := range v.customSinks {
+		if err := sink.Close(); err != nil {
+			v.logger().Warnf("Failed to close sink %T: %v", sink, err)
+		}
+	}
+}
+
+// setRouter replaces the webhook router.
+func (v *Venter) setRouter(router *webhookRouter) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.router = router
+}
+
+// syncSinks sends all pods matching each new or changed VentSink to
+// it, so new subscribers receive the current state of the pods.  If
+// initial is true, all pods have just been sent to all sinks, so the
+// sinks are only marked as synced.
+func (v *Venter) syncSinks(ctx context.Context, pods []v1.Pod, initial bool) {
+	if v.sinks == nil {
+		return
+	}
+	v.mu.RLock()
+	router := v.router
+	v.mu.RUnlock()
+	for _, sink := range v.sinks.unsynced() {
+		if initial {
+			v.sinks.markSynced(sink)
+			continue
+		}
+		v.logger().Infof("Sending current pods to VentSink %s", sink.name)
+		for _, pod := range pods {
+			if hook, ok := router.sinkWebhook(sink, pod); ok {
+				payload := webhookPayload{Pod: pod, event: PodNew}
+				v.deliver(ctx, v.attach([]webhook{hook}), &payload, nil)
+			}
+		}
+		v.sinks.markSynced(sink)
+	}
+}
+
+// deliver posts payload to hooks or, in a dry run, prints what would
+// be posted, including how the pod differs from last, the state of the
+// pod last sent, if any.
+func (v *Venter) deliver(ctx context.Context, hooks []webhook, payload *webhookPayload, last *v1.Pod) {
+	if v.dryRun != nil {
+		v.dryRun.print(withLogger(ctx, v.log), hooks, payload, last)
+		return
+	}
+	postToWebhooks(v.deliveryContext(ctx), hooks, payload)
+}
+
+// track records that pod was sent for event.  Deleted pods are no
+// longer tracked.  It returns the state of the pod last sent, nil if
+// it was not tracked.
+func (v *Venter) track(pod v1.Pod, event PodEvent) *v1.Pod {
+	v.trackedMu.Lock()
+	defer v.trackedMu.Unlock()
+	slug := podSlug(pod)
+	var last *v1.Pod
+	if t, ok := v.tracked[slug]; ok {
+		last = &t.Pod
+	}
+	if event == PodDeleted {
+		delete(v.tracked, slug)
+		return last
+	}
+	if v.tracked == nil {
+		v.tracked = map[string]trackedPod{}
+	}
+	v.tracked[slug] = trackedPod{Pod: pod, Event: event, Sent: time.Now()}
+	return last
+}
+
+// trackedPods returns the pods last sent by slug.
+func (v *Venter) trackedPods() map[string]trackedPod {
+	v.trackedMu.Lock()
+	defer v.trackedMu.Unlock()
+	tracked := make(map[string]trackedPod, len(v.tracked))
+	for slug, t := range v.tracked {
+		tracked[slug] = t
+	}
+	return tracked
+}
+
+// requestResync makes the next cycle start immediately and send all
+// pods as new.  It returns false if resyncing is not possible.
+func (v *Venter) requestResync() bool {
+	if v.resync == nil {
+		return false
+	}
+	select {
+	case v.resync <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// filterPods returns the pods that pass the current filter and the
+// custom filter, if any.
+func (v *Venter) filterPods(pods []v1.Pod) []v1.Pod {
+	v.mu.RLock()
+	filter := v.filter
+	v.mu.RUnlock()
+	pods = filter.filter(pods)
+	if v.customFilter == nil {
+		return pods
+	}
+	filtered := make([]v1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if v.customFilter.Matches(pod) {
+			filtered = append(filtered, pod)
+		}
 	}
+	return filtered
 }
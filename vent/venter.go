@@ -0,0 +1,221 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultInterval is how long a Venter waits between listing pods if
+// Options provides no interval.
+const DefaultInterval = 2 * time.Minute
+
+// Message is a pod event delivered to a Sink.
+type Message struct {
+	// Event is why the pod is sent.
+	Event PodEvent
+	// Pod is the current state of the pod.  The phase of deleted
+	// pods is "Deleted".
+	Pod v1.Pod
+	// Key identifies the pod, NAMESPACE/NAME.  Backends that
+	// partition messages, like Kafka, partition them by key.
+	Key string
+	// Body is the serialized payload, possibly encrypted.
+	Body []byte
+	// ContentType is the media type of Body.
+	ContentType string
+	// Header holds the delivery metadata, like the delivery ID and
+	// signatures, keyed by lower-case name.  Backends deliver it
+	// alongside Body, e.g., as HTTP headers.
+	Header map[string]string
+}
+
+// Sink receives the pod events a Venter sends.  Custom sinks provided
+// in Options receive every pod event in addition to the webhooks.
+// Webhooks are also delivered by sinks, chosen by the scheme of their
+// URL, see RegisterSinkScheme.  Custom sinks are called from the loop
+// processing pods, so sinks that deliver messages slowly should queue
+// them, e.g., using NewQueueSink.  The context is done when pending
+// deliveries are abandoned at shutdown.
+type Sink interface {
+	// Send delivers msg.
+	Send(ctx context.Context, msg Message) error
+	// Close releases the resources of the sink, like its
+	// connections.  The sink is not used after it is closed.
+	Close() error
+}
+
+// SinkFunc adapts a function to a Sink.
+type SinkFunc func(ctx context.Context, msg Message) error
+
+// Send calls f.
+func (f SinkFunc) Send(ctx context.Context, msg Message) error {
+	return f(ctx, msg)
+}
+
+// Close does nothing.
+func (f SinkFunc) Close() error {
+	return nil
+}
+
+// Filter decides which pods a Venter sends, in addition to the
+// filters in its configuration.
+type Filter interface {
+	// Matches returns true if pod should be sent.
+	Matches(pod v1.Pod) bool
+}
+
+// FilterFunc adapts a function to a Filter.
+type FilterFunc func(pod v1.Pod) bool
+
+// Matches calls f.
+func (f FilterFunc) Matches(pod v1.Pod) bool {
+	return f(pod)
+}
+
+// HealthPolicy decides whether a pod is healthy.  Pods whose state
+// has not changed are sent as unhealthy every cycle until they are
+// healthy.
+type HealthPolicy interface {
+	// Healthy returns true if pod is healthy.
+	Healthy(pod v1.Pod) bool
+}
+
+// HealthPolicyFunc adapts a function to a HealthPolicy.
+type HealthPolicyFunc func(pod v1.Pod) bool
+
+// Healthy calls f.
+func (f HealthPolicyFunc) Healthy(pod v1.Pod) bool {
+	return f(pod)
+}
+
+// Options configure a Venter created using NewVenter.
+type Options struct {
+	// Config is the configuration of the Venter.
+	Config Config
+	// DynamicClient, if not nil, is used to watch VentSinks.
+	DynamicClient dynamic.Interface
+	// Sinks receive every pod event in addition to the webhooks.
+	Sinks []Sink
+	// Filter, if not nil, further restricts the pods sent.
+	Filter Filter
+	// HealthPolicy decides which unchanged pods are sent as
+	// unhealthy.  By default pods are healthy if they are running and
+	// all their conditions and containers are ready.
+	HealthPolicy HealthPolicy
+	// Interval is how long to wait between listing pods,
+	// DefaultInterval if zero.
+	Interval time.Duration
+	// Logger, if not nil, logs the messages of the Venter, which
+	// are output at its level.  The log format and levels in the
+	// configuration are then ignored, and the log level cannot be
+	// changed using the admin API.  By default, the Venter creates
+	// its own logger using the logging configuration.
+	Logger *logrus.Entry
+}
+
+// NewVenter creates a Venter that lists pods using clientset.  It
+// returns an error if the configuration is invalid.  Use Run to start sending pods and Handler to serve
+// its metrics, health checks, and admin API.  If the configuration has
+// a dry run, payloads are printed to standard output and the sinks are
+// not called.
+func NewVenter(clientset kubernetes.Interface, opts Options) (*Venter, error) {
+	if clientset == nil {
+		return nil, fmt.Errorf("no Kubernetes API client provided")
+	}
+	if opts.Interval < 0 {
+		return nil, fmt.Errorf("invalid interval %s, must not be negative", opts.Interval)
+	}
+	v := newVenter()
+	if opts.Logger != nil {
+		v.log, v.levels = opts.Logger, nil
+	} else {
+		v.levels = &logLevels{level: logrus.InfoLevel}
+		log, logErr := newLogger(opts.Config, v.levels)
+		if logErr != nil {
+			return nil, fmt.Errorf("invalid logging configuration: %v", logErr)
+		}
+		v.log = log
+	}
+	if err := v.setConfig(opts.Config); err != nil {
+		return nil, err
+	}
+	v.clientset = clientset
+	v.dynamicClient = opts.DynamicClient
+	v.customSinks = opts.Sinks
+	v.customFilter = opts.Filter
+	if opts.HealthPolicy != nil {
+		v.health = opts.HealthPolicy
+	}
+	if opts.Interval > 0 {
+		v.interval = opts.Interval
+	}
+
+	v.endpoints.log = v.log
+	v.sinkCache.log = v.log
+
+	if opts.Config.DryRun {
+		v.logger().Info("Dry run, printing payloads rather than sending them")
+		v.dryRun = newDryRun(os.Stdout)
+	}
+	if opts.Config.Tracing.Endpoint != "" {
+		v.logger().Infof("Exporting traces to %s", opts.Config.Tracing.Endpoint)
+		t, tracerErr := newTracer(opts.Config.Tracing)
+		if tracerErr != nil {
+			return nil, tracerErr
+		}
+		v.tracer = t
+	}
+	v.events = newEventRecorder(clientset)
+	if v.events == nil {
+		v.moduleLogger(LogModuleServer).Info("Unable to identify k8svent pod, not recording Kubernetes events")
+	}
+	v.endpoints.setEvents(v.events)
+	return v, nil
+}
+
+// sendToSinks sends the payload to every custom sink, logging the
+// sinks that fail.  In a dry run, the sinks are not called.
+func (v *Venter) sendToSinks(ctx context.Context, payload *webhookPayload) {
+	if v.dryRun != nil {
+		return
+	}
+	body, jsonErr := json.Marshal(payload)
+	if jsonErr != nil {
+		v.moduleLogger(LogModuleDelivery).Errorf("Failed to marshal event to JSON: %v: %+v", jsonErr, payload)
+		return
+	}
+	msg := Message{
+		Event:       payload.event,
+		Pod:         payload.Pod,
+		Key:         podSlug(payload.Pod),
+		Body:        body,
+		ContentType: "application/json",
+	}
+	for _, sink := range v.customSinks {
+		if err := sink.Send(v.deliveryContext(ctx), msg); err != nil {
+			v.moduleLogger(LogModuleDelivery).WithField("pod", podSlug(payload.Pod)).Errorf("Failed to send to sink %T: %v", sink, err)
+		}
+	}
+}
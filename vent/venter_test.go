@@ -0,0 +1,206 @@
+// Copyright © 2020 Atomist
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// messageSink records the messages sent to it.
+type messageSink struct {
+	mu       sync.Mutex
+	messages []string
+	closed   bool
+}
+
+func (s *messageSink) Send(ctx context.Context, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, string(msg.Event)+" "+podSlug(msg.Pod))
+	return nil
+}
+
+func (s *messageSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// has returns true if the sink received msg.
+func (s *messageSink) has(msg string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.messages {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVenterRun(t *testing.T) {
+	nullLogger, globalHook := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "venter")
+	venterLogger, venterHook := test.NewNullLogger()
+
+	var mu sync.Mutex
+	received := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		received[podSlug(payload.Pod)] = true
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "replacements", Name: "westerberg"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "replacements", Name: "stinson"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "replacements", Name: "mars"}, Spec: v1.PodSpec{NodeName: "excluded"}},
+	)
+	sink := &messageSink{}
+	v, venterErr := NewVenter(clientset, Options{
+		Config:       Config{Webhooks: []Webhook{{URL: server.URL + "/webhook"}}},
+		Sinks:        []Sink{sink},
+		Filter:       FilterFunc(func(pod v1.Pod) bool { return pod.Spec.NodeName != "excluded" }),
+		HealthPolicy: HealthPolicyFunc(func(pod v1.Pod) bool { return pod.Name != "stinson" }),
+		Interval:     20 * time.Millisecond,
+		Logger:       venterLogger.WithField("test", "venter"),
+	})
+	if venterErr != nil {
+		t.Fatalf("failed to create venter: %v", venterErr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- v.Run(ctx) }()
+
+	waitFor := func(msg string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !sink.has(msg) {
+			if time.Now().After(deadline) {
+				t.Fatalf("sink did not receive '%s': %v", msg, sink.messages)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("new replacements/westerberg")
+	waitFor("new replacements/stinson")
+	waitFor("unhealthy replacements/stinson")
+	if err := clientset.CoreV1().Pods("replacements").Delete("westerberg", &metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete pod: %v", err)
+	}
+	waitFor("deleted replacements/westerberg")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after its context was done")
+	}
+	if sink.has("new replacements/mars") || sink.has("unhealthy replacements/westerberg") {
+		t.Errorf("sink received filtered or healthy pods: %v", sink.messages)
+	}
+	if !sink.closed {
+		t.Error("run did not close the sink")
+	}
+	if len(venterHook.AllEntries()) == 0 {
+		t.Error("nothing logged using the logger in the options")
+	}
+	for _, entry := range globalHook.AllEntries() {
+		t.Errorf("logged using the global logger: %s", entry.Message)
+	}
+	if open := len(v.sinkCache.sinks); open != 0 {
+		t.Errorf("run did not close the webhook sink, %d sinks open", open)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !received["replacements/westerberg"] || !received["replacements/stinson"] || received["replacements/mars"] {
+		t.Errorf("webhook received pods not as expected: %v", received)
+	}
+}
+
+func TestNewVenterErrors(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	logger = nullLogger.WithField("test", "venter")
+
+	clientset := fake.NewSimpleClientset()
+	if _, err := NewVenter(nil, Options{}); err == nil {
+		t.Error("creating venter without a client did not fail")
+	}
+	if _, err := NewVenter(clientset, Options{Config: Config{LogLevel: "loud"}}); err == nil {
+		t.Error("creating venter with an invalid configuration did not fail")
+	}
+	if _, err := NewVenter(clientset, Options{Interval: -time.Second}); err == nil {
+		t.Error("creating venter with a negative interval did not fail")
+	}
+	if err := newVenter().Run(context.Background()); err == nil {
+		t.Error("running venter without a client did not fail")
+	}
+}
+
+func TestNewVenterLogger(t *testing.T) {
+	nullLogger, _ := test.NewNullLogger()
+	global := nullLogger.WithField("test", "venter")
+	logger = global
+	defer resetLogLevel()
+	globalLevel := levels.current()
+
+	clientset := fake.NewSimpleClientset()
+	v, venterErr := NewVenter(clientset, Options{Config: Config{
+		LogLevel:  "trace",
+		LogLevels: map[string]string{LogModuleServer: "error"},
+		LogFormat: LogFormatLogfmt,
+	}})
+	if venterErr != nil {
+		t.Fatalf("failed to create venter: %v", venterErr)
+	}
+	if logger != global || levels.current() != globalLevel {
+		t.Error("creating a venter changed the global logger")
+	}
+	if v.log == nil || v.log == global || v.levels == levels || v.levels.current() != logrus.TraceLevel {
+		t.Error("venter did not create its own logger using the configuration")
+	}
+
+	provided := nullLogger.WithField("test", "provided")
+	v, venterErr = NewVenter(clientset, Options{Config: Config{LogLevel: "trace"}, Logger: provided})
+	if venterErr != nil {
+		t.Fatalf("failed to create venter: %v", venterErr)
+	}
+	if v.log != provided || v.levels != nil {
+		t.Error("venter did not use the provided logger")
+	}
+	if err := v.setConfig(Config{LogLevel: "error"}); err != nil || levels.current() != globalLevel {
+		t.Errorf("reloading a venter with a provided logger changed the global log level: %v", err)
+	}
+}
@@ -15,13 +15,15 @@
 package vent
 
 import (
-	"bytes"
+	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"fmt"
-	"net/http"
+	"sync"
+	"time"
 
-	"github.com/cenk/backoff"
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
 )
 
@@ -29,68 +31,234 @@ import (
 // endpoints.
 type webhookPayload struct {
 	Pod v1.Pod `json:"pod"`
+	// event is why the pod is being sent.  It is only included in
+	// the payload by formats that support it.
+	event PodEvent
 }
 
-// PostToWebhooks marshals payload into JSON and posts it to the webhook
-// URLs provided.
-func postToWebhooks(urls []string, payload *webhookPayload, secret string) {
-	slug := podSlug(payload.Pod)
-	log := logger.WithField("pod", slug)
+// Payload formats.
+const (
+	// FormatJSON sends the webhook payload as JSON, the default.
+	FormatJSON = "json"
+	// FormatCloudEvents sends the webhook payload as the data of a
+	// CloudEvents JSON event whose type includes the pod event.
+	FormatCloudEvents = "cloudevents"
+)
 
-	objJSON, jsonErr := json.Marshal(payload)
-	if jsonErr != nil {
-		log.Errorf("Failed to marshal event to JSON: %v: %+v", jsonErr, payload)
-		return
-	}
-	log.Tracef("Sending payload: %s", string(objJSON))
+// cloudEventsContentType is the content type of structured
+// CloudEvents JSON events.
+const cloudEventsContentType = "application/cloudevents+json"
 
-	for _, url := range urls {
-		go func(u string) {
-			log.Infof("Posting to '%s'", u)
-			if err := postToWebhook(slug, u, objJSON, secret); err != nil {
-				log.Errorf("Failed to post to '%s': %s", u, err.Error())
-			}
-		}(url)
+// cloudEventTypePrefix is prepended to the pod event to create the
+// CloudEvents type.
+const cloudEventTypePrefix = "com.atomist.k8svent.pod."
+
+// cloudEvent is a CloudEvents v1.0 event in structured JSON mode.
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            *webhookPayload `json:"data"`
+}
+
+// formatPayload serializes the payload in the requested format.
+func formatPayload(payload *webhookPayload, format string) ([]byte, error) {
+	switch format {
+	case "", FormatJSON:
+		return json.Marshal(payload)
+	case FormatCloudEvents:
+		id, idErr := generateDeliveryID()
+		if idErr != nil {
+			return nil, idErr
+		}
+		event := payload.event
+		if event == "" {
+			event = PodChanged
+		}
+		return json.Marshal(cloudEvent{
+			SpecVersion:     "1.0",
+			ID:              id,
+			Source:          "/" + Pkg,
+			Type:            cloudEventTypePrefix + string(event),
+			Subject:         podSlug(payload.Pod),
+			Time:            time.Now().UTC().Format(time.RFC3339),
+			DataContentType: "application/json",
+			Data:            payload,
+		})
 	}
+	return nil, fmt.Errorf("unsupported payload format '%s'", format)
 }
 
-// postToWebhook post the provided payload to the URL.
-func postToWebhook(pod string, url string, payload []byte, secret string) (e error) {
-	log := logger.WithField("pod", pod)
+// webhook is a webhook endpoint ready to receive payloads.
+type webhook struct {
+	// url is the webhook endpoint.
+	url string
+	// secret, if not empty, is used to sign payloads.
+	secret string
+	// key, if not nil, is the public key payloads are encrypted to.
+	key *rsa.PublicKey
+	// events, if not empty, are the only pod events sent.
+	events map[PodEvent]bool
+	// format is the payload format, FormatJSON if empty.
+	format string
+	// state, if not nil, records the deliveries to the endpoint.
+	state *endpointState
+	// sinks, if not nil, holds the sink delivering to the endpoint
+	// open between deliveries.
+	sinks *sinkCache
+}
+
+// wants returns true if the webhook should receive the pod event.
+func (h webhook) wants(event PodEvent) bool {
+	return len(h.events) == 0 || event == "" || h.events[event]
+}
 
-	post := func() error {
-		client := &http.Client{}
-		req, reqErr := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-		if reqErr != nil {
-			return fmt.Errorf("failed to create POST request to %s: %v", url, reqErr)
+// newWebhooks loads the configuration of each webhook, returning an
+// error if any of them are invalid.  Webhooks without their own
+// secret use the provided default secret.
+func newWebhooks(configs []Webhook, secret string) (w []webhook, e error) {
+	hooks := make([]webhook, 0, len(configs))
+	for _, config := range configs {
+		hook := webhook{url: config.URL, secret: config.Secret}
+		if hook.secret == "" {
+			hook.secret = secret
 		}
-		req.Header.Add("content-type", "application/json")
-		if secret != "" {
-			signature, signErr := generateSignature(payload, secret)
-			if signErr != nil {
-				return signErr
+		if config.EncryptionKey != "" {
+			key, keyErr := loadPublicKey(config.EncryptionKey)
+			if keyErr != nil {
+				return w, fmt.Errorf("failed to load encryption key for %s: %v", config.URL, keyErr)
 			}
-			log.Debugf("Signing payload with secret: %s", signature)
-			req.Header.Add("x-atomist-signature", signature)
+			hook.key = key
 		}
-		resp, postErr := client.Do(req)
-		if postErr != nil {
-			return fmt.Errorf("failed to POST event to %s: %v", url, postErr)
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// PostToWebhooks serializes payload in the format of each webhook and
+// posts it to the webhooks that want the payload event.  If ctx has a
+// current span, a child span is recorded that ends when all the
+// deliveries are complete.  Deliveries to paused endpoints wait until
+// the endpoint is resumed.  If ctx is done before a delivery succeeds,
+// the delivery is abandoned.
+func postToWebhooks(ctx context.Context, hooks []webhook, payload *webhookPayload) {
+	slug := podSlug(payload.Pod)
+	log := contextLogger(ctx, LogModuleDelivery).WithField("pod", slug)
+	ctx, span := startSpan(ctx, "postToWebhooks", trace.SpanKindInternal)
+	span.SetAttributes(attribute.String("pod", slug), attribute.String("event", string(payload.event)))
+
+	var wg sync.WaitGroup
+	for _, hook := range hooks {
+		if !hook.wants(payload.event) {
+			log.Debugf("Not posting %s event to '%s'", payload.event, hook.url)
+			continue
 		}
-		defer resp.Body.Close()
-		corrID, corrErr := extractPropertyString(resp, "correlation_id")
-		if corrErr != nil {
-			log.Warnf("Failed to extract correlation ID from %s response: %v", url, corrErr)
+		objJSON, jsonErr := formatPayload(payload, hook.format)
+		if jsonErr != nil {
+			log.Errorf("Failed to marshal event to JSON: %v: %+v", jsonErr, payload)
+			setSpanError(span, jsonErr)
+			continue
 		}
-		if resp.StatusCode < 200 || resp.StatusCode > 299 {
-			return fmt.Errorf("non-200 response from webhook %s: code:%d,correlation_id:%s", url, resp.StatusCode, corrID)
+		log.Tracef("Sending payload: %s", string(objJSON))
+		d := hook.state.start(slug, payload.event)
+		d.payload = payload
+		wg.Add(1)
+		go func(h webhook) {
+			defer wg.Done()
+			start := time.Now()
+			err := h.state.wait(ctx)
+			if err == nil {
+				log.Infof("Posting to '%s'", h.url)
+				err = postToWebhook(ctx, slug, h, objJSON)
+			}
+			if err != nil && ctx.Err() != nil {
+				log.Warnf("Abandoned delivery to '%s': %v", h.url, ctx.Err())
+				h.state.abandon(d)
+				return
+			}
+			if err != nil {
+				log.Errorf("Failed to post to '%s': %s", h.url, err.Error())
+				setSpanError(span, err)
+			}
+			h.state.finish(d, err, time.Since(start))
+		}(hook)
+	}
+	if span.IsRecording() {
+		go func() {
+			wg.Wait()
+			span.End()
+		}()
+	}
+}
+
+// postToWebhook sends the provided payload to the webhook using the
+// sink for the scheme of its URL.  If the webhook has an encryption
+// key, the payload is encrypted before it is signed and sent.  Each
+// attempt is signed anew, recorded as a child of the current span in
+// ctx, if any, and the span is propagated to the webhook in the W3C
+// traceparent header.  Attempts and retries stop when ctx is done.
+func postToWebhook(ctx context.Context, pod string, hook webhook, payload []byte) error {
+	msg, msgErr := webhookMessage(pod, hook, payload)
+	if msgErr != nil {
+		return msgErr
+	}
+	backend, release, openErr := hook.sinks.acquire(hook.url)
+	if openErr != nil {
+		return openErr
+	}
+	defer release()
+	signed := NewSigningSink(backend, hook.secret)
+
+	attempts := 0
+	attempt := SinkFunc(func(ctx context.Context, msg Message) (err error) {
+		attempts++
+		ctx, span := startSpan(ctx, "postToWebhook", trace.SpanKindClient)
+		defer func() { endSpan(span, err) }()
+		span.SetAttributes(attribute.String("endpoint", redactURL(hook.url)), attribute.Int("attempt", attempts))
+		if headers := traceHeaders(ctx); len(headers) > 0 {
+			msg = withHeader(msg, headers)
 		}
-		log.WithFields(logrus.Fields{
-			"code":           resp.StatusCode,
-			"correlation_id": corrID,
-		}).Infof("Posted to '%s'", url)
-		return nil
+		return signed.Send(ctx, msg)
+	})
+	retry := &retrySink{
+		sink: attempt,
+		beforeRetry: func(ctx context.Context) error {
+			hook.state.retry()
+			return hook.state.wait(ctx)
+		},
+	}
+	return retry.Send(ctx, msg)
+}
+
+// webhookMessage returns the message delivering payload about pod to
+// the webhook, with a new delivery ID.  If the webhook has an
+// encryption key, the body is the encrypted payload.
+func webhookMessage(pod string, hook webhook, payload []byte) (Message, error) {
+	body, contentType, bodyErr := webhookBody(hook, payload)
+	if bodyErr != nil {
+		return Message{}, bodyErr
 	}
+	return withDelivery(Message{Key: pod, Body: body, ContentType: contentType})
+}
 
-	return backoff.Retry(post, backoff.NewExponentialBackOff())
+// webhookBody returns the body sent to the webhook for payload and
+// its content type.  If the webhook has an encryption key, the body
+// is the encrypted payload.
+func webhookBody(hook webhook, payload []byte) ([]byte, string, error) {
+	contentType := "application/json"
+	if hook.format == FormatCloudEvents {
+		contentType = cloudEventsContentType
+	}
+	if hook.key == nil {
+		return payload, contentType, nil
+	}
+	encrypted, encryptErr := encryptPayload(payload, hook.key)
+	if encryptErr != nil {
+		return nil, "", fmt.Errorf("failed to encrypt payload for %s: %v", hook.url, encryptErr)
+	}
+	return encrypted, jweContentType, nil
 }
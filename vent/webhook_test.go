@@ -40,7 +40,7 @@ func TestPostToWebhooks(t *testing.T) {
 	}
 
 	// should accept empty list of webhook URLs
-	postToWebhooks([]string{}, &objects[0], "")
+	postToWebhooks(context.Background(), []webhook{}, &objects[0])
 
 	store := map[string]interface{}{}
 	m := &sync.Mutex{}
@@ -65,10 +65,10 @@ func TestPostToWebhooks(t *testing.T) {
 			t.Errorf("event server process failed: %v", err)
 		}
 	}()
-	urls := []string{fmt.Sprintf("http://%s%s", addr, tail)}
+	hooks := []webhook{{url: fmt.Sprintf("http://%s%s", addr, tail)}}
 
 	for _, o := range objects {
-		postToWebhooks(urls, &o, "")
+		postToWebhooks(context.Background(), hooks, &o)
 	}
 	for i := 0; i < len(objects); i++ {
 		<-stopCh
@@ -86,6 +86,45 @@ func TestPostToWebhooks(t *testing.T) {
 	}
 }
 
+func TestFormatPayload(t *testing.T) {
+	payload := &webhookPayload{event: PodDeleted}
+	payload.Pod.ObjectMeta.Namespace = "jason"
+	payload.Pod.ObjectMeta.Name = "isbell"
+
+	plain, plainErr := formatPayload(payload, "")
+	if plainErr != nil {
+		t.Fatalf("failed to format JSON payload: %v", plainErr)
+	}
+	if strings.Contains(string(plain), "deleted") {
+		t.Errorf("JSON payload should not include event: %s", string(plain))
+	}
+
+	ce, ceErr := formatPayload(payload, FormatCloudEvents)
+	if ceErr != nil {
+		t.Fatalf("failed to format CloudEvents payload: %v", ceErr)
+	}
+	event := cloudEvent{}
+	if err := json.Unmarshal(ce, &event); err != nil {
+		t.Fatalf("failed to unmarshal CloudEvent: %v", err)
+	}
+	if event.SpecVersion != "1.0" || event.Type != "com.atomist.k8svent.pod.deleted" || event.Subject != "jason/isbell" ||
+		event.ID == "" || event.Data == nil || event.Data.Pod.ObjectMeta.Name != "isbell" {
+		t.Errorf("CloudEvent not as expected: %s", string(ce))
+	}
+
+	if _, err := formatPayload(payload, "xml"); err == nil {
+		t.Error("unsupported format did not return error")
+	}
+
+	hook := webhook{events: map[PodEvent]bool{PodNew: true}}
+	if !hook.wants(PodNew) || hook.wants(PodDeleted) {
+		t.Error("webhook event filter not applied")
+	}
+	if !(webhook{}).wants(PodDeleted) {
+		t.Error("webhook without events should want all events")
+	}
+}
+
 func TestPostToWebhook(t *testing.T) {
 	nullLogger, hook := test.NewNullLogger()
 	nullLogger.SetLevel(logrus.InfoLevel)
@@ -253,7 +292,7 @@ func TestPostToWebhook(t *testing.T) {
 	}()
 	url := fmt.Sprintf("http://%s%s", addr, tail)
 	hook.Reset()
-	if err := postToWebhook("some/pod", url, payload, "Coast2Coast"); err != nil {
+	if err := postToWebhook(context.Background(), "some/pod", webhook{url: url, secret: "Coast2Coast"}, payload); err != nil {
 		t.Errorf("failed to handle server response: %v", err)
 	}
 	if len(hook.Entries) != 1 {
@@ -279,7 +318,7 @@ func TestPostToWebhook(t *testing.T) {
 		t.Errorf("correlation ID does not match: %s != %s", corrID, eCorrID)
 	}
 	hook.Reset()
-	if err := postToWebhook("some/pod", url, payload, ""); err != nil {
+	if err := postToWebhook(context.Background(), "some/pod", webhook{url: url}, payload); err != nil {
 		t.Errorf("failed to handle invalid server response: %v", err)
 	}
 	if len(hook.Entries) != 2 {